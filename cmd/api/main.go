@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"syscall"
@@ -16,12 +17,22 @@ import (
 	"wgeasygo/internal/auth"
 	"wgeasygo/internal/config"
 	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
 	"wgeasygo/internal/handlers"
 	"wgeasygo/internal/middleware"
+	"wgeasygo/internal/models"
+	"wgeasygo/internal/oidc"
+	"wgeasygo/internal/secrets"
+	"wgeasygo/internal/webhooks"
+	"wgeasygo/pkg/ipam"
+	"wgeasygo/pkg/tailscale"
 	"wgeasygo/pkg/wgmanager"
 	"wgeasygo/pkg/wgserver"
 )
 
+// webhookDeliveryRetention is how long finished webhook deliveries stay in the delivery log
+const webhookDeliveryRetention = 30 * 24 * time.Hour
+
 func main() {
 	// Load configuration
 	configPath := os.Getenv("CONFIG_PATH")
@@ -34,13 +45,27 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Load master key for secrets stored in the database
+	cipher, err := loadCipher(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
 	// Initialize database
-	database, err := db.Initialize(cfg.Database.Path)
+	database, err := db.Initialize(cfg.Database.Path, cipher)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
 
+	// One-shot maintenance command: re-wrap all peer secrets under a new master key
+	if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+		if err := rotateMasterKey(cfg); err != nil {
+			log.Fatalf("Failed to rotate master key: %v", err)
+		}
+		return
+	}
+
 	// Create admin user if it doesn't exist
 	if err := ensureAdminUser(cfg); err != nil {
 		log.Fatalf("Failed to create admin user: %v", err)
@@ -56,9 +81,23 @@ func main() {
 		log.Printf("Warning: Failed to load saved settings: %v", err)
 	}
 
+	// Build peer address pools from the configured subnets
+	pools, err := ipam.NewPools(cfg.WireGuard.Subnet, cfg.WireGuard.SubnetV6, cfg.WireGuard.ReservedIPs)
+	if err != nil {
+		log.Fatalf("Invalid WireGuard subnet configuration: %v", err)
+	}
+
+	// Give pre-existing peers an IPv6 address when dual-stack is enabled
+	if err := assignMissingIPv6(pools); err != nil {
+		log.Printf("Warning: Failed to assign IPv6 addresses: %v", err)
+	}
+
 	// Initialize WireGuard manager
 	wgManager := wgmanager.New(&cfg.WireGuard)
 
+	// Event hub for live peer updates
+	hub := events.NewHub()
+
 	// Sync existing peers to WireGuard interface
 	peers, err := db.DB.GetAllPeers()
 	if err != nil {
@@ -69,6 +108,9 @@ func main() {
 		}
 	}
 
+	// Peers may have expired while the panel was stopped
+	disableExpiredPeers(wgManager, hub)
+
 	// Set Gin mode to release for production (no debug logs)
 	gin.SetMode(gin.ReleaseMode)
 
@@ -78,14 +120,31 @@ func main() {
 	// Add middlewares
 	// Only Recovery middleware - no request logging to reduce log volume
 	router.Use(gin.Recovery())
+	router.Use(middleware.Metrics())
 	router.Use(middleware.SecurityHeaders())
 	router.Use(middleware.CORS()) // For development - configure properly for production
 
 	// Create handlers
-	authHandler := handlers.NewAuthHandler(cfg)
-	peerHandler := handlers.NewPeerHandler(cfg, wgManager)
+	authHandler := handlers.NewAuthHandler(cfg, hub)
+	peerHandler := handlers.NewPeerHandler(cfg, wgManager, pools, hub)
 	settingsHandler := handlers.NewSettingsHandler(cfg)
 	tailscaleHandler := handlers.NewTailscaleHandler(cfg)
+	metricsHandler := handlers.NewMetricsHandler(wgManager, pools)
+	streamTickets := middleware.NewStreamTickets(30 * time.Second)
+	eventsHandler := handlers.NewEventsHandler(hub, streamTickets)
+	webhookDispatcher := webhooks.NewDispatcher(hub)
+	webhookHandler := handlers.NewWebhookHandler(webhookDispatcher)
+	auditHandler := handlers.NewAuditHandler()
+	userHandler := handlers.NewUserHandler(cfg)
+	apiTokenHandler := handlers.NewAPITokenHandler()
+
+	var oidcHandler *handlers.OIDCHandler
+	if cfg.OIDC.Enabled {
+		if err := oidc.ValidateConfig(&cfg.OIDC); err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+		oidcHandler = handlers.NewOIDCHandler(cfg, authHandler)
+	}
 
 	// Rate limiter for auth endpoints
 	rateLimiter := middleware.NewRateLimiter(
@@ -100,42 +159,150 @@ func main() {
 		authGroup := v1.Group("/auth")
 		{
 			authGroup.POST("/login", rateLimiter.Middleware(), authHandler.Login)
+			authGroup.POST("/login/2fa", rateLimiter.Middleware(), authHandler.LoginTwoFactor)
 			authGroup.POST("/refresh", authHandler.Refresh)
 			authGroup.POST("/logout", authHandler.Logout)
+
+			// Single sign-on, only when configured; the login page shows it if /auth/oidc answers
+			if oidcHandler != nil {
+				authGroup.GET("/oidc", oidcHandler.Info)
+				authGroup.GET("/oidc/login", rateLimiter.Middleware(), oidcHandler.Login)
+				authGroup.GET("/oidc/callback", rateLimiter.Middleware(), oidcHandler.Callback)
+			}
 		}
 
+		// Live peer events, opened with a ticket from POST /events/ticket since EventSource cannot send headers
+		v1.GET("/events", streamTickets.Middleware(), eventsHandler.StreamEvents)
+
 		// Protected routes
 		protected := v1.Group("/")
 		protected.Use(middleware.AuthMiddleware(&cfg.JWT))
 		{
-			// Peer management
+			// Every route requires a scope, see models.RoleScopes for the scopes of each role
+			readPeers := middleware.RequireScope(models.ScopePeersRead)
+			writePeers := middleware.RequireScope(models.ScopePeersWrite)
+			readSettings := middleware.RequireScope(models.ScopeSettingsRead)
+			writeSettings := middleware.RequireScope(models.ScopeSettingsWrite)
+
+			// Peer management; configs and QR codes hold private keys, so they need peers:write
 			peers := protected.Group("/peers")
 			{
-				peers.POST("", peerHandler.CreatePeer)
-				peers.GET("", peerHandler.ListPeers)
-				peers.PATCH("/:ip", peerHandler.UpdatePeer)
-				peers.DELETE("/:ip", peerHandler.DeletePeer)
-				peers.GET("/:ip/config", peerHandler.GetPeerConfig)
-				peers.GET("/:ip/qrcode", peerHandler.GetPeerQRCode)
-				peers.GET("/:ip/logs", settingsHandler.GetPeerLogs)
+				peers.POST("", writePeers, peerHandler.CreatePeer)
+				peers.GET("", readPeers, peerHandler.ListPeers)
+				peers.PATCH("/:ip", writePeers, peerHandler.UpdatePeer)
+				peers.DELETE("/:ip", writePeers, peerHandler.DeletePeer)
+				peers.GET("/:ip/config", writePeers, peerHandler.GetPeerConfig)
+				peers.GET("/:ip/qrcode", writePeers, peerHandler.GetPeerQRCode)
+				peers.POST("/:ip/psk/rotate", writePeers, peerHandler.RotatePresharedKey)
+				peers.POST("/:ip/rotate-keys", writePeers, peerHandler.RotateKeys)
+				peers.POST("/:ip/share", writePeers, peerHandler.CreateShareLink)
+				peers.GET("/:ip/logs", readPeers, settingsHandler.GetPeerLogs)
+				peers.GET("/:ip/traffic", readPeers, peerHandler.GetPeerTraffic)
+			}
+
+			protected.POST("/events/ticket", readPeers, eventsHandler.CreateTicket)
+
+			// Peer groups: shared client settings, and enabling or disabling all members at once
+			groups := protected.Group("/groups")
+			{
+				groups.GET("", readPeers, peerHandler.ListGroups)
+				groups.POST("", writePeers, peerHandler.CreateGroup)
+				groups.GET("/:id", readPeers, peerHandler.GetGroup)
+				groups.GET("/:id/peers", readPeers, peerHandler.ListGroupPeers)
+				groups.PATCH("/:id", writePeers, peerHandler.UpdateGroup)
+				groups.DELETE("/:id", writePeers, peerHandler.DeleteGroup)
+				groups.POST("/:id/enable", writePeers, peerHandler.EnableGroup)
+				groups.POST("/:id/disable", writePeers, peerHandler.DisableGroup)
+			}
+
+			// Outstanding share links; minting them and revoking need the same scope as downloading configs
+			shareLinks := protected.Group("/share-links", writePeers)
+			{
+				shareLinks.GET("", peerHandler.ListShareLinks)
+				shareLinks.DELETE("/:id", peerHandler.RevokeShareLink)
 			}
 
+			// API tokens; everyone manages their own, scopes are checked by the handler
+			tokens := protected.Group("/tokens")
+			{
+				tokens.GET("", apiTokenHandler.ListTokens)
+				tokens.POST("", apiTokenHandler.CreateToken)
+				tokens.PATCH("/:id", apiTokenHandler.UpdateToken)
+				tokens.DELETE("/:id", apiTokenHandler.DeleteToken)
+			}
+
+			// User management
+			users := protected.Group("/users", middleware.RequireScope(models.ScopeUsersWrite))
+			{
+				users.GET("", userHandler.ListUsers)
+				users.POST("", userHandler.CreateUser)
+				users.PATCH("/:id", userHandler.UpdateUser)
+				users.DELETE("/:id", userHandler.DeleteUser)
+			}
+
+			// Failed login counts and lockouts per username
+			lockouts := protected.Group("/lockouts", middleware.RequireScope(models.ScopeUsersWrite))
+			{
+				lockouts.GET("", userHandler.ListLockouts)
+				lockouts.DELETE("/:username", userHandler.Unlock)
+			}
+
+			// Outbound webhooks; their URLs often hold credentials, so even listing needs settings:write
+			webhookRoutes := protected.Group("/webhooks", writeSettings)
+			{
+				webhookRoutes.GET("", webhookHandler.ListWebhooks)
+				webhookRoutes.POST("", webhookHandler.CreateWebhook)
+				webhookRoutes.PATCH("/:id", webhookHandler.UpdateWebhook)
+				webhookRoutes.DELETE("/:id", webhookHandler.DeleteWebhook)
+				webhookRoutes.GET("/:id/deliveries", webhookHandler.ListDeliveries)
+				webhookRoutes.POST("/:id/test", webhookHandler.TestWebhook)
+			}
+
+			// Audit log
+			readAudit := middleware.RequireScope(models.ScopeAuditRead)
+			protected.GET("/audit", readAudit, auditHandler.ListEntries)
+			protected.GET("/audit/export", readAudit, auditHandler.Export)
+
 			// Settings
 			settings := protected.Group("/settings")
 			{
-				settings.GET("", settingsHandler.GetSettings)
-				settings.PUT("", settingsHandler.UpdateSettings)
+				settings.GET("", readSettings, settingsHandler.GetSettings)
+				settings.PUT("", writeSettings, settingsHandler.UpdateSettings)
+			}
+
+			// Self-service portal: the requesting user's own peers; configs reuse the peer handlers
+			// behind an ownership check
+			devices := protected.Group("/devices", middleware.RequireScope(models.ScopeDevices))
+			{
+				devices.GET("", peerHandler.ListDevices)
+				devices.POST("", peerHandler.CreateDevice)
+				devices.GET("/:ip/config", peerHandler.RequireOwnPeer, peerHandler.GetPeerConfig)
+				devices.GET("/:ip/qrcode", peerHandler.RequireOwnPeer, peerHandler.GetPeerQRCode)
+				devices.POST("/:ip/disable", peerHandler.DisableDevice)
+			}
+
+			// The requesting user's own account: sign-in sessions and two-factor authentication
+			account := protected.Group("/account")
+			{
+				account.GET("", authHandler.Account)
+				account.GET("/sessions", authHandler.ListSessions)
+				account.DELETE("/sessions/:id", authHandler.RevokeSession)
+				account.GET("/2fa", authHandler.TwoFactorStatus)
+				account.POST("/2fa/setup", authHandler.SetupTwoFactor)
+				account.POST("/2fa/enable", authHandler.EnableTwoFactor)
+				account.POST("/2fa/disable", authHandler.DisableTwoFactor)
+				account.POST("/2fa/recovery-codes", authHandler.RegenerateRecoveryCodes)
 			}
 
 			// Tailscale
 			tailscale := protected.Group("/tailscale")
 			{
-				tailscale.GET("/status", tailscaleHandler.GetStatus)
-				tailscale.POST("/connect", tailscaleHandler.Connect)
-				tailscale.POST("/disconnect", tailscaleHandler.Disconnect)
-				tailscale.POST("/routing/enable", tailscaleHandler.EnableRouting)
-				tailscale.POST("/routing/disable", tailscaleHandler.DisableRouting)
-				tailscale.GET("/routes", tailscaleHandler.GetRoutes)
+				tailscale.GET("/status", readPeers, tailscaleHandler.GetStatus)
+				tailscale.POST("/connect", writeSettings, tailscaleHandler.Connect)
+				tailscale.POST("/disconnect", writeSettings, tailscaleHandler.Disconnect)
+				tailscale.POST("/routing/enable", writeSettings, tailscaleHandler.EnableRouting)
+				tailscale.POST("/routing/disable", writeSettings, tailscaleHandler.DisableRouting)
+				tailscale.GET("/routes", readPeers, tailscaleHandler.GetRoutes)
 			}
 		}
 	}
@@ -148,6 +315,20 @@ func main() {
 		c.JSON(200, gin.H{"status": "ok", "version": "1.0.0"})
 	})
 
+	// Prometheus metrics, with their own token instead of a user login
+	// Without a token the route stays unregistered unless open access is explicitly allowed
+	if cfg.Metrics.Enabled {
+		if cfg.Metrics.Token == "" && !cfg.Metrics.AllowUnauthenticated {
+			log.Println("Warning: metrics are enabled but no metrics token is set, not serving /metrics (set METRICS_TOKEN or metrics.allow_unauthenticated)")
+		} else {
+			router.GET("/metrics", middleware.StaticToken(cfg.Metrics.Token), metricsHandler.GetMetrics)
+		}
+	}
+
+	// Share links, public: the signed one-time token in the URL is the credential
+	router.GET("/share/:token", rateLimiter.Middleware(), peerHandler.ShowShareLink)
+	router.POST("/share/:token", rateLimiter.Middleware(), peerHandler.DownloadShareLink)
+
 	// Serve static frontend files
 	router.Static("/assets", "./web/dist/assets")
 	router.StaticFile("/logo.svg", "./web/dist/logo.svg")
@@ -182,6 +363,16 @@ func main() {
 					log.Println("Cleaned expired refresh tokens")
 				}
 
+				// Merge old traffic samples into coarser buckets
+				if err := db.DB.DownsampleTraffic(time.Now()); err != nil {
+					log.Printf("Warning: Failed to downsample traffic history: %v", err)
+				}
+
+				// Trim the webhook delivery log
+				if err := db.DB.CleanWebhookDeliveries(time.Now().Add(-webhookDeliveryRetention)); err != nil {
+					log.Printf("Warning: Failed to clean webhook deliveries: %v", err)
+				}
+
 				// Optimize database (incremental vacuum + optimize)
 				if err := db.DB.Optimize(); err != nil {
 					log.Printf("Warning: Failed to optimize database: %v", err)
@@ -202,6 +393,92 @@ func main() {
 		}
 	}()
 
+	// Finish key rotations once the new key has connected or the grace period is over. Often, since
+	// the new key's traffic goes nowhere until then.
+	go func() {
+		ticker := time.NewTicker(handlers.KeyRotationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				completeKeyRotations(wgManager)
+			}
+		}
+	}()
+
+	// Disable peers once their expiry date has passed, record transfer usage and enforce quotas
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				disableExpiredPeers(wgManager, hub)
+				recordTransferUsage(wgManager, hub)
+			}
+		}
+	}()
+
+	// Record connection sessions, independent of anyone polling the peer list
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				trackSessions(wgManager)
+			}
+		}
+	}()
+
+	// Sample peer stats for live event subscribers, only while someone is listening
+	go func() {
+		sampler := events.NewSampler(hub)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !hub.HasSubscribers() {
+					sampler.Reset()
+					continue
+				}
+				samplePeerEvents(wgManager, sampler)
+			}
+		}
+	}()
+
+	// Report Tailscale connection changes, only while someone is listening
+	go func() {
+		manager := tailscale.NewManager()
+		var connected *bool // Unknown until the first check
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !hub.HasSubscribers() || !manager.IsInstalled() {
+					connected = nil
+					continue
+				}
+				connected = watchTailscale(manager, hub, connected)
+			}
+		}
+	}()
+
+	// Deliver events to webhooks
+	go webhookDispatcher.Run(ctx)
+
 	// Create HTTP server
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	srv := &http.Server{
@@ -244,6 +521,357 @@ func main() {
 	log.Println("Server exited gracefully")
 }
 
+// keyFilePath returns the configured key file, defaulting to secret.key next to the database
+func keyFilePath(cfg *config.Config) string {
+	if cfg.Database.KeyFile != "" {
+		return cfg.Database.KeyFile
+	}
+	return filepath.Join(filepath.Dir(cfg.Database.Path), "secret.key")
+}
+
+// loadCipher loads the master key from DB_MASTER_KEY or the key file (created on first run)
+// A key file is only created while the database holds no encrypted secrets, so a lost key
+// stops the panel instead of leaving every peer undecryptable
+func loadCipher(cfg *config.Config) (*secrets.Cipher, error) {
+	encrypted, err := db.HasEncryptedSecrets(cfg.Database.Path)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := secrets.LoadMasterKey(cfg.Database.MasterKey, keyFilePath(cfg), !encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.New(masterKey)
+}
+
+// rotateMasterKey generates a new master key and re-wraps every peer secret with it
+// The new key is staged next to the key file before the database is touched, so a crash
+// never leaves data wrapped under a key that was not saved
+func rotateMasterKey(cfg *config.Config) error {
+	newKey, err := secrets.GenerateKey()
+	if err != nil {
+		return err
+	}
+	next, err := secrets.New(newKey)
+	if err != nil {
+		return err
+	}
+
+	// Master key supplied via environment: we cannot update it, print it instead
+	if cfg.Database.MasterKey != "" {
+		count, err := db.DB.RotateMasterKey(next)
+		if err != nil {
+			return err
+		}
+		log.Printf("Re-wrapped secrets of %d peers (key id %s)", count, next.KeyID())
+		fmt.Printf("New master key (set DB_MASTER_KEY to this value before restarting):\n%s\n", secrets.EncodeKey(newKey))
+		return nil
+	}
+
+	keyFile := keyFilePath(cfg)
+	stagedFile := keyFile + ".new"
+	if err := secrets.WriteKeyFile(stagedFile, newKey); err != nil {
+		return err
+	}
+
+	count, err := db.DB.RotateMasterKey(next)
+	if err != nil {
+		os.Remove(stagedFile)
+		return err
+	}
+
+	if err := os.Rename(keyFile, keyFile+".old"); err != nil {
+		return fmt.Errorf("secrets were re-wrapped but %s could not be replaced, move %s into place manually: %w", keyFile, stagedFile, err)
+	}
+	if err := os.Rename(stagedFile, keyFile); err != nil {
+		return fmt.Errorf("secrets were re-wrapped but %s could not be replaced, move %s into place manually: %w", keyFile, stagedFile, err)
+	}
+
+	log.Printf("Re-wrapped secrets of %d peers (key id %s); previous key kept at %s.old", count, next.KeyID(), keyFile)
+	return nil
+}
+
+// completeKeyRotations moves each rotating peer's addresses to its new key and drops the previous
+// key, once the new key has completed a handshake or the grace period has ended
+func completeKeyRotations(wgManager *wgmanager.WGManager) {
+	peers, err := db.DB.GetPeersInKeyRotation()
+	if err != nil {
+		log.Printf("Warning: Failed to get peers in key rotation: %v", err)
+		return
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	stats, _ := wgManager.GetPeerStats() // Without stats only expiry applies
+
+	for _, peer := range peers {
+		connected := false
+		if peerStats, ok := stats[peer.PublicKey]; ok && !peerStats.LatestHandshake.IsZero() {
+			connected = true
+		}
+		expired := peer.KeyGraceUntil == nil || time.Now().After(*peer.KeyGraceUntil)
+		if !connected && !expired {
+			continue
+		}
+
+		if peer.Enabled {
+			if err := wgManager.AddPeer(&peer); err != nil {
+				log.Printf("Warning: Failed to move peer %s to its new key: %v", peer.Name, err)
+				continue
+			}
+			if err := wgManager.RemovePeer(peer.PreviousPublicKey); err != nil {
+				log.Printf("Warning: Failed to remove previous key of peer %s: %v", peer.Name, err)
+				continue
+			}
+		}
+
+		if err := db.DB.FinishKeyRotation(peer.ID); err != nil {
+			log.Printf("Warning: Failed to finish key rotation of peer %s: %v", peer.Name, err)
+			continue
+		}
+		log.Printf("Completed key rotation of peer %s", peer.Name)
+	}
+}
+
+// disableExpiredPeers removes expired peers from the interface and marks them disabled as expired
+func disableExpiredPeers(wgManager *wgmanager.WGManager, hub *events.Hub) {
+	peers, err := db.DB.GetExpiredPeers()
+	if err != nil {
+		log.Printf("Warning: Failed to get expired peers: %v", err)
+		return
+	}
+
+	for _, peer := range peers {
+		if err := disablePeer(wgManager, &peer, models.DisabledReasonExpired); err != nil {
+			log.Printf("Warning: Failed to disable expired peer %s: %v", peer.Name, err)
+			continue
+		}
+		log.Printf("Disabled expired peer %s", peer.Name)
+		publishPeerUpdate(hub, peer.ID, events.PeerDisabled)
+	}
+}
+
+// disablePeer removes a peer from the interface and marks it disabled for reason
+func disablePeer(wgManager *wgmanager.WGManager, peer *models.Peer, reason string) error {
+	// Drop the previous key too if the peer is disabled during a key rotation grace period
+	if peer.PreviousPublicKey != "" {
+		if err := wgManager.RemovePeer(peer.PreviousPublicKey); err != nil {
+			return err
+		}
+	}
+	if err := wgManager.RemovePeer(peer.PublicKey); err != nil {
+		return err
+	}
+	return db.DB.DisablePeer(peer.ID, reason)
+}
+
+// recordTransferUsage adds the traffic since the last run to each peer's persisted usage and history,
+// disables peers that exceeded a quota and re-enables them once the quota allows it again
+// (a new month, or a raised quota)
+func recordTransferUsage(wgManager *wgmanager.WGManager, hub *events.Hub) {
+	stats, err := wgManager.GetPeerStats()
+	if err != nil {
+		log.Printf("Warning: Failed to get peer stats for usage: %v", err)
+		return
+	}
+
+	peers, err := db.DB.GetAllPeers()
+	if err != nil {
+		log.Printf("Warning: Failed to get peers for usage: %v", err)
+		return
+	}
+
+	now := time.Now()
+	month := now.UTC().Format(models.UsageMonthFormat)
+
+	for _, peer := range peers {
+		if !peer.Enabled {
+			if peer.DisabledReason != models.DisabledReasonQuota || peer.QuotaExceeded() || peer.IsExpired() {
+				continue
+			}
+			if err := wgManager.AddPeer(&peer); err != nil {
+				log.Printf("Warning: Failed to re-enable peer %s: %v", peer.Name, err)
+				continue
+			}
+			if err := db.DB.EnablePeer(peer.ID); err != nil {
+				wgManager.RemovePeer(peer.PublicKey)
+				log.Printf("Warning: Failed to re-enable peer %s: %v", peer.Name, err)
+				continue
+			}
+			log.Printf("Re-enabled peer %s, its quota allows traffic again", peer.Name)
+			publishPeerUpdate(hub, peer.ID, events.PeerEnabled)
+			continue
+		}
+
+		peerStats, ok := wgmanager.LookupPeerStats(stats, &peer)
+		if !ok {
+			continue
+		}
+
+		rx, tx, changed := wgmanager.UsageSince(&peer, peerStats)
+		if !changed {
+			continue
+		}
+
+		if err := db.DB.RecordPeerUsage(peer.ID, rx, tx, peerStats.TransferRx, peerStats.TransferTx, peerStats.PublicKey, now); err != nil {
+			log.Printf("Warning: Failed to record usage of peer %s: %v", peer.Name, err)
+			continue
+		}
+
+		peer.UsageRx += rx
+		peer.UsageTx += tx
+		peer.MonthlyUsage = peer.CurrentMonthlyUsage() + rx + tx
+		peer.UsageMonth = month
+		if !peer.QuotaExceeded() {
+			continue
+		}
+
+		if err := disablePeer(wgManager, &peer, models.DisabledReasonQuota); err != nil {
+			log.Printf("Warning: Failed to disable peer %s over quota: %v", peer.Name, err)
+			continue
+		}
+		log.Printf("Disabled peer %s, quota exceeded", peer.Name)
+		publishPeerUpdate(hub, peer.ID, events.PeerQuotaExceeded, events.PeerDisabled)
+	}
+}
+
+// publishPeerUpdate tells event subscribers about a peer changed outside the API,
+// followed by eventTypes describing the change
+func publishPeerUpdate(hub *events.Hub, id int64, eventTypes ...string) {
+	peer, err := db.DB.GetPeerByID(id)
+	if err != nil {
+		return
+	}
+	resp := handlers.NewPeerResponse(peer)
+	hub.Publish(events.PeerUpdated, resp)
+	for _, eventType := range eventTypes {
+		hub.Publish(eventType, resp)
+	}
+}
+
+// samplePeerEvents feeds one stats sample of all enabled peers to the event sampler
+func samplePeerEvents(wgManager *wgmanager.WGManager, sampler *events.Sampler) {
+	stats, err := wgManager.GetPeerStats()
+	if err != nil {
+		log.Printf("Warning: Failed to get peer stats for events: %v", err)
+		return
+	}
+
+	peers, err := db.DB.GetAllPeers()
+	if err != nil {
+		log.Printf("Warning: Failed to get peers for events: %v", err)
+		return
+	}
+
+	statuses := make([]events.PeerStatus, 0, len(peers))
+	for _, peer := range peers {
+		status := events.PeerStatus{ID: peer.ID, AssignedIP: peer.AssignedIP}
+		if peerStats, ok := wgmanager.LookupPeerStats(stats, &peer); ok && peer.Enabled {
+			status.IsOnline = peerStats.IsOnline
+			status.LatestHandshake = peerStats.LatestHandshake
+			status.Endpoint = peerStats.Endpoint
+			status.TransferRx = peerStats.TransferRx
+			status.TransferTx = peerStats.TransferTx
+		}
+		statuses = append(statuses, status)
+	}
+
+	sampler.Sample(statuses)
+}
+
+// watchTailscale publishes a Tailscale event when the connection state differs from connected
+// and returns the current state; a nil connected only records the state
+func watchTailscale(manager *tailscale.Manager, hub *events.Hub, connected *bool) *bool {
+	status, err := manager.GetStatus()
+	if err != nil {
+		return connected
+	}
+
+	if connected != nil && *connected != status.Connected {
+		eventType := events.TailscaleDisconnected
+		if status.Connected {
+			eventType = events.TailscaleConnected
+		}
+		hub.Publish(eventType, events.TailscaleState{Connected: status.Connected, BackendState: status.BackendState})
+	}
+	return &status.Connected
+}
+
+// trackSessions records connection sessions while connection logging is enabled. A session starts
+// when a peer has a recent handshake and ends when the handshake goes stale; an endpoint change
+// ends the session and starts a new one. Bytes are counted like recordTransferUsage does.
+func trackSessions(wgManager *wgmanager.WGManager) {
+	sessions, err := db.DB.GetOpenSessions()
+	if err != nil {
+		log.Printf("Warning: Failed to get open sessions: %v", err)
+		return
+	}
+
+	// Close sessions left open when logging is turned off
+	if setting, _ := db.DB.GetSetting("logging_enabled"); setting != "true" {
+		for _, session := range sessions {
+			if err := db.DB.EndSession(session.ID, session.LastSeenAt); err != nil {
+				log.Printf("Warning: Failed to end session %d: %v", session.ID, err)
+			}
+		}
+		return
+	}
+
+	stats, err := wgManager.GetPeerStats()
+	if err != nil {
+		log.Printf("Warning: Failed to get peer stats for sessions: %v", err)
+		return
+	}
+
+	peers, err := db.DB.GetAllPeers()
+	if err != nil {
+		log.Printf("Warning: Failed to get peers for sessions: %v", err)
+		return
+	}
+
+	for _, peer := range peers {
+		peerStats, ok := wgmanager.LookupPeerStats(stats, &peer)
+		online := ok && peer.Enabled && peerStats.IsOnline && peerStats.Endpoint != ""
+		session, open := sessions[peer.ID]
+
+		if open && online && session.Endpoint == peerStats.Endpoint {
+			rx, tx := peerStats.TransferRx, peerStats.TransferTx
+			if rx >= session.CounterRx {
+				rx -= session.CounterRx
+			}
+			if tx >= session.CounterTx {
+				tx -= session.CounterTx
+			}
+			if err := db.DB.UpdateSession(session.ID, rx, tx, peerStats.TransferRx, peerStats.TransferTx); err != nil {
+				log.Printf("Warning: Failed to update session of peer %s: %v", peer.Name, err)
+			}
+			continue
+		}
+
+		connectedAt := time.Now()
+		if open {
+			// Offline: the session ended when it was last seen. Roaming: it ends now.
+			disconnectedAt := session.LastSeenAt
+			if online {
+				disconnectedAt = connectedAt
+			}
+			if err := db.DB.EndSession(session.ID, disconnectedAt); err != nil {
+				log.Printf("Warning: Failed to end session of peer %s: %v", peer.Name, err)
+				continue
+			}
+		} else if online {
+			connectedAt = peerStats.LatestHandshake
+		}
+
+		if online {
+			if err := db.DB.StartSession(peer.ID, peerStats.Endpoint, connectedAt, peerStats.TransferRx, peerStats.TransferTx); err != nil {
+				log.Printf("Warning: Failed to start session of peer %s: %v", peer.Name, err)
+			}
+		}
+	}
+}
+
 // ensureAdminUser creates the initial admin user if it doesn't exist
 func ensureAdminUser(cfg *config.Config) error {
 	exists, err := db.DB.UserExists(cfg.Admin.Username)
@@ -257,7 +885,7 @@ func ensureAdminUser(cfg *config.Config) error {
 			return err
 		}
 
-		_, err = db.DB.CreateUser(cfg.Admin.Username, passwordHash)
+		_, err = db.DB.CreateUser(cfg.Admin.Username, passwordHash, models.RoleAdmin)
 		if err != nil {
 			return err
 		}
@@ -290,6 +918,35 @@ func loadSavedSettings(cfg *config.Config) error {
 	return nil
 }
 
+// assignMissingIPv6 allocates IPv6 addresses for peers created before dual-stack was enabled
+func assignMissingIPv6(pools *ipam.Pools) error {
+	if pools.V6 == nil {
+		return nil
+	}
+
+	peers, err := db.DB.GetAllPeers()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		if peer.AssignedIPv6 != "" {
+			continue
+		}
+
+		ipv6, err := db.DB.GetNextAvailableIP(pools.V6)
+		if err != nil {
+			return err
+		}
+		if err := db.DB.SetPeerIPv6(peer.ID, ipv6); err != nil {
+			return err
+		}
+		log.Printf("Assigned IPv6 %s to peer %s", ipv6, peer.Name)
+	}
+
+	return nil
+}
+
 // autoConfigureWireGuard reads server public key and endpoint from wg0.conf
 func autoConfigureWireGuard(cfg *config.Config) error {
 	setup := wgserver.NewSetup()
@@ -11,6 +11,10 @@ if [ "$(cat /proc/sys/net/ipv4/ip_forward 2>/dev/null)" != "1" ]; then
     echo "WARNING: IP forwarding is not enabled. VPN may not work correctly."
     echo "Make sure to run with --sysctl net.ipv4.ip_forward=1"
 fi
+if [ -n "$WG_NETWORK_V6" ] && [ "$(cat /proc/sys/net/ipv6/conf/all/forwarding 2>/dev/null)" != "1" ]; then
+    echo "WARNING: IPv6 forwarding is not enabled. IPv6 traffic of VPN clients will not be routed."
+    echo "Make sure to run with --sysctl net.ipv6.conf.all.forwarding=1"
+fi
 
 # Ensure data directories exist with proper permissions
 mkdir -p /data/wireguard /data/db /data/tailscale
@@ -73,6 +77,25 @@ NETWORK_MASK=$(echo "$WG_NETWORK" | cut -d'/' -f2)
 IFS='.' read -r -a octets <<< "$NETWORK_PREFIX"
 SERVER_IP="${octets[0]}.${octets[1]}.${octets[2]}.$((octets[3] + 1))"
 
+# Optional IPv6 (ULA) network for dual-stack peers; the server takes network + 1 like for IPv4
+INTERFACE_ADDRESS="${SERVER_IP}/${NETWORK_MASK}"
+POST_UP="iptables -t nat -A POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -A INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j ACCEPT"
+POST_DOWN="iptables -t nat -D POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -D INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT"
+if [ -n "$WG_NETWORK_V6" ]; then
+    NETWORK_V6_PREFIX=$(echo "$WG_NETWORK_V6" | cut -d'/' -f1)
+    NETWORK_V6_MASK=$(echo "$WG_NETWORK_V6" | cut -d'/' -f2)
+    case "$NETWORK_V6_PREFIX" in
+        *::) SERVER_IPV6="${NETWORK_V6_PREFIX}1" ;;
+        *)
+            echo "ERROR: WG_NETWORK_V6 must be a network address ending in '::', e.g. fd42:42:42::/64"
+            exit 1
+            ;;
+    esac
+    INTERFACE_ADDRESS="${INTERFACE_ADDRESS}, ${SERVER_IPV6}/${NETWORK_V6_MASK}"
+    POST_UP="${POST_UP}; ip6tables -t nat -A POSTROUTING -s ${WG_NETWORK_V6} -o ${DEFAULT_IFACE} -j MASQUERADE; ip6tables -A INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; ip6tables -A FORWARD -i wg0 -j ACCEPT; ip6tables -A FORWARD -o wg0 -j ACCEPT"
+    POST_DOWN="${POST_DOWN}; ip6tables -t nat -D POSTROUTING -s ${WG_NETWORK_V6} -o ${DEFAULT_IFACE} -j MASQUERADE; ip6tables -D INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; ip6tables -D FORWARD -i wg0 -j ACCEPT; ip6tables -D FORWARD -o wg0 -j ACCEPT"
+fi
+
 # Initialize WireGuard server if not configured
 if [ ! -f /etc/wireguard/wg0.conf ]; then
     echo "Initializing WireGuard server..."
@@ -84,17 +107,20 @@ if [ ! -f /etc/wireguard/wg0.conf ]; then
     # Create WireGuard config
     cat > /etc/wireguard/wg0.conf << EOF
 [Interface]
-Address = ${SERVER_IP}/${NETWORK_MASK}
+Address = ${INTERFACE_ADDRESS}
 ListenPort = ${WG_PORT}
 PrivateKey = ${SERVER_PRIVATE_KEY}
-PostUp = iptables -t nat -A POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -A INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j ACCEPT
-PostDown = iptables -t nat -D POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -D INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT
+PostUp = ${POST_UP}
+PostDown = ${POST_DOWN}
 EOF
 
     chmod 600 /etc/wireguard/wg0.conf
 
     echo "WireGuard server initialized"
     echo "  Server IP: ${SERVER_IP}"
+    if [ -n "$SERVER_IPV6" ]; then
+        echo "  Server IPv6: ${SERVER_IPV6}"
+    fi
     echo "  Public Key: ${SERVER_PUBLIC_KEY}"
 else
     echo "WireGuard configuration found, checking for network changes..."
@@ -102,21 +128,22 @@ else
     SERVER_PRIVATE_KEY=$(grep PrivateKey /etc/wireguard/wg0.conf | awk '{print $3}')
 
     # Get current network from config
-    CURRENT_NETWORK=$(grep -oP 'POSTROUTING -s \K[0-9./]+' /etc/wireguard/wg0.conf 2>/dev/null || echo "")
+    CURRENT_NETWORK=$(grep -oP '^PostUp = iptables -t nat -A POSTROUTING -s \K[0-9./]+' /etc/wireguard/wg0.conf 2>/dev/null || echo "")
     CURRENT_ADDRESS=$(grep -oP 'Address = \K[0-9./]+' /etc/wireguard/wg0.conf 2>/dev/null || echo "")
+    CURRENT_NETWORK_V6=$(grep -oP 'ip6tables -t nat -A POSTROUTING -s \K[0-9a-fA-F:/]+' /etc/wireguard/wg0.conf 2>/dev/null || echo "")
 
-    # Check if WG_NETWORK changed
-    if [ -n "$CURRENT_NETWORK" ] && [ "$CURRENT_NETWORK" != "$WG_NETWORK" ]; then
-        echo "Network changed from $CURRENT_NETWORK to $WG_NETWORK, updating configuration..."
+    # Check if WG_NETWORK or WG_NETWORK_V6 changed (including IPv6 being turned on or off)
+    if { [ -n "$CURRENT_NETWORK" ] && [ "$CURRENT_NETWORK" != "$WG_NETWORK" ]; } || [ "$CURRENT_NETWORK_V6" != "$WG_NETWORK_V6" ]; then
+        echo "Network changed from $CURRENT_NETWORK ${CURRENT_NETWORK_V6} to $WG_NETWORK ${WG_NETWORK_V6}, updating configuration..."
 
         # Update config with new network
         cat > /etc/wireguard/wg0.conf << EOF
 [Interface]
-Address = ${SERVER_IP}/${NETWORK_MASK}
+Address = ${INTERFACE_ADDRESS}
 ListenPort = ${WG_PORT}
 PrivateKey = ${SERVER_PRIVATE_KEY}
-PostUp = iptables -t nat -A POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -A INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j ACCEPT
-PostDown = iptables -t nat -D POSTROUTING -s ${WG_NETWORK} -o ${DEFAULT_IFACE} -j MASQUERADE; iptables -D INPUT -p udp -m udp --dport ${WG_PORT} -j ACCEPT; iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT
+PostUp = ${POST_UP}
+PostDown = ${POST_DOWN}
 EOF
 
         # Preserve existing peers
@@ -125,7 +152,7 @@ EOF
         fi
 
         chmod 600 /etc/wireguard/wg0.conf
-        echo "Configuration updated with new network: $WG_NETWORK"
+        echo "Configuration updated with new network: $WG_NETWORK ${WG_NETWORK_V6}"
     fi
 fi
 
@@ -1,10 +1,10 @@
 package auth
 
 import (
-	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -20,8 +20,10 @@ var (
 )
 
 type Claims struct {
-	UserID   int64  `json:"user_id"`
-	Username string `json:"username"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID int64  `json:"sid"` // The login session, revoking it invalidates the token
 	jwt.RegisteredClaims
 }
 
@@ -46,13 +48,15 @@ func VerifyPassword(password, hash string) error {
 	return nil
 }
 
-// GenerateAccessToken creates a short-lived JWT access token
-func GenerateAccessToken(userID int64, username string, cfg *config.JWTConfig) (string, error) {
+// GenerateAccessToken creates a short-lived JWT access token for a session
+func GenerateAccessToken(userID int64, username, role string, sessionID int64, cfg *config.JWTConfig) (string, error) {
 	expirationTime := time.Now().Add(time.Duration(cfg.AccessExpiryMinutes) * time.Minute)
 
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -73,6 +77,12 @@ func GenerateRefreshToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
+// HashRefreshToken returns the hash a refresh token is stored and looked up by
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // ValidateAccessToken verifies and parses the access token
 func ValidateAccessToken(tokenString string, cfg *config.JWTConfig) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
@@ -103,25 +113,21 @@ func GetRefreshTokenExpiry(cfg *config.JWTConfig) time.Time {
 	return time.Now().Add(time.Duration(cfg.RefreshExpiryDays) * 24 * time.Hour)
 }
 
-// GenerateAPIToken creates a deterministic 43-character API token from password
-// Token stays constant unless password changes - uses fixed salt so same password = same token across instances
-func GenerateAPIToken(password string, _ string) string {
-	// Use fixed salt so token is deterministic based only on password
-	// This allows same password to generate same token on different servers/restarts
-	fixedSalt := "wireguard-panel-api-token-salt-v1"
-
-	// Use HMAC-SHA256 with password and fixed salt
-	h := hmac.New(sha256.New, []byte(fixedSalt))
-	h.Write([]byte(password))
-	hash := h.Sum(nil)
-
-	// Encode to base64url (URL-safe base64 without padding)
-	token := base64.RawURLEncoding.EncodeToString(hash)
+// APITokenPrefix starts every API token, telling them apart from JWTs
+const APITokenPrefix = "wgt_"
 
-	// Ensure exactly 43 characters
-	if len(token) > 43 {
-		token = token[:43]
+// GenerateAPIToken creates a random API token
+func GenerateAPIToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
 	}
+	return APITokenPrefix + base64.RawURLEncoding.EncodeToString(bytes), nil
+}
 
-	return token
+// HashAPIToken returns the hash an API token is stored and looked up by. The token is
+// random and long, so a fast hash cannot be brute-forced like a password hash could.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// shareKeyLabel separates the share link signing key from other uses of the same secret
+const shareKeyLabel = "wgeasygo share link"
+
+func shareSignature(secret string, payload []byte) []byte {
+	key := hmac.New(sha256.New, []byte(secret))
+	key.Write([]byte(shareKeyLabel))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// GenerateShareToken creates the token of a share link URL: its expiry and random bytes,
+// signed with secret. Forged or expired tokens are rejected by VerifyShareToken before any
+// lookup; whether the link was used or revoked is up to the database.
+func GenerateShareToken(secret string, expiresAt time.Time) (string, error) {
+	payload := make([]byte, 8+24)
+	binary.BigEndian.PutUint64(payload, uint64(expiresAt.Unix()))
+	if _, err := rand.Read(payload[8:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(shareSignature(secret, payload)), nil
+}
+
+// VerifyShareToken checks a share link token's signature and expiry
+func VerifyShareToken(secret, token string, now time.Time) error {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) != 8+24 {
+		return ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, shareSignature(secret, payload)) {
+		return ErrInvalidToken
+	}
+	if now.Unix() >= int64(binary.BigEndian.Uint64(payload)) {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+// HashShareToken returns the hash a share link is stored and looked up by
+func HashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	token, err := GenerateShareToken("secret", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyShareToken("secret", token, now); err != nil {
+		t.Fatalf("fresh token: %v", err)
+	}
+	if err := VerifyShareToken("secret", token, now.Add(time.Hour)); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("token at its expiry: %v, want ErrExpiredToken", err)
+	}
+	if err := VerifyShareToken("other secret", token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token checked with another secret: %v, want ErrInvalidToken", err)
+	}
+
+	// Moving the expiry forward breaks the signature
+	payload, signature, _ := strings.Cut(token, ".")
+	later, err := GenerateShareToken("secret", now.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	laterPayload, _, _ := strings.Cut(later, ".")
+	for _, forged := range []string{laterPayload[:11] + payload[11:] + "." + signature, payload, payload + ".", "", "." + signature} {
+		if err := VerifyShareToken("secret", forged, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("VerifyShareToken(%q) = %v, want ErrInvalidToken", forged, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, truncated to six digits
+func TestTOTPCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code, _ := totpCode(secret, step+offset)
+		if got, ok := VerifyTOTP(secret, code, now); !ok || got != step+offset {
+			t.Errorf("code of step %+d: VerifyTOTP = %d, %v, want step %d", offset, got, ok, step+offset)
+		}
+	}
+
+	stale, _ := totpCode(secret, step-2)
+	if _, ok := VerifyTOTP(secret, stale, now); ok {
+		t.Error("code from two steps ago was accepted")
+	}
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := VerifyTOTP(secret, code, now); ok {
+			t.Errorf("malformed code %q was accepted", code)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("code %q is not formatted as four groups of four", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+
+	sloppy := strings.ToLower(strings.ReplaceAll(codes[0], "-", " "))
+	if HashRecoveryCode(sloppy) != HashRecoveryCode(codes[0]) {
+		t.Error("hash depends on case or separators")
+	}
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Error("different codes have the same hash")
+	}
+}
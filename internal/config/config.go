@@ -14,6 +14,9 @@ type Config struct {
 	WireGuard WireGuardConfig `mapstructure:"wireguard"`
 	Security  SecurityConfig  `mapstructure:"security"`
 	Admin     AdminConfig     `mapstructure:"admin"`
+	Metrics   MetricsConfig   `mapstructure:"metrics"`
+	OIDC      OIDCConfig      `mapstructure:"oidc"`
+	Portal    PortalConfig    `mapstructure:"portal"`
 }
 
 type ServerConfig struct {
@@ -23,7 +26,9 @@ type ServerConfig struct {
 }
 
 type DatabaseConfig struct {
-	Path string `mapstructure:"path"`
+	Path      string `mapstructure:"path"`
+	KeyFile   string `mapstructure:"key_file"`   // Master key for secrets stored in the database; defaults to secret.key next to the database
+	MasterKey string `mapstructure:"master_key"` // Base64 master key; takes precedence over key_file (set via DB_MASTER_KEY)
 }
 
 type JWTConfig struct {
@@ -34,19 +39,25 @@ type JWTConfig struct {
 }
 
 type WireGuardConfig struct {
-	Interface       string `mapstructure:"interface"`
-	ServerPublicKey string `mapstructure:"server_public_key"`
-	ServerEndpoint  string `mapstructure:"server_endpoint"`
-	DNS             string `mapstructure:"dns"`
-	AllowedIPs      string `mapstructure:"allowed_ips"`
-	Subnet          string `mapstructure:"subnet"`
-	ConfigPath      string `mapstructure:"config_path"`
+	Interface       string   `mapstructure:"interface"`
+	ServerPublicKey string   `mapstructure:"server_public_key"`
+	ServerEndpoint  string   `mapstructure:"server_endpoint"`
+	DNS             string   `mapstructure:"dns"`
+	AllowedIPs      string   `mapstructure:"allowed_ips"`
+	Subnet          string   `mapstructure:"subnet"`
+	SubnetV6        string   `mapstructure:"subnet_v6"`      // Optional IPv6 (ULA) subnet for dual-stack peers
+	ReservedIPs     []string `mapstructure:"reserved_ips"`   // Addresses, CIDRs or "a-b" ranges never handed to peers
+	PresharedKeys   bool     `mapstructure:"preshared_keys"` // Generate a preshared key for new peers unless the request says otherwise
+	ConfigPath      string   `mapstructure:"config_path"`
 }
 
 type SecurityConfig struct {
 	BcryptCost             int `mapstructure:"bcrypt_cost"`
 	RateLimitRequests      int `mapstructure:"rate_limit_requests"`
 	RateLimitWindowSeconds int `mapstructure:"rate_limit_window_seconds"`
+	LoginDelayAfter        int `mapstructure:"login_delay_after"` // Failed logins in a row before each further attempt is delayed
+	LockoutThreshold       int `mapstructure:"lockout_threshold"` // Failed logins in a row that lock the account
+	LockoutMinutes         int `mapstructure:"lockout_minutes"`
 }
 
 type AdminConfig struct {
@@ -54,6 +65,37 @@ type AdminConfig struct {
 	Password string `mapstructure:"password"`
 }
 
+type MetricsConfig struct {
+	Enabled              bool   `mapstructure:"enabled"`               // Serve Prometheus metrics on /metrics
+	Token                string `mapstructure:"token"`                 // Bearer token required to scrape /metrics
+	AllowUnauthenticated bool   `mapstructure:"allow_unauthenticated"` // Serve /metrics without a token
+}
+
+// PortalConfig configures the self-service portal where users manage their own peers
+type PortalConfig struct {
+	DefaultMaxDevices int `mapstructure:"default_max_devices"` // Device cap of new users unless set when creating them
+}
+
+// OIDCConfig enables single sign-on through an OpenID Connect identity provider
+type OIDCConfig struct {
+	Enabled        bool     `mapstructure:"enabled"`
+	Name           string   `mapstructure:"name"`   // Shown on the login button
+	Issuer         string   `mapstructure:"issuer"` // Discovery is read from <issuer>/.well-known/openid-configuration
+	ClientID       string   `mapstructure:"client_id"`
+	ClientSecret   string   `mapstructure:"client_secret"` // Empty for a public client, which relies on PKCE alone
+	RedirectURL    string   `mapstructure:"redirect_url"`  // https://<panel>/api/v1/auth/oidc/callback
+	Scopes         []string `mapstructure:"scopes"`
+	UsernameClaim  string   `mapstructure:"username_claim"`
+	GroupsClaim    string   `mapstructure:"groups_claim"`
+	AdminGroups    []string `mapstructure:"admin_groups"`
+	OperatorGroups []string `mapstructure:"operator_groups"`
+	ViewerGroups   []string `mapstructure:"viewer_groups"`
+	UserGroups     []string `mapstructure:"user_groups"`      // Members get the self-service portal only
+	DefaultRole    string   `mapstructure:"default_role"`     // Role of users in none of the groups; empty refuses them
+	AutoCreate     bool     `mapstructure:"auto_create"`      // Create a panel user on a person's first login
+	LinkByUsername bool     `mapstructure:"link_by_username"` // Sign in to the existing panel user with the same name
+}
+
 var AppConfig *Config
 
 func Load(configPath string) (*Config, error) {
@@ -72,6 +114,24 @@ func Load(configPath string) (*Config, error) {
 	viper.BindEnv("admin.password", "ADMIN_PASSWORD")
 	viper.BindEnv("wireguard.server_endpoint", "WG_SERVER_ENDPOINT")
 	viper.BindEnv("wireguard.server_public_key", "WG_SERVER_PUBLIC_KEY")
+	viper.BindEnv("wireguard.subnet_v6", "WG_NETWORK_V6")
+	viper.BindEnv("database.master_key", "DB_MASTER_KEY")
+	viper.BindEnv("metrics.token", "METRICS_TOKEN")
+	viper.BindEnv("oidc.enabled", "OIDC_ENABLED")
+	viper.BindEnv("oidc.issuer", "OIDC_ISSUER")
+	viper.BindEnv("oidc.client_id", "OIDC_CLIENT_ID")
+	viper.BindEnv("oidc.client_secret", "OIDC_CLIENT_SECRET")
+	viper.BindEnv("oidc.redirect_url", "OIDC_REDIRECT_URL")
+
+	viper.SetDefault("security.login_delay_after", 3)
+	viper.SetDefault("security.lockout_threshold", 10)
+	viper.SetDefault("security.lockout_minutes", 15)
+	viper.SetDefault("oidc.name", "SSO")
+	viper.SetDefault("oidc.scopes", []string{"openid", "profile", "email"})
+	viper.SetDefault("oidc.username_claim", "preferred_username")
+	viper.SetDefault("oidc.groups_claim", "groups")
+	viper.SetDefault("oidc.auto_create", true)
+	viper.SetDefault("portal.default_max_devices", 3)
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Printf("Warning: Could not read config file: %v. Using defaults and env vars.", err)
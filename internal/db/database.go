@@ -2,22 +2,55 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"wgeasygo/internal/models"
+	"wgeasygo/internal/secrets"
+	"wgeasygo/pkg/ipam"
 )
 
+// ErrIPConflict is returned when an address is already assigned to another peer
+var ErrIPConflict = errors.New("IP address is already assigned to another peer")
+
+// ErrPublicKeyConflict is returned when a public key is already used by another peer
+var ErrPublicKeyConflict = errors.New("public key is already used by another peer")
+
+// peerConflict maps unique constraint violations on peer addresses and keys to ErrIPConflict and
+// ErrPublicKeyConflict. The checks before a write cannot see a concurrent request's insert,
+// the constraint can.
+func peerConflict(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return err
+	}
+	// The message names the columns, e.g. "UNIQUE constraint failed: peers.assigned_ip"
+	message := sqliteErr.Error()
+	switch {
+	case strings.Contains(message, "peers.assigned_ip"): // Also matches peers.assigned_ipv6
+		return ErrIPConflict
+	case strings.Contains(message, "peers.public_key"):
+		return ErrPublicKeyConflict
+	}
+	return err
+}
+
 type Database struct {
-	conn *sql.DB
+	conn   *sql.DB
+	cipher *secrets.Cipher // Encrypts peer secrets at rest
 }
 
 var DB *Database
 
-func Initialize(dbPath string) (*Database, error) {
+func Initialize(dbPath string, cipher *secrets.Cipher) (*Database, error) {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0750); err != nil {
@@ -43,7 +76,7 @@ func Initialize(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	db := &Database{conn: conn}
+	db := &Database{conn: conn, cipher: cipher}
 
 	if err := db.migrate(); err != nil {
 		conn.Close()
@@ -54,6 +87,40 @@ func Initialize(dbPath string) (*Database, error) {
 	return db, nil
 }
 
+// HasEncryptedSecrets reports whether the database at dbPath already holds peer secrets encrypted
+// under some master key. It runs before Initialize, so a missing database or one from before
+// encryption at rest simply reports false.
+func HasEncryptedSecrets(dbPath string) (bool, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	conn, err := sql.Open("sqlite3", dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return false, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+
+	var count int
+	err = conn.QueryRow("SELECT COUNT(*) FROM peers WHERE private_key LIKE 'enc:%' OR COALESCE(preshared_key, '') LIKE 'enc:%'").Scan(&count)
+	if err != nil {
+		// Try again without preshared_key in case the database predates that column
+		if err := conn.QueryRow("SELECT COUNT(*) FROM peers WHERE private_key LIKE 'enc:%'").Scan(&count); err != nil {
+			// No peers table yet
+			return false, nil
+		}
+	}
+	if count == 0 {
+		// Webhook secrets are encrypted too; the table may not exist yet
+		_ = conn.QueryRow("SELECT COUNT(*) FROM webhooks WHERE secret LIKE 'enc:%'").Scan(&count)
+	}
+	if count == 0 {
+		// And so are TOTP secrets; the column may not exist yet
+		_ = conn.QueryRow("SELECT COUNT(*) FROM users WHERE totp_secret LIKE 'enc:%'").Scan(&count)
+	}
+	return count > 0, nil
+}
+
 func (d *Database) migrate() error {
 	migrations := []string{
 		`CREATE TABLE IF NOT EXISTS users (
@@ -73,6 +140,17 @@ func (d *Database) migrate() error {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			auth_method TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			source_ip TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
 		`CREATE TABLE IF NOT EXISTS refresh_tokens (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id INTEGER NOT NULL,
@@ -93,10 +171,120 @@ func (d *Database) migrate() error {
 			connected_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (peer_id) REFERENCES peers(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS traffic_samples (
+			peer_id INTEGER NOT NULL,
+			resolution INTEGER NOT NULL,
+			bucket INTEGER NOT NULL,
+			rx INTEGER NOT NULL DEFAULT 0,
+			tx INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (peer_id, resolution, bucket),
+			FOREIGN KEY (peer_id) REFERENCES peers(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '',
+			enabled INTEGER DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			response_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			next_attempt_at DATETIME,
+			created_at DATETIME NOT NULL,
+			delivered_at DATETIME,
+			FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			prefix TEXT NOT NULL,
+			scopes TEXT NOT NULL DEFAULT '',
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME NOT NULL,
+			user_id INTEGER NOT NULL DEFAULT 0,
+			username TEXT NOT NULL DEFAULT '',
+			source_ip TEXT NOT NULL DEFAULT '',
+			auth_method TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			before_state TEXT NOT NULL DEFAULT '',
+			after_state TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			source_ip TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_lockouts (
+			username TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at DATETIME NOT NULL,
+			locked_until DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS share_links (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			peer_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			consumed_at DATETIME,
+			consumed_ip TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (peer_id) REFERENCES peers(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS peer_groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			dns TEXT NOT NULL DEFAULT '',
+			allowed_ips TEXT NOT NULL DEFAULT '',
+			mtu INTEGER NOT NULL DEFAULT 0,
+			persistent_keepalive INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_peers_assigned_ip ON peers(assigned_ip)`,
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token ON refresh_tokens(token)`,
 		`CREATE INDEX IF NOT EXISTS idx_connection_logs_peer_id ON connection_logs(peer_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_connection_logs_connected_at ON connection_logs(connected_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_traffic_samples_peer_bucket ON traffic_samples(peer_id, bucket)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(status, next_attempt_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_username ON login_failures(username, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_created_at ON login_failures(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_share_links_expires_at ON share_links(expires_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
 	}
 
 	for _, migration := range migrations {
@@ -112,19 +300,285 @@ func (d *Database) migrate() error {
 	// Create index on api_token after the column exists
 	_, _ = d.conn.Exec("CREATE INDEX IF NOT EXISTS idx_users_api_token ON users(api_token)")
 
+	// Password-derived API tokens were replaced by the api_tokens table, stop honouring them
+	_, _ = d.conn.Exec("UPDATE users SET api_token = '' WHERE api_token != ''")
+
+	// Add role and disabled columns; users from before roles existed are admins
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'admin'")
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0")
+
+	// Add TOTP columns: the secret (encrypted, set once enrollment starts), whether the user
+	// finished enrollment, and the last step a code was accepted for, so codes are not replayed
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0")
+
+	// Users signing in through OIDC are linked by the provider's subject
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN oidc_subject TEXT NOT NULL DEFAULT ''")
+	_, _ = d.conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc_subject ON users(oidc_subject) WHERE oidc_subject != ''")
+
+	// Device cap for the self-service portal, and the user each peer belongs to there
+	_, _ = d.conn.Exec("ALTER TABLE users ADD COLUMN max_devices INTEGER NOT NULL DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN owner_id INTEGER REFERENCES users(id) ON DELETE SET NULL")
+	_, _ = d.conn.Exec("CREATE INDEX IF NOT EXISTS idx_peers_owner_id ON peers(owner_id)")
+
+	// Group whose client settings a peer inherits; peers of a deleted group fall back to the server's
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN group_id INTEGER REFERENCES peer_groups(id) ON DELETE SET NULL")
+	_, _ = d.conn.Exec("CREATE INDEX IF NOT EXISTS idx_peers_group_id ON peers(group_id)")
+
+	// Client settings of a single peer, over its group's; interface_lines holds one line each
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN dns TEXT NOT NULL DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN allowed_ips TEXT NOT NULL DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN mtu INTEGER NOT NULL DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN persistent_keepalive INTEGER")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN endpoint_host TEXT NOT NULL DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN endpoint_port INTEGER NOT NULL DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN interface_lines TEXT NOT NULL DEFAULT ''")
+
+	// Refresh tokens belong to a session and are stored hashed in the token column; when a
+	// token is rotated it is kept with rotated_at set to detect reuse. Tokens from before
+	// sessions were stored in plaintext, drop them (their users log in again).
+	_, _ = d.conn.Exec("ALTER TABLE refresh_tokens ADD COLUMN session_id INTEGER REFERENCES sessions(id) ON DELETE CASCADE")
+	_, _ = d.conn.Exec("ALTER TABLE refresh_tokens ADD COLUMN rotated_at DATETIME")
+	if _, err := d.conn.Exec("DELETE FROM refresh_tokens WHERE session_id IS NULL"); err != nil {
+		return err
+	}
+
+	// Add assigned_ipv6 column for dual-stack peers (empty when IPv6 is disabled)
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN assigned_ipv6 TEXT DEFAULT ''")
+	_, _ = d.conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_peers_assigned_ipv6 ON peers(assigned_ipv6) WHERE assigned_ipv6 != ''")
+
+	// Record whether the server holds the peer's private key (false for bring-your-own-key peers)
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN has_private_key INTEGER DEFAULT 1")
+
+	// Add preshared_key column (encrypted, empty when the peer has no preshared key)
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN preshared_key TEXT DEFAULT ''")
+
+	// Track the previous key of peers in a key rotation grace period
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN previous_public_key TEXT DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN key_grace_until DATETIME")
+
+	// Optional expiry date and the reason a peer was disabled (manual or expired)
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN expires_at DATETIME")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN disabled_reason TEXT DEFAULT ''")
+
+	// Persisted transfer usage, the last interface counters it was computed from, and quotas
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN usage_rx INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN usage_tx INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN monthly_usage INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN usage_month TEXT DEFAULT ''")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN counter_rx INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN counter_tx INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN monthly_quota INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN total_quota INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE peers ADD COLUMN counter_key TEXT DEFAULT ''")
+
+	// Counters stored before counter_key existed belong to the key stats were read from
+	_, _ = d.conn.Exec(`UPDATE peers SET counter_key = CASE WHEN COALESCE(previous_public_key, '') != '' THEN previous_public_key ELSE public_key END
+		WHERE COALESCE(counter_key, '') = '' AND (counter_rx != 0 OR counter_tx != 0)`)
+
+	// Connection logs are sessions with an end, a last poll time and bytes transferred
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN disconnected_at DATETIME")
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN last_seen_at DATETIME")
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN rx_bytes INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN tx_bytes INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN counter_rx INTEGER DEFAULT 0")
+	_, _ = d.conn.Exec("ALTER TABLE connection_logs ADD COLUMN counter_tx INTEGER DEFAULT 0")
+
+	// Endpoint changes logged by earlier versions have no known end, close them where they started
+	_, _ = d.conn.Exec("UPDATE connection_logs SET disconnected_at = connected_at, last_seen_at = connected_at WHERE last_seen_at IS NULL")
+
+	// Encrypt private keys stored in plaintext by earlier versions
+	return d.encryptPlaintextPrivateKeys()
+}
+
+// encryptPlaintextPrivateKeys encrypts every private key not yet in the encrypted format
+// It runs on each start but only touches rows written before encryption at rest existed
+func (d *Database) encryptPlaintextPrivateKeys() error {
+	rows, err := d.conn.Query("SELECT id, private_key FROM peers WHERE private_key != '' AND private_key NOT LIKE 'enc:%'")
+	if err != nil {
+		return err
+	}
+
+	plaintext := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var privateKey string
+		if err := rows.Scan(&id, &privateKey); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext[id] = privateKey
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(plaintext) == 0 {
+		return nil
+	}
+
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, privateKey := range plaintext {
+		encrypted, err := d.cipher.Encrypt(privateKey)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE peers SET private_key = ? WHERE id = ?", encrypted, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Encrypted %d plaintext peer private keys", len(plaintext))
 	return nil
 }
 
+// secretsByID runs a query selecting an ID and an encrypted value and returns the values by ID
+func (d *Database) secretsByID(query string) (map[int64]string, error) {
+	rows, err := d.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			return nil, err
+		}
+		values[id] = value
+	}
+	return values, rows.Err()
+}
+
+// RotateMasterKey re-wraps every encrypted peer, webhook and TOTP secret under next in a single
+// transaction and switches the database to it. Values keep their data keys, so only the
+// wrapping changes. It returns the number of peers.
+func (d *Database) RotateMasterKey(next *secrets.Cipher) (int, error) {
+	rows, err := d.conn.Query("SELECT id, private_key, COALESCE(preshared_key, '') FROM peers")
+	if err != nil {
+		return 0, err
+	}
+
+	type peerSecrets struct {
+		id                       int64
+		privateKey, presharedKey string
+	}
+	var all []peerSecrets
+	for rows.Next() {
+		var ps peerSecrets
+		if err := rows.Scan(&ps.id, &ps.privateKey, &ps.presharedKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, ps)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	webhookSecrets, err := d.secretsByID("SELECT id, secret FROM webhooks")
+	if err != nil {
+		return 0, err
+	}
+	totpSecrets, err := d.secretsByID("SELECT id, totp_secret FROM users WHERE totp_secret != ''")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for id, secret := range webhookSecrets {
+		rewrapped, err := d.cipher.Rewrap(secret, next)
+		if err != nil {
+			return 0, fmt.Errorf("failed to re-wrap secret of webhook %d: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE webhooks SET secret = ? WHERE id = ?", rewrapped, id); err != nil {
+			return 0, err
+		}
+	}
+
+	for id, secret := range totpSecrets {
+		rewrapped, err := d.cipher.Rewrap(secret, next)
+		if err != nil {
+			return 0, fmt.Errorf("failed to re-wrap TOTP secret of user %d: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", rewrapped, id); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, ps := range all {
+		privateKey, err := d.cipher.Rewrap(ps.privateKey, next)
+		if err != nil {
+			return 0, fmt.Errorf("failed to re-wrap private key of peer %d: %w", ps.id, err)
+		}
+		presharedKey, err := d.cipher.Rewrap(ps.presharedKey, next)
+		if err != nil {
+			return 0, fmt.Errorf("failed to re-wrap preshared key of peer %d: %w", ps.id, err)
+		}
+		if _, err := tx.Exec("UPDATE peers SET private_key = ?, preshared_key = ? WHERE id = ?", privateKey, presharedKey, ps.id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	d.cipher = next
+	return len(all), nil
+}
+
 func (d *Database) Close() error {
 	return d.conn.Close()
 }
 
 // User operations
-func (d *Database) CreateUser(username, passwordHash string) (*models.User, error) {
+
+const userColumns = "id, username, password_hash, role, disabled, totp_enabled, oidc_subject != '', max_devices, created_at, updated_at"
+
+func scanUser(row rowScanner) (*models.User, error) {
+	var user models.User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled, &user.TOTPEnabled, &user.SSO, &user.MaxDevices, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ErrUsernameTaken is returned when a user with the same name exists
+var ErrUsernameTaken = errors.New("username already taken")
+
+// ErrLastAdmin is returned when a change would leave no enabled admin
+var ErrLastAdmin = errors.New("at least one enabled admin is required")
+
+func (d *Database) CreateUser(username, passwordHash, role string) (*models.User, error) {
 	result, err := d.conn.Exec(
-		"INSERT INTO users (username, password_hash, api_token) VALUES (?, ?, '')",
-		username, passwordHash,
+		"INSERT INTO users (username, password_hash, api_token, role) VALUES (?, ?, '', ?)",
+		username, passwordHash, role,
 	)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return nil, ErrUsernameTaken
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -137,54 +591,72 @@ func (d *Database) CreateUser(username, passwordHash string) (*models.User, erro
 	return d.GetUserByID(id)
 }
 
-func (d *Database) GetUserByID(id int64) (*models.User, error) {
-	var user models.User
-	err := d.conn.QueryRow(
-		"SELECT id, username, password_hash, COALESCE(api_token, ''), created_at, updated_at FROM users WHERE id = ?",
-		id,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIToken, &user.CreatedAt, &user.UpdatedAt)
+// CreateSSOUser adds a user who signs in through OIDC only; without a password hash
+// password logins always fail
+func (d *Database) CreateSSOUser(username, role, subject string) (*models.User, error) {
+	result, err := d.conn.Exec(
+		"INSERT INTO users (username, password_hash, api_token, role, oidc_subject) VALUES (?, '', '', ?, ?)",
+		username, role, subject,
+	)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return nil, ErrUsernameTaken
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
-}
 
-func (d *Database) GetUserByUsername(username string) (*models.User, error) {
-	var user models.User
-	err := d.conn.QueryRow(
-		"SELECT id, username, password_hash, COALESCE(api_token, ''), created_at, updated_at FROM users WHERE username = ?",
-		username,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIToken, &user.CreatedAt, &user.UpdatedAt)
+	id, err := result.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
+
+	return d.GetUserByID(id)
+}
+
+// GetUserByOIDCSubject returns the user linked to a subject at the identity provider
+func (d *Database) GetUserByOIDCSubject(subject string) (*models.User, error) {
+	return scanUser(d.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE oidc_subject = ? AND oidc_subject != ''", subject))
 }
 
-// GetUserByAPIToken finds a user by their API token
-func (d *Database) GetUserByAPIToken(token string) (*models.User, error) {
-	// Prevent empty token lookups
-	if token == "" {
-		return nil, sql.ErrNoRows
+// LinkOIDCSubject links an existing user to a subject, unless it is linked to another one
+func (d *Database) LinkOIDCSubject(userID int64, subject string) (bool, error) {
+	result, err := d.conn.Exec(
+		"UPDATE users SET oidc_subject = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND oidc_subject = ''",
+		subject, userID,
+	)
+	if err != nil {
+		return false, err
 	}
-	var user models.User
-	err := d.conn.QueryRow(
-		"SELECT id, username, password_hash, COALESCE(api_token, ''), created_at, updated_at FROM users WHERE api_token = ? AND api_token != ''",
-		token,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIToken, &user.CreatedAt, &user.UpdatedAt)
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (d *Database) GetUserByID(id int64) (*models.User, error) {
+	return scanUser(d.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (d *Database) GetUserByUsername(username string) (*models.User, error) {
+	return scanUser(d.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+}
+
+// GetUsers returns all users ordered by name
+func (d *Database) GetUsers() ([]models.User, error) {
+	rows, err := d.conn.Query("SELECT " + userColumns + " FROM users ORDER BY username")
 	if err != nil {
 		return nil, err
 	}
-	return &user, nil
-}
+	defer rows.Close()
 
-// UpdateUserAPIToken updates the user's API token
-func (d *Database) UpdateUserAPIToken(userID int64, apiToken string) error {
-	_, err := d.conn.Exec(
-		"UPDATE users SET api_token = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-		apiToken, userID,
-	)
-	return err
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
 }
 
 func (d *Database) UserExists(username string) (bool, error) {
@@ -204,293 +676,1879 @@ func (d *Database) UpdateUserPassword(userID int64, passwordHash string) error {
 	return err
 }
 
-// Peer operations
-func (d *Database) CreatePeer(peer *models.Peer) (*models.Peer, error) {
-	result, err := d.conn.Exec(
-		"INSERT INTO peers (name, public_key, private_key, assigned_ip, enabled) VALUES (?, ?, ?, ?, ?)",
-		peer.Name, peer.PublicKey, peer.PrivateKey, peer.AssignedIP, peer.Enabled,
-	)
-	if err != nil {
-		return nil, err
-	}
+// API token operations
 
-	id, err := result.LastInsertId()
+const apiTokenColumns = "id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at"
+
+func scanAPIToken(row rowScanner) (*models.APIToken, error) {
+	var token models.APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes, &expiresAt, &lastUsedAt, &token.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
-
-	return d.GetPeerByID(id)
+	token.Scopes = []string{}
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return &token, nil
 }
 
-func (d *Database) GetPeerByID(id int64) (*models.Peer, error) {
-	var peer models.Peer
-	err := d.conn.QueryRow(
-		"SELECT id, name, public_key, private_key, assigned_ip, enabled, created_at, updated_at FROM peers WHERE id = ?",
-		id,
-	).Scan(&peer.ID, &peer.Name, &peer.PublicKey, &peer.PrivateKey, &peer.AssignedIP, &peer.Enabled, &peer.CreatedAt, &peer.UpdatedAt)
+// CreateAPIToken stores a token by the hash of its value
+func (d *Database) CreateAPIToken(token *models.APIToken, tokenHash string) (*models.APIToken, error) {
+	var expiresAt interface{}
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+	result, err := d.conn.Exec(
+		"INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		token.UserID, token.Name, tokenHash, token.Prefix, strings.Join(token.Scopes, ","), expiresAt, time.Now().UTC(),
+	)
 	if err != nil {
 		return nil, err
 	}
-	return &peer, nil
-}
 
-func (d *Database) GetPeerByIP(ip string) (*models.Peer, error) {
-	var peer models.Peer
-	err := d.conn.QueryRow(
-		"SELECT id, name, public_key, private_key, assigned_ip, enabled, created_at, updated_at FROM peers WHERE assigned_ip = ?",
-		ip,
-	).Scan(&peer.ID, &peer.Name, &peer.PublicKey, &peer.PrivateKey, &peer.AssignedIP, &peer.Enabled, &peer.CreatedAt, &peer.UpdatedAt)
+	id, err := result.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
-	return &peer, nil
+	return d.GetAPIToken(id)
 }
 
-func (d *Database) UpdatePeer(ip string, name *string, enabled *bool) (*models.Peer, error) {
-	if name != nil {
-		_, err := d.conn.Exec("UPDATE peers SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE assigned_ip = ?", *name, ip)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if enabled != nil {
-		_, err := d.conn.Exec("UPDATE peers SET enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE assigned_ip = ?", *enabled, ip)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return d.GetPeerByIP(ip)
+func (d *Database) GetAPIToken(id int64) (*models.APIToken, error) {
+	return scanAPIToken(d.conn.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
 }
 
-func (d *Database) GetAllPeers() ([]models.Peer, error) {
-	rows, err := d.conn.Query(
-		"SELECT id, name, public_key, private_key, assigned_ip, enabled, created_at, updated_at FROM peers ORDER BY created_at DESC",
-	)
+// GetAPITokenByHash finds the token whose value hashes to tokenHash
+func (d *Database) GetAPITokenByHash(tokenHash string) (*models.APIToken, error) {
+	return scanAPIToken(d.conn.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", tokenHash))
+}
+
+// GetAPITokens returns a user's tokens, or every user's tokens if userID is 0
+func (d *Database) GetAPITokens(userID int64) ([]models.APIToken, error) {
+	rows, err := d.conn.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE ? = 0 OR user_id = ? ORDER BY id", userID, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var peers []models.Peer
+	tokens := []models.APIToken{}
 	for rows.Next() {
-		var peer models.Peer
-		if err := rows.Scan(&peer.ID, &peer.Name, &peer.PublicKey, &peer.PrivateKey, &peer.AssignedIP, &peer.Enabled, &peer.CreatedAt, &peer.UpdatedAt); err != nil {
+		token, err := scanAPIToken(rows)
+		if err != nil {
 			return nil, err
 		}
-		peers = append(peers, peer)
+		tokens = append(tokens, *token)
 	}
+	return tokens, rows.Err()
+}
 
-	return peers, rows.Err()
+func (d *Database) UpdateAPITokenName(id int64, name string) error {
+	_, err := d.conn.Exec("UPDATE api_tokens SET name = ? WHERE id = ?", name, id)
+	return err
 }
 
-func (d *Database) DeletePeer(ip string) error {
-	result, err := d.conn.Exec("DELETE FROM peers WHERE assigned_ip = ?", ip)
+// TouchAPIToken records that a token was used at the given time
+func (d *Database) TouchAPIToken(id int64, at time.Time) error {
+	_, err := d.conn.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", at.UTC(), id)
+	return err
+}
+
+// DeleteAPIToken revokes a token
+func (d *Database) DeleteAPIToken(id int64) error {
+	result, err := d.conn.Exec("DELETE FROM api_tokens WHERE id = ?", id)
 	if err != nil {
 		return err
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Login lockout operations
+
+// loginFailureRetention is how long failed logins are kept for the lockout overview
+const loginFailureRetention = 7 * 24 * time.Hour
+
+// RecordLoginFailure logs a failed login for username from sourceIP and returns how many
+// failures the username has in a row. The count starts over when the previous failure is
+// older than resetAfter.
+func (d *Database) RecordLoginFailure(username, sourceIP string, at time.Time, resetAfter time.Duration) (int, error) {
+	at = at.UTC()
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO login_failures (username, source_ip, created_at) VALUES (?, ?, ?)",
+		username, sourceIP, at,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO login_lockouts (username, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+			last_failure_at = excluded.last_failure_at`,
+		username, at, at.Add(-resetAfter),
+	); err != nil {
+		return 0, err
+	}
+
+	var failures int
+	if err := tx.QueryRow("SELECT failures FROM login_lockouts WHERE username = ?", username).Scan(&failures); err != nil {
+		return 0, err
+	}
+
+	// Prune here rather than in a background job, failures are what fills these tables
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE created_at < ?", at.Add(-loginFailureRetention)); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM login_lockouts WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)",
+		at.Add(-resetAfter), at,
+	); err != nil {
+		return 0, err
+	}
+	return failures, tx.Commit()
+}
+
+// LockLogin refuses logins for username until the given time
+func (d *Database) LockLogin(username string, until time.Time) error {
+	_, err := d.conn.Exec("UPDATE login_lockouts SET locked_until = ? WHERE username = ?", until.UTC(), username)
+	return err
+}
+
+// ClearLoginLockout forgets a username's failures and unlocks it. The failed logins stay
+// in the history.
+func (d *Database) ClearLoginLockout(username string) error {
+	_, err := d.conn.Exec("DELETE FROM login_lockouts WHERE username = ?", username)
+	return err
+}
+
+const loginLockoutColumns = "username, failures, last_failure_at, locked_until"
+
+func scanLoginLockout(row rowScanner) (*models.LoginLockout, error) {
+	var lockout models.LoginLockout
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&lockout.Username, &lockout.Failures, &lockout.LastFailureAt, &lockedUntil); err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		lockout.LockedUntil = &lockedUntil.Time
+	}
+	return &lockout, nil
+}
+
+// loginSourceIPs returns the addresses a username's failed logins came from, most recent first
+func (d *Database) loginSourceIPs(username string) ([]string, error) {
+	rows, err := d.conn.Query(
+		"SELECT source_ip FROM login_failures WHERE username = ? GROUP BY source_ip ORDER BY MAX(created_at) DESC LIMIT 10",
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
+// GetLoginLockout returns a username's failure count and lockout, sql.ErrNoRows if it has none
+func (d *Database) GetLoginLockout(username string) (*models.LoginLockout, error) {
+	lockout, err := scanLoginLockout(d.conn.QueryRow("SELECT "+loginLockoutColumns+" FROM login_lockouts WHERE username = ?", username))
+	if err != nil {
+		return nil, err
+	}
+	if lockout.SourceIPs, err = d.loginSourceIPs(username); err != nil {
+		return nil, err
+	}
+	return lockout, nil
+}
+
+// GetLoginLockouts returns every username with recent failed logins, most recent first.
+// Usernames that do not exist are included, they show what an attacker is guessing.
+func (d *Database) GetLoginLockouts() ([]models.LoginLockout, error) {
+	rows, err := d.conn.Query("SELECT " + loginLockoutColumns + " FROM login_lockouts ORDER BY last_failure_at DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	lockouts := []models.LoginLockout{}
+	for rows.Next() {
+		lockout, err := scanLoginLockout(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lockouts = append(lockouts, *lockout)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only after closing rows, the database has a single connection
+	for i := range lockouts {
+		if lockouts[i].SourceIPs, err = d.loginSourceIPs(lockouts[i].Username); err != nil {
+			return nil, err
+		}
+	}
+	return lockouts, nil
+}
+
+// Two-factor authentication operations
+
+// GetUserTOTP returns a user's decrypted TOTP secret, empty if they have not started enrollment
+func (d *Database) GetUserTOTP(userID int64) (string, error) {
+	var secret string
+	if err := d.conn.QueryRow("SELECT totp_secret FROM users WHERE id = ?", userID).Scan(&secret); err != nil {
+		return "", err
+	}
+	return d.cipher.Decrypt(secret)
+}
+
+// StartTOTPEnrollment stores a new secret for a user whose enrollment is not finished yet
+func (d *Database) StartTOTPEnrollment(userID int64, secret string) error {
+	encrypted, err := d.cipher.Encrypt(secret)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.Exec(
+		"UPDATE users SET totp_secret = ?, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND totp_enabled = 0",
+		encrypted, userID,
+	)
+	return err
+}
+
+// EnableTOTP finishes enrollment after a code for step was verified, replacing the recovery codes
+func (d *Database) EnableTOTP(userID, step int64, codeHashes []string) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE users SET totp_enabled = 1, totp_last_step = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		step, userID,
+	); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP removes a user's secret and recovery codes
+func (d *Database) DisableTOTP(userID int64) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := disableTOTP(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func disableTOTP(tx *sql.Tx, userID int64) error {
+	if _, err := tx.Exec(
+		"UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		userID,
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	return err
+}
+
+// UseTOTPStep records that a code for step was accepted. It returns false if a code for
+// this or a later step was accepted before, so the code is a replay.
+func (d *Database) UseTOTPStep(userID, step int64) (bool, error) {
+	result, err := d.conn.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new ones
+func (d *Database) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks the unused recovery code with codeHash as used, reporting whether there was one
+func (d *Database) UseRecoveryCode(userID int64, codeHash string) (bool, error) {
+	result, err := d.conn.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE id = (SELECT id FROM recovery_codes WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1)",
+		time.Now().UTC(), userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has
+func (d *Database) CountRecoveryCodes(userID int64) (int, error) {
+	var count int
+	err := d.conn.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// otherEnabledAdmins counts the enabled admins other than userID
+func otherEnabledAdmins(tx *sql.Tx, userID int64) (int, error) {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND disabled = 0 AND id != ?", models.RoleAdmin, userID).Scan(&count)
+	return count, err
+}
+
+// UpdateUserAccess sets a user's role and disabled state. It returns ErrLastAdmin instead
+// if the user is the only enabled admin and would stop being one.
+func (d *Database) UpdateUserAccess(userID int64, role string, disabled bool) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role != models.RoleAdmin || disabled {
+		admins, err := otherEnabledAdmins(tx, userID)
+		if err != nil {
+			return err
+		}
+		if admins == 0 {
+			return ErrLastAdmin
+		}
+	}
+
+	result, err := tx.Exec(
+		"UPDATE users SET role = ?, disabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		role, disabled, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// UpdateUser saves an admin's changes to a user in one transaction: the role, disabled state
+// and device cap of user, and passwordHash unless it is empty. resetTwoFactor turns off the
+// user's two-factor authentication. A new password or disabling the user ends their sessions.
+// It returns ErrLastAdmin instead if the user is the only enabled admin and would stop being one.
+func (d *Database) UpdateUser(user *models.User, passwordHash string, resetTwoFactor bool) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if user.Role != models.RoleAdmin || user.Disabled {
+		admins, err := otherEnabledAdmins(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if admins == 0 {
+			return ErrLastAdmin
+		}
+	}
+
+	result, err := tx.Exec(
+		"UPDATE users SET role = ?, disabled = ?, max_devices = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		user.Role, user.Disabled, user.MaxDevices, user.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if passwordHash != "" {
+		if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, user.ID); err != nil {
+			return err
+		}
+	}
+	if resetTwoFactor {
+		if err := disableTOTP(tx, user.ID); err != nil {
+			return err
+		}
+	}
+	if passwordHash != "" || user.Disabled {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetUserMaxDevices sets how many peers a user may own before the portal refuses new ones
+func (d *Database) SetUserMaxDevices(userID int64, maxDevices int) error {
+	_, err := d.conn.Exec("UPDATE users SET max_devices = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", maxDevices, userID)
+	return err
+}
+
+// DeleteUser removes a user with their refresh tokens. It returns ErrLastAdmin instead
+// if the user is the only enabled admin.
+func (d *Database) DeleteUser(userID int64) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	admins, err := otherEnabledAdmins(tx, userID)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+
+	result, err := tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// Peer operations
+
+// peerColumns is the column list shared by every peer SELECT, in scanPeer order
+const peerColumns = "id, name, public_key, private_key, COALESCE(has_private_key, 1), COALESCE(preshared_key, ''), assigned_ip, COALESCE(assigned_ipv6, ''), enabled, COALESCE(disabled_reason, ''), expires_at, COALESCE(previous_public_key, ''), key_grace_until, " +
+	"COALESCE(usage_rx, 0), COALESCE(usage_tx, 0), COALESCE(monthly_usage, 0), COALESCE(usage_month, ''), COALESCE(counter_rx, 0), COALESCE(counter_tx, 0), COALESCE(counter_key, ''), " +
+	"COALESCE(monthly_quota, 0), COALESCE(total_quota, 0), owner_id, group_id, created_at, updated_at, " +
+	"dns, allowed_ips, mtu, persistent_keepalive, endpoint_host, endpoint_port, interface_lines"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (d *Database) scanPeer(row rowScanner) (*models.Peer, error) {
+	var peer models.Peer
+	var privateKey, presharedKey string
+	var expiresAt, keyGraceUntil sql.NullTime
+	var ownerID, groupID, keepalive sql.NullInt64
+	var interfaceLines string
+	overrides := &peer.Overrides
+	err := row.Scan(&peer.ID, &peer.Name, &peer.PublicKey, &privateKey, &peer.HasPrivateKey, &presharedKey, &peer.AssignedIP, &peer.AssignedIPv6, &peer.Enabled, &peer.DisabledReason, &expiresAt, &peer.PreviousPublicKey, &keyGraceUntil,
+		&peer.UsageRx, &peer.UsageTx, &peer.MonthlyUsage, &peer.UsageMonth, &peer.CounterRx, &peer.CounterTx, &peer.CounterKey,
+		&peer.MonthlyQuota, &peer.TotalQuota, &ownerID, &groupID, &peer.CreatedAt, &peer.UpdatedAt,
+		&overrides.DNS, &overrides.AllowedIPs, &overrides.MTU, &keepalive, &overrides.EndpointHost, &overrides.EndpointPort, &interfaceLines)
+	if err != nil {
+		return nil, err
+	}
+	if keepalive.Valid {
+		seconds := int(keepalive.Int64)
+		overrides.PersistentKeepalive = &seconds
+	}
+	if interfaceLines != "" {
+		overrides.InterfaceLines = strings.Split(interfaceLines, "\n")
+	}
+	if ownerID.Valid {
+		peer.OwnerID = &ownerID.Int64
+	}
+	if groupID.Valid {
+		peer.GroupID = &groupID.Int64
+	}
+	if expiresAt.Valid {
+		peer.ExpiresAt = &expiresAt.Time
+	}
+	if keyGraceUntil.Valid {
+		peer.KeyGraceUntil = &keyGraceUntil.Time
+	}
+
+	// Secrets are encrypted at rest and only decrypted into the model
+	peer.PrivateKey, err = d.cipher.Decrypt(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key of peer %d: %w", peer.ID, err)
+	}
+	peer.PresharedKey, err = d.cipher.Decrypt(presharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt preshared key of peer %d: %w", peer.ID, err)
+	}
+	return &peer, nil
+}
+
+func (d *Database) CreatePeer(peer *models.Peer) (*models.Peer, error) {
+	if err := checkIPConflict(d.conn, 0, peer.AssignedIP, peer.AssignedIPv6); err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := d.conn.QueryRow("SELECT COUNT(*) FROM peers WHERE public_key = ?", peer.PublicKey).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrPublicKeyConflict
+	}
+
+	privateKey, err := d.cipher.Encrypt(peer.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	presharedKey, err := d.cipher.Encrypt(peer.PresharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := d.conn.Exec(
+		"INSERT INTO peers (name, public_key, private_key, has_private_key, preshared_key, assigned_ip, assigned_ipv6, enabled, expires_at, monthly_quota, total_quota, owner_id, group_id, "+
+			"dns, allowed_ips, mtu, persistent_keepalive, endpoint_host, endpoint_port, interface_lines) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		peer.Name, peer.PublicKey, privateKey, peer.HasPrivateKey, presharedKey, peer.AssignedIP, peer.AssignedIPv6, peer.Enabled, peer.ExpiresAt, peer.MonthlyQuota, peer.TotalQuota, peer.OwnerID, peer.GroupID,
+		peer.Overrides.DNS, peer.Overrides.AllowedIPs, peer.Overrides.MTU, peer.Overrides.PersistentKeepalive, peer.Overrides.EndpointHost, peer.Overrides.EndpointPort, strings.Join(peer.Overrides.InterfaceLines, "\n"),
+	)
+	if err != nil {
+		return nil, peerConflict(err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.GetPeerByID(id)
+}
+
+func (d *Database) GetPeerByID(id int64) (*models.Peer, error) {
+	return d.scanPeer(d.conn.QueryRow("SELECT "+peerColumns+" FROM peers WHERE id = ?", id))
+}
+
+// GetPeerByIP finds a peer by either its IPv4 or its IPv6 address
+func (d *Database) GetPeerByIP(ip string) (*models.Peer, error) {
+	return d.scanPeer(d.conn.QueryRow(
+		"SELECT "+peerColumns+" FROM peers WHERE assigned_ip = ? OR (assigned_ipv6 = ? AND assigned_ipv6 != '')",
+		ip, ip,
+	))
+}
+
+func (d *Database) UpdatePeer(ip string, name *string, enabled *bool) (*models.Peer, error) {
+	if name != nil {
+		_, err := d.conn.Exec("UPDATE peers SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE assigned_ip = ?", *name, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if enabled != nil {
+		// A manual change replaces whatever reason the peer was disabled for. Interface
+		// counters restart when the peer is added or removed, so they are reset with it; a
+		// peer that already is in the requested state keeps its counters and reason.
+		reason := ""
+		if !*enabled {
+			reason = models.DisabledReasonManual
+		}
+		_, err := d.conn.Exec(
+			"UPDATE peers SET enabled = ?, disabled_reason = ?, counter_rx = 0, counter_tx = 0, updated_at = CURRENT_TIMESTAMP WHERE assigned_ip = ? AND enabled != ?",
+			*enabled, reason, ip, *enabled,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.GetPeerByIP(ip)
+}
+
+// GetExpiredPeers returns enabled peers whose expiry date has passed
+func (d *Database) GetExpiredPeers() ([]models.Peer, error) {
+	// Compared in Go: stored timestamps may carry different zone offsets
+	rows, err := d.conn.Query("SELECT " + peerColumns + " FROM peers WHERE enabled = 1 AND expires_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []models.Peer
+	for rows.Next() {
+		peer, err := d.scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		if peer.IsExpired() {
+			peers = append(peers, *peer)
+		}
+	}
+
+	return peers, rows.Err()
+}
+
+// DisablePeer disables a peer and records why
+func (d *Database) DisablePeer(id int64, reason string) error {
+	_, err := d.conn.Exec(
+		"UPDATE peers SET enabled = 0, disabled_reason = ?, counter_rx = 0, counter_tx = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		reason, id,
+	)
+	return err
+}
+
+// EnablePeer re-enables a peer that was disabled automatically
+func (d *Database) EnablePeer(id int64) error {
+	_, err := d.conn.Exec(
+		"UPDATE peers SET enabled = 1, disabled_reason = '', counter_rx = 0, counter_tx = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		id,
+	)
+	return err
+}
+
+// RecordPeerUsage adds transferred bytes to a peer's usage and traffic history, and stores the
+// interface counters they were computed from along with the public key they were read for.
+// Monthly usage starts over in a new month.
+func (d *Database) RecordPeerUsage(id int64, rxBytes, txBytes, counterRx, counterTx int64, counterKey string, at time.Time) error {
+	month := at.UTC().Format(models.UsageMonthFormat)
+
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE peers SET usage_rx = usage_rx + ?, usage_tx = usage_tx + ?,
+			monthly_usage = CASE WHEN usage_month = ? THEN monthly_usage + ? ELSE ? END,
+			usage_month = ?, counter_rx = ?, counter_tx = ?, counter_key = ?
+		WHERE id = ?
+	`, rxBytes, txBytes, month, rxBytes+txBytes, rxBytes+txBytes, month, counterRx, counterTx, counterKey, id)
+	if err != nil {
+		return err
+	}
+
+	if rxBytes > 0 || txBytes > 0 {
+		step := int64(TrafficResolutions[0].Step / time.Second)
+		_, err = tx.Exec(`
+			INSERT INTO traffic_samples (peer_id, resolution, bucket, rx, tx) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(peer_id, resolution, bucket) DO UPDATE SET rx = rx + excluded.rx, tx = tx + excluded.tx
+		`, id, step, at.Unix()-at.Unix()%step, rxBytes, txBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SavePeer writes an admin's changes to a peer in one transaction: its name, addresses, expiry
+// date, quotas, owner, group and client setting overrides, and with enabledChanged its enabled
+// state, disabled reason and interface counters. It returns ErrIPConflict if another peer holds
+// either address.
+func (d *Database) SavePeer(peer *models.Peer, enabledChanged bool) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkIPConflict(tx, peer.ID, peer.AssignedIP, peer.AssignedIPv6); err != nil {
+		return err
+	}
+
+	overrides := &peer.Overrides
+	_, err = tx.Exec(`
+		UPDATE peers SET name = ?, assigned_ip = ?, assigned_ipv6 = ?, expires_at = ?, monthly_quota = ?, total_quota = ?,
+			owner_id = ?, group_id = ?, dns = ?, allowed_ips = ?, mtu = ?, persistent_keepalive = ?, endpoint_host = ?,
+			endpoint_port = ?, interface_lines = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, peer.Name, peer.AssignedIP, peer.AssignedIPv6, peer.ExpiresAt, peer.MonthlyQuota, peer.TotalQuota,
+		peer.OwnerID, peer.GroupID, overrides.DNS, overrides.AllowedIPs, overrides.MTU, overrides.PersistentKeepalive, overrides.EndpointHost,
+		overrides.EndpointPort, strings.Join(overrides.InterfaceLines, "\n"), peer.ID)
+	if err != nil {
+		return peerConflict(err)
+	}
+
+	// Usage is recorded concurrently, so the counters are only written along with the state
+	// they belong to
+	if enabledChanged {
+		_, err = tx.Exec(
+			"UPDATE peers SET enabled = ?, disabled_reason = ?, counter_rx = ?, counter_tx = ? WHERE id = ?",
+			peer.Enabled, peer.DisabledReason, peer.CounterRx, peer.CounterTx, peer.ID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queryRower is the connection or a transaction
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkIPConflict reports ErrIPConflict if another peer (id != excludeID) holds ipv4 or ipv6
+func checkIPConflict(q queryRower, excludeID int64, ipv4, ipv6 string) error {
+	var count int
+	err := q.QueryRow(
+		"SELECT COUNT(*) FROM peers WHERE id != ? AND (assigned_ip = ? OR (? != '' AND assigned_ipv6 = ?))",
+		excludeID, ipv4, ipv6, ipv6,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrIPConflict
+	}
+	return nil
+}
+
+// UpdatePeerPresharedKey replaces a peer's preshared key (encrypted at rest)
+func (d *Database) UpdatePeerPresharedKey(id int64, presharedKey string) error {
+	encrypted, err := d.cipher.Encrypt(presharedKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.Exec("UPDATE peers SET preshared_key = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", encrypted, id)
+	return err
+}
+
+// RotatePeerKeys replaces a peer's key pair, returning ErrPublicKeyConflict if another peer has
+// publicKey. previousPublicKey and graceUntil are set when the old key stays valid for a grace
+// period, and cleared otherwise. privateKey is empty for client-held keys.
+func (d *Database) RotatePeerKeys(id int64, publicKey, privateKey, previousPublicKey string, graceUntil *time.Time) error {
+	encrypted, err := d.cipher.Encrypt(privateKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM peers WHERE public_key = ? AND id != ?", publicKey, id).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrPublicKeyConflict
+	}
+
+	_, err = tx.Exec(
+		`UPDATE peers SET public_key = ?, private_key = ?, has_private_key = ?, previous_public_key = ?, key_grace_until = ?,
+			updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		publicKey, encrypted, privateKey != "", previousPublicKey, graceUntil, id,
+	)
+	if err != nil {
+		return peerConflict(err)
+	}
+	return tx.Commit()
+}
+
+// RestorePeerKeys puts back the keys a peer had before RotatePeerKeys, when the interface
+// could not be updated to the new ones
+func (d *Database) RestorePeerKeys(peer *models.Peer) error {
+	return d.RotatePeerKeys(peer.ID, peer.PublicKey, peer.PrivateKey, peer.PreviousPublicKey, peer.KeyGraceUntil)
+}
+
+// GetPeersInKeyRotation returns peers whose previous key is still in its grace period
+func (d *Database) GetPeersInKeyRotation() ([]models.Peer, error) {
+	rows, err := d.conn.Query("SELECT " + peerColumns + " FROM peers WHERE previous_public_key != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []models.Peer
+	for rows.Next() {
+		peer, err := d.scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, *peer)
+	}
+
+	return peers, rows.Err()
+}
+
+// FinishKeyRotation forgets a peer's previous key once the grace period is over.
+// Stored counters of the previous key are reset, they are no baseline for the new key's counters.
+func (d *Database) FinishKeyRotation(id int64) error {
+	_, err := d.conn.Exec(`
+		UPDATE peers SET previous_public_key = '', key_grace_until = NULL,
+			counter_rx = CASE WHEN counter_key = public_key THEN counter_rx ELSE 0 END,
+			counter_tx = CASE WHEN counter_key = public_key THEN counter_tx ELSE 0 END,
+			counter_key = CASE WHEN counter_key = public_key THEN counter_key ELSE '' END,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	return err
+}
+
+// SetPeerIPv6 assigns an IPv6 address to an existing peer
+func (d *Database) SetPeerIPv6(id int64, ipv6 string) error {
+	_, err := d.conn.Exec("UPDATE peers SET assigned_ipv6 = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", ipv6, id)
+	return err
+}
+
+func (d *Database) GetAllPeers() ([]models.Peer, error) {
+	rows, err := d.conn.Query("SELECT " + peerColumns + " FROM peers ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	return d.scanPeers(rows)
+}
+
+// GetPeersByOwner returns the peers a user owns in the self-service portal
+func (d *Database) GetPeersByOwner(userID int64) ([]models.Peer, error) {
+	rows, err := d.conn.Query("SELECT "+peerColumns+" FROM peers WHERE owner_id = ? ORDER BY created_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	return d.scanPeers(rows)
+}
+
+// CountPeersByOwner returns how many peers a user owns, enabled or not
+func (d *Database) CountPeersByOwner(userID int64) (int, error) {
+	var count int
+	err := d.conn.QueryRow("SELECT COUNT(*) FROM peers WHERE owner_id = ?", userID).Scan(&count)
+	return count, err
+}
+
+// GetPeersByGroup returns a group's peers
+func (d *Database) GetPeersByGroup(groupID int64) ([]models.Peer, error) {
+	rows, err := d.conn.Query("SELECT "+peerColumns+" FROM peers WHERE group_id = ? ORDER BY created_at DESC", groupID)
+	if err != nil {
+		return nil, err
+	}
+	return d.scanPeers(rows)
+}
+
+// scanPeers reads and closes rows of peerColumns
+func (d *Database) scanPeers(rows *sql.Rows) ([]models.Peer, error) {
+	defer rows.Close()
+
+	var peers []models.Peer
+	for rows.Next() {
+		peer, err := d.scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, *peer)
+	}
+
+	return peers, rows.Err()
+}
+
+func (d *Database) DeletePeer(ip string) error {
+	result, err := d.conn.Exec("DELETE FROM peers WHERE assigned_ip = ?", ip)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetNextAvailableIP returns the lowest free address in the pool
+// IPv4 pools are checked against assigned_ip and IPv6 pools against assigned_ipv6
+func (d *Database) GetNextAvailableIP(pool *ipam.Pool) (string, error) {
+	column := "assigned_ip"
+	if pool.Is6() {
+		column = "assigned_ipv6"
+	}
+
+	// Get all assigned IPs
+	rows, err := d.conn.Query("SELECT " + column + " FROM peers WHERE " + column + " != ''")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	// Use a set for O(1) lookup
+	usedIPs := make(map[netip.Addr]struct{}, 256)
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return "", err
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			usedIPs[addr] = struct{}{}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	addr, err := pool.Next(usedIPs)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// Session and refresh token operations
+
+const sessionColumns = "id, user_id, auth_method, user_agent, source_ip, created_at, last_used_at, expires_at"
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	var s models.Session
+	if err := row.Scan(&s.ID, &s.UserID, &s.AuthMethod, &s.UserAgent, &s.SourceIP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSession starts a session with its first refresh token
+func (d *Database) CreateSession(session *models.Session, tokenHash string) (*models.Session, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		"INSERT INTO sessions (user_id, auth_method, user_agent, source_ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session.UserID, session.AuthMethod, session.UserAgent, session.SourceIP, now, now, session.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (user_id, session_id, token, expires_at) VALUES (?, ?, ?, ?)",
+		session.UserID, id, tokenHash, session.ExpiresAt.UTC(),
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d.GetSession(id)
+}
+
+func (d *Database) GetSession(id int64) (*models.Session, error) {
+	return scanSession(d.conn.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+}
+
+// GetSessions returns a user's unexpired sessions, most recently used first
+func (d *Database) GetSessions(userID int64) ([]models.Session, error) {
+	rows, err := d.conn.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_used_at DESC",
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// GetRefreshToken returns the refresh token with the given hash, rotated or not
+func (d *Database) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	var rt models.RefreshToken
+	var rotatedAt sql.NullTime
+	err := d.conn.QueryRow(
+		"SELECT id, user_id, session_id, token, expires_at, rotated_at, created_at FROM refresh_tokens WHERE token = ?",
+		tokenHash,
+	).Scan(&rt.ID, &rt.UserID, &rt.SessionID, &rt.TokenHash, &rt.ExpiresAt, &rotatedAt, &rt.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if rotatedAt.Valid {
+		rt.RotatedAt = &rotatedAt.Time
+	}
+	return &rt, nil
+}
+
+// RotateRefreshToken replaces a session's current refresh token with a new one and extends
+// the session. It returns false if the old token was rotated already, by a concurrent request.
+func (d *Database) RotateRefreshToken(old *models.RefreshToken, newHash string, expiresAt time.Time, sourceIP, userAgent string) (bool, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec("UPDATE refresh_tokens SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL", now, old.ID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (user_id, session_id, token, expires_at) VALUES (?, ?, ?, ?)",
+		old.UserID, old.SessionID, newHash, expiresAt.UTC(),
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE sessions SET last_used_at = ?, expires_at = ?, source_ip = ?, user_agent = ? WHERE id = ?",
+		now, expiresAt.UTC(), sourceIP, userAgent, old.SessionID,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteSession ends a session, revoking all of its refresh tokens
+func (d *Database) DeleteSession(id int64) error {
+	_, err := d.conn.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// DeleteUserSessions ends all of a user's sessions except keepID (0 to end all of them)
+func (d *Database) DeleteUserSessions(userID, keepID int64) error {
+	_, err := d.conn.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keepID)
+	return err
+}
+
+// CleanExpiredTokens removes expired sessions and their refresh tokens
+func (d *Database) CleanExpiredTokens() error {
+	now := time.Now().UTC()
+	if _, err := d.conn.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		return err
+	}
+	if _, err := d.conn.Exec("DELETE FROM share_links WHERE expires_at < ?", now); err != nil {
+		return err
+	}
+	_, err := d.conn.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now)
+	return err
+}
+
+// Share link operations
+
+const shareLinkColumns = "s.id, s.peer_id, p.name, s.kind, s.created_by, s.created_at, s.expires_at, s.consumed_at, s.consumed_ip"
+
+const shareLinkFrom = " FROM share_links s JOIN peers p ON p.id = s.peer_id"
+
+func scanShareLink(row rowScanner) (*models.ShareLink, error) {
+	var l models.ShareLink
+	var consumedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.PeerID, &l.PeerName, &l.Kind, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &consumedAt, &l.ConsumedIP); err != nil {
+		return nil, err
+	}
+	if consumedAt.Valid {
+		l.ConsumedAt = &consumedAt.Time
+	}
+	return &l, nil
+}
+
+// CreateShareLink stores a share link by the hash of its token
+func (d *Database) CreateShareLink(link *models.ShareLink, tokenHash string) (*models.ShareLink, error) {
+	result, err := d.conn.Exec(
+		"INSERT INTO share_links (peer_id, kind, token_hash, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		link.PeerID, link.Kind, tokenHash, link.CreatedBy, time.Now().UTC(), link.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return d.GetShareLink(id)
+}
+
+func (d *Database) GetShareLink(id int64) (*models.ShareLink, error) {
+	return scanShareLink(d.conn.QueryRow("SELECT "+shareLinkColumns+shareLinkFrom+" WHERE s.id = ?", id))
+}
+
+func (d *Database) GetShareLinkByToken(tokenHash string) (*models.ShareLink, error) {
+	return scanShareLink(d.conn.QueryRow("SELECT "+shareLinkColumns+shareLinkFrom+" WHERE s.token_hash = ?", tokenHash))
+}
+
+// GetOutstandingShareLinks returns the links that can still be used, newest first
+func (d *Database) GetOutstandingShareLinks() ([]models.ShareLink, error) {
+	rows, err := d.conn.Query(
+		"SELECT "+shareLinkColumns+shareLinkFrom+" WHERE s.consumed_at IS NULL AND s.expires_at > ? ORDER BY s.created_at DESC",
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, *link)
+	}
+	return links, rows.Err()
+}
+
+// ConsumeShareLink marks a link used. It returns false if the link was already used or has
+// expired, so of two concurrent downloads only one succeeds.
+func (d *Database) ConsumeShareLink(id int64, sourceIP string) (bool, error) {
+	now := time.Now().UTC()
+	result, err := d.conn.Exec(
+		"UPDATE share_links SET consumed_at = ?, consumed_ip = ? WHERE id = ? AND consumed_at IS NULL AND expires_at > ?",
+		now, sourceIP, id, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteShareLink revokes a link; it returns sql.ErrNoRows if there is none with the ID
+func (d *Database) DeleteShareLink(id int64) error {
+	result, err := d.conn.Exec("DELETE FROM share_links WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Optimize performs database maintenance to reclaim space and optimize performance
+func (d *Database) Optimize() error {
+	// Run incremental vacuum to reclaim free pages (non-blocking)
+	if _, err := d.conn.Exec("PRAGMA incremental_vacuum(100)"); err != nil {
+		return err
+	}
+
+	// Optimize query planner statistics
+	if _, err := d.conn.Exec("PRAGMA optimize"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FullVacuum performs a full database vacuum (use sparingly, blocks writes)
+func (d *Database) FullVacuum() error {
+	_, err := d.conn.Exec("VACUUM")
+	return err
+}
+
+// Settings operations
+func (d *Database) GetSetting(key string) (string, error) {
+	var value string
+	err := d.conn.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (d *Database) SetSetting(key, value string) error {
+	_, err := d.conn.Exec(`
+		INSERT INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value = ?, updated_at = CURRENT_TIMESTAMP
+	`, key, value, value)
+	return err
+}
+
+func (d *Database) GetAllSettings() (map[string]string, error) {
+	rows, err := d.conn.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+	return settings, rows.Err()
+}
+
+// Traffic history operations
+
+// TrafficResolution is one level of the traffic history: samples are summed into buckets of
+// Step and kept for Retention, after which they are merged into the next level
+type TrafficResolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// TrafficResolutions lists the history levels from finest to coarsest
+var TrafficResolutions = []TrafficResolution{
+	{Step: time.Minute, Retention: 24 * time.Hour},
+	{Step: 5 * time.Minute, Retention: 7 * 24 * time.Hour},
+	{Step: time.Hour, Retention: 90 * 24 * time.Hour},
+	{Step: 24 * time.Hour, Retention: 2 * 365 * 24 * time.Hour},
+}
+
+// DownsampleTraffic merges samples older than their level's retention into the next level
+// and drops samples of the coarsest level once they are past its retention
+func (d *Database) DownsampleTraffic(now time.Time) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, level := range TrafficResolutions {
+		step := int64(level.Step / time.Second)
+		cutoff := now.Add(-level.Retention).Unix()
+
+		if i+1 < len(TrafficResolutions) {
+			next := int64(TrafficResolutions[i+1].Step / time.Second)
+			// WHERE true resolves the parsing ambiguity between a join and the upsert clause
+			_, err := tx.Exec(`
+				INSERT INTO traffic_samples (peer_id, resolution, bucket, rx, tx)
+				SELECT peer_id, ?, bucket - bucket % ?, SUM(rx), SUM(tx) FROM traffic_samples
+				WHERE resolution = ? AND bucket < ? AND true
+				GROUP BY peer_id, bucket - bucket % ?
+				ON CONFLICT(peer_id, resolution, bucket) DO UPDATE SET rx = rx + excluded.rx, tx = tx + excluded.tx
+			`, next, next, step, cutoff, next)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM traffic_samples WHERE resolution = ? AND bucket < ?", step, cutoff); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetTrafficSeries returns a peer's traffic in [from, to) summed into buckets of step,
+// keyed by bucket start. Empty buckets are left out.
+func (d *Database) GetTrafficSeries(peerID int64, from, to time.Time, step time.Duration) (map[int64]models.TrafficPoint, error) {
+	seconds := int64(step / time.Second)
+	rows, err := d.conn.Query(`
+		SELECT bucket - bucket % ?, SUM(rx), SUM(tx) FROM traffic_samples
+		WHERE peer_id = ? AND bucket >= ? AND bucket < ?
+		GROUP BY bucket - bucket % ?
+	`, seconds, peerID, from.Unix(), to.Unix(), seconds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make(map[int64]models.TrafficPoint)
+	for rows.Next() {
+		var bucket int64
+		var point models.TrafficPoint
+		if err := rows.Scan(&bucket, &point.Rx, &point.Tx); err != nil {
+			return nil, err
+		}
+		point.Time = time.Unix(bucket, 0).UTC()
+		points[bucket] = point
+	}
+	return points, rows.Err()
+}
+
+// Connection log operations
+
+// connectionLogColumns is the column list shared by every connection log SELECT, in scanConnectionLog order
+const connectionLogColumns = "id, peer_id, endpoint, connected_at, disconnected_at, last_seen_at, COALESCE(rx_bytes, 0), COALESCE(tx_bytes, 0), COALESCE(counter_rx, 0), COALESCE(counter_tx, 0)"
+
+func scanConnectionLog(row rowScanner) (*models.ConnectionLog, error) {
+	var log models.ConnectionLog
+	var disconnectedAt, lastSeenAt sql.NullTime
+	err := row.Scan(&log.ID, &log.PeerID, &log.Endpoint, &log.ConnectedAt, &disconnectedAt, &lastSeenAt, &log.RxBytes, &log.TxBytes, &log.CounterRx, &log.CounterTx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.LastSeenAt = log.ConnectedAt
+	if lastSeenAt.Valid {
+		log.LastSeenAt = lastSeenAt.Time
+	}
+
+	end := time.Now()
+	if disconnectedAt.Valid {
+		log.DisconnectedAt = &disconnectedAt.Time
+		end = disconnectedAt.Time
+	}
+	log.Duration = int64(end.Sub(log.ConnectedAt) / time.Second)
+	if log.Duration < 0 {
+		log.Duration = 0
+	}
+	return &log, nil
+}
+
+// StartSession opens a connection session for a peer. counterRx and counterTx are the
+// interface counters at the start, so only later traffic is counted towards the session.
+func (d *Database) StartSession(peerID int64, endpoint string, connectedAt time.Time, counterRx, counterTx int64) error {
+	_, err := d.conn.Exec(
+		"INSERT INTO connection_logs (peer_id, endpoint, connected_at, last_seen_at, counter_rx, counter_tx) VALUES (?, ?, ?, ?, ?, ?)",
+		peerID, endpoint, connectedAt, time.Now(), counterRx, counterTx,
+	)
+	return err
+}
+
+// UpdateSession adds transferred bytes to an open session and marks it seen now
+func (d *Database) UpdateSession(id int64, rxBytes, txBytes, counterRx, counterTx int64) error {
+	_, err := d.conn.Exec(`
+		UPDATE connection_logs SET rx_bytes = rx_bytes + ?, tx_bytes = tx_bytes + ?,
+			counter_rx = ?, counter_tx = ?, last_seen_at = ?
+		WHERE id = ?
+	`, rxBytes, txBytes, counterRx, counterTx, time.Now(), id)
+	return err
+}
+
+// EndSession closes a session at disconnectedAt
+func (d *Database) EndSession(id int64, disconnectedAt time.Time) error {
+	_, err := d.conn.Exec("UPDATE connection_logs SET disconnected_at = ? WHERE id = ?", disconnectedAt, id)
+	return err
+}
+
+// GetOpenSessions returns the active session of each peer, keyed by peer ID
+func (d *Database) GetOpenSessions() (map[int64]models.ConnectionLog, error) {
+	rows, err := d.conn.Query("SELECT " + connectionLogColumns + " FROM connection_logs WHERE disconnected_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
+	sessions := make(map[int64]models.ConnectionLog)
+	for rows.Next() {
+		session, err := scanConnectionLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions[session.PeerID] = *session
+	}
+	return sessions, rows.Err()
+}
+
+func (d *Database) GetConnectionLogs(peerID int64, limit int) ([]models.ConnectionLog, error) {
+	rows, err := d.conn.Query(`
+		SELECT `+connectionLogColumns+`
+		FROM connection_logs
+		WHERE peer_id = ?
+		ORDER BY connected_at DESC
+		LIMIT ?
+	`, peerID, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	var logs []models.ConnectionLog
+	for rows.Next() {
+		log, err := scanConnectionLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, *log)
 	}
+	return logs, rows.Err()
+}
 
-	return nil
+func (d *Database) DeletePeerLogs(peerID int64) error {
+	_, err := d.conn.Exec("DELETE FROM connection_logs WHERE peer_id = ?", peerID)
+	return err
 }
 
-func (d *Database) GetNextAvailableIP(subnet string) (string, error) {
-	// Parse subnet to get base IP (e.g., "10.8.0.0/24" -> "10.8.0")
-	baseIP := subnet
-	if idx := len(baseIP) - 1; idx > 0 {
-		for i := len(baseIP) - 1; i >= 0; i-- {
-			if baseIP[i] == '/' {
-				baseIP = baseIP[:i]
-				break
-			}
-		}
+// Peer group operations
+
+// ErrGroupNameConflict is returned when another peer group has the same name
+var ErrGroupNameConflict = errors.New("a peer group with this name already exists")
+
+const peerGroupColumns = "g.id, g.name, g.description, g.dns, g.allowed_ips, g.mtu, g.persistent_keepalive, " +
+	"(SELECT COUNT(*) FROM peers WHERE group_id = g.id), g.created_at, g.updated_at"
+
+func scanPeerGroup(row rowScanner) (*models.PeerGroup, error) {
+	var group models.PeerGroup
+	var keepalive sql.NullInt64
+	err := row.Scan(&group.ID, &group.Name, &group.Description, &group.DNS, &group.AllowedIPs, &group.MTU, &keepalive,
+		&group.PeerCount, &group.CreatedAt, &group.UpdatedAt)
+	if err != nil {
+		return nil, err
 	}
+	if keepalive.Valid {
+		seconds := int(keepalive.Int64)
+		group.PersistentKeepalive = &seconds
+	}
+	return &group, nil
+}
 
-	// Get the base (first 3 octets)
-	var o1, o2, o3, o4 int
-	fmt.Sscanf(baseIP, "%d.%d.%d.%d", &o1, &o2, &o3, &o4)
+// groupNameConflict maps the unique constraint on group names to ErrGroupNameConflict
+func groupNameConflict(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrGroupNameConflict
+	}
+	return err
+}
 
-	// Get all assigned IPs using optimized query
-	rows, err := d.conn.Query("SELECT assigned_ip FROM peers ORDER BY assigned_ip")
+func (d *Database) CreatePeerGroup(group *models.PeerGroup) (*models.PeerGroup, error) {
+	result, err := d.conn.Exec(
+		"INSERT INTO peer_groups (name, description, dns, allowed_ips, mtu, persistent_keepalive) VALUES (?, ?, ?, ?, ?, ?)",
+		group.Name, group.Description, group.DNS, group.AllowedIPs, group.MTU, group.PersistentKeepalive,
+	)
 	if err != nil {
-		return "", err
+		return nil, groupNameConflict(err)
 	}
-	defer rows.Close()
 
-	// Use a set for O(1) lookup
-	usedIPs := make(map[string]struct{}, 256)
-	for rows.Next() {
-		var ip string
-		if err := rows.Scan(&ip); err != nil {
-			return "", err
-		}
-		usedIPs[ip] = struct{}{}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
 	}
+	return d.GetPeerGroup(id)
+}
 
-	if err := rows.Err(); err != nil {
-		return "", err
+func (d *Database) GetPeerGroup(id int64) (*models.PeerGroup, error) {
+	return scanPeerGroup(d.conn.QueryRow("SELECT "+peerGroupColumns+" FROM peer_groups g WHERE g.id = ?", id))
+}
+
+func (d *Database) GetPeerGroups() ([]models.PeerGroup, error) {
+	rows, err := d.conn.Query("SELECT " + peerGroupColumns + " FROM peer_groups g ORDER BY g.name")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Find next available IP (start from .2, .1 is usually server)
-	for i := 2; i < 255; i++ {
-		ip := fmt.Sprintf("%d.%d.%d.%d", o1, o2, o3, i)
-		if _, exists := usedIPs[ip]; !exists {
-			return ip, nil
+	groups := []models.PeerGroup{}
+	for rows.Next() {
+		group, err := scanPeerGroup(rows)
+		if err != nil {
+			return nil, err
 		}
+		groups = append(groups, *group)
 	}
-
-	return "", fmt.Errorf("no available IP addresses in subnet")
+	return groups, rows.Err()
 }
 
-// Refresh token operations
-func (d *Database) SaveRefreshToken(userID int64, token string, expiresAt time.Time) error {
+// UpdatePeerGroup saves a group's name, description and client settings
+func (d *Database) UpdatePeerGroup(group *models.PeerGroup) error {
 	_, err := d.conn.Exec(
-		"INSERT INTO refresh_tokens (user_id, token, expires_at) VALUES (?, ?, ?)",
-		userID, token, expiresAt,
+		"UPDATE peer_groups SET name = ?, description = ?, dns = ?, allowed_ips = ?, mtu = ?, persistent_keepalive = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		group.Name, group.Description, group.DNS, group.AllowedIPs, group.MTU, group.PersistentKeepalive, group.ID,
 	)
-	return err
+	return groupNameConflict(err)
 }
 
-func (d *Database) GetRefreshToken(token string) (*models.RefreshToken, error) {
-	var rt models.RefreshToken
-	err := d.conn.QueryRow(
-		"SELECT id, user_id, token, expires_at, created_at FROM refresh_tokens WHERE token = ?",
-		token,
-	).Scan(&rt.ID, &rt.UserID, &rt.Token, &rt.ExpiresAt, &rt.CreatedAt)
+// DeletePeerGroup removes a group; its peers stay, without a group
+func (d *Database) DeletePeerGroup(id int64) error {
+	result, err := d.conn.Exec("DELETE FROM peer_groups WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Webhook operations
+
+const webhookColumns = "id, name, url, secret, events, enabled, created_at, updated_at"
+
+func (d *Database) scanWebhook(row rowScanner) (*models.Webhook, error) {
+	var webhook models.Webhook
+	var secret, events string
+	err := row.Scan(&webhook.ID, &webhook.Name, &webhook.URL, &secret, &events, &webhook.Enabled, &webhook.CreatedAt, &webhook.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
-	return &rt, nil
+	webhook.Secret, err = d.cipher.Decrypt(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret of webhook %d: %w", webhook.ID, err)
+	}
+	if events != "" {
+		webhook.Events = strings.Split(events, ",")
+	}
+	return &webhook, nil
 }
 
-func (d *Database) DeleteRefreshToken(token string) error {
-	_, err := d.conn.Exec("DELETE FROM refresh_tokens WHERE token = ?", token)
-	return err
+// CreateWebhook stores a new webhook; its secret is encrypted at rest like peer keys
+func (d *Database) CreateWebhook(webhook *models.Webhook) (*models.Webhook, error) {
+	secret, err := d.cipher.Encrypt(webhook.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := d.conn.Exec(
+		"INSERT INTO webhooks (name, url, secret, events, enabled) VALUES (?, ?, ?, ?, ?)",
+		webhook.Name, webhook.URL, secret, strings.Join(webhook.Events, ","), webhook.Enabled,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return d.GetWebhook(id)
 }
 
-func (d *Database) DeleteUserRefreshTokens(userID int64) error {
-	_, err := d.conn.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userID)
-	return err
+func (d *Database) GetWebhook(id int64) (*models.Webhook, error) {
+	return d.scanWebhook(d.conn.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
 }
 
-func (d *Database) CleanExpiredTokens() error {
-	_, err := d.conn.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", time.Now())
-	return err
+func (d *Database) GetWebhooks() ([]models.Webhook, error) {
+	rows, err := d.conn.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []models.Webhook
+	for rows.Next() {
+		webhook, err := d.scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	return webhooks, rows.Err()
 }
 
-// Optimize performs database maintenance to reclaim space and optimize performance
-func (d *Database) Optimize() error {
-	// Run incremental vacuum to reclaim free pages (non-blocking)
-	if _, err := d.conn.Exec("PRAGMA incremental_vacuum(100)"); err != nil {
+// HasEnabledWebhooks reports whether any webhook wants events
+func (d *Database) HasEnabledWebhooks() (bool, error) {
+	var count int
+	err := d.conn.QueryRow("SELECT COUNT(*) FROM webhooks WHERE enabled = 1").Scan(&count)
+	return count > 0, err
+}
+
+// UpdateWebhook saves a webhook's name, URL, secret, events and enabled state
+func (d *Database) UpdateWebhook(webhook *models.Webhook) error {
+	secret, err := d.cipher.Encrypt(webhook.Secret)
+	if err != nil {
 		return err
 	}
 
-	// Optimize query planner statistics
-	if _, err := d.conn.Exec("PRAGMA optimize"); err != nil {
+	_, err = d.conn.Exec(
+		"UPDATE webhooks SET name = ?, url = ?, secret = ?, events = ?, enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		webhook.Name, webhook.URL, secret, strings.Join(webhook.Events, ","), webhook.Enabled, webhook.ID,
+	)
+	return err
+}
+
+// DeleteWebhook removes a webhook together with its delivery log
+func (d *Database) DeleteWebhook(id int64) error {
+	result, err := d.conn.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
 		return err
 	}
-
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-// FullVacuum performs a full database vacuum (use sparingly, blocks writes)
-func (d *Database) FullVacuum() error {
-	_, err := d.conn.Exec("VACUUM")
-	return err
+const webhookDeliveryColumns = "id, webhook_id, event_type, payload, status, attempts, response_code, error, next_attempt_at, created_at, delivered_at"
+
+func scanWebhookDelivery(row rowScanner) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventType, &delivery.Payload, &delivery.Status, &delivery.Attempts,
+		&delivery.ResponseCode, &delivery.Error, &nextAttemptAt, &delivery.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	if nextAttemptAt.Valid {
+		delivery.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return &delivery, nil
 }
 
-// Settings operations
-func (d *Database) GetSetting(key string) (string, error) {
-	var value string
-	err := d.conn.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
-	if err == sql.ErrNoRows {
-		return "", nil
+// EnqueueWebhookDelivery records an event for a webhook as pending, with its first attempt due at due
+func (d *Database) EnqueueWebhookDelivery(webhookID int64, eventType, payload string, createdAt, due time.Time) (*models.WebhookDelivery, error) {
+	result, err := d.conn.Exec(
+		"INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		webhookID, eventType, payload, models.DeliveryPending, due.UTC(), createdAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
 	}
-	return value, err
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDelivery(d.conn.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
 }
 
-func (d *Database) SetSetting(key, value string) error {
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due, oldest first
+func (d *Database) GetDueWebhookDeliveries(now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	rows, err := d.conn.Query(
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY id LIMIT ?",
+		models.DeliveryPending, now.UTC(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// SaveWebhookAttempt stores the outcome of a delivery attempt: its status, attempt count,
+// response, and when it is retried (pending) or was delivered
+func (d *Database) SaveWebhookAttempt(delivery *models.WebhookDelivery) error {
+	var nextAttemptAt, deliveredAt interface{}
+	if delivery.NextAttemptAt != nil {
+		nextAttemptAt = delivery.NextAttemptAt.UTC()
+	}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = delivery.DeliveredAt.UTC()
+	}
+
 	_, err := d.conn.Exec(`
-		INSERT INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(key) DO UPDATE SET value = ?, updated_at = CURRENT_TIMESTAMP
-	`, key, value, value)
+		UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?
+	`, delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error, nextAttemptAt, deliveredAt, delivery.ID)
 	return err
 }
 
-func (d *Database) GetAllSettings() (map[string]string, error) {
-	rows, err := d.conn.Query("SELECT key, value FROM settings")
+// GetWebhookDeliveries returns the latest deliveries of a webhook, newest first
+func (d *Database) GetWebhookDeliveries(webhookID int64, limit int) ([]models.WebhookDelivery, error) {
+	rows, err := d.conn.Query(
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?",
+		webhookID, limit,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	settings := make(map[string]string)
+	var deliveries []models.WebhookDelivery
 	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
 			return nil, err
 		}
-		settings[key] = value
+		deliveries = append(deliveries, *delivery)
 	}
-	return settings, rows.Err()
+	return deliveries, rows.Err()
 }
 
-// Connection log operations
-func (d *Database) AddConnectionLog(peerID int64, endpoint string) error {
-	// Only log if this endpoint is different from the last logged endpoint for this peer
-	var lastEndpoint string
-	err := d.conn.QueryRow(`
-		SELECT endpoint FROM connection_logs
-		WHERE peer_id = ?
-		ORDER BY connected_at DESC
-		LIMIT 1
-	`, peerID).Scan(&lastEndpoint)
+// CleanWebhookDeliveries drops delivered and failed deliveries created before cutoff
+func (d *Database) CleanWebhookDeliveries(before time.Time) error {
+	_, err := d.conn.Exec(
+		"DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?",
+		models.DeliveryPending, before.UTC(),
+	)
+	return err
+}
 
-	// If there's a previous log and it's the same endpoint, skip
-	if err == nil && lastEndpoint == endpoint {
-		return nil // Same endpoint as last log, skip
+// Audit log operations
+
+const auditColumns = "id, created_at, user_id, username, source_ip, auth_method, action, target, before_state, after_state"
+
+func scanAuditEntry(row rowScanner) (*models.AuditEntry, error) {
+	var entry models.AuditEntry
+	var before, after string
+	err := row.Scan(&entry.ID, &entry.CreatedAt, &entry.UserID, &entry.Username, &entry.SourceIP, &entry.AuthMethod,
+		&entry.Action, &entry.Target, &before, &after)
+	if err != nil {
+		return nil, err
 	}
+	if before != "" {
+		entry.Before = json.RawMessage(before)
+	}
+	if after != "" {
+		entry.After = json.RawMessage(after)
+	}
+	entry.FillChanges()
+	return &entry, nil
+}
 
-	// Log new endpoint (either first log or different endpoint)
-	_, err = d.conn.Exec(
-		"INSERT INTO connection_logs (peer_id, endpoint) VALUES (?, ?)",
-		peerID, endpoint,
+// AddAuditEntry appends an entry to the audit log
+func (d *Database) AddAuditEntry(entry *models.AuditEntry) error {
+	_, err := d.conn.Exec(
+		"INSERT INTO audit_log (created_at, user_id, username, source_ip, auth_method, action, target, before_state, after_state) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.CreatedAt.UTC(), entry.UserID, entry.Username, entry.SourceIP, entry.AuthMethod, entry.Action, entry.Target,
+		string(entry.Before), string(entry.After),
 	)
 	return err
 }
 
-func (d *Database) GetConnectionLogs(peerID int64, limit int) ([]models.ConnectionLog, error) {
-	rows, err := d.conn.Query(`
-		SELECT id, peer_id, endpoint, connected_at
-		FROM connection_logs
-		WHERE peer_id = ?
-		ORDER BY connected_at DESC
-		LIMIT ?
-	`, peerID, limit)
+// auditWhere builds the WHERE clause selecting the entries matched by filter
+func auditWhere(filter models.AuditFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Action != "" {
+		if strings.HasSuffix(filter.Action, ".") {
+			conditions = append(conditions, "substr(action, 1, ?) = ?")
+			args = append(args, len(filter.Action), filter.Action)
+		} else {
+			conditions = append(conditions, "action = ?")
+			args = append(args, filter.Action)
+		}
+	}
+	if filter.Username != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "target = ?")
+		args = append(args, filter.Target)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// GetAuditEntries returns one page of matching entries, newest first, and the number of matches
+func (d *Database) GetAuditEntries(filter models.AuditFilter, limit, offset int) ([]models.AuditEntry, int, error) {
+	where, args := auditWhere(filter)
+
+	var total int
+	if err := d.conn.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.conn.Query("SELECT "+auditColumns+" FROM audit_log"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var logs []models.ConnectionLog
+	entries := []models.AuditEntry{}
 	for rows.Next() {
-		var log models.ConnectionLog
-		if err := rows.Scan(&log.ID, &log.PeerID, &log.Endpoint, &log.ConnectedAt); err != nil {
-			return nil, err
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, 0, err
 		}
-		logs = append(logs, log)
+		entries = append(entries, *entry)
 	}
-	return logs, rows.Err()
+	return entries, total, rows.Err()
 }
 
-func (d *Database) DeletePeerLogs(peerID int64) error {
-	_, err := d.conn.Exec("DELETE FROM connection_logs WHERE peer_id = ?", peerID)
-	return err
+// ForEachAuditPage calls fn with every matching entry, oldest first, in pages of up to
+// pageSize entries, stopping at the first error. The database is not in use while fn runs,
+// so fn may take as long as it needs, e.g. to write the page to a slow client.
+func (d *Database) ForEachAuditPage(filter models.AuditFilter, pageSize int, fn func([]models.AuditEntry) error) error {
+	where, args := auditWhere(filter)
+	if where == "" {
+		where = " WHERE id > ?"
+	} else {
+		where += " AND id > ?"
+	}
+
+	var lastID int64
+	for {
+		page, err := d.auditPageAfter(where, append(args, lastID, pageSize))
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+		lastID = page[len(page)-1].ID
+	}
+}
+
+// auditPageAfter reads the entries of one ForEachAuditPage page; args end with the ID to
+// continue after and the page size
+func (d *Database) auditPageAfter(where string, args []interface{}) ([]models.AuditEntry, error) {
+	rows, err := d.conn.Query("SELECT "+auditColumns+" FROM audit_log"+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, rows.Err()
 }
@@ -0,0 +1,703 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wgeasygo/internal/models"
+	"wgeasygo/internal/secrets"
+)
+
+func openTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := secrets.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Initialize(filepath.Join(t.TempDir(), "test.db"), cipher)
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	t.Cleanup(func() { d.conn.Close() })
+	return d
+}
+
+func TestPeerConflict(t *testing.T) {
+	d := openTestDatabase(t)
+	insert := "INSERT INTO peers (name, public_key, private_key, assigned_ip, assigned_ipv6) VALUES (?, ?, '', ?, ?)"
+	if _, err := d.conn.Exec(insert, "first", "key-1", "10.8.0.2", "fd42:42:42::2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		publicKey string
+		ipv4      string
+		ipv6      string
+		want      error
+	}{
+		{name: "assigned_ip", publicKey: "key-2", ipv4: "10.8.0.2", ipv6: "fd42:42:42::3", want: ErrIPConflict},
+		{name: "assigned_ipv6", publicKey: "key-2", ipv4: "10.8.0.3", ipv6: "fd42:42:42::2", want: ErrIPConflict},
+		{name: "public_key", publicKey: "key-1", ipv4: "10.8.0.3", ipv6: "fd42:42:42::3", want: ErrPublicKeyConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := d.conn.Exec(insert, tt.name, tt.publicKey, tt.ipv4, tt.ipv6)
+			if err == nil {
+				t.Fatal("duplicate insert succeeded")
+			}
+			if got := peerConflict(err); !errors.Is(got, tt.want) {
+				t.Errorf("peerConflict(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+
+	if err := peerConflict(nil); err != nil {
+		t.Errorf("peerConflict(nil) = %v, want nil", err)
+	}
+	other := errors.New("disk I/O error")
+	if err := peerConflict(other); err != other {
+		t.Errorf("peerConflict(%v) = %v, want it unchanged", other, err)
+	}
+}
+
+func TestCreatePeerConcurrentConflict(t *testing.T) {
+	d := openTestDatabase(t)
+
+	const requests = 8
+	errs := make([]error, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.CreatePeer(&models.Peer{
+				Name:       fmt.Sprintf("peer-%d", i),
+				PublicKey:  fmt.Sprintf("key-%d", i),
+				AssignedIP: "10.8.0.2",
+				Enabled:    true,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrIPConflict):
+			t.Errorf("CreatePeer error = %v, want ErrIPConflict", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent creates succeeded, want 1", created)
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	d := openTestDatabase(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, e := range []models.AuditEntry{
+		{Username: "admin", Action: "peer.create", Target: "peer:1", After: json.RawMessage(`{"name":"a"}`)},
+		{Username: "admin", Action: "peer.update", Target: "peer:1", Before: json.RawMessage(`{"name":"a","enabled":true}`), After: json.RawMessage(`{"name":"b","enabled":true}`)},
+		{Username: "ops", Action: "settings.update", Target: "settings"},
+		{Username: "admin", Action: "peerless.action"},
+	} {
+		e.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		if err := d.AddAuditEntry(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to := start.Add(time.Hour), start.Add(3*time.Hour)
+	tests := []struct {
+		name    string
+		filter  models.AuditFilter
+		actions []string // Newest first
+	}{
+		{name: "all", actions: []string{"peerless.action", "settings.update", "peer.update", "peer.create"}},
+		{name: "action prefix", filter: models.AuditFilter{Action: "peer."}, actions: []string{"peer.update", "peer.create"}},
+		{name: "exact action", filter: models.AuditFilter{Action: "peer.create"}, actions: []string{"peer.create"}},
+		{name: "user and target", filter: models.AuditFilter{Username: "admin", Target: "peer:1"}, actions: []string{"peer.update", "peer.create"}},
+		{name: "time range", filter: models.AuditFilter{From: &from, To: &to}, actions: []string{"settings.update", "peer.update"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, total, err := d.GetAuditEntries(tt.filter, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != len(tt.actions) || len(entries) != len(tt.actions) {
+				t.Fatalf("got %d entries (total %d), want %d", len(entries), total, len(tt.actions))
+			}
+			for i, entry := range entries {
+				if entry.Action != tt.actions[i] {
+					t.Errorf("entry %d is %s, want %s", i, entry.Action, tt.actions[i])
+				}
+			}
+		})
+	}
+
+	entries, total, err := d.GetAuditEntries(models.AuditFilter{}, 1, 2)
+	if err != nil || total != 4 || len(entries) != 1 || entries[0].Action != "peer.update" {
+		t.Fatalf("second-to-last page = %+v, total %d, %v", entries, total, err)
+	}
+	if changes := entries[0].Changes; len(changes) != 1 || string(changes["name"].Before) != `"a"` || string(changes["name"].After) != `"b"` {
+		t.Errorf("changes = %v, want only the name", changes)
+	}
+
+	var exported []string
+	pages := 0
+	err = d.ForEachAuditPage(models.AuditFilter{Action: "peer."}, 1, func(page []models.AuditEntry) error {
+		pages++
+		for _, entry := range page {
+			exported = append(exported, entry.Action)
+		}
+		return nil
+	})
+	if err != nil || len(exported) != 2 || exported[0] != "peer.create" || pages != 2 {
+		t.Errorf("export = %v in %d pages, %v, want peer entries oldest first, one per page", exported, pages, err)
+	}
+	exported = nil
+	err = d.ForEachAuditPage(models.AuditFilter{}, 3, func(page []models.AuditEntry) error {
+		for _, entry := range page {
+			exported = append(exported, entry.Action)
+		}
+		return nil
+	})
+	if err != nil || len(exported) != 4 {
+		t.Errorf("unfiltered export = %v, %v, want all 4 entries", exported, err)
+	}
+}
+
+func TestLastAdminIsKept(t *testing.T) {
+	d := openTestDatabase(t)
+	admin, err := d.CreateUser("admin", "hash", models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := d.CreateUser("viewer", "hash", models.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateUser("admin", "hash", models.RoleViewer); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("duplicate CreateUser error = %v, want ErrUsernameTaken", err)
+	}
+
+	if err := d.UpdateUserAccess(admin.ID, models.RoleOperator, false); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("demoting the last admin: %v, want ErrLastAdmin", err)
+	}
+	if err := d.UpdateUserAccess(admin.ID, models.RoleAdmin, true); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("disabling the last admin: %v, want ErrLastAdmin", err)
+	}
+	if err := d.DeleteUser(admin.ID); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("deleting the last admin: %v, want ErrLastAdmin", err)
+	}
+
+	// With a second admin the first one can go
+	if err := d.UpdateUserAccess(viewer.ID, models.RoleAdmin, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateUserAccess(admin.ID, models.RoleAdmin, true); err != nil {
+		t.Errorf("disabling an admin while another one is enabled: %v", err)
+	}
+	if err := d.DeleteUser(viewer.ID); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("deleting the only enabled admin: %v, want ErrLastAdmin", err)
+	}
+	if err := d.DeleteUser(admin.ID); err != nil {
+		t.Errorf("deleting a disabled admin: %v", err)
+	}
+}
+
+func TestTOTPCodesAreSingleUse(t *testing.T) {
+	d := openTestDatabase(t)
+	user, err := d.CreateUser("admin", "hash", models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.StartTOTPEnrollment(user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := d.GetUserTOTP(user.ID); err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("GetUserTOTP = %q, %v", secret, err)
+	}
+	if err := d.EnableTOTP(user.ID, 100, []string{"hash-a", "hash-b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		step int64
+		want bool
+	}{{100, false}, {99, false}, {101, true}, {101, false}} {
+		if got, err := d.UseTOTPStep(user.ID, tt.step); err != nil || got != tt.want {
+			t.Errorf("UseTOTPStep(%d) = %v, %v, want %v", tt.step, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		hash string
+		want bool
+	}{{"hash-a", true}, {"hash-a", false}, {"unknown", false}} {
+		if got, err := d.UseRecoveryCode(user.ID, tt.hash); err != nil || got != tt.want {
+			t.Errorf("UseRecoveryCode(%s) = %v, %v, want %v", tt.hash, got, err, tt.want)
+		}
+	}
+	if n, err := d.CountRecoveryCodes(user.ID); err != nil || n != 1 {
+		t.Errorf("CountRecoveryCodes = %d, %v, want 1", n, err)
+	}
+
+	// Enrollment cannot restart while enabled, so the secret cannot be swapped silently
+	if err := d.StartTOTPEnrollment(user.ID, "OTHERSECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ := d.GetUserTOTP(user.ID); secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("secret changed to %q while enabled", secret)
+	}
+
+	if err := d.DisableTOTP(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := d.CountRecoveryCodes(user.ID); n != 0 {
+		t.Errorf("%d recovery codes left after DisableTOTP", n)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	d := openTestDatabase(t)
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		failures, err := d.RecordLoginFailure("admin", ip, start.Add(time.Duration(i)*time.Minute), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != i+1 {
+			t.Errorf("failure %d counted as %d", i+1, failures)
+		}
+	}
+
+	until := start.Add(time.Hour)
+	if err := d.LockLogin("admin", until); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := d.GetLoginLockout("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lockout.Locked(start.Add(30*time.Minute)) || lockout.Locked(until) {
+		t.Errorf("locked until %v, want %v", lockout.LockedUntil, until)
+	}
+	if got := strings.Join(lockout.SourceIPs, ","); got != "192.0.2.1,192.0.2.2" {
+		t.Errorf("source IPs = %s, want most recent first", got)
+	}
+
+	// A failure long after the previous one starts a new count
+	if failures, err := d.RecordLoginFailure("admin", "192.0.2.3", start.Add(3*time.Hour), time.Hour); err != nil || failures != 1 {
+		t.Errorf("failure after the reset period counted as %d, %v", failures, err)
+	}
+
+	if err := d.ClearLoginLockout("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetLoginLockout("admin"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetLoginLockout after clearing: %v, want sql.ErrNoRows", err)
+	}
+	if lockouts, err := d.GetLoginLockouts(); err != nil || len(lockouts) != 0 {
+		t.Errorf("GetLoginLockouts = %v, %v, want none", lockouts, err)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	d := openTestDatabase(t)
+	user, err := d.CreateUser("admin", "hash", models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	session, err := d.CreateSession(&models.Session{UserID: user.ID, UserAgent: "curl", SourceIP: "192.0.2.1", ExpiresAt: expires}, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := d.GetRefreshToken("first")
+	if err != nil || first.SessionID != session.ID || first.RotatedAt != nil {
+		t.Fatalf("first token = %+v, %v", first, err)
+	}
+
+	if ok, err := d.RotateRefreshToken(first, "second", expires, "192.0.2.2", "firefox"); err != nil || !ok {
+		t.Fatalf("rotating: %v, %v", ok, err)
+	}
+	// A concurrent rotation of the same token loses
+	if ok, err := d.RotateRefreshToken(first, "third", expires, "192.0.2.3", "curl"); err != nil || ok {
+		t.Errorf("rotating a rotated token: %v, %v, want false", ok, err)
+	}
+
+	if first, _ = d.GetRefreshToken("first"); first.RotatedAt == nil {
+		t.Error("rotated token is not marked")
+	}
+	if session, _ = d.GetSession(session.ID); session.SourceIP != "192.0.2.2" || session.UserAgent != "firefox" {
+		t.Errorf("session after refresh = %+v", session)
+	}
+
+	// Revoking the session revokes every token of its family
+	if err := d.DeleteSession(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"first", "second"} {
+		if _, err := d.GetRefreshToken(hash); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("token %s after revoking its session: %v, want sql.ErrNoRows", hash, err)
+		}
+	}
+	if sessions, err := d.GetSessions(user.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("GetSessions = %v, %v, want none", sessions, err)
+	}
+}
+
+func TestPeerOwners(t *testing.T) {
+	d := openTestDatabase(t)
+	if _, err := d.CreateUser("admin", "hash", models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	user, err := d.CreateUser("alice", "hash", models.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := d.CreatePeer(&models.Peer{Name: "phone", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true, OwnerID: &user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.CreatePeer(&models.Peer{Name: "server", PublicKey: "key-2", AssignedIP: "10.8.0.3", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owned.OwnerID == nil || *owned.OwnerID != user.ID || other.OwnerID != nil {
+		t.Fatalf("owners = %v, %v", owned.OwnerID, other.OwnerID)
+	}
+
+	other.OwnerID = &user.ID
+	if err := d.SavePeer(other, false); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := d.CountPeersByOwner(user.ID); err != nil || count != 2 {
+		t.Errorf("CountPeersByOwner = %d, %v, want 2", count, err)
+	}
+	other.OwnerID = nil
+	if err := d.SavePeer(other, false); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := d.GetPeersByOwner(user.ID)
+	if err != nil || len(peers) != 1 || peers[0].ID != owned.ID {
+		t.Errorf("GetPeersByOwner = %v, %v, want only %q", peers, err, owned.Name)
+	}
+
+	// Deleting the user keeps their peers, without an owner
+	if err := d.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := d.GetPeerByID(owned.ID)
+	if err != nil || peer.OwnerID != nil {
+		t.Errorf("peer of a deleted user: %+v, %v", peer, err)
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	d := openTestDatabase(t)
+	peer, err := d.CreatePeer(&models.Peer{Name: "phone", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := d.CreateShareLink(&models.ShareLink{
+		PeerID: peer.ID, Kind: models.ShareKindConfig, CreatedBy: "admin", ExpiresAt: time.Now().Add(time.Hour),
+	}, "hash-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateShareLink(&models.ShareLink{
+		PeerID: peer.ID, Kind: models.ShareKindQRCode, CreatedBy: "admin", ExpiresAt: time.Now().Add(-time.Minute),
+	}, "hash-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := d.GetShareLinkByToken("hash-1")
+	if err != nil || found.ID != link.ID || found.PeerName != "phone" {
+		t.Fatalf("GetShareLinkByToken = %+v, %v", found, err)
+	}
+	if links, err := d.GetOutstandingShareLinks(); err != nil || len(links) != 1 || links[0].ID != link.ID {
+		t.Errorf("outstanding links = %+v, %v, want only the unexpired one", links, err)
+	}
+
+	// A link is consumed once, the second download gets nothing
+	for i, want := range []bool{true, false} {
+		if consumed, err := d.ConsumeShareLink(link.ID, "192.0.2.1"); err != nil || consumed != want {
+			t.Errorf("ConsumeShareLink #%d = %v, %v, want %v", i+1, consumed, err, want)
+		}
+	}
+	used, err := d.GetShareLink(link.ID)
+	if err != nil || used.Usable(time.Now()) || used.ConsumedIP != "192.0.2.1" {
+		t.Errorf("used link = %+v, %v", used, err)
+	}
+	if links, err := d.GetOutstandingShareLinks(); err != nil || len(links) != 0 {
+		t.Errorf("outstanding links after use = %+v, %v", links, err)
+	}
+
+	if err := d.DeleteShareLink(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteShareLink(link.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleting a revoked link: %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestPeerGroups(t *testing.T) {
+	d := openTestDatabase(t)
+	keepalive := 0
+	group, err := d.CreatePeerGroup(&models.PeerGroup{
+		Name:           "split-tunnel-office",
+		ClientSettings: models.ClientSettings{AllowedIPs: "10.0.0.0/8", MTU: 1380, PersistentKeepalive: &keepalive},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.PersistentKeepalive == nil || *group.PersistentKeepalive != 0 || group.MTU != 1380 {
+		t.Errorf("created group = %+v", group)
+	}
+	if _, err := d.CreatePeerGroup(&models.PeerGroup{Name: "split-tunnel-office"}); !errors.Is(err, ErrGroupNameConflict) {
+		t.Errorf("duplicate group name: %v, want ErrGroupNameConflict", err)
+	}
+
+	member, err := d.CreatePeer(&models.Peer{Name: "laptop", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true, GroupID: &group.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.CreatePeer(&models.Peer{Name: "phone", PublicKey: "key-2", AssignedIP: "10.8.0.3", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.GroupID = &group.ID
+	if err := d.SavePeer(other, false); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err := d.GetPeersByGroup(group.ID); err != nil || len(peers) != 2 {
+		t.Errorf("GetPeersByGroup = %d peers, %v, want 2", len(peers), err)
+	}
+	if groups, err := d.GetPeerGroups(); err != nil || len(groups) != 1 || groups[0].PeerCount != 2 {
+		t.Errorf("GetPeerGroups = %+v, %v", groups, err)
+	}
+
+	group.PersistentKeepalive = nil
+	if err := d.UpdatePeerGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := d.GetPeerGroup(group.ID); err != nil || updated.PersistentKeepalive != nil {
+		t.Errorf("keepalive after reset = %v, %v, want inherited", updated.PersistentKeepalive, err)
+	}
+
+	// Deleting the group keeps its peers, without a group
+	if err := d.DeletePeerGroup(group.ID); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := d.GetPeerByID(member.ID)
+	if err != nil || peer.GroupID != nil {
+		t.Errorf("peer of a deleted group: %+v, %v", peer, err)
+	}
+}
+
+func TestPeerOverrides(t *testing.T) {
+	d := openTestDatabase(t)
+	keepalive := 0
+	overrides := models.ClientOverrides{
+		ClientSettings: models.ClientSettings{DNS: "10.0.0.53", AllowedIPs: "10.0.0.0/8", MTU: 1380, PersistentKeepalive: &keepalive},
+		EndpointHost:   "vpn2.example.com",
+		EndpointPort:   443,
+		InterfaceLines: []string{"Table = off", "ListenPort = 51821"},
+	}
+	peer, err := d.CreatePeer(&models.Peer{Name: "laptop", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true, Overrides: overrides})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := peer.Overrides
+	if got.DNS != overrides.DNS || got.AllowedIPs != overrides.AllowedIPs || got.MTU != 1380 || got.PersistentKeepalive == nil || *got.PersistentKeepalive != 0 ||
+		got.EndpointHost != overrides.EndpointHost || got.EndpointPort != 443 || strings.Join(got.InterfaceLines, "|") != "Table = off|ListenPort = 51821" {
+		t.Errorf("stored overrides = %+v, want %+v", got, overrides)
+	}
+
+	peer.Overrides = models.ClientOverrides{}
+	if err := d.SavePeer(peer, false); err != nil {
+		t.Fatal(err)
+	}
+	cleared, err := d.GetPeerByID(peer.ID)
+	if err != nil || cleared.Overrides.PersistentKeepalive != nil || cleared.Overrides.InterfaceLines != nil || cleared.Overrides.DNS != "" {
+		t.Errorf("overrides after clearing = %+v, %v", cleared.Overrides, err)
+	}
+}
+
+func TestPeerUsageCounters(t *testing.T) {
+	d := openTestDatabase(t)
+	peer, err := d.CreatePeer(&models.Peer{Name: "laptop", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	if err := d.RecordPeerUsage(peer.ID, 1000, 500, 1000, 500, "key-1", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RecordPeerUsage(peer.ID, 200, 100, 1200, 600, "key-1", at.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling a peer that already is enabled keeps the counters the next usage is computed from
+	enabled, disabled := true, false
+	peer, err = d.UpdatePeer(peer.AssignedIP, nil, &enabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.UsageRx != 1200 || peer.UsageTx != 600 || peer.MonthlyUsage != 1800 || peer.CounterRx != 1200 || peer.CounterTx != 600 || peer.CounterKey != "key-1" {
+		t.Errorf("usage after enabling an enabled peer = %d/%d, month %d, counters %d/%d %q",
+			peer.UsageRx, peer.UsageTx, peer.MonthlyUsage, peer.CounterRx, peer.CounterTx, peer.CounterKey)
+	}
+
+	// Disabling resets the counters with the interface's, and keeps the reason of an earlier disable
+	if err := d.DisablePeer(peer.ID, models.DisabledReasonQuota); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err = d.UpdatePeer(peer.AssignedIP, nil, &disabled); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Enabled || peer.DisabledReason != models.DisabledReasonQuota || peer.CounterRx != 0 || peer.CounterTx != 0 {
+		t.Errorf("peer after disabling a disabled peer: enabled %v, reason %q, counters %d/%d",
+			peer.Enabled, peer.DisabledReason, peer.CounterRx, peer.CounterTx)
+	}
+
+	// A new month starts the monthly usage over
+	if err := d.RecordPeerUsage(peer.ID, 50, 50, 50, 50, "key-1", at.AddDate(0, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err = d.GetPeerByID(peer.ID); err != nil || peer.MonthlyUsage != 100 || peer.UsageRx != 1250 {
+		t.Errorf("usage in a new month: month %d, total rx %d, %v", peer.MonthlyUsage, peer.UsageRx, err)
+	}
+}
+
+func TestRotatePeerKeys(t *testing.T) {
+	d := openTestDatabase(t)
+	peer, err := d.CreatePeer(&models.Peer{Name: "laptop", PublicKey: "key-1", PrivateKey: "private-1", AssignedIP: "10.8.0.2", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreatePeer(&models.Peer{Name: "phone", PublicKey: "key-2", AssignedIP: "10.8.0.3", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.RotatePeerKeys(peer.ID, "key-2", "", "", nil); !errors.Is(err, ErrPublicKeyConflict) {
+		t.Errorf("rotating to another peer's key: %v, want ErrPublicKeyConflict", err)
+	}
+
+	graceUntil := time.Now().Add(time.Hour)
+	if err := d.RotatePeerKeys(peer.ID, "key-3", "", "key-1", &graceUntil); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := d.GetPeerByID(peer.ID)
+	if err != nil || rotated.PublicKey != "key-3" || rotated.HasPrivateKey || rotated.PreviousPublicKey != "key-1" || rotated.KeyGraceUntil == nil {
+		t.Errorf("rotated peer = %+v, %v", rotated, err)
+	}
+
+	// Undoing a rotation the interface did not take
+	if err := d.RestorePeerKeys(peer); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := d.GetPeerByID(peer.ID)
+	if err != nil || restored.PublicKey != "key-1" || restored.PrivateKey != "private-1" || restored.PreviousPublicKey != "" || restored.KeyGraceUntil != nil {
+		t.Errorf("restored peer = %+v, %v", restored, err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	d := openTestDatabase(t)
+	admin, err := d.CreateUser("admin", "hash", models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateSession(&models.Session{UserID: admin.ID, ExpiresAt: time.Now().Add(time.Hour)}, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is saved when the change is refused, not even the other fields
+	demoted := *admin
+	demoted.Role, demoted.MaxDevices = models.RoleViewer, 9
+	if err := d.UpdateUser(&demoted, "new hash", false); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("demoting the last admin: %v, want ErrLastAdmin", err)
+	}
+	user, err := d.GetUserByID(admin.ID)
+	if err != nil || user.Role != models.RoleAdmin || user.MaxDevices == 9 || user.PasswordHash != "hash" {
+		t.Errorf("user after a refused update = %+v, %v", user, err)
+	}
+
+	user.MaxDevices = 9
+	if err := d.UpdateUser(user, "new hash", false); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = d.GetUserByID(admin.ID); err != nil || user.MaxDevices != 9 || user.PasswordHash != "new hash" {
+		t.Errorf("updated user = %+v, %v", user, err)
+	}
+	if sessions, err := d.GetSessions(admin.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions after a password change = %d, %v, want none", len(sessions), err)
+	}
+}
+
+func TestSavePeer(t *testing.T) {
+	d := openTestDatabase(t)
+	peer, err := d.CreatePeer(&models.Peer{Name: "laptop", PublicKey: "key-1", AssignedIP: "10.8.0.2", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreatePeer(&models.Peer{Name: "phone", PublicKey: "key-2", AssignedIP: "10.8.0.3", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RecordPeerUsage(peer.ID, 1000, 500, 1000, 500, "key-1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A conflicting address keeps every other change from being saved too
+	changed := *peer
+	changed.Name, changed.AssignedIP, changed.MonthlyQuota = "renamed", "10.8.0.3", 1<<30
+	if err := d.SavePeer(&changed, false); !errors.Is(err, ErrIPConflict) {
+		t.Errorf("moving to a taken address: %v, want ErrIPConflict", err)
+	}
+	if got, err := d.GetPeerByID(peer.ID); err != nil || got.Name != "laptop" || got.MonthlyQuota != 0 {
+		t.Errorf("peer after a refused change = %+v, %v", got, err)
+	}
+
+	// The counters the peer's usage is recorded from stay unless the enabled state is saved
+	changed.AssignedIP = "10.8.0.4"
+	if err := d.SavePeer(&changed, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetPeerByID(peer.ID)
+	if err != nil || got.Name != "renamed" || got.AssignedIP != "10.8.0.4" || got.MonthlyQuota != 1<<30 || got.CounterRx != 1000 || !got.Enabled {
+		t.Errorf("saved peer = %+v, %v", got, err)
+	}
+
+	changed.Enabled, changed.DisabledReason, changed.CounterRx, changed.CounterTx = false, models.DisabledReasonManual, 0, 0
+	if err := d.SavePeer(&changed, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.GetPeerByID(peer.ID); err != nil || got.Enabled || got.DisabledReason != models.DisabledReasonManual || got.CounterRx != 0 {
+		t.Errorf("disabled peer = %+v, %v", got, err)
+	}
+}
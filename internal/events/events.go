@@ -0,0 +1,202 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types pushed to subscribers
+const (
+	PeerCreated   = "peer.created"   // Data: models.PeerResponse
+	PeerUpdated   = "peer.updated"   // Data: models.PeerResponse
+	PeerDeleted   = "peer.deleted"   // Data: PeerRef
+	PeerOnline    = "peer.online"    // Data: PeerStatus
+	PeerOffline   = "peer.offline"   // Data: PeerStatus
+	PeerHandshake = "peer.handshake" // Data: PeerStatus
+	PeerStats     = "peer.stats"     // Data: []PeerStatus, every sample
+
+	PeerEnabled       = "peer.enabled"        // Data: models.PeerResponse
+	PeerDisabled      = "peer.disabled"       // Data: models.PeerResponse, disabled_reason says why
+	PeerQuotaExceeded = "peer.quota_exceeded" // Data: models.PeerResponse
+
+	LoginFailureBurst     = "security.login_failures"       // Data: LoginFailures
+	AccountLocked         = "security.account_locked"       // Data: AccountLockout
+	RefreshTokenReused    = "security.refresh_token_reused" // Data: RefreshTokenReuse
+	TailscaleConnected    = "tailscale.connected"           // Data: TailscaleState
+	TailscaleDisconnected = "tailscale.disconnected"        // Data: TailscaleState
+)
+
+// Event is a message for stream subscribers
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// securityPrefix starts the types of security events, which name users and their IP addresses
+const securityPrefix = "security."
+
+// IsSecurity reports whether the event is one of the security.* events
+func (e Event) IsSecurity() bool {
+	return strings.HasPrefix(e.Type, securityPrefix)
+}
+
+// PeerRef identifies a peer that no longer exists
+type PeerRef struct {
+	ID         int64  `json:"id"`
+	AssignedIP string `json:"assigned_ip"`
+}
+
+// PeerStatus is a peer's live state from one stats sample
+type PeerStatus struct {
+	ID              int64     `json:"id"`
+	AssignedIP      string    `json:"assigned_ip"`
+	IsOnline        bool      `json:"is_online"`
+	LatestHandshake time.Time `json:"latest_handshake,omitempty"`
+	Endpoint        string    `json:"endpoint,omitempty"`
+	TransferRx      int64     `json:"transfer_rx"`
+	TransferTx      int64     `json:"transfer_tx"`
+	RxRate          float64   `json:"rx_rate"` // Bytes per second since the previous sample
+	TxRate          float64   `json:"tx_rate"`
+}
+
+// LoginFailures reports a burst of failed logins within a time window
+type LoginFailures struct {
+	Count     int      `json:"count"`
+	Window    int64    `json:"window"` // Seconds
+	Usernames []string `json:"usernames"`
+	ClientIPs []string `json:"client_ips"`
+}
+
+// AccountLockout reports that a username was locked after too many failed logins in a row
+type AccountLockout struct {
+	Username    string    `json:"username"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	SourceIPs   []string  `json:"source_ips"`
+}
+
+// RefreshTokenReuse reports that a rotated refresh token was presented again, a sign it was
+// stolen; the session it belonged to has been revoked
+type RefreshTokenReuse struct {
+	Username  string `json:"username"`
+	SessionID int64  `json:"session_id"`
+	SourceIP  string `json:"source_ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+// TailscaleState is the Tailscale connection state after a change
+type TailscaleState struct {
+	Connected    bool   `json:"connected"`
+	BackendState string `json:"backend_state"`
+}
+
+// subscriberBuffer is how many events a slow subscriber may fall behind before events are dropped
+const subscriberBuffer = 64
+
+// Hub fans events out to subscribers
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving every published event and a function that ends the subscription
+func (h *Hub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// HasSubscribers reports whether anyone is listening, so producers can skip expensive work
+func (h *Hub) HasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// Publish sends an event to all subscribers without blocking
+// Subscribers whose buffer is full miss the event
+func (h *Hub) Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Sampler turns successive peer stats samples into events
+type Sampler struct {
+	hub      *Hub
+	now      func() time.Time // Clock for rate calculation, replaceable in tests
+	previous map[int64]PeerStatus
+	sampled  time.Time
+}
+
+func NewSampler(hub *Hub) *Sampler {
+	return &Sampler{hub: hub, now: time.Now}
+}
+
+// Sample publishes online/offline transitions and handshake updates since the previous sample,
+// followed by a PeerStats event with every peer's current state and transfer rates.
+// statuses must hold the peers' counters and handshakes; rates are filled in here.
+func (s *Sampler) Sample(statuses []PeerStatus) {
+	now := s.now()
+	elapsed := now.Sub(s.sampled).Seconds()
+	current := make(map[int64]PeerStatus, len(statuses))
+
+	for i := range statuses {
+		status := &statuses[i]
+		previous, known := s.previous[status.ID]
+
+		// Counters that went down were reset, so there is no meaningful rate for this sample
+		if known && elapsed > 0 && status.TransferRx >= previous.TransferRx && status.TransferTx >= previous.TransferTx {
+			status.RxRate = float64(status.TransferRx-previous.TransferRx) / elapsed
+			status.TxRate = float64(status.TransferTx-previous.TransferTx) / elapsed
+		}
+		current[status.ID] = *status
+
+		if !known {
+			continue
+		}
+		if status.IsOnline != previous.IsOnline {
+			eventType := PeerOffline
+			if status.IsOnline {
+				eventType = PeerOnline
+			}
+			s.hub.Publish(eventType, *status)
+		}
+		if !status.LatestHandshake.Equal(previous.LatestHandshake) && !status.LatestHandshake.IsZero() {
+			s.hub.Publish(PeerHandshake, *status)
+		}
+	}
+
+	s.previous = current
+	s.sampled = now
+	s.hub.Publish(PeerStats, statuses)
+}
+
+// Reset forgets the previous sample, e.g. after nobody was subscribed for a while
+func (s *Sampler) Reset() {
+	s.previous = nil
+}
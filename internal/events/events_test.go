@@ -0,0 +1,109 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// drain returns the events published so far without blocking
+func drain(ch <-chan Event) []Event {
+	var received []Event
+	for {
+		select {
+		case event := <-ch:
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func eventTypes(received []Event) []string {
+	types := make([]string, len(received))
+	for i, event := range received {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func equalTypes(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSampler(t *testing.T) {
+	hub := NewHub()
+	ch, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	clock := time.Unix(1700000000, 0)
+	sampler := NewSampler(hub)
+	sampler.now = func() time.Time { return clock }
+	handshake := clock.Add(-10 * time.Second)
+
+	// First sample: nothing to compare with, so only the stats event and no rates
+	sampler.Sample([]PeerStatus{{ID: 1, TransferRx: 1000, TransferTx: 500}})
+	received := drain(ch)
+	if got, want := eventTypes(received), []string{PeerStats}; !equalTypes(got, want) {
+		t.Fatalf("first sample events = %v, want %v", got, want)
+	}
+	if statuses := received[0].Data.([]PeerStatus); statuses[0].RxRate != 0 || statuses[0].TxRate != 0 {
+		t.Errorf("first sample rates = %v/%v, want 0/0", statuses[0].RxRate, statuses[0].TxRate)
+	}
+
+	// Peer comes online with a handshake: transition, handshake and stats with rates over 5 seconds
+	clock = clock.Add(5 * time.Second)
+	sampler.Sample([]PeerStatus{{ID: 1, IsOnline: true, LatestHandshake: handshake, TransferRx: 6000, TransferTx: 1500}})
+	received = drain(ch)
+	if got, want := eventTypes(received), []string{PeerOnline, PeerHandshake, PeerStats}; !equalTypes(got, want) {
+		t.Fatalf("second sample events = %v, want %v", got, want)
+	}
+	status := received[2].Data.([]PeerStatus)[0]
+	if status.RxRate != 1000 || status.TxRate != 200 {
+		t.Errorf("rates = %v/%v, want 1000/200", status.RxRate, status.TxRate)
+	}
+
+	// Same handshake, counters reset by an interface restart: no events besides stats, no rate
+	clock = clock.Add(5 * time.Second)
+	sampler.Sample([]PeerStatus{{ID: 1, IsOnline: true, LatestHandshake: handshake, TransferRx: 100, TransferTx: 100}})
+	received = drain(ch)
+	if got, want := eventTypes(received), []string{PeerStats}; !equalTypes(got, want) {
+		t.Fatalf("third sample events = %v, want %v", got, want)
+	}
+	if status := received[0].Data.([]PeerStatus)[0]; status.RxRate != 0 || status.TxRate != 0 {
+		t.Errorf("rates after counter reset = %v/%v, want 0/0", status.RxRate, status.TxRate)
+	}
+
+	// Going offline
+	clock = clock.Add(5 * time.Second)
+	sampler.Sample([]PeerStatus{{ID: 1, LatestHandshake: handshake, TransferRx: 100, TransferTx: 100}})
+	if got, want := eventTypes(drain(ch)), []string{PeerOffline, PeerStats}; !equalTypes(got, want) {
+		t.Fatalf("fourth sample events = %v, want %v", got, want)
+	}
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	hub := NewHub()
+	ch, unsubscribe := hub.Subscribe()
+	if !hub.HasSubscribers() {
+		t.Fatal("HasSubscribers = false after Subscribe")
+	}
+
+	unsubscribe()
+	unsubscribe() // Must be safe to call twice
+	if hub.HasSubscribers() {
+		t.Fatal("HasSubscribers = true after unsubscribe")
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("channel still open after unsubscribe")
+	}
+
+	hub.Publish(PeerCreated, nil) // Must not panic on the closed channel
+}
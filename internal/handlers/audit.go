@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+
+	// The export is read and written in pages of auditExportPageSize entries, each of which
+	// the client gets auditExportWriteTimeout to take
+	auditExportPageSize     = 500
+	auditExportWriteTimeout = 30 * time.Second
+)
+
+// recordAudit writes an audit log entry for the request's user. before and after are
+// snapshots of the target, nil when it did not exist. A failure to write the entry is
+// logged but does not fail the request, the action has already happened.
+func recordAudit(c *gin.Context, action, target string, before, after interface{}) {
+	entry := &models.AuditEntry{
+		CreatedAt:  time.Now(),
+		UserID:     c.GetInt64("user_id"),
+		Username:   c.GetString("username"),
+		SourceIP:   c.ClientIP(),
+		AuthMethod: c.GetString("auth_method"),
+		Action:     action,
+		Target:     target,
+	}
+
+	var err error
+	if entry.Before, err = auditSnapshot(before); err == nil {
+		entry.After, err = auditSnapshot(after)
+	}
+	if err == nil {
+		err = db.DB.AddAuditEntry(entry)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to write audit log entry %s %s: %v", action, target, err)
+	}
+}
+
+func auditSnapshot(state interface{}) (json.RawMessage, error) {
+	if state == nil {
+		return nil, nil
+	}
+	return json.Marshal(state)
+}
+
+func peerTarget(id int64) string {
+	return fmt.Sprintf("peer:%d", id)
+}
+
+func webhookTarget(id int64) string {
+	return fmt.Sprintf("webhook:%d", id)
+}
+
+type AuditHandler struct{}
+
+func NewAuditHandler() *AuditHandler {
+	return &AuditHandler{}
+}
+
+// auditFilter reads the action, user, target, from and to query parameters, writing a
+// response if one of them is invalid
+func auditFilter(c *gin.Context) (models.AuditFilter, bool) {
+	filter := models.AuditFilter{
+		Action:   c.Query("action"),
+		Username: c.Query("user"),
+		Target:   c.Query("target"),
+	}
+
+	for _, bound := range []struct {
+		param string
+		dest  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := c.Query(bound.param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid " + bound.param + " time",
+				Message: "Use RFC 3339, e.g. 2024-01-02T15:04:05Z",
+			})
+			return filter, false
+		}
+		*bound.dest = &t
+	}
+
+	return filter, true
+}
+
+// queryInt parses an optional positive integer query parameter no larger than max
+func queryInt(c *gin.Context, name string, def, max int) (int, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return def, true
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 1 || value > max {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: fmt.Sprintf("%s must be between 1 and %d", name, max),
+		})
+		return 0, false
+	}
+	return value, true
+}
+
+// ListEntries returns one page of the audit log, newest first. Query parameters: page,
+// per_page, action (exact or a prefix ending in "."), user, target, from and to (RFC 3339).
+func (h *AuditHandler) ListEntries(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+	page, ok := queryInt(c, "page", 1, 1<<20)
+	if !ok {
+		return
+	}
+	perPage, ok := queryInt(c, "per_page", defaultAuditPageSize, maxAuditPageSize)
+	if !ok {
+		return
+	}
+
+	entries, total, err := db.DB.GetAuditEntries(filter, perPage, (page-1)*perPage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get audit log",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.AuditPage{
+		Entries: entries,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	})
+}
+
+// Export streams the matching audit log entries as JSON lines, oldest first. It takes the
+// same filters as ListEntries.
+func (h *AuditHandler) Export(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.jsonl", time.Now().UTC().Format("20060102-150405")))
+	c.Status(http.StatusOK)
+
+	// The server's write timeout is meant for ordinary requests, extend it for each page
+	rc := http.NewResponseController(c.Writer)
+	encoder := json.NewEncoder(c.Writer)
+	err := db.DB.ForEachAuditPage(filter, auditExportPageSize, func(page []models.AuditEntry) error {
+		rc.SetWriteDeadline(time.Now().Add(auditExportWriteTimeout))
+		for i := range page {
+			if err := encoder.Encode(&page[i]); err != nil {
+				return err
+			}
+		}
+		return rc.Flush()
+	})
+	if err != nil {
+		// The status is already sent, the truncated export is all the client gets
+		log.Printf("Warning: Audit log export failed: %v", err)
+	}
+}
@@ -1,22 +1,107 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"wgeasygo/internal/auth"
 	"wgeasygo/internal/config"
 	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
 	"wgeasygo/internal/models"
+	"wgeasygo/pkg/metrics"
 )
 
 type AuthHandler struct {
-	config *config.Config
+	config     *config.Config
+	hub        *events.Hub
+	failures   loginFailureTracker
+	challenges loginChallenges
 }
 
-func NewAuthHandler(cfg *config.Config) *AuthHandler {
-	return &AuthHandler{config: cfg}
+func NewAuthHandler(cfg *config.Config, hub *events.Hub) *AuthHandler {
+	return &AuthHandler{config: cfg, hub: hub, challenges: loginChallenges{pending: make(map[string]*loginChallenge)}}
+}
+
+// A burst of failed logins is reported once per window when the window holds this many failures
+const (
+	loginFailureBurst  = 5
+	loginFailureWindow = 5 * time.Minute
+
+	maxTrackedLoginFailures = 1000 // Bounds memory during an attack, the burst is reported long before
+	maxReportedLoginSources = 10   // Usernames and client IPs listed in a report
+)
+
+type failedLogin struct {
+	at       time.Time
+	username string
+	clientIP string
+}
+
+// loginFailureTracker keeps the failed logins of the last window to detect bursts
+type loginFailureTracker struct {
+	mu       sync.Mutex
+	failures []failedLogin
+	reported time.Time
+}
+
+// record adds a failed login and returns a report if it completes a burst
+func (t *loginFailureTracker) record(failure failedLogin) *events.LoginFailures {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := failure.at.Add(-loginFailureWindow)
+	kept := t.failures[:0]
+	for _, f := range t.failures {
+		if f.at.After(cutoff) {
+			kept = append(kept, f)
+		}
+	}
+	t.failures = append(kept, failure)
+	if len(t.failures) > maxTrackedLoginFailures {
+		t.failures = t.failures[len(t.failures)-maxTrackedLoginFailures:]
+	}
+
+	if len(t.failures) < loginFailureBurst || t.reported.After(cutoff) {
+		return nil
+	}
+	t.reported = failure.at
+
+	report := &events.LoginFailures{
+		Count:     len(t.failures),
+		Window:    int64(loginFailureWindow / time.Second),
+		Usernames: []string{},
+		ClientIPs: []string{},
+	}
+	seenUsers, seenIPs := make(map[string]bool), make(map[string]bool)
+	for i := len(t.failures) - 1; i >= 0; i-- {
+		f := t.failures[i]
+		if !seenUsers[f.username] && len(report.Usernames) < maxReportedLoginSources {
+			seenUsers[f.username] = true
+			report.Usernames = append(report.Usernames, f.username)
+		}
+		if !seenIPs[f.clientIP] && len(report.ClientIPs) < maxReportedLoginSources {
+			seenIPs[f.clientIP] = true
+			report.ClientIPs = append(report.ClientIPs, f.clientIP)
+		}
+	}
+	return report
+}
+
+// loginFailed counts a failed login against the username and publishes a burst report
+// when one is complete
+func (h *AuthHandler) loginFailed(c *gin.Context, username string) {
+	metrics.LoginFailures.Inc()
+	c.Set("username", username)
+	c.Set("auth_method", models.AuthMethodPassword)
+	recordAudit(c, "auth.login_failed", "user:"+username, nil, nil)
+	h.recordLoginLockout(c, username)
+	if report := h.failures.record(failedLogin{at: time.Now(), username: username, clientIP: c.ClientIP()}); report != nil {
+		h.hub.Publish(events.LoginFailureBurst, *report)
+	}
 }
 
 // Login handles user authentication and token generation
@@ -29,10 +114,16 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Per-account limit, the rate limiter alone does not stop attempts from many addresses
+	if !h.checkLoginLockout(c, req.Username) {
+		return
+	}
+
 	// Get user from database
 	user, err := db.DB.GetUserByUsername(req.Username)
 	if err != nil {
 		// Use same error for security (don't reveal if user exists)
+		h.loginFailed(c, req.Username)
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
 			Error: "Invalid credentials",
 		})
@@ -41,33 +132,98 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	// Verify password
 	if err := auth.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+		h.loginFailed(c, req.Username)
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
 			Error: "Invalid credentials",
 		})
 		return
 	}
 
-	// Generate deterministic API token from password
-	apiToken := auth.GenerateAPIToken(req.Password, h.config.JWT.AccessSecret)
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Account disabled",
+		})
+		return
+	}
 
-	// Update API token in database if it changed (or first time)
-	if user.APIToken != apiToken {
-		if err := db.DB.UpdateUserAPIToken(user.ID, apiToken); err != nil {
+	// With two-factor authentication the tokens are only issued for a valid code
+	if user.TOTPEnabled {
+		challenge, err := h.challenges.issue(user.ID)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-				Error: "Failed to update API token",
+				Error: "Failed to start two-factor login",
 			})
 			return
 		}
+		c.JSON(http.StatusOK, models.TwoFactorChallenge{
+			TwoFactorRequired: true,
+			Challenge:         challenge,
+			ExpiresIn:         int(loginChallengeTTL / time.Second),
+		})
+		return
 	}
 
-	// Generate access token
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, &h.config.JWT)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-			Error: "Failed to generate access token",
-		})
+	h.startSession(c, user, models.AuthMethodPassword)
+}
+
+// maxUserAgentLength bounds the user agent kept to tell sessions apart
+const maxUserAgentLength = 256
+
+func userAgent(c *gin.Context) string {
+	ua := c.Request.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	return ua
+}
+
+// setRefreshCookie sets the refresh token as an HTTP-only secure cookie with SameSite=Strict
+func setRefreshCookie(c *gin.Context, token string, expiresAt time.Time) {
+	maxAge := int(time.Until(expiresAt).Seconds())
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(
+		"refresh_token",
+		token,
+		maxAge,
+		"/api/v1/auth",
+		"",   // domain - empty for current domain
+		true, // secure - HTTPS only
+		true, // httpOnly - not accessible via JavaScript
+	)
+}
+
+func clearRefreshCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(
+		"refresh_token",
+		"",
+		-1,
+		"/api/v1/auth",
+		"",
+		true,
+		true,
+	)
+}
+
+// startSession starts a session for a user who just logged in, responding with an access
+// token and setting the session's first refresh token as a cookie
+func (h *AuthHandler) startSession(c *gin.Context, user *models.User, authMethod string) {
+	accessToken, ok := h.createSession(c, user, authMethod)
+	if !ok {
 		return
 	}
+	c.JSON(http.StatusOK, models.LoginResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   h.config.JWT.AccessExpiryMinutes * 60,
+	})
+}
+
+// createSession saves a session for a user who just logged in, sets its refresh token cookie
+// and returns an access token. It writes a response only if that fails.
+func (h *AuthHandler) createSession(c *gin.Context, user *models.User, authMethod string) (string, bool) {
+	if err := db.DB.ClearLoginLockout(user.Username); err != nil {
+		log.Printf("Warning: Failed to reset failed logins of %q: %v", user.Username, err)
+	}
 
 	// Generate refresh token
 	refreshToken, err := auth.GenerateRefreshToken()
@@ -75,39 +231,77 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to generate refresh token",
 		})
-		return
+		return "", false
 	}
 
-	// Save refresh token to database
+	// Save the session with the refresh token's hash
 	expiresAt := auth.GetRefreshTokenExpiry(&h.config.JWT)
-	if err := db.DB.SaveRefreshToken(user.ID, refreshToken, expiresAt); err != nil {
+	session, err := db.DB.CreateSession(&models.Session{
+		UserID:     user.ID,
+		AuthMethod: authMethod,
+		UserAgent:  userAgent(c),
+		SourceIP:   c.ClientIP(),
+		ExpiresAt:  expiresAt,
+	}, auth.HashRefreshToken(refreshToken))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to save refresh token",
 		})
-		return
+		return "", false
 	}
 
-	// Set refresh token as HTTP-only secure cookie with SameSite=Strict
-	maxAge := int(time.Until(expiresAt).Seconds())
-	c.SetSameSite(http.SameSiteStrictMode)
-	c.SetCookie(
-		"refresh_token",
-		refreshToken,
-		maxAge,
-		"/api/v1/auth",
-		"",    // domain - empty for current domain
-		true,  // secure - HTTPS only
-		true,  // httpOnly - not accessible via JavaScript
-	)
+	// Generate access token
+	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, user.Role, session.ID, &h.config.JWT)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate access token",
+		})
+		return "", false
+	}
 
-	c.JSON(http.StatusOK, models.LoginResponse{
-		AccessToken: accessToken,
-		ExpiresIn:   h.config.JWT.AccessExpiryMinutes * 60,
-		APIToken:    apiToken,
+	setRefreshCookie(c, refreshToken, expiresAt)
+
+	c.Set("user_id", user.ID)
+	c.Set("username", user.Username)
+	c.Set("role", user.Role)
+	c.Set("auth_method", authMethod)
+	recordAudit(c, "auth.login", "user:"+user.Username, nil, nil)
+	return accessToken, true
+}
+
+// refreshTokenReused revokes the session of a refresh token that was presented after it had
+// been rotated. Either the caller or whoever refreshed with the token before holds a copy, and
+// there is no telling which one is legitimate, so both are signed out.
+func (h *AuthHandler) refreshTokenReused(c *gin.Context, token *models.RefreshToken) {
+	if err := db.DB.DeleteSession(token.SessionID); err != nil {
+		log.Printf("Warning: Failed to revoke session %d after refresh token reuse: %v", token.SessionID, err)
+	}
+
+	username := ""
+	if user, err := db.DB.GetUserByID(token.UserID); err == nil {
+		username = user.Username
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+	}
+	c.Set("auth_method", models.AuthMethodRefreshToken)
+	log.Printf("Warning: Rotated refresh token of %q reused from %s, session %d revoked", username, c.ClientIP(), token.SessionID)
+	recordAudit(c, "auth.refresh_reuse", sessionTarget(token.SessionID), nil, nil)
+	h.hub.Publish(events.RefreshTokenReused, events.RefreshTokenReuse{
+		Username:  username,
+		SessionID: token.SessionID,
+		SourceIP:  c.ClientIP(),
+		UserAgent: userAgent(c),
+	})
+
+	clearRefreshCookie(c)
+	c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+		Error:   "Refresh token reuse detected",
+		Message: "The session was revoked, log in again",
 	})
 }
 
-// Refresh handles access token refresh using the refresh token cookie
+// Refresh handles access token refresh using the refresh token cookie. Each refresh rotates
+// the refresh token; presenting a rotated one revokes the whole session.
 func (h *AuthHandler) Refresh(c *gin.Context) {
 	// Get refresh token from cookie
 	refreshToken, err := c.Cookie("refresh_token")
@@ -119,18 +313,21 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 	}
 
 	// Validate refresh token from database
-	tokenData, err := db.DB.GetRefreshToken(refreshToken)
+	tokenData, err := db.DB.GetRefreshToken(auth.HashRefreshToken(refreshToken))
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
 			Error: "Invalid refresh token",
 		})
 		return
 	}
+	if tokenData.RotatedAt != nil {
+		h.refreshTokenReused(c, tokenData)
+		return
+	}
 
 	// Check if token is expired
 	if time.Now().After(tokenData.ExpiresAt) {
-		// Delete expired token
-		db.DB.DeleteRefreshToken(refreshToken)
+		db.DB.DeleteSession(tokenData.SessionID)
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
 			Error: "Refresh token expired",
 		})
@@ -145,21 +342,15 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 		})
 		return
 	}
-
-	// Generate new access token
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, &h.config.JWT)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-			Error: "Failed to generate access token",
+	if user.Disabled {
+		db.DB.DeleteSession(tokenData.SessionID)
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Account disabled",
 		})
 		return
 	}
 
-	// Optionally rotate refresh token for enhanced security
-	// Delete old token
-	db.DB.DeleteRefreshToken(refreshToken)
-
-	// Generate new refresh token
+	// Rotate the refresh token, the old one stays behind marked as rotated
 	newRefreshToken, err := auth.GenerateRefreshToken()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
@@ -167,55 +358,66 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 		})
 		return
 	}
-
-	// Save new refresh token
 	expiresAt := auth.GetRefreshTokenExpiry(&h.config.JWT)
-	if err := db.DB.SaveRefreshToken(user.ID, newRefreshToken, expiresAt); err != nil {
+	rotated, err := db.DB.RotateRefreshToken(tokenData, auth.HashRefreshToken(newRefreshToken), expiresAt, c.ClientIP(), userAgent(c))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to save refresh token",
 		})
 		return
 	}
+	if !rotated {
+		// Another request rotated the same token a moment ago
+		h.refreshTokenReused(c, tokenData)
+		return
+	}
 
-	// Set new refresh token cookie with SameSite=Strict
-	maxAge := int(time.Until(expiresAt).Seconds())
-	c.SetSameSite(http.SameSiteStrictMode)
-	c.SetCookie(
-		"refresh_token",
-		newRefreshToken,
-		maxAge,
-		"/api/v1/auth",
-		"",
-		true,
-		true,
-	)
+	// Generate new access token
+	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, user.Role, tokenData.SessionID, &h.config.JWT)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate access token",
+		})
+		return
+	}
+
+	setRefreshCookie(c, newRefreshToken, expiresAt)
 
 	c.JSON(http.StatusOK, models.LoginResponse{
 		AccessToken: accessToken,
 		ExpiresIn:   h.config.JWT.AccessExpiryMinutes * 60,
-		APIToken:    user.APIToken,
 	})
 }
 
-// Logout invalidates the refresh token
+// Logout ends the session of the refresh token cookie
 func (h *AuthHandler) Logout(c *gin.Context) {
 	refreshToken, err := c.Cookie("refresh_token")
 	if err == nil {
-		// Delete token from database
-		db.DB.DeleteRefreshToken(refreshToken)
+		if tokenData, err := db.DB.GetRefreshToken(auth.HashRefreshToken(refreshToken)); err == nil {
+			// Logout is authenticated by the cookie alone, attribute it to the token's user
+			if user, err := db.DB.GetUserByID(tokenData.UserID); err == nil {
+				c.Set("user_id", user.ID)
+				c.Set("username", user.Username)
+				c.Set("auth_method", models.AuthMethodRefreshToken)
+				recordAudit(c, "auth.logout", "user:"+user.Username, nil, nil)
+			}
+
+			// Revoke the session with all of its refresh tokens
+			db.DB.DeleteSession(tokenData.SessionID)
+		}
 	}
 
 	// Clear the cookie with SameSite=Strict
-	c.SetSameSite(http.SameSiteStrictMode)
-	c.SetCookie(
-		"refresh_token",
-		"",
-		-1,
-		"/api/v1/auth",
-		"",
-		true,
-		true,
-	)
+	clearRefreshCookie(c)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
+
+// Account returns the requesting user, so the panel can show what their role allows
+func (h *AuthHandler) Account(c *gin.Context) {
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
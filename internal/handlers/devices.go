@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/models"
+	"wgeasygo/pkg/wgmanager"
+)
+
+// The self-service portal: users with the devices:own scope see and manage the peers they own,
+// and nothing else. Peers of other users answer 404 as if they did not exist.
+
+// ownPeer loads the peer named by the :ip parameter if the requesting user owns it, writing a
+// response otherwise
+func ownPeer(c *gin.Context) (*models.Peer, bool) {
+	ip := c.Param("ip")
+	if !wgmanager.ValidateIP(ip) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid IP address format",
+		})
+		return nil, false
+	}
+
+	peer, err := db.DB.GetPeerByIP(ip)
+	if err != nil || peer.OwnerID == nil || *peer.OwnerID != c.GetInt64("user_id") {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Device not found",
+		})
+		return nil, false
+	}
+	return peer, true
+}
+
+// RequireOwnPeer lets a request through to a peer handler only for the requesting user's peers
+func (h *PeerHandler) RequireOwnPeer(c *gin.Context) {
+	if _, ok := ownPeer(c); !ok {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// ListDevices returns the requesting user's peers with real-time stats and their device cap
+func (h *PeerHandler) ListDevices(c *gin.Context) {
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+
+	peers, err := db.DB.GetPeersByOwner(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve devices",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.DevicesResponse{
+		Devices:    h.peerResponses(peers),
+		MaxDevices: user.MaxDevices,
+	})
+}
+
+// CreateDevice creates a peer owned by the requesting user, unless they already have as many
+// as their device cap allows. Addresses, expiry and quotas are left to admins.
+func (h *PeerHandler) CreateDevice(c *gin.Context) {
+	var req models.CreateDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	// Counting and creating must not interleave, or parallel requests could pass the cap
+	h.devicesMu.Lock()
+	defer h.devicesMu.Unlock()
+
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	count, err := db.DB.CountPeersByOwner(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to count devices",
+		})
+		return
+	}
+	if count >= user.MaxDevices {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Device limit reached",
+			Message: fmt.Sprintf("You may have at most %d devices; disable one and ask an admin to remove it", user.MaxDevices),
+		})
+		return
+	}
+
+	if resp, ok := h.createPeer(c, &models.CreatePeerRequest{
+		Name:      req.Name,
+		PublicKey: req.PublicKey,
+		OwnerID:   &user.ID,
+	}); ok {
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+// DisableDevice disables one of the requesting user's peers, for example a lost phone. Only
+// an admin or operator can enable it again.
+func (h *PeerHandler) DisableDevice(c *gin.Context) {
+	peer, ok := ownPeer(c)
+	if !ok {
+		return
+	}
+	if !peer.Enabled {
+		c.JSON(http.StatusOK, NewPeerResponse(peer))
+		return
+	}
+
+	if err := h.removeFromInterface(peer); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error:   "Failed to disable device",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	enabled := false
+	updatedPeer, err := db.DB.UpdatePeer(peer.AssignedIP, nil, &enabled)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to disable device",
+		})
+		return
+	}
+
+	resp := NewPeerResponse(updatedPeer)
+	recordAudit(c, "peer.update", peerTarget(peer.ID), NewPeerResponse(peer), resp)
+	h.hub.Publish(events.PeerUpdated, resp)
+	h.hub.Publish(events.PeerDisabled, resp)
+	c.JSON(http.StatusOK, resp)
+}
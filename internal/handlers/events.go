@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/middleware"
+	"wgeasygo/internal/models"
+)
+
+// streamKeepalive is how often an idle stream gets a comment line so proxies keep it open
+const streamKeepalive = 25 * time.Second
+
+type EventsHandler struct {
+	hub     *events.Hub
+	tickets *middleware.StreamTickets
+}
+
+func NewEventsHandler(hub *events.Hub, tickets *middleware.StreamTickets) *EventsHandler {
+	return &EventsHandler{hub: hub, tickets: tickets}
+}
+
+// CreateTicket issues a single-use ticket for opening the event stream
+// The stream URL takes the ticket instead of the caller's token, so no credential ends up in logs
+func (h *EventsHandler) CreateTicket(c *gin.Context) {
+	ticket, err := h.tickets.Issue(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create stream ticket",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":     ticket,
+		"expires_in": int(h.tickets.TTL().Seconds()),
+	})
+}
+
+// StreamEvents pushes peer events to the client as Server-Sent Events until it disconnects
+// Each event is sent with its type as the SSE event name and the full Event as JSON data.
+// The stream ends once the user is disabled or changes role, or its session or API token is revoked.
+func (h *EventsHandler) StreamEvents(c *gin.Context) {
+	ch, unsubscribe := h.hub.Subscribe()
+	defer unsubscribe()
+
+	// Security events name users with their IP addresses, so only those who can see the
+	// lockout list or the audit log get them
+	security := middleware.HasScope(c, models.ScopeUsersWrite) || middleware.HasScope(c, models.ScopeAuditRead)
+
+	// The server's write timeout is meant for ordinary requests, extend it before each write
+	rc := http.NewResponseController(c.Writer)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Disable nginx response buffering
+	c.Status(http.StatusOK)
+	rc.SetWriteDeadline(time.Now().Add(streamKeepalive * 2))
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			if !middleware.StillAuthorized(c) {
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(streamKeepalive * 2))
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if event.IsSecurity() && !security {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			rc.SetWriteDeadline(time.Now().Add(streamKeepalive * 2))
+			if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/models"
+	"wgeasygo/pkg/wgmanager"
+)
+
+func groupTarget(id int64) string {
+	return fmt.Sprintf("group:%d", id)
+}
+
+// groupFromParam loads the peer group named by the :id parameter, writing a response if that fails
+func groupFromParam(c *gin.Context) (*models.PeerGroup, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid group ID",
+		})
+		return nil, false
+	}
+
+	group, err := db.DB.GetPeerGroup(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Group not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get group",
+		})
+		return nil, false
+	}
+	return group, true
+}
+
+// savePeerGroup validates a new or changed group and stores it, writing the error response
+// if either fails
+func savePeerGroup(c *gin.Context, group *models.PeerGroup) bool {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Name must not be empty",
+		})
+		return false
+	}
+	if err := wgmanager.ValidateClientSettings(&group.ClientSettings); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid client settings",
+			Message: err.Error(),
+		})
+		return false
+	}
+
+	var err error
+	if group.ID == 0 {
+		var created *models.PeerGroup
+		if created, err = db.DB.CreatePeerGroup(group); err == nil {
+			*group = *created
+		}
+	} else {
+		err = db.DB.UpdatePeerGroup(group)
+	}
+	if errors.Is(err, db.ErrGroupNameConflict) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Group name already in use",
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to save group",
+		})
+		return false
+	}
+	return true
+}
+
+// ListGroups returns all peer groups with how many peers each has
+func (h *PeerHandler) ListGroups(c *gin.Context) {
+	groups, err := db.DB.GetPeerGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve groups",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// GetGroup returns a peer group
+func (h *PeerHandler) GetGroup(c *gin.Context) {
+	if group, ok := groupFromParam(c); ok {
+		c.JSON(http.StatusOK, group)
+	}
+}
+
+// ListGroupPeers returns a group's peers with real-time stats
+func (h *PeerHandler) ListGroupPeers(c *gin.Context) {
+	group, ok := groupFromParam(c)
+	if !ok {
+		return
+	}
+
+	peers, err := db.DB.GetPeersByGroup(group.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve peers",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, h.peerResponses(peers))
+}
+
+// CreateGroup adds a peer group; its peers are assigned with group_id on the peers
+func (h *PeerHandler) CreateGroup(c *gin.Context) {
+	var req models.CreatePeerGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid request body",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	group := &models.PeerGroup{
+		Name:           req.Name,
+		Description:    req.Description,
+		ClientSettings: req.ClientSettings,
+	}
+	if !savePeerGroup(c, group) {
+		return
+	}
+
+	recordAudit(c, "group.create", groupTarget(group.ID), nil, group)
+	c.JSON(http.StatusCreated, group)
+}
+
+// UpdateGroup changes a group's name, description or client settings. Peers pick up new
+// settings the next time their config is downloaded.
+func (h *PeerHandler) UpdateGroup(c *gin.Context) {
+	var req models.UpdatePeerGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	group, ok := groupFromParam(c)
+	if !ok {
+		return
+	}
+	before := *group
+
+	if req.Name != nil {
+		group.Name = *req.Name
+	}
+	if req.Description != nil {
+		group.Description = *req.Description
+	}
+	if req.DNS != nil {
+		group.DNS = *req.DNS
+	}
+	if req.AllowedIPs != nil {
+		group.AllowedIPs = *req.AllowedIPs
+	}
+	if req.MTU != nil {
+		group.MTU = *req.MTU
+	}
+	if req.PersistentKeepalive != nil {
+		group.PersistentKeepalive = req.PersistentKeepalive
+		if *req.PersistentKeepalive == -1 {
+			group.PersistentKeepalive = nil
+		}
+	}
+	if !savePeerGroup(c, group) {
+		return
+	}
+
+	recordAudit(c, "group.update", groupTarget(group.ID), before, group)
+	c.JSON(http.StatusOK, group)
+}
+
+// DeleteGroup removes a group; its peers are kept and use the server's client settings again
+func (h *PeerHandler) DeleteGroup(c *gin.Context) {
+	group, ok := groupFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.DeletePeerGroup(group.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete group",
+		})
+		return
+	}
+
+	recordAudit(c, "group.delete", groupTarget(group.ID), group, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted"})
+}
+
+// EnableGroup puts the peers disabled with their group back on the interface. Peers
+// disabled on their own, or expired or over quota in the meantime, stay disabled.
+func (h *PeerHandler) EnableGroup(c *gin.Context) {
+	h.setGroupEnabled(c, true)
+}
+
+// DisableGroup takes all of a group's enabled peers off the interface
+func (h *PeerHandler) DisableGroup(c *gin.Context) {
+	h.setGroupEnabled(c, false)
+}
+
+func (h *PeerHandler) setGroupEnabled(c *gin.Context, enabled bool) {
+	group, ok := groupFromParam(c)
+	if !ok {
+		return
+	}
+	peers, err := db.DB.GetPeersByGroup(group.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve peers",
+		})
+		return
+	}
+
+	response := models.PeerGroupActionResponse{Group: *group, Changed: []models.PeerResponse{}}
+	for _, peer := range peers {
+		if peer.Enabled == enabled {
+			continue
+		}
+		if err := h.setGroupPeerEnabled(&peer, enabled); err != nil {
+			response.Skipped = append(response.Skipped, models.SkippedPeer{
+				ID:         peer.ID,
+				Name:       peer.Name,
+				AssignedIP: peer.AssignedIP,
+				Reason:     err.Error(),
+			})
+			continue
+		}
+
+		peer.Enabled, peer.DisabledReason = enabled, ""
+		if !enabled {
+			peer.DisabledReason = models.DisabledReasonGroup
+		}
+		resp := NewPeerResponse(&peer)
+		response.Changed = append(response.Changed, resp)
+		h.hub.Publish(events.PeerUpdated, resp)
+		if enabled {
+			h.hub.Publish(events.PeerEnabled, resp)
+		} else {
+			h.hub.Publish(events.PeerDisabled, resp)
+		}
+	}
+
+	action := "group.disable"
+	if enabled {
+		action = "group.enable"
+	}
+	recordAudit(c, action, groupTarget(group.ID), nil, response)
+	c.JSON(http.StatusOK, response)
+}
+
+// setGroupPeerEnabled enables or disables one peer of a group, on the interface and in the
+// database. The error says why the peer was left alone.
+func (h *PeerHandler) setGroupPeerEnabled(peer *models.Peer, enabled bool) error {
+	if !enabled {
+		if err := h.removeFromInterface(peer); err != nil {
+			return fmt.Errorf("failed to remove from WireGuard: %w", err)
+		}
+		if err := db.DB.DisablePeer(peer.ID, models.DisabledReasonGroup); err != nil {
+			return fmt.Errorf("failed to disable: %w", err)
+		}
+		return nil
+	}
+
+	switch {
+	case peer.DisabledReason != models.DisabledReasonGroup:
+		return errors.New("disabled on its own, enable it individually")
+	case peer.IsExpired():
+		return errors.New("expired, set a new expiry date to enable it")
+	case peer.QuotaExceeded():
+		return errors.New("quota exceeded, raise or remove the quota to enable it")
+	}
+	if err := h.wgManager.AddPeer(peer); err != nil {
+		return fmt.Errorf("failed to add to WireGuard: %w", err)
+	}
+	if err := db.DB.EnablePeer(peer.ID); err != nil {
+		h.removeFromInterface(peer)
+		return fmt.Errorf("failed to enable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/models"
+	"wgeasygo/pkg/metrics"
+)
+
+// loginFailureReset is how long after the last failed login the count starts over
+const loginFailureReset = 24 * time.Hour
+
+// loginDelay returns how long logins for an account are refused after its nth failure in a
+// row: nothing at first, then a delay doubling from one second, then the full lockout
+func loginDelay(cfg *config.SecurityConfig, failures int) time.Duration {
+	lockout := time.Duration(cfg.LockoutMinutes) * time.Minute
+	if cfg.LockoutThreshold > 0 && failures >= cfg.LockoutThreshold {
+		return lockout
+	}
+	if failures < cfg.LoginDelayAfter {
+		return 0
+	}
+	exponent := failures - cfg.LoginDelayAfter
+	if exponent > 16 {
+		exponent = 16
+	}
+	delay := time.Duration(1<<exponent) * time.Second
+	if lockout > 0 && delay > lockout {
+		delay = lockout
+	}
+	return delay
+}
+
+// checkLoginLockout refuses a login attempt while the username is locked, writing a response.
+// The same answer is given for usernames that do not exist.
+func (h *AuthHandler) checkLoginLockout(c *gin.Context, username string) bool {
+	lockout, err := db.DB.GetLoginLockout(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to check login attempts",
+		})
+		return false
+	}
+
+	now := time.Now()
+	if !lockout.Locked(now) {
+		return true
+	}
+	retryAfter := int(lockout.LockedUntil.Sub(now).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+		Error:   "Too many failed login attempts",
+		Message: fmt.Sprintf("Try again in %d seconds", retryAfter),
+	})
+	return false
+}
+
+// recordLoginLockout counts a failed login for a username and delays or locks further
+// attempts. Starting a lockout is audited and published.
+func (h *AuthHandler) recordLoginLockout(c *gin.Context, username string) {
+	now := time.Now()
+	failures, err := db.DB.RecordLoginFailure(username, c.ClientIP(), now, loginFailureReset)
+	if err != nil {
+		log.Printf("Warning: Failed to record failed login for %q: %v", username, err)
+		return
+	}
+
+	delay := loginDelay(&h.config.Security, failures)
+	if delay == 0 {
+		return
+	}
+	if err := db.DB.LockLogin(username, now.Add(delay)); err != nil {
+		log.Printf("Warning: Failed to delay logins for %q: %v", username, err)
+		return
+	}
+
+	if h.config.Security.LockoutThreshold <= 0 || failures < h.config.Security.LockoutThreshold {
+		return
+	}
+	lockout, err := db.DB.GetLoginLockout(username)
+	if err != nil {
+		log.Printf("Warning: Failed to read lockout of %q: %v", username, err)
+		return
+	}
+	metrics.LoginLockouts.Inc()
+	recordAudit(c, "auth.lockout", "user:"+username, nil, lockout)
+	h.hub.Publish(events.AccountLocked, events.AccountLockout{
+		Username:    username,
+		Failures:    failures,
+		LockedUntil: *lockout.LockedUntil,
+		SourceIPs:   lockout.SourceIPs,
+	})
+}
+
+// ListLockouts returns the usernames with recent failed logins, whether or not they exist,
+// with the addresses the attempts came from
+func (h *UserHandler) ListLockouts(c *gin.Context) {
+	lockouts, err := db.DB.GetLoginLockouts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve lockouts",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
+
+// Unlock clears a username's failed logins so it can log in right away
+func (h *UserHandler) Unlock(c *gin.Context) {
+	username := c.Param("username")
+	lockout, err := db.DB.GetLoginLockout(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "No failed logins for this username",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get lockout",
+		})
+		return
+	}
+
+	if err := db.DB.ClearLoginLockout(username); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to unlock",
+		})
+		return
+	}
+
+	recordAudit(c, "auth.unlock", "user:"+username, lockout, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Unlocked"})
+}
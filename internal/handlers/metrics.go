@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/pkg/ipam"
+	"wgeasygo/pkg/metrics"
+	"wgeasygo/pkg/tailscale"
+	"wgeasygo/pkg/wgmanager"
+)
+
+type MetricsHandler struct {
+	wgManager *wgmanager.WGManager
+	pools     *ipam.Pools
+	tailscale *tailscale.Manager
+}
+
+func NewMetricsHandler(wg *wgmanager.WGManager, pools *ipam.Pools) *MetricsHandler {
+	return &MetricsHandler{
+		wgManager: wg,
+		pools:     pools,
+		tailscale: tailscale.NewManager(),
+	}
+}
+
+// GetMetrics serves metrics in the Prometheus text format
+// Peer, pool and Tailscale metrics are collected at scrape time; sources that fail are left out
+func (h *MetricsHandler) GetMetrics(c *gin.Context) {
+	var buf bytes.Buffer
+
+	peers, err := db.DB.GetAllPeers()
+	if err == nil {
+		stats, _ := h.wgManager.GetPeerStats() // Without stats only peer counts are exported
+
+		enabled := 0
+		for _, peer := range peers {
+			if peer.Enabled {
+				enabled++
+			}
+		}
+		metrics.WriteHeader(&buf, "wgeasygo_peers", "Managed peers by state", "gauge")
+		metrics.WriteSample(&buf, "wgeasygo_peers", []string{"state", "enabled"}, float64(enabled))
+		metrics.WriteSample(&buf, "wgeasygo_peers", []string{"state", "disabled"}, float64(len(peers)-enabled))
+
+		if stats != nil {
+			families := []struct {
+				name, help, kind string
+				value            func(*wgmanager.PeerStats) float64
+			}{
+				{"wgeasygo_peer_receive_bytes_total", "Bytes received from the peer since it was added to the interface", "counter",
+					func(s *wgmanager.PeerStats) float64 { return float64(s.TransferRx) }},
+				{"wgeasygo_peer_transmit_bytes_total", "Bytes sent to the peer since it was added to the interface", "counter",
+					func(s *wgmanager.PeerStats) float64 { return float64(s.TransferTx) }},
+				{"wgeasygo_peer_latest_handshake_seconds", "Unix time of the peer's latest handshake, 0 if none", "gauge",
+					func(s *wgmanager.PeerStats) float64 {
+						if s.LatestHandshake.IsZero() {
+							return 0
+						}
+						return float64(s.LatestHandshake.Unix())
+					}},
+				{"wgeasygo_peer_online", "Whether the peer had a handshake in the last 3 minutes", "gauge",
+					func(s *wgmanager.PeerStats) float64 {
+						if s.IsOnline {
+							return 1
+						}
+						return 0
+					}},
+			}
+			for _, family := range families {
+				metrics.WriteHeader(&buf, family.name, family.help, family.kind)
+				for _, peer := range peers {
+					if peerStats, ok := wgmanager.LookupPeerStats(stats, &peer); ok {
+						labels := []string{"peer", peer.Name, "ip", peer.AssignedIP}
+						metrics.WriteSample(&buf, family.name, labels, family.value(peerStats))
+					}
+				}
+			}
+		}
+
+		// Every peer holds one address of each pool it has an address in
+		usedV4, usedV6 := len(peers), 0
+		for _, peer := range peers {
+			if peer.AssignedIPv6 != "" {
+				usedV6++
+			}
+		}
+		metrics.WriteHeader(&buf, "wgeasygo_ip_pool_size", "Assignable addresses in the peer address pool", "gauge")
+		metrics.WriteSample(&buf, "wgeasygo_ip_pool_size", []string{"family", "ipv4", "subnet", h.pools.V4.Prefix().String()}, h.pools.V4.Size())
+		if h.pools.V6 != nil {
+			metrics.WriteSample(&buf, "wgeasygo_ip_pool_size", []string{"family", "ipv6", "subnet", h.pools.V6.Prefix().String()}, h.pools.V6.Size())
+		}
+		metrics.WriteHeader(&buf, "wgeasygo_ip_pool_used", "Addresses assigned to peers", "gauge")
+		metrics.WriteSample(&buf, "wgeasygo_ip_pool_used", []string{"family", "ipv4", "subnet", h.pools.V4.Prefix().String()}, float64(usedV4))
+		if h.pools.V6 != nil {
+			metrics.WriteSample(&buf, "wgeasygo_ip_pool_used", []string{"family", "ipv6", "subnet", h.pools.V6.Prefix().String()}, float64(usedV6))
+		}
+	}
+
+	if status, err := h.tailscale.GetStatus(); err == nil {
+		connected := 0.0
+		if status.Connected {
+			connected = 1
+		}
+		metrics.WriteHeader(&buf, "wgeasygo_tailscale_connected", "Whether Tailscale is connected, labelled with its backend state", "gauge")
+		metrics.WriteSample(&buf, "wgeasygo_tailscale_connected", []string{"backend_state", status.BackendState}, connected)
+	}
+
+	metrics.HTTPRequests.Write(&buf)
+	metrics.HTTPDuration.Write(&buf)
+	metrics.LoginFailures.Write(&buf)
+	metrics.LoginLockouts.Write(&buf)
+
+	c.Header("Content-Length", strconv.Itoa(buf.Len()))
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
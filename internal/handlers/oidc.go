@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/auth"
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+	"wgeasygo/internal/oidc"
+)
+
+// An OIDC login must come back from the identity provider within the TTL
+const (
+	oidcLoginTTL       = 10 * time.Minute
+	maxPendingOIDC     = 1000 // Bounds memory, expired logins are dropped first
+	oidcStateCookie    = "oidc_state"
+	oidcCookiePath     = "/api/v1/auth/oidc"
+	oidcLoginErrorPath = "/login?sso_error="
+)
+
+type pendingOIDCLogin struct {
+	nonce     string
+	verifier  string
+	expiresAt time.Time
+}
+
+// OIDCHandler signs users in through the identity provider. Logins end like password logins,
+// with a session and its refresh token cookie; the browser is then sent to the panel, which
+// refreshes to get an access token, so no token ever appears in a URL.
+type OIDCHandler struct {
+	auth     *AuthHandler
+	config   *config.OIDCConfig
+	provider *oidc.Provider
+	// Device cap of users created at their first login
+	maxDevices int
+
+	mu      sync.Mutex
+	pending map[string]*pendingOIDCLogin // By state
+}
+
+func NewOIDCHandler(cfg *config.Config, authHandler *AuthHandler) *OIDCHandler {
+	return &OIDCHandler{
+		auth:       authHandler,
+		config:     &cfg.OIDC,
+		provider:   oidc.NewProvider(&cfg.OIDC),
+		maxDevices: cfg.Portal.DefaultMaxDevices,
+		pending:    make(map[string]*pendingOIDCLogin),
+	}
+}
+
+// Errors of mapping an identity to a panel user, reported to the login page by code
+var (
+	errOIDCUnknownUser = errors.New("no panel user for this identity")
+	errOIDCConflict    = errors.New("username belongs to another panel user")
+)
+
+// Info tells the login page to offer single sign-on and what to call it
+func (h *OIDCHandler) Info(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "name": h.config.Name})
+}
+
+func (h *OIDCHandler) setStateCookie(c *gin.Context, state string, maxAge int) {
+	// Lax, the identity provider sends the browser back with a cross-site navigation
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, oidcCookiePath, "", true, true)
+}
+
+// loginError sends the browser back to the login page with a short error code
+func loginError(c *gin.Context, code string) {
+	c.Redirect(http.StatusFound, oidcLoginErrorPath+url.QueryEscape(code))
+}
+
+// Login starts a login at the identity provider. The state is also kept in a cookie, so only
+// the browser that started a login can finish it.
+func (h *OIDCHandler) Login(c *gin.Context) {
+	state, err := auth.GenerateRefreshToken()
+	if err != nil {
+		loginError(c, "failed")
+		return
+	}
+	nonce, err := auth.GenerateRefreshToken()
+	if err != nil {
+		loginError(c, "failed")
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		loginError(c, "failed")
+		return
+	}
+
+	target, err := h.provider.AuthCodeURL(c.Request.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("Warning: OIDC login unavailable: %v", err)
+		loginError(c, "unavailable")
+		return
+	}
+
+	h.mu.Lock()
+	now := time.Now()
+	for key, login := range h.pending {
+		if now.After(login.expiresAt) {
+			delete(h.pending, key)
+		}
+	}
+	if len(h.pending) >= maxPendingOIDC {
+		for key := range h.pending {
+			delete(h.pending, key)
+			break
+		}
+	}
+	h.pending[state] = &pendingOIDCLogin{nonce: nonce, verifier: verifier, expiresAt: now.Add(oidcLoginTTL)}
+	h.mu.Unlock()
+
+	h.setStateCookie(c, state, int(oidcLoginTTL/time.Second))
+	c.Redirect(http.StatusFound, target)
+}
+
+// takePending removes and returns the login started with state, if it has not expired
+func (h *OIDCHandler) takePending(state string) (*pendingOIDCLogin, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	login, ok := h.pending[state]
+	delete(h.pending, state)
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, false
+	}
+	return login, true
+}
+
+// Callback finishes a login when the identity provider sends the browser back
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	cookieState, _ := c.Cookie(oidcStateCookie)
+	h.setStateCookie(c, "", -1)
+
+	if c.Query("error") != "" {
+		loginError(c, "denied")
+		return
+	}
+	state := c.Query("state")
+	if state == "" || cookieState != state {
+		loginError(c, "state")
+		return
+	}
+	login, ok := h.takePending(state)
+	if !ok {
+		loginError(c, "expired")
+		return
+	}
+
+	idToken, err := h.provider.Exchange(c.Request.Context(), c.Query("code"), login.verifier)
+	if err != nil {
+		log.Printf("Warning: OIDC code exchange failed: %v", err)
+		loginError(c, "failed")
+		return
+	}
+	identity, err := h.provider.Verify(c.Request.Context(), idToken, login.nonce)
+	if err != nil {
+		log.Printf("Warning: OIDC login rejected: %v", err)
+		loginError(c, "failed")
+		return
+	}
+
+	c.Set("auth_method", models.AuthMethodOIDC)
+	user, err := h.panelUser(c, identity)
+	if err != nil {
+		c.Set("username", identity.Username)
+		recordAudit(c, "auth.login_failed", "user:"+identity.Username, nil, gin.H{"reason": err.Error()})
+		switch {
+		case errors.Is(err, oidc.ErrNoRole):
+			loginError(c, "forbidden")
+		case errors.Is(err, errOIDCUnknownUser):
+			loginError(c, "unknown_user")
+		case errors.Is(err, errOIDCConflict):
+			loginError(c, "conflict")
+		default:
+			log.Printf("Warning: OIDC login of %q failed: %v", identity.Username, err)
+			loginError(c, "failed")
+		}
+		return
+	}
+	if user.Disabled {
+		loginError(c, "disabled")
+		return
+	}
+
+	if _, ok := h.auth.createSession(c, user, models.AuthMethodOIDC); !ok {
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// panelUser finds or creates the panel user for an identity and gives it the role its groups
+// map to, so role changes at the identity provider apply at the next login
+func (h *OIDCHandler) panelUser(c *gin.Context, identity *oidc.Identity) (*models.User, error) {
+	role, err := h.provider.Role(identity.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.DB.GetUserByOIDCSubject(identity.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = h.linkUser(c, identity, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != role {
+		before := *user
+		err := db.DB.UpdateUserAccess(user.ID, role, user.Disabled)
+		if errors.Is(err, db.ErrLastAdmin) {
+			// Keep the last admin, the panel would be unmanageable otherwise
+			log.Printf("Warning: Not demoting %q, the last enabled admin, to %s as the identity provider's groups say", user.Username, role)
+			return user, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		user.Role = role
+		recordAudit(c, "user.update", userTarget(user.ID), before, user)
+	}
+	return user, nil
+}
+
+// linkUser links an identity seen for the first time to an existing user with the same name,
+// if configured, or creates a user for it
+func (h *OIDCHandler) linkUser(c *gin.Context, identity *oidc.Identity, role string) (*models.User, error) {
+	username := strings.TrimSpace(identity.Username)
+	if len(username) > 64 {
+		username = username[:64]
+	}
+
+	if h.config.LinkByUsername {
+		user, err := db.DB.GetUserByUsername(username)
+		if err == nil {
+			linked, err := db.DB.LinkOIDCSubject(user.ID, identity.Subject)
+			if err != nil {
+				return nil, err
+			}
+			if !linked {
+				return nil, errOIDCConflict
+			}
+			user.SSO = true
+			return user, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if !h.config.AutoCreate {
+		return nil, errOIDCUnknownUser
+	}
+	user, err := db.DB.CreateSSOUser(username, role, identity.Subject)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		return nil, errOIDCConflict
+	}
+	if err == nil {
+		err = db.DB.SetUserMaxDevices(user.ID, h.maxDevices)
+		user.MaxDevices = h.maxDevices
+	}
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(c, "user.create", userTarget(user.ID), nil, user)
+	return user, nil
+}
@@ -1,26 +1,178 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/skip2/go-qrcode"
 	"wgeasygo/internal/config"
 	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
 	"wgeasygo/internal/models"
+	"wgeasygo/pkg/ipam"
 	"wgeasygo/pkg/wgmanager"
 )
 
 type PeerHandler struct {
 	config    *config.Config
 	wgManager *wgmanager.WGManager
+	pools     *ipam.Pools
+	hub       *events.Hub
+
+	devicesMu sync.Mutex // Serializes self-service device requests, see CreateDevice
 }
 
-func NewPeerHandler(cfg *config.Config, wg *wgmanager.WGManager) *PeerHandler {
+func NewPeerHandler(cfg *config.Config, wg *wgmanager.WGManager, pools *ipam.Pools, hub *events.Hub) *PeerHandler {
 	return &PeerHandler{
 		config:    cfg,
 		wgManager: wg,
+		pools:     pools,
+		hub:       hub,
+	}
+}
+
+// NewPeerResponse converts a stored peer to its API representation (without private key)
+func NewPeerResponse(peer *models.Peer) models.PeerResponse {
+	resp := models.PeerResponse{
+		ID:              peer.ID,
+		Name:            peer.Name,
+		PublicKey:       peer.PublicKey,
+		AssignedIP:      peer.AssignedIP,
+		AssignedIPv6:    peer.AssignedIPv6,
+		HasPrivateKey:   peer.HasPrivateKey,
+		HasPresharedKey: peer.PresharedKey != "",
+		Enabled:         peer.Enabled,
+		DisabledReason:  peer.DisabledReason,
+		ExpiresAt:       peer.ExpiresAt,
+		Expired:         peer.IsExpired(),
+		KeyGraceUntil:   peer.KeyGraceUntil,
+		CreatedAt:       peer.CreatedAt,
+		UsageRx:         peer.UsageRx,
+		UsageTx:         peer.UsageTx,
+		MonthlyUsage:    peer.CurrentMonthlyUsage(),
+		MonthlyQuota:    peer.MonthlyQuota,
+		TotalQuota:      peer.TotalQuota,
+		OwnerID:         peer.OwnerID,
+		GroupID:         peer.GroupID,
+		Overrides:       peer.Overrides,
+	}
+	if peer.MonthlyQuota > 0 {
+		remaining := max(peer.MonthlyQuota-resp.MonthlyUsage, 0)
+		resp.MonthlyRemaining = &remaining
+	}
+	if peer.TotalQuota > 0 {
+		remaining := max(peer.TotalQuota-peer.UsageRx-peer.UsageTx, 0)
+		resp.TotalRemaining = &remaining
+	}
+	return resp
+}
+
+// requestedAddress validates an optional manually specified address
+// An empty request yields an empty result so the caller can fall back to automatic allocation
+func (h *PeerHandler) requestedAddress(pool *ipam.Pool, requested string) (string, error) {
+	if requested == "" {
+		return "", nil
+	}
+	return parseAssignableAddress(pool, requested)
+}
+
+// parseAssignableAddress validates an address against the pool and returns it in canonical form
+func parseAssignableAddress(pool *ipam.Pool, requested string) (string, error) {
+	if pool == nil {
+		return "", fmt.Errorf("no subnet configured for %s", requested)
+	}
+
+	addr, err := netip.ParseAddr(requested)
+	if err != nil || addr.Zone() != "" {
+		return "", fmt.Errorf("%s is not a valid IP address", requested)
+	}
+	addr = addr.Unmap()
+	if !pool.Assignable(addr) {
+		return "", fmt.Errorf("%s is outside %s or reserved", addr, pool.Prefix())
+	}
+
+	return addr.String(), nil
+}
+
+// validateExpiry rejects expiry dates that have already passed and normalizes to UTC
+// so stored timestamps compare consistently
+func validateExpiry(expiresAt *time.Time) (*time.Time, error) {
+	if expiresAt == nil {
+		return nil, nil
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	utc := expiresAt.UTC()
+	return &utc, nil
+}
+
+// respondAllocationError maps an exhausted address pool to 409 and anything else to 500
+func respondAllocationError(c *gin.Context, message string, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ipam.ErrPoolExhausted) {
+		status = http.StatusConflict
+	}
+	c.JSON(status, models.ErrorResponse{
+		Error:   message,
+		Message: err.Error(),
+	})
+}
+
+// validOwner checks that the user a peer is given to exists, writing a response if not
+func validOwner(c *gin.Context, ownerID int64) bool {
+	_, err := db.DB.GetUserByID(ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Owner not found",
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get owner",
+		})
+		return false
 	}
+	return true
+}
+
+// validGroup checks that the group a peer is put in exists, writing a response if not
+func validGroup(c *gin.Context, groupID int64) bool {
+	_, err := db.DB.GetPeerGroup(groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Group not found",
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get group",
+		})
+		return false
+	}
+	return true
+}
+
+// validOverrides validates and normalizes a peer's client setting overrides, writing a
+// response if they are invalid
+func validOverrides(c *gin.Context, overrides *models.ClientOverrides) bool {
+	if err := wgmanager.ValidateClientOverrides(overrides); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid client settings",
+			Message: err.Error(),
+		})
+		return false
+	}
+	return true
 }
 
 // CreatePeer creates a new WireGuard peer
@@ -32,63 +184,163 @@ func (h *PeerHandler) CreatePeer(c *gin.Context) {
 		})
 		return
 	}
+	if req.OwnerID != nil && !validOwner(c, *req.OwnerID) {
+		return
+	}
+	if req.GroupID != nil && !validGroup(c, *req.GroupID) {
+		return
+	}
+
+	if resp, ok := h.createPeer(c, &req); ok {
+		c.JSON(http.StatusCreated, resp)
+	}
+}
 
-	// Generate key pair
-	privateKey, publicKey, err := wgmanager.GenerateKeyPair()
+// createPeer generates keys and addresses for a peer as requested, stores it and adds it to
+// the interface. On failure a response has been written.
+func (h *PeerHandler) createPeer(c *gin.Context, req *models.CreatePeerRequest) (models.PeerResponse, bool) {
+	expiresAt, err := validateExpiry(req.ExpiresAt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-			Error: "Failed to generate key pair",
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid expiry date",
+			Message: err.Error(),
 		})
-		return
+		return models.PeerResponse{}, false
+	}
+	if req.MonthlyQuota < 0 || req.TotalQuota < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Quotas must not be negative",
+		})
+		return models.PeerResponse{}, false
+	}
+	var overrides models.ClientOverrides
+	if req.Overrides != nil {
+		overrides = *req.Overrides
+		if !validOverrides(c, &overrides) {
+			return models.PeerResponse{}, false
+		}
 	}
 
-	// Get next available IP
-	assignedIP, err := db.DB.GetNextAvailableIP(h.config.WireGuard.Subnet)
+	// Use the client's public key if given, otherwise generate a key pair
+	privateKey, publicKey := "", req.PublicKey
+	if publicKey != "" {
+		if !wgmanager.ValidatePublicKey(publicKey) {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid public key format",
+			})
+			return models.PeerResponse{}, false
+		}
+	} else {
+		privateKey, publicKey, err = wgmanager.GenerateKeyPair()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to generate key pair",
+			})
+			return models.PeerResponse{}, false
+		}
+	}
+
+	// Generate a preshared key if requested (or enabled by default in config)
+	presharedKey := ""
+	if (req.PresharedKey == nil && h.config.WireGuard.PresharedKeys) || (req.PresharedKey != nil && *req.PresharedKey) {
+		var err error
+		presharedKey, err = wgmanager.GeneratePresharedKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to generate preshared key",
+			})
+			return models.PeerResponse{}, false
+		}
+	}
+
+	// Use the requested static IP or get next available IP
+	assignedIP, err := h.requestedAddress(h.pools.V4, req.AssignedIP)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-			Error:   "Failed to assign IP address",
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid IP address",
 			Message: err.Error(),
 		})
-		return
+		return models.PeerResponse{}, false
+	}
+	if assignedIP == "" {
+		assignedIP, err = db.DB.GetNextAvailableIP(h.pools.V4)
+		if err != nil {
+			respondAllocationError(c, "Failed to assign IP address", err)
+			return models.PeerResponse{}, false
+		}
+	}
+
+	// Same for IPv6 when dual-stack is enabled
+	assignedIPv6, err := h.requestedAddress(h.pools.V6, req.AssignedIPv6)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid IPv6 address",
+			Message: err.Error(),
+		})
+		return models.PeerResponse{}, false
+	}
+	if assignedIPv6 == "" && h.pools.V6 != nil {
+		assignedIPv6, err = db.DB.GetNextAvailableIP(h.pools.V6)
+		if err != nil {
+			respondAllocationError(c, "Failed to assign IPv6 address", err)
+			return models.PeerResponse{}, false
+		}
 	}
 
 	// Create peer in database
 	peer := &models.Peer{
-		Name:       req.Name,
-		PublicKey:  publicKey,
-		PrivateKey: privateKey,
-		AssignedIP: assignedIP,
-		Enabled:    true,
+		Name:          req.Name,
+		PublicKey:     publicKey,
+		PrivateKey:    privateKey,
+		HasPrivateKey: privateKey != "",
+		PresharedKey:  presharedKey,
+		AssignedIP:    assignedIP,
+		AssignedIPv6:  assignedIPv6,
+		Enabled:       true,
+		ExpiresAt:     expiresAt,
+		MonthlyQuota:  req.MonthlyQuota,
+		TotalQuota:    req.TotalQuota,
+		OwnerID:       req.OwnerID,
+		GroupID:       req.GroupID,
+		Overrides:     overrides,
 	}
 
 	createdPeer, err := db.DB.CreatePeer(peer)
+	if errors.Is(err, db.ErrIPConflict) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "IP address already in use",
+		})
+		return models.PeerResponse{}, false
+	}
+	if errors.Is(err, db.ErrPublicKeyConflict) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Public key already in use",
+		})
+		return models.PeerResponse{}, false
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error:   "Failed to create peer",
 			Message: err.Error(),
 		})
-		return
+		return models.PeerResponse{}, false
 	}
 
 	// Add peer to WireGuard interface
-	if err := h.wgManager.AddPeer(publicKey, assignedIP); err != nil {
+	if err := h.wgManager.AddPeer(createdPeer); err != nil {
 		// Rollback database entry on failure
 		db.DB.DeletePeer(assignedIP)
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error:   "Failed to add peer to WireGuard",
 			Message: err.Error(),
 		})
-		return
+		return models.PeerResponse{}, false
 	}
 
-	c.JSON(http.StatusCreated, models.PeerResponse{
-		ID:         createdPeer.ID,
-		Name:       createdPeer.Name,
-		PublicKey:  createdPeer.PublicKey,
-		AssignedIP: createdPeer.AssignedIP,
-		Enabled:    createdPeer.Enabled,
-		CreatedAt:  createdPeer.CreatedAt,
-	})
+	resp := NewPeerResponse(createdPeer)
+	recordAudit(c, "peer.create", peerTarget(createdPeer.ID), nil, resp)
+	h.hub.Publish(events.PeerCreated, resp)
+	return resp, true
 }
 
 // ListPeers returns all managed peers with real-time stats
@@ -101,52 +353,38 @@ func (h *PeerHandler) ListPeers(c *gin.Context) {
 		return
 	}
 
+	c.JSON(http.StatusOK, h.peerResponses(peers))
+}
+
+// peerResponses converts stored peers to their API representation with real-time stats
+func (h *PeerHandler) peerResponses(peers []models.Peer) []models.PeerResponse {
 	// Get real-time stats from WireGuard
 	stats, _ := h.wgManager.GetPeerStats() // Ignore error, stats are optional
 
-	// Check if logging is enabled
-	loggingEnabled := false
-	if logSetting, _ := db.DB.GetSetting("logging_enabled"); logSetting == "true" {
-		loggingEnabled = true
-	}
-
 	// Convert to response format (without private keys)
 	// Pre-allocate slice to avoid repeated allocations
 	response := make([]models.PeerResponse, 0, len(peers))
 	for _, peer := range peers {
-		resp := models.PeerResponse{
-			ID:         peer.ID,
-			Name:       peer.Name,
-			PublicKey:  peer.PublicKey,
-			AssignedIP: peer.AssignedIP,
-			Enabled:    peer.Enabled,
-			CreatedAt:  peer.CreatedAt,
-		}
+		resp := NewPeerResponse(&peer)
 
 		// Add real-time stats if available
 		if stats != nil {
-			if peerStats, ok := stats[peer.PublicKey]; ok {
+			if peerStats, ok := wgmanager.LookupPeerStats(stats, &peer); ok {
 				resp.IsOnline = peerStats.IsOnline
 				resp.LatestHandshake = peerStats.LatestHandshake
 				resp.TransferRx = peerStats.TransferRx
 				resp.TransferTx = peerStats.TransferTx
 				resp.Endpoint = peerStats.Endpoint
-
-				// Log connection if enabled and peer is online with endpoint
-				if loggingEnabled && peerStats.IsOnline && peerStats.Endpoint != "" {
-					// AddConnectionLog already handles duplicate prevention
-					_ = db.DB.AddConnectionLog(peer.ID, peerStats.Endpoint)
-				}
 			}
 		}
 
 		response = append(response, resp)
 	}
-
-	c.JSON(http.StatusOK, response)
+	return response
 }
 
-// UpdatePeer updates a peer's name or enabled status
+// UpdatePeer updates a peer's name, enabled status, addresses, expiry date, quotas, owner, group
+// or client setting overrides
 func (h *PeerHandler) UpdatePeer(c *gin.Context) {
 	ip := c.Param("ip")
 	if !wgmanager.ValidateIP(ip) {
@@ -173,46 +411,204 @@ func (h *PeerHandler) UpdatePeer(c *gin.Context) {
 		return
 	}
 
-	// Handle enable/disable in WireGuard
-	if req.Enabled != nil {
-		if *req.Enabled && !peer.Enabled {
-			// Enable: add peer back to WireGuard
-			if err := h.wgManager.AddPeer(peer.PublicKey, peer.AssignedIP); err != nil {
-				c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-					Error:   "Failed to enable peer",
-					Message: err.Error(),
-				})
-				return
+	before := NewPeerResponse(peer)
+
+	// Resolve the new expiry date first so an expired peer can be extended and re-enabled at once
+	expiresAt := peer.ExpiresAt
+	if req.ExpiresAt != nil {
+		expiresAt = nil
+		if *req.ExpiresAt != "" {
+			parsed, err := time.Parse(time.RFC3339, *req.ExpiresAt)
+			if err == nil {
+				expiresAt, err = validateExpiry(&parsed)
 			}
-		} else if !*req.Enabled && peer.Enabled {
-			// Disable: remove peer from WireGuard
-			if err := h.wgManager.RemovePeer(peer.PublicKey); err != nil {
-				c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-					Error:   "Failed to disable peer",
+			if err != nil {
+				c.JSON(http.StatusBadRequest, models.ErrorResponse{
+					Error:   "Invalid expiry date",
 					Message: err.Error(),
 				})
 				return
 			}
 		}
 	}
+	if req.Enabled != nil && *req.Enabled && !peer.Enabled && expiresAt != nil && !expiresAt.After(time.Now()) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Peer has expired",
+			Message: "Set a new expires_at to enable this peer",
+		})
+		return
+	}
+
+	// Same for quotas: apply the new limits before deciding whether the peer may be enabled
+	quotas := *peer
+	if req.MonthlyQuota != nil {
+		quotas.MonthlyQuota = *req.MonthlyQuota
+	}
+	if req.TotalQuota != nil {
+		quotas.TotalQuota = *req.TotalQuota
+	}
+	if quotas.MonthlyQuota < 0 || quotas.TotalQuota < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Quotas must not be negative",
+		})
+		return
+	}
+	if req.Enabled != nil && *req.Enabled && !peer.Enabled && quotas.QuotaExceeded() {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Peer has exceeded its quota",
+			Message: "Raise or remove the quota to enable this peer",
+		})
+		return
+	}
+
+	// An owner ID of 0 takes the peer away from its owner
+	var ownerID *int64
+	if req.OwnerID != nil && *req.OwnerID != 0 {
+		if !validOwner(c, *req.OwnerID) {
+			return
+		}
+		ownerID = req.OwnerID
+	}
+
+	// Likewise a group ID of 0 takes the peer out of its group
+	var groupID *int64
+	if req.GroupID != nil && *req.GroupID != 0 {
+		if !validGroup(c, *req.GroupID) {
+			return
+		}
+		groupID = req.GroupID
+	}
+
+	if req.Overrides != nil && !validOverrides(c, req.Overrides) {
+		return
+	}
+
+	updated := *peer
+	if req.AssignedIP != nil || req.AssignedIPv6 != nil {
+		if !h.resolvePeerAddresses(c, peer, &updated, req.AssignedIP, req.AssignedIPv6) {
+			return
+		}
+	}
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	updated.ExpiresAt = expiresAt
+	updated.MonthlyQuota, updated.TotalQuota = quotas.MonthlyQuota, quotas.TotalQuota
+	if req.OwnerID != nil {
+		updated.OwnerID = ownerID
+	}
+	if req.GroupID != nil {
+		updated.GroupID = groupID
+	}
+	if req.Overrides != nil {
+		updated.Overrides = *req.Overrides
+	}
+	enabledChanged := req.Enabled != nil && *req.Enabled != peer.Enabled
+	if enabledChanged {
+		// A manual change replaces whatever reason the peer was disabled for, and the
+		// interface counters restart when the peer is added or removed
+		updated.Enabled, updated.DisabledReason = *req.Enabled, ""
+		if !updated.Enabled {
+			updated.DisabledReason = models.DisabledReasonManual
+		}
+		updated.CounterRx, updated.CounterTx = 0, 0
+	}
 
-	// Update in database
-	updatedPeer, err := db.DB.UpdatePeer(ip, req.Name, req.Enabled)
+	// All changes are saved together, then the interface follows; if it cannot, the
+	// database gets the previous state back
+	err = db.DB.SavePeer(&updated, enabledChanged)
+	if errors.Is(err, db.ErrIPConflict) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "IP address already in use",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to update peer",
 		})
 		return
 	}
+	if err := h.applyPeerUpdate(peer, &updated); err != nil {
+		db.DB.SavePeer(peer, enabledChanged)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error:   "Failed to update peer in WireGuard",
+			Message: err.Error(),
+		})
+		return
+	}
 
-	c.JSON(http.StatusOK, models.PeerResponse{
-		ID:         updatedPeer.ID,
-		Name:       updatedPeer.Name,
-		PublicKey:  updatedPeer.PublicKey,
-		AssignedIP: updatedPeer.AssignedIP,
-		Enabled:    updatedPeer.Enabled,
-		CreatedAt:  updatedPeer.CreatedAt,
-	})
+	updatedPeer, err := db.DB.GetPeerByID(peer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve peer",
+		})
+		return
+	}
+
+	resp := NewPeerResponse(updatedPeer)
+	recordAudit(c, "peer.update", peerTarget(peer.ID), before, resp)
+	h.hub.Publish(events.PeerUpdated, resp)
+	if enabledChanged {
+		eventType := events.PeerDisabled
+		if *req.Enabled {
+			eventType = events.PeerEnabled
+		}
+		h.hub.Publish(eventType, resp)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// resolvePeerAddresses validates the new addresses of peer and sets them on moved, writing a
+// response if they are invalid or cannot be changed right now
+func (h *PeerHandler) resolvePeerAddresses(c *gin.Context, peer, moved *models.Peer, ipv4, ipv6 *string) bool {
+	if ipv4 != nil {
+		addr, err := parseAssignableAddress(h.pools.V4, *ipv4)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid IP address",
+				Message: err.Error(),
+			})
+			return false
+		}
+		moved.AssignedIP = addr
+	}
+	if ipv6 != nil {
+		addr, err := parseAssignableAddress(h.pools.V6, *ipv6)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid IPv6 address",
+				Message: err.Error(),
+			})
+			return false
+		}
+		moved.AssignedIPv6 = addr
+	}
+
+	// The interface holds both keys during a key rotation, moving only one would split the peer
+	if peer.PreviousPublicKey != "" && (moved.AssignedIP != peer.AssignedIP || moved.AssignedIPv6 != peer.AssignedIPv6) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Key rotation in progress",
+			Message: "Addresses can be changed once the key rotation has completed",
+		})
+		return false
+	}
+	return true
+}
+
+// applyPeerUpdate brings the interface from a peer's state before an update to the one after it
+func (h *PeerHandler) applyPeerUpdate(before, after *models.Peer) error {
+	switch {
+	case after.Enabled && !before.Enabled:
+		return h.wgManager.AddPeer(after)
+	case !after.Enabled && before.Enabled:
+		return h.removeFromInterface(before)
+	case after.Enabled && (after.AssignedIP != before.AssignedIP || after.AssignedIPv6 != before.AssignedIPv6):
+		// A single `wg set` replaces the allowed IPs, so the interface never holds both the
+		// old and the new addresses
+		return h.wgManager.AddPeer(after)
+	}
+	return nil
 }
 
 // DeletePeer removes a peer by its assigned IP
@@ -235,7 +631,7 @@ func (h *PeerHandler) DeletePeer(c *gin.Context) {
 	}
 
 	// Remove from WireGuard interface
-	if err := h.wgManager.RemovePeer(peer.PublicKey); err != nil {
+	if err := h.removeFromInterface(peer); err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error:   "Failed to remove peer from WireGuard",
 			Message: err.Error(),
@@ -244,16 +640,387 @@ func (h *PeerHandler) DeletePeer(c *gin.Context) {
 	}
 
 	// Delete from database
-	if err := db.DB.DeletePeer(ip); err != nil {
+	if err := db.DB.DeletePeer(peer.AssignedIP); err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to delete peer from database",
 		})
 		return
 	}
 
+	recordAudit(c, "peer.delete", peerTarget(peer.ID), NewPeerResponse(peer), nil)
+	h.hub.Publish(events.PeerDeleted, events.PeerRef{ID: peer.ID, AssignedIP: peer.AssignedIP})
 	c.JSON(http.StatusOK, gin.H{"message": "Peer deleted successfully"})
 }
 
+// clientConfig generates a peer's client config with the settings of its group
+func (h *PeerHandler) clientConfig(peer *models.Peer) (string, error) {
+	var group *models.PeerGroup
+	if peer.GroupID != nil {
+		var err error
+		if group, err = db.DB.GetPeerGroup(*peer.GroupID); err != nil {
+			return "", fmt.Errorf("failed to load group of peer %s: %w", peer.Name, err)
+		}
+	}
+	return h.wgManager.GenerateClientConfig(peer, group)
+}
+
+// removeFromInterface removes a peer's key, and its previous key during a rotation grace period
+func (h *PeerHandler) removeFromInterface(peer *models.Peer) error {
+	if peer.PreviousPublicKey != "" {
+		if err := h.wgManager.RemovePeer(peer.PreviousPublicKey); err != nil {
+			return err
+		}
+	}
+	return h.wgManager.RemovePeer(peer.PublicKey)
+}
+
+// KeyRotationCheckInterval is how often key rotations in their grace period are checked for a
+// handshake of the new key, which then gets the peer's addresses
+const KeyRotationCheckInterval = 5 * time.Second
+
+// RotateKeys replaces a peer's key pair while keeping its IP, name and logs
+// With a grace period the old key keeps working until the new key connects or the period ends.
+// The new key can complete a handshake right away, but its traffic is only routed once the
+// handshake has been noticed, up to KeyRotationCheckInterval later.
+func (h *PeerHandler) RotateKeys(c *gin.Context) {
+	ip := c.Param("ip")
+	if !wgmanager.ValidateIP(ip) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid IP address format",
+		})
+		return
+	}
+
+	// Body is optional
+	var req models.RotateKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+	if req.GracePeriodMinutes < 0 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Grace period must not be negative",
+		})
+		return
+	}
+
+	peer, err := db.DB.GetPeerByIP(ip)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Peer not found",
+		})
+		return
+	}
+
+	if peer.PreviousPublicKey != "" {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Key rotation already in progress",
+		})
+		return
+	}
+
+	// Use the client's new public key if given, otherwise generate a key pair
+	privateKey, publicKey := "", req.PublicKey
+	if publicKey != "" {
+		if !wgmanager.ValidatePublicKey(publicKey) {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid public key format",
+			})
+			return
+		}
+	} else {
+		privateKey, publicKey, err = wgmanager.GenerateKeyPair()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to generate key pair",
+			})
+			return
+		}
+	}
+
+	rotated := *peer
+	rotated.PublicKey = publicKey
+	rotated.PrivateKey = privateKey
+	rotated.HasPrivateKey = privateKey != ""
+
+	// A grace period only matters while the peer is on the interface
+	previousPublicKey := ""
+	var graceUntil *time.Time
+	if req.GracePeriodMinutes > 0 && peer.Enabled {
+		until := time.Now().Add(time.Duration(req.GracePeriodMinutes) * time.Minute)
+		graceUntil = &until
+		previousPublicKey = peer.PublicKey
+	}
+
+	err = db.DB.RotatePeerKeys(peer.ID, publicKey, privateKey, previousPublicKey, graceUntil)
+	if errors.Is(err, db.ErrPublicKeyConflict) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Public key already in use",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to rotate keys",
+		})
+		return
+	}
+
+	// The interface is updated after the database, which gets the old keys back if that fails
+	if peer.Enabled {
+		if err := h.rotateOnInterface(peer, &rotated, graceUntil != nil); err != nil {
+			db.DB.RestorePeerKeys(peer)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error:   "Failed to rotate keys in WireGuard",
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	updatedPeer, err := db.DB.GetPeerByID(peer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve peer",
+		})
+		return
+	}
+
+	configContent, err := h.clientConfig(updatedPeer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate configuration",
+		})
+		return
+	}
+
+	resp := NewPeerResponse(updatedPeer)
+	recordAudit(c, "peer.rotate_keys", peerTarget(peer.ID), NewPeerResponse(peer), resp)
+	h.hub.Publish(events.PeerUpdated, resp)
+	response := gin.H{
+		"message": "Keys rotated",
+		"peer":    resp,
+		"config":  configContent,
+	}
+	if graceUntil != nil {
+		response["note"] = fmt.Sprintf("Until the new key's first handshake has been noticed, which takes up to %d seconds, "+
+			"traffic is only routed for the previous key", int(KeyRotationCheckInterval/time.Second))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// rotateOnInterface replaces the previous key of an enabled peer with the rotated one. With
+// a grace period the new key is added without addresses, which stay with the previous key until
+// the new key has connected (see KeyRotationCheckInterval).
+func (h *PeerHandler) rotateOnInterface(previous, rotated *models.Peer, grace bool) error {
+	if grace {
+		return h.wgManager.AddPendingPeer(rotated.PublicKey, rotated.PresharedKey)
+	}
+
+	// Adding the new key moves the addresses to it, then the old key can go
+	if err := h.wgManager.AddPeer(rotated); err != nil {
+		return err
+	}
+	if err := h.wgManager.RemovePeer(previous.PublicKey); err != nil {
+		h.wgManager.RemovePeer(rotated.PublicKey)
+		h.wgManager.AddPeer(previous)
+		return err
+	}
+	return nil
+}
+
+// RotatePresharedKey generates a new preshared key for a peer (adding one if it had none)
+// and returns the updated client configuration
+func (h *PeerHandler) RotatePresharedKey(c *gin.Context) {
+	ip := c.Param("ip")
+	if !wgmanager.ValidateIP(ip) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid IP address format",
+		})
+		return
+	}
+
+	peer, err := db.DB.GetPeerByIP(ip)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Peer not found",
+		})
+		return
+	}
+
+	// The previous key would keep the old preshared key on the interface
+	if peer.PreviousPublicKey != "" {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Key rotation in progress",
+			Message: "The preshared key can be rotated once the key rotation has completed",
+		})
+		return
+	}
+
+	presharedKey, err := wgmanager.GeneratePresharedKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate preshared key",
+		})
+		return
+	}
+
+	if err := db.DB.UpdatePeerPresharedKey(peer.ID, presharedKey); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to save preshared key",
+		})
+		return
+	}
+
+	before := NewPeerResponse(peer)
+	oldPresharedKey := peer.PresharedKey
+	peer.PresharedKey = presharedKey
+
+	// Push the new key to the interface; disabled peers pick it up when re-enabled
+	if peer.Enabled {
+		if err := h.wgManager.AddPeer(peer); err != nil {
+			// Rollback database change so it matches the interface again
+			db.DB.UpdatePeerPresharedKey(peer.ID, oldPresharedKey)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error:   "Failed to set preshared key in WireGuard",
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+
+	configContent, err := h.clientConfig(peer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate configuration",
+		})
+		return
+	}
+
+	resp := NewPeerResponse(peer)
+	recordAudit(c, "peer.rotate_psk", peerTarget(peer.ID), before, resp)
+	h.hub.Publish(events.PeerUpdated, resp)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Preshared key rotated",
+		"peer":    resp,
+		"config":  configContent,
+	})
+}
+
+// maxTrafficPoints limits the size of a traffic series response
+const maxTrafficPoints = 10000
+
+// GetPeerTraffic returns a peer's traffic history as a series of rx/tx buckets
+// Query parameters: from and to (RFC 3339, default the last 24 hours) and step (duration such as
+// "5m" or "1h", default chosen from the range). Older history is only kept at coarser steps.
+func (h *PeerHandler) GetPeerTraffic(c *gin.Context) {
+	ip := c.Param("ip")
+	if !wgmanager.ValidateIP(ip) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid IP address format",
+		})
+		return
+	}
+
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid to, expected an RFC 3339 timestamp",
+			})
+			return
+		}
+		to = parsed.UTC()
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid from, expected an RFC 3339 timestamp",
+			})
+			return
+		}
+		from = parsed.UTC()
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "from must be before to",
+		})
+		return
+	}
+
+	step := defaultTrafficStep(to.Sub(from))
+	if value := c.Query("step"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < time.Minute || parsed%time.Minute != 0 {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid step, expected a whole number of minutes such as 5m or 1h",
+			})
+			return
+		}
+		step = parsed
+	}
+
+	// Align to bucket boundaries so every point covers a full step
+	seconds := int64(step / time.Second)
+	from = time.Unix(from.Unix()-from.Unix()%seconds, 0).UTC()
+	if to.Sub(from)/step > maxTrafficPoints {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Too many points",
+			Message: fmt.Sprintf("Use a larger step or a shorter range (at most %d points)", maxTrafficPoints),
+		})
+		return
+	}
+
+	peer, err := db.DB.GetPeerByIP(ip)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Peer not found",
+		})
+		return
+	}
+
+	buckets, err := db.DB.GetTrafficSeries(peer.ID, from, to, step)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get traffic history",
+		})
+		return
+	}
+
+	// Fill empty buckets with zeros so graphs have evenly spaced points
+	points := make([]models.TrafficPoint, 0, int(to.Sub(from)/step)+1)
+	for t := from; t.Before(to); t = t.Add(step) {
+		point, ok := buckets[t.Unix()]
+		if !ok {
+			point = models.TrafficPoint{Time: t}
+		}
+		points = append(points, point)
+	}
+
+	c.JSON(http.StatusOK, models.TrafficSeriesResponse{
+		From:   from,
+		To:     to,
+		Step:   int64(step / time.Second),
+		Points: points,
+	})
+}
+
+// defaultTrafficStep picks the finest stored resolution that keeps a range under 300 points
+func defaultTrafficStep(span time.Duration) time.Duration {
+	for _, level := range db.TrafficResolutions {
+		if span/level.Step <= 300 {
+			return level.Step
+		}
+	}
+	return db.TrafficResolutions[len(db.TrafficResolutions)-1].Step
+}
+
 // GetPeerConfig returns the client configuration file for a peer
 func (h *PeerHandler) GetPeerConfig(c *gin.Context) {
 	ip := c.Param("ip")
@@ -272,7 +1039,7 @@ func (h *PeerHandler) GetPeerConfig(c *gin.Context) {
 		return
 	}
 
-	configContent, err := h.wgManager.GenerateClientConfig(peer)
+	configContent, err := h.clientConfig(peer)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to generate configuration",
@@ -305,7 +1072,16 @@ func (h *PeerHandler) GetPeerQRCode(c *gin.Context) {
 		return
 	}
 
-	configContent, err := h.wgManager.GenerateClientConfig(peer)
+	// A QR code is only useful if it can be imported as-is
+	if !peer.HasPrivateKey {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "QR code not available",
+			Message: "This peer uses its own key pair; the server does not hold its private key",
+		})
+		return
+	}
+
+	configContent, err := h.clientConfig(peer)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to generate configuration",
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+)
+
+func sessionTarget(id int64) string {
+	return fmt.Sprintf("session:%d", id)
+}
+
+// ListSessions returns the requesting user's active sessions, marking the one making the request
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	sessions, err := db.DB.GetSessions(c.GetInt64("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve sessions",
+		})
+		return
+	}
+
+	current := c.GetInt64("session_id")
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs one of the requesting user's sessions out, its access tokens stop
+// working right away
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid session ID",
+		})
+		return
+	}
+
+	session, err := db.DB.GetSession(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && session.UserID != c.GetInt64("user_id")) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Session not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get session",
+		})
+		return
+	}
+
+	if err := db.DB.DeleteSession(session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke session",
+		})
+		return
+	}
+
+	recordAudit(c, "auth.session.revoke", sessionTarget(session.ID), session, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
@@ -5,7 +5,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
-	"wgeasygo/internal/auth"
 	"wgeasygo/internal/config"
 	"wgeasygo/internal/db"
 	"wgeasygo/internal/models"
@@ -44,21 +43,28 @@ func (h *SettingsHandler) GetSettings(c *gin.Context) {
 		loggingEnabled = true
 	}
 
-	// Get API token from user
-	apiToken := ""
-	user, err := db.DB.GetUserByUsername(h.config.Admin.Username)
-	if err == nil {
-		apiToken = user.APIToken
-	}
-
 	c.JSON(http.StatusOK, models.SettingsResponse{
 		DNS:            dns,
 		AllowedIPs:     allowedIPs,
 		LoggingEnabled: loggingEnabled,
-		APIToken:       apiToken,
 	})
 }
 
+// auditedSettings returns the stored settings that UpdateSettings changes, for the audit log
+func auditedSettings() map[string]string {
+	snapshot := make(map[string]string)
+	settings, err := db.DB.GetAllSettings()
+	if err != nil {
+		return snapshot
+	}
+	for _, key := range []string{"dns", "allowed_ips", "logging_enabled"} {
+		if val, ok := settings[key]; ok {
+			snapshot[key] = val
+		}
+	}
+	return snapshot
+}
+
 func (h *SettingsHandler) UpdateSettings(c *gin.Context) {
 	var req models.UpdateSettingsRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -68,6 +74,8 @@ func (h *SettingsHandler) UpdateSettings(c *gin.Context) {
 		return
 	}
 
+	before := auditedSettings()
+
 	// Update DNS
 	if req.DNS != nil {
 		if err := db.DB.SetSetting("dns", *req.DNS); err != nil {
@@ -116,8 +124,8 @@ func (h *SettingsHandler) UpdateSettings(c *gin.Context) {
 			return
 		}
 
-		// Update password in database
-		user, err := db.DB.GetUserByUsername(h.config.Admin.Username)
+		// Update the requesting admin's password in database
+		user, err := db.DB.GetUserByID(c.GetInt64("user_id"))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 				Error: "Failed to find admin user",
@@ -132,18 +140,16 @@ func (h *SettingsHandler) UpdateSettings(c *gin.Context) {
 			return
 		}
 
-		// Generate new API token from new password
-		newAPIToken := auth.GenerateAPIToken(*req.AdminPassword, h.config.JWT.AccessSecret)
-		if err := db.DB.UpdateUserAPIToken(user.ID, newAPIToken); err != nil {
-			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-				Error: "Failed to update API token",
-			})
-			return
-		}
+		// Sign out the user's other sessions (force re-login)
+		db.DB.DeleteUserSessions(user.ID, c.GetInt64("session_id"))
+	}
 
-		// Invalidate all existing refresh tokens (force re-login)
-		db.DB.DeleteUserRefreshTokens(user.ID)
+	// The password itself is never logged, only that it changed
+	after := auditedSettings()
+	if req.AdminPassword != nil && *req.AdminPassword != "" {
+		after["admin_password"] = "changed"
 	}
+	recordAudit(c, "settings.update", "settings", before, after)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Settings updated"})
 }
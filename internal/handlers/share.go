@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"wgeasygo/internal/auth"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+	"wgeasygo/pkg/wgmanager"
+)
+
+// Share links are meant for the next day or so, not as a standing way into a peer's config
+const (
+	defaultShareLinkExpiry = 24 * time.Hour
+	maxShareLinkExpiry     = 7 * 24 * time.Hour
+	shareLinkPath          = "/share/"
+)
+
+func shareLinkTarget(id int64) string {
+	return fmt.Sprintf("share_link:%d", id)
+}
+
+// shareLinkURL returns the absolute URL of a share link as the requesting browser reaches the panel
+func shareLinkURL(c *gin.Context, token string) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + shareLinkPath + token
+}
+
+// CreateShareLink mints a one-time link to a peer's config or QR code for someone without a
+// login, e.g. to send to the person setting up the device
+func (h *PeerHandler) CreateShareLink(c *gin.Context) {
+	ip := c.Param("ip")
+	if !wgmanager.ValidateIP(ip) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid IP address format",
+		})
+		return
+	}
+
+	// Body is optional
+	var req models.CreateShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = models.ShareKindConfig
+	}
+	if req.Kind != models.ShareKindConfig && req.Kind != models.ShareKindQRCode {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid kind",
+			Message: fmt.Sprintf("Expected %s or %s", models.ShareKindConfig, models.ShareKindQRCode),
+		})
+		return
+	}
+	expiry := defaultShareLinkExpiry
+	if req.ExpiresInMinutes != 0 {
+		expiry = time.Duration(req.ExpiresInMinutes) * time.Minute
+	}
+	if expiry <= 0 || expiry > maxShareLinkExpiry {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid expiry",
+			Message: fmt.Sprintf("expires_in_minutes must be between 1 and %d", int(maxShareLinkExpiry/time.Minute)),
+		})
+		return
+	}
+
+	peer, err := db.DB.GetPeerByIP(ip)
+	if err != nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Peer not found",
+		})
+		return
+	}
+	if req.Kind == models.ShareKindQRCode && !peer.HasPrivateKey {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "QR code not available",
+			Message: "This peer uses its own key pair; the server does not hold its private key",
+		})
+		return
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	token, err := auth.GenerateShareToken(h.config.JWT.AccessSecret, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate share link",
+		})
+		return
+	}
+	link, err := db.DB.CreateShareLink(&models.ShareLink{
+		PeerID:    peer.ID,
+		Kind:      req.Kind,
+		CreatedBy: c.GetString("username"),
+		ExpiresAt: expiresAt,
+	}, auth.HashShareToken(token))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to save share link",
+		})
+		return
+	}
+
+	recordAudit(c, "share.create", shareLinkTarget(link.ID), nil, link)
+	c.JSON(http.StatusCreated, models.ShareLinkResponse{ShareLink: *link, URL: shareLinkURL(c, token)})
+}
+
+// ListShareLinks returns the share links that have been neither used nor revoked and have not expired
+func (h *PeerHandler) ListShareLinks(c *gin.Context) {
+	links, err := db.DB.GetOutstandingShareLinks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve share links",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, links)
+}
+
+// RevokeShareLink makes a share link unusable
+func (h *PeerHandler) RevokeShareLink(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid share link ID",
+		})
+		return
+	}
+
+	link, err := db.DB.GetShareLink(id)
+	if err == nil {
+		err = db.DB.DeleteShareLink(id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Share link not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke share link",
+		})
+		return
+	}
+
+	recordAudit(c, "share.revoke", shareLinkTarget(id), link, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// sharePage is what a share link shows in a browser. Opening the link does not use it up, the
+// button does, so link previews and mail scanners fetching the URL leave it working.
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>WireGuard configuration</title>
+<style>
+body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; background: #121212; color: rgba(255, 255, 255, 0.87); font-family: system-ui, sans-serif; }
+main { max-width: 340px; padding: 32px 28px; background: #1e1e1e; border-radius: 12px; text-align: center; }
+h1 { font-size: 1.25rem; margin: 0 0 12px; }
+p { font-size: 0.875rem; color: rgba(255, 255, 255, 0.6); }
+button { width: 100%; padding: 12px; border: none; border-radius: 6px; background: #88171a; color: white; font-size: 0.875rem; cursor: pointer; }
+</style>
+</head>
+<body>
+<main>
+{{if .Link}}
+<h1>{{.Link.PeerName}}</h1>
+<p>This link works once, until {{.Link.ExpiresAt.UTC.Format "2006-01-02 15:04 UTC"}}.
+{{if eq .Link.Kind "qrcode"}}Open it on a screen the WireGuard app can scan.{{else}}Import the file into the WireGuard app.{{end}}</p>
+<form method="post">
+<button type="submit">{{if eq .Link.Kind "qrcode"}}Show QR code{{else}}Download configuration{{end}}</button>
+</form>
+{{else}}
+<h1>Link not available</h1>
+<p>This link is invalid, has expired or has already been used. Ask for a new one.</p>
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+// renderSharePage writes the share page, for a usable link or with link nil for any other
+func renderSharePage(c *gin.Context, status int, link *models.ShareLink) {
+	// The page's own styles are inline, everything else stays blocked
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	sharePage.Execute(c.Writer, gin.H{"Link": link})
+}
+
+// shareLinkFromParam loads the usable share link of the :token parameter, rendering the
+// error page if there is none. Invalid, expired, used and revoked links look the same.
+func (h *PeerHandler) shareLinkFromParam(c *gin.Context) (*models.ShareLink, bool) {
+	// The URL is the credential: keep it out of caches and other sites' referrer logs
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Robots-Tag", "noindex")
+
+	token := c.Param("token")
+	if auth.VerifyShareToken(h.config.JWT.AccessSecret, token, time.Now()) != nil {
+		renderSharePage(c, http.StatusNotFound, nil)
+		return nil, false
+	}
+	link, err := db.DB.GetShareLinkByToken(auth.HashShareToken(token))
+	if err != nil || !link.Usable(time.Now()) {
+		renderSharePage(c, http.StatusNotFound, nil)
+		return nil, false
+	}
+	return link, true
+}
+
+// ShowShareLink shows what a share link downloads, with a button to do so
+func (h *PeerHandler) ShowShareLink(c *gin.Context) {
+	if link, ok := h.shareLinkFromParam(c); ok {
+		renderSharePage(c, http.StatusOK, link)
+	}
+}
+
+// DownloadShareLink uses up a share link and sends the peer's config or QR code
+func (h *PeerHandler) DownloadShareLink(c *gin.Context) {
+	link, ok := h.shareLinkFromParam(c)
+	if !ok {
+		return
+	}
+
+	peer, err := db.DB.GetPeerByID(link.PeerID)
+	if err != nil {
+		renderSharePage(c, http.StatusNotFound, nil)
+		return
+	}
+	configContent, err := h.clientConfig(peer)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to generate configuration")
+		return
+	}
+	var qr []byte
+	if link.Kind == models.ShareKindQRCode {
+		if qr, err = qrcode.Encode(configContent, qrcode.Medium, 256); err != nil {
+			c.String(http.StatusInternalServerError, "Failed to generate QR code")
+			return
+		}
+	}
+
+	// Only one of concurrent downloads gets past this
+	consumed, err := db.DB.ConsumeShareLink(link.ID, c.ClientIP())
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to use share link")
+		return
+	}
+	if !consumed {
+		renderSharePage(c, http.StatusNotFound, nil)
+		return
+	}
+
+	c.Set("auth_method", models.AuthMethodShareLink)
+	after := *link
+	now := time.Now()
+	after.ConsumedAt, after.ConsumedIP = &now, c.ClientIP()
+	recordAudit(c, "share.download", shareLinkTarget(link.ID), link, after)
+
+	if qr != nil {
+		c.Data(http.StatusOK, "image/png", qr)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+peer.Name+".conf")
+	c.Header("Content-Type", "text/plain")
+	c.String(http.StatusOK, configContent)
+}
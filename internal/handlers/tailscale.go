@@ -66,6 +66,8 @@ func (h *TailscaleHandler) Connect(c *gin.Context) {
 		"backend_state": status.BackendState,
 	}
 
+	recordAudit(c, "tailscale.connect", "tailscale", nil, gin.H{"connected": status.Connected, "backend_state": status.BackendState})
+
 	if status.AuthURL != "" {
 		response["auth_url"] = status.AuthURL
 		response["message"] = "Please authenticate using the URL"
@@ -93,6 +95,7 @@ func (h *TailscaleHandler) Disconnect(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "tailscale.disconnect", "tailscale", nil, nil)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Tailscale disconnected",
@@ -133,6 +136,7 @@ func (h *TailscaleHandler) EnableRouting(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "tailscale.routing.enable", "tailscale", nil, gin.H{"subnet": h.config.WireGuard.Subnet})
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Routing enabled - WireGuard clients can now access Tailscale network",
@@ -157,6 +161,7 @@ func (h *TailscaleHandler) DisableRouting(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "tailscale.routing.disable", "tailscale", nil, nil)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Routing disabled",
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/auth"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/middleware"
+	"wgeasygo/internal/models"
+)
+
+// apiTokenPrefixLength is how much of a token is kept to tell tokens apart
+const apiTokenPrefixLength = len(auth.APITokenPrefix) + 6
+
+// APITokenHandler manages API tokens. Users manage their own tokens; users:write also
+// allows listing and revoking everyone's.
+type APITokenHandler struct{}
+
+func NewAPITokenHandler() *APITokenHandler {
+	return &APITokenHandler{}
+}
+
+func apiTokenTarget(id int64) string {
+	return fmt.Sprintf("api_token:%d", id)
+}
+
+// validateScopes checks scopes against models.Scopes and drops duplicates. A token
+// cannot have a scope the request creating it lacks.
+func validateScopes(c *gin.Context, scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	valid := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !models.ValidScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q, supported scopes are %s", scope, strings.Join(models.Scopes, ", "))
+		}
+		if !middleware.HasScope(c, scope) {
+			return nil, fmt.Errorf("you do not have the %s scope yourself", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			valid = append(valid, scope)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return valid, nil
+}
+
+// apiTokenFromParam loads the token named by the :id parameter if the request may manage it,
+// writing a response if that fails. Other users' tokens are reported as not found.
+func apiTokenFromParam(c *gin.Context) (*models.APIToken, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid token ID",
+		})
+		return nil, false
+	}
+
+	token, err := db.DB.GetAPIToken(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && token.UserID != c.GetInt64("user_id") && !middleware.HasScope(c, models.ScopeUsersWrite)) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Token not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get token",
+		})
+		return nil, false
+	}
+	return token, true
+}
+
+// ListTokens returns the user's tokens, or with all=true and users:write every user's tokens
+func (h *APITokenHandler) ListTokens(c *gin.Context) {
+	userID := c.GetInt64("user_id")
+	if c.Query("all") == "true" {
+		if !middleware.HasScope(c, models.ScopeUsersWrite) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "required_scope": models.ScopeUsersWrite})
+			return
+		}
+		userID = 0
+	}
+
+	tokens, err := db.DB.GetAPITokens(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve tokens",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken creates a token for the user; the response is the only one that includes it
+func (h *APITokenHandler) CreateToken(c *gin.Context) {
+	var req models.CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid request body",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Name must not be empty",
+		})
+		return
+	}
+
+	scopes, err := validateScopes(c, req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid scopes",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Expiry date must be in the future",
+		})
+		return
+	}
+
+	value, err := auth.GenerateAPIToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate token",
+		})
+		return
+	}
+
+	token, err := db.DB.CreateAPIToken(&models.APIToken{
+		UserID:    c.GetInt64("user_id"),
+		Name:      req.Name,
+		Prefix:    value[:apiTokenPrefixLength],
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	}, auth.HashAPIToken(value))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create token",
+		})
+		return
+	}
+
+	recordAudit(c, "api_token.create", apiTokenTarget(token.ID), nil, token)
+	c.JSON(http.StatusCreated, models.APITokenResponse{APIToken: *token, Token: value})
+}
+
+// UpdateToken renames a token; scopes and expiry are fixed, create a new token to change them
+func (h *APITokenHandler) UpdateToken(c *gin.Context) {
+	var req models.UpdateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	token, ok := apiTokenFromParam(c)
+	if !ok {
+		return
+	}
+	before := *token
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Name must not be empty",
+			})
+			return
+		}
+		if err := db.DB.UpdateAPITokenName(token.ID, name); err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to update token",
+			})
+			return
+		}
+		token.Name = name
+	}
+
+	recordAudit(c, "api_token.update", apiTokenTarget(token.ID), before, token)
+	c.JSON(http.StatusOK, token)
+}
+
+// DeleteToken revokes a token
+func (h *APITokenHandler) DeleteToken(c *gin.Context) {
+	token, ok := apiTokenFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.DeleteAPIToken(token.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke token",
+		})
+		return
+	}
+
+	recordAudit(c, "api_token.delete", apiTokenTarget(token.ID), token, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"wgeasygo/internal/auth"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+)
+
+// totpIssuer names the panel in authenticator apps
+const totpIssuer = "wgeasygo"
+
+// A login challenge must be answered with a code within the TTL and a few attempts
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+	maxLoginChallenges        = 1000 // Bounds memory, expired challenges are dropped first
+)
+
+type loginChallenge struct {
+	userID    int64
+	expiresAt time.Time
+	attempts  int
+}
+
+// loginChallenges holds the logins that passed the password check and wait for a second factor.
+// They are kept in memory only: a restart just means logging in again.
+type loginChallenges struct {
+	mu      sync.Mutex
+	pending map[string]*loginChallenge
+}
+
+// issue starts a challenge for a user and returns its token
+func (l *loginChallenges) issue(userID int64) (string, error) {
+	token, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, challenge := range l.pending {
+		if now.After(challenge.expiresAt) {
+			delete(l.pending, key)
+		}
+	}
+	if len(l.pending) >= maxLoginChallenges {
+		for key := range l.pending {
+			delete(l.pending, key)
+			break
+		}
+	}
+	l.pending[token] = &loginChallenge{userID: userID, expiresAt: now.Add(loginChallengeTTL)}
+	return token, nil
+}
+
+// attempt counts an attempt at answering a challenge and returns its user. A challenge
+// that expired or ran out of attempts is removed.
+func (l *loginChallenges) attempt(token string) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	challenge, ok := l.pending[token]
+	if !ok {
+		return 0, false
+	}
+	challenge.attempts++
+	if time.Now().After(challenge.expiresAt) || challenge.attempts > loginChallengeMaxAttempts {
+		delete(l.pending, token)
+		return 0, false
+	}
+	return challenge.userID, true
+}
+
+// complete removes an answered challenge so it cannot be used twice
+func (l *loginChallenges) complete(token string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pending, token)
+}
+
+// verifySecondFactor checks an authenticator code, or failing that a recovery code, for a user
+// with two-factor authentication. Both are single use. It returns the auth method that matched.
+func verifySecondFactor(userID int64, code string) (string, bool, error) {
+	secret, err := db.DB.GetUserTOTP(userID)
+	if err != nil {
+		return "", false, err
+	}
+	if secret != "" {
+		if step, ok := auth.VerifyTOTP(secret, code, time.Now()); ok {
+			fresh, err := db.DB.UseTOTPStep(userID, step)
+			return models.AuthMethodTOTP, fresh, err
+		}
+	}
+
+	used, err := db.DB.UseRecoveryCode(userID, auth.HashRecoveryCode(code))
+	return models.AuthMethodRecoveryCode, used, err
+}
+
+// LoginTwoFactor completes a login with the challenge returned by Login and a code from the
+// user's authenticator app or one of their recovery codes
+func (h *AuthHandler) LoginTwoFactor(c *gin.Context) {
+	var req models.LoginTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	userID, ok := h.challenges.attempt(req.Challenge)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error:   "Invalid or expired challenge",
+			Message: "Log in with your password again",
+		})
+		return
+	}
+
+	user, err := db.DB.GetUserByID(userID)
+	if err != nil || user.Disabled || !user.TOTPEnabled {
+		h.challenges.complete(req.Challenge)
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Invalid or expired challenge",
+		})
+		return
+	}
+
+	if !h.checkLoginLockout(c, user.Username) {
+		return
+	}
+
+	method, ok, err := verifySecondFactor(user.ID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to verify code",
+		})
+		return
+	}
+	if !ok {
+		h.loginFailed(c, user.Username)
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Invalid code",
+		})
+		return
+	}
+
+	h.challenges.complete(req.Challenge)
+	h.startSession(c, user, method)
+}
+
+// requireSession rejects requests that are not made from a logged-in panel session, so an
+// API token cannot change how its own user signs in
+func requireSession(c *gin.Context) bool {
+	if c.GetString("auth_method") != models.AuthMethodJWT {
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error:   "Panel session required",
+			Message: "Two-factor authentication cannot be managed with an API token",
+		})
+		return false
+	}
+	return true
+}
+
+// accountUser loads the requesting user, writing a response if that fails
+func accountUser(c *gin.Context) (*models.User, bool) {
+	user, err := db.DB.GetUserByID(c.GetInt64("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get user",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+// TwoFactorStatus reports whether the user has two-factor authentication and how many
+// recovery codes they have left
+func (h *AuthHandler) TwoFactorStatus(c *gin.Context) {
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+
+	remaining, err := db.DB.CountRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to count recovery codes",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, models.TwoFactorStatus{Enabled: user.TOTPEnabled, RecoveryCodesRemaining: remaining})
+}
+
+// SetupTwoFactor generates a new secret for the user to add to an authenticator app. It only
+// takes effect once EnableTwoFactor receives a code for it.
+func (h *AuthHandler) SetupTwoFactor(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error:   "Two-factor authentication is already enabled",
+			Message: "Disable it first to set up a new authenticator",
+		})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate secret",
+		})
+		return
+	}
+	if err := db.DB.StartTOTPEnrollment(user.ID, secret); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to save secret",
+		})
+		return
+	}
+
+	uri := auth.TOTPURI(totpIssuer, user.Username, secret)
+	qr, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate QR code",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.TwoFactorSetupResponse{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr),
+	})
+}
+
+// newRecoveryCodes generates recovery codes and their hashes, writing a response if that fails
+func newRecoveryCodes(c *gin.Context) ([]string, []string, bool) {
+	codes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to generate recovery codes",
+		})
+		return nil, nil, false
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, true
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user proves their authenticator
+// app has the secret from SetupTwoFactor. The response holds the recovery codes, shown only once.
+func (h *AuthHandler) EnableTwoFactor(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := db.DB.GetUserTOTP(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get secret",
+		})
+		return
+	}
+	if secret == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Set up two-factor authentication first",
+		})
+		return
+	}
+
+	step, ok := auth.VerifyTOTP(secret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid code",
+			Message: "Check that your device's clock is correct",
+		})
+		return
+	}
+
+	codes, hashes, ok := newRecoveryCodes(c)
+	if !ok {
+		return
+	}
+	if err := db.DB.EnableTOTP(user.ID, step, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	recordAudit(c, "auth.2fa.enable", userTarget(user.ID), nil, nil)
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns off two-factor authentication; it takes the password and a current code
+func (h *AuthHandler) DisableTwoFactor(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+	var req models.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Two-factor authentication is not enabled",
+		})
+		return
+	}
+	if err := auth.VerifyPassword(req.Password, user.PasswordHash); err != nil {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Invalid password",
+		})
+		return
+	}
+	if !h.checkCode(c, user.ID, req.Code) {
+		return
+	}
+
+	if err := db.DB.DisableTOTP(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	recordAudit(c, "auth.2fa.disable", userTarget(user.ID), nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes; it takes a current code
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	if !requireSession(c) {
+		return
+	}
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	user, ok := accountUser(c)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Two-factor authentication is not enabled",
+		})
+		return
+	}
+	if !h.checkCode(c, user.ID, req.Code) {
+		return
+	}
+
+	codes, hashes, ok := newRecoveryCodes(c)
+	if !ok {
+		return
+	}
+	if err := db.DB.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to save recovery codes",
+		})
+		return
+	}
+
+	recordAudit(c, "auth.2fa.recovery_codes", userTarget(user.ID), nil, nil)
+	c.JSON(http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// checkCode verifies a second factor for an account change, writing a response if it is wrong
+func (h *AuthHandler) checkCode(c *gin.Context, userID int64, code string) bool {
+	_, ok, err := verifySecondFactor(userID, code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to verify code",
+		})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Invalid code",
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/auth"
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+)
+
+type UserHandler struct {
+	config *config.Config
+}
+
+func NewUserHandler(cfg *config.Config) *UserHandler {
+	return &UserHandler{config: cfg}
+}
+
+func userTarget(id int64) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func respondInvalidRole(c *gin.Context, role string) {
+	c.JSON(http.StatusBadRequest, models.ErrorResponse{
+		Error:   "Invalid role",
+		Message: fmt.Sprintf("%q is not one of %s, %s, %s or %s", role, models.RoleAdmin, models.RoleOperator, models.RoleViewer, models.RoleUser),
+	})
+}
+
+func respondInvalidMaxDevices(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, models.ErrorResponse{
+		Error: "max_devices must not be negative",
+	})
+}
+
+func respondLastAdmin(c *gin.Context) {
+	c.JSON(http.StatusConflict, models.ErrorResponse{
+		Error:   "Cannot remove the last admin",
+		Message: "Make another user an admin first",
+	})
+}
+
+// userFromParam loads the user named by the :id parameter, writing a response if that fails
+func userFromParam(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return nil, false
+	}
+
+	user, err := db.DB.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "User not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get user",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+// ListUsers returns all users
+func (h *UserHandler) ListUsers(c *gin.Context) {
+	users, err := db.DB.GetUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve users",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// CreateUser adds a user with a password and role
+func (h *UserHandler) CreateUser(c *gin.Context) {
+	var req models.CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid request body",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Username must not be empty",
+		})
+		return
+	}
+	if !models.ValidRole(req.Role) {
+		respondInvalidRole(c, req.Role)
+		return
+	}
+	maxDevices := h.config.Portal.DefaultMaxDevices
+	if req.MaxDevices != nil {
+		maxDevices = *req.MaxDevices
+	}
+	if maxDevices < 0 {
+		respondInvalidMaxDevices(c)
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(req.Password, h.config.Security.BcryptCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to hash password",
+		})
+		return
+	}
+
+	user, err := db.DB.CreateUser(req.Username, passwordHash, req.Role)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Username already taken",
+		})
+		return
+	}
+	if err == nil {
+		err = db.DB.SetUserMaxDevices(user.ID, maxDevices)
+		user.MaxDevices = maxDevices
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create user",
+		})
+		return
+	}
+
+	recordAudit(c, "user.create", userTarget(user.ID), nil, user)
+	c.JSON(http.StatusCreated, user)
+}
+
+// UpdateUser changes a user's role or device cap, disables or enables them, sets a new
+// password or turns off their two-factor authentication. Disabling a user or changing their password signs
+// them out everywhere.
+func (h *UserHandler) UpdateUser(c *gin.Context) {
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	user, ok := userFromParam(c)
+	if !ok {
+		return
+	}
+	before := *user
+
+	// Everything is checked before anything is saved, and saved together
+	if req.Role != nil {
+		if !models.ValidRole(*req.Role) {
+			respondInvalidRole(c, *req.Role)
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if req.MaxDevices != nil {
+		if *req.MaxDevices < 0 {
+			respondInvalidMaxDevices(c)
+			return
+		}
+		user.MaxDevices = *req.MaxDevices
+	}
+	passwordHash := ""
+	if req.Password != nil {
+		if len(*req.Password) < 8 {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Password must be at least 8 characters",
+			})
+			return
+		}
+		var err error
+		passwordHash, err = auth.HashPassword(*req.Password, h.config.Security.BcryptCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to hash password",
+			})
+			return
+		}
+	}
+	passwordChanged := passwordHash != ""
+
+	err := db.DB.UpdateUser(user, passwordHash, req.ResetTwoFactor && user.TOTPEnabled)
+	if errors.Is(err, db.ErrLastAdmin) {
+		respondLastAdmin(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update user",
+		})
+		return
+	}
+
+	updated, err := db.DB.GetUserByID(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve user",
+		})
+		return
+	}
+
+	// The password itself is never logged, only that it changed
+	after := struct {
+		*models.User
+		PasswordChanged bool `json:"password_changed,omitempty"`
+	}{updated, passwordChanged}
+	recordAudit(c, "user.update", userTarget(user.ID), before, after)
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteUser removes a user; the last enabled admin cannot be deleted
+func (h *UserHandler) DeleteUser(c *gin.Context) {
+	user, ok := userFromParam(c)
+	if !ok {
+		return
+	}
+
+	err := db.DB.DeleteUser(user.ID)
+	if errors.Is(err, db.ErrLastAdmin) {
+		respondLastAdmin(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete user",
+		})
+		return
+	}
+
+	recordAudit(c, "user.delete", userTarget(user.ID), user, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+	"wgeasygo/internal/webhooks"
+)
+
+// maxDeliveryLog limits how many deliveries the delivery log endpoint returns
+const maxDeliveryLog = 500
+
+type WebhookHandler struct {
+	dispatcher *webhooks.Dispatcher
+}
+
+func NewWebhookHandler(dispatcher *webhooks.Dispatcher) *WebhookHandler {
+	return &WebhookHandler{dispatcher: dispatcher}
+}
+
+// validateWebhookURL accepts absolute http and https URLs
+func validateWebhookURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return raw, nil
+}
+
+// validateWebhookEvents checks event types against webhooks.Events and drops duplicates
+func validateWebhookEvents(eventTypes []string) ([]string, error) {
+	seen := make(map[string]bool, len(eventTypes))
+	valid := make([]string, 0, len(eventTypes))
+	for _, eventType := range eventTypes {
+		eventType = strings.TrimSpace(eventType)
+		if !webhooks.Supported(eventType) {
+			return nil, fmt.Errorf("unknown event %q, supported events are %s", eventType, strings.Join(webhooks.Events, ", "))
+		}
+		if !seen[eventType] {
+			seen[eventType] = true
+			valid = append(valid, eventType)
+		}
+	}
+	return valid, nil
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// webhookFromParam loads the webhook named by the :id parameter, writing a response if that fails
+func webhookFromParam(c *gin.Context) (*models.Webhook, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid webhook ID",
+		})
+		return nil, false
+	}
+
+	webhook, err := db.DB.GetWebhook(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Webhook not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get webhook",
+		})
+		return nil, false
+	}
+	return webhook, true
+}
+
+// ListWebhooks returns all webhooks without their secrets
+func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	list, err := db.DB.GetWebhooks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to retrieve webhooks",
+		})
+		return
+	}
+
+	response := make([]models.WebhookResponse, 0, len(list))
+	for _, webhook := range list {
+		response = append(response, models.WebhookResponse{Webhook: webhook})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// CreateWebhook adds a webhook; the response is the only one that includes its secret
+func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
+	var req models.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid request body",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	webhookURL, err := validateWebhookURL(req.URL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid webhook URL",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	eventTypes, err := validateWebhookEvents(req.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error:   "Invalid webhook events",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = generateWebhookSecret(); err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to generate webhook secret",
+			})
+			return
+		}
+	}
+
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	webhook, err := db.DB.CreateWebhook(&models.Webhook{
+		Name:    req.Name,
+		URL:     webhookURL,
+		Secret:  secret,
+		Events:  eventTypes,
+		Enabled: enabled,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create webhook",
+		})
+		return
+	}
+
+	recordAudit(c, "webhook.create", webhookTarget(webhook.ID), nil, webhook)
+	h.dispatcher.WebhooksChanged()
+	c.JSON(http.StatusCreated, models.WebhookResponse{Webhook: *webhook, Secret: webhook.Secret})
+}
+
+// UpdateWebhook changes a webhook's settings; with rotate_secret the new secret is returned
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	var req models.UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid request body",
+		})
+		return
+	}
+
+	webhook, ok := webhookFromParam(c)
+	if !ok {
+		return
+	}
+	before := *webhook
+
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Name must not be empty",
+			})
+			return
+		}
+		webhook.Name = *req.Name
+	}
+
+	if req.URL != nil {
+		webhookURL, err := validateWebhookURL(*req.URL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid webhook URL",
+				Message: err.Error(),
+			})
+			return
+		}
+		webhook.URL = webhookURL
+	}
+
+	if req.Events != nil {
+		eventTypes, err := validateWebhookEvents(*req.Events)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error:   "Invalid webhook events",
+				Message: err.Error(),
+			})
+			return
+		}
+		webhook.Events = eventTypes
+	}
+
+	if req.Enabled != nil {
+		webhook.Enabled = *req.Enabled
+	}
+
+	response := models.WebhookResponse{}
+	if req.RotateSecret {
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to generate webhook secret",
+			})
+			return
+		}
+		webhook.Secret = secret
+		response.Secret = secret
+	}
+
+	if err := db.DB.UpdateWebhook(webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update webhook",
+		})
+		return
+	}
+
+	after := struct {
+		*models.Webhook
+		SecretRotated bool `json:"secret_rotated,omitempty"`
+	}{webhook, req.RotateSecret}
+	recordAudit(c, "webhook.update", webhookTarget(webhook.ID), before, after)
+	h.dispatcher.WebhooksChanged()
+	response.Webhook = *webhook
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteWebhook removes a webhook and its delivery log
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	webhook, ok := webhookFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := db.DB.DeleteWebhook(webhook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to delete webhook",
+		})
+		return
+	}
+
+	recordAudit(c, "webhook.delete", webhookTarget(webhook.ID), webhook, nil)
+	h.dispatcher.WebhooksChanged()
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// ListDeliveries returns a webhook's delivery log, newest first (query parameter limit, default 100)
+func (h *WebhookHandler) ListDeliveries(c *gin.Context) {
+	webhook, ok := webhookFromParam(c)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > maxDeliveryLog {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: fmt.Sprintf("limit must be between 1 and %d", maxDeliveryLog),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := db.DB.GetWebhookDeliveries(webhook.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get webhook deliveries",
+		})
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []models.WebhookDelivery{}
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// TestWebhook sends a webhook.test event to the webhook right away and returns the delivery,
+// including the response status or error. A failed test is retried like any delivery.
+func (h *WebhookHandler) TestWebhook(c *gin.Context) {
+	webhook, ok := webhookFromParam(c)
+	if !ok {
+		return
+	}
+
+	delivery, err := h.dispatcher.Test(c.Request.Context(), webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to send test event",
+		})
+		return
+	}
+
+	recordAudit(c, "webhook.test", webhookTarget(webhook.ID), nil, nil)
+	c.JSON(http.StatusOK, delivery)
+}
@@ -2,7 +2,9 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,8 +14,32 @@ import (
 	"wgeasygo/internal/auth"
 	"wgeasygo/internal/config"
 	"wgeasygo/internal/db"
+	"wgeasygo/internal/models"
+	"wgeasygo/pkg/metrics"
 )
 
+// apiTokenTouchInterval limits how often a token's last use is written
+const apiTokenTouchInterval = time.Minute
+
+// authenticateAPIToken looks up an API token by its hash and returns it with its user,
+// if the token has not expired and the user is enabled
+func authenticateAPIToken(tokenString string) (*models.APIToken, *models.User, bool) {
+	token, err := db.DB.GetAPITokenByHash(auth.HashAPIToken(tokenString))
+	if err != nil || token.Expired() {
+		return nil, nil, false
+	}
+	user, err := db.DB.GetUserByID(token.UserID)
+	if err != nil || user.Disabled {
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenTouchInterval {
+		db.DB.TouchAPIToken(token.ID, now)
+	}
+	return token, user, true
+}
+
 // AuthMiddleware validates JWT access tokens or API tokens from Authorization header
 func AuthMiddleware(cfg *config.JWTConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -41,34 +67,189 @@ func AuthMiddleware(cfg *config.JWTConfig) gin.HandlerFunc {
 			return
 		}
 
-		// First try to validate as JWT access token
-		claims, err := auth.ValidateAccessToken(tokenString, cfg)
-		if err == nil {
-			// Valid JWT token
-			c.Set("user_id", claims.UserID)
-			c.Set("username", claims.Username)
+		// API tokens have a prefix of their own
+		if strings.HasPrefix(tokenString, auth.APITokenPrefix) {
+			token, user, ok := authenticateAPIToken(tokenString)
+			if !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+				c.Abort()
+				return
+			}
+			c.Set("user_id", user.ID)
+			c.Set("username", user.Username)
+			c.Set("role", user.Role)
+			c.Set("scopes", token.Scopes)
+			c.Set("api_token_id", token.ID)
+			c.Set("auth_method", models.AuthMethodAPIToken)
 			c.Next()
 			return
 		}
 
-		// If JWT validation failed, try API token (exactly 43 characters)
-		if len(tokenString) == 43 {
-			user, apiErr := db.DB.GetUserByAPIToken(tokenString)
-			if apiErr == nil {
-				// Valid API token
-				c.Set("user_id", user.ID)
-				c.Set("username", user.Username)
+		// Otherwise it must be a JWT access token
+		claims, err := auth.ValidateAccessToken(tokenString, cfg)
+		if err == nil {
+			// Valid JWT token, as long as its user is still enabled with the same role;
+			// otherwise the client refreshes it and gets the current role. Its session must
+			// not have been revoked.
+			user, userErr := db.DB.GetUserByID(claims.UserID)
+			session, sessionErr := db.DB.GetSession(claims.SessionID)
+			if userErr == nil && !user.Disabled && user.Role == claims.Role &&
+				sessionErr == nil && session.UserID == user.ID && time.Now().Before(session.ExpiresAt) {
+				c.Set("user_id", claims.UserID)
+				c.Set("username", claims.Username)
+				c.Set("role", claims.Role)
+				c.Set("session_id", claims.SessionID)
+				c.Set("auth_method", models.AuthMethodJWT)
 				c.Next()
 				return
 			}
 		}
 
-		// Both validations failed - use generic error for security
+		// Use generic error for security
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 		c.Abort()
 	}
 }
 
+// HasScope reports whether the request's user, and its API token if it used one, grant scope
+func HasScope(c *gin.Context, scope string) bool {
+	if !models.RoleHasScope(c.GetString("role"), scope) {
+		return false
+	}
+	if scopes, ok := c.Get("scopes"); ok {
+		for _, s := range scopes.([]string) {
+			if s == scope {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// RequireScope allows a request only if AuthMiddleware authenticated it with scope
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasScope(c, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "required_scope": scope})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// StreamTickets issues short-lived, single-use tickets for event streams. Browsers' EventSource
+// cannot send an Authorization header, and a ticket in the URL is harmless once redeemed, unlike
+// an access or API token that would end up in proxy and access logs.
+type StreamTickets struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	tickets map[string]streamTicket
+}
+
+type streamTicket struct {
+	userID     int64
+	username   string
+	role       string
+	scopes     []string // The API token's scopes, nil for a session
+	sessionID  int64
+	apiTokenID int64
+	expiresAt  time.Time
+}
+
+func NewStreamTickets(ttl time.Duration) *StreamTickets {
+	return &StreamTickets{ttl: ttl, tickets: make(map[string]streamTicket)}
+}
+
+// Issue creates a ticket for a request authenticated by AuthMiddleware. The stream gets the
+// request's role and scopes, and its session or API token so it can be ended when revoked.
+func (st *StreamTickets) Issue(c *gin.Context) (string, error) {
+	ticket, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	t := streamTicket{
+		userID:     c.GetInt64("user_id"),
+		username:   c.GetString("username"),
+		role:       c.GetString("role"),
+		sessionID:  c.GetInt64("session_id"),
+		apiTokenID: c.GetInt64("api_token_id"),
+	}
+	if scopes, ok := c.Get("scopes"); ok {
+		t.scopes = scopes.([]string)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Drop tickets that were never redeemed
+	now := time.Now()
+	for key, t := range st.tickets {
+		if now.After(t.expiresAt) {
+			delete(st.tickets, key)
+		}
+	}
+
+	t.expiresAt = now.Add(st.ttl)
+	st.tickets[ticket] = t
+	return ticket, nil
+}
+
+// TTL returns how long an issued ticket stays valid
+func (st *StreamTickets) TTL() time.Duration {
+	return st.ttl
+}
+
+// Middleware authenticates a request by the "ticket" query parameter, consuming the ticket
+func (st *StreamTickets) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+
+		st.mu.Lock()
+		t, ok := st.tickets[ticket]
+		delete(st.tickets, ticket)
+		st.mu.Unlock()
+
+		if ticket == "" || !ok || time.Now().After(t.expiresAt) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired stream ticket"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", t.userID)
+		c.Set("username", t.username)
+		c.Set("role", t.role)
+		if t.scopes != nil {
+			c.Set("scopes", t.scopes)
+		}
+		if t.apiTokenID != 0 {
+			c.Set("api_token_id", t.apiTokenID)
+		} else {
+			c.Set("session_id", t.sessionID)
+		}
+		c.Set("auth_method", models.AuthMethodStreamTicket)
+		c.Next()
+	}
+}
+
+// StillAuthorized reports whether what authenticated a long-running request, such as an event
+// stream, is still valid: its user is enabled with the same role, and its session or API token
+// has been neither revoked nor expired
+func StillAuthorized(c *gin.Context) bool {
+	user, err := db.DB.GetUserByID(c.GetInt64("user_id"))
+	if err != nil || user.Disabled || user.Role != c.GetString("role") {
+		return false
+	}
+	if id := c.GetInt64("api_token_id"); id != 0 {
+		token, err := db.DB.GetAPIToken(id)
+		return err == nil && token.UserID == user.ID && !token.Expired()
+	}
+	session, err := db.DB.GetSession(c.GetInt64("session_id"))
+	return err == nil && session.UserID == user.ID && time.Now().Before(session.ExpiresAt)
+}
+
 // RateLimiter provides IP-based rate limiting
 type RateLimiter struct {
 	visitors map[string]*visitorInfo
@@ -159,6 +340,43 @@ func (rl *RateLimiter) Middleware() gin.HandlerFunc {
 	}
 }
 
+// StaticToken requires "Authorization: Bearer <token>" matching a configured token
+// An empty token leaves the route open
+func StaticToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" ||
+			subtle.ConstantTimeCompare([]byte(parts[1]), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing token"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Metrics records request counts and latency per route
+// Requests that match no route share one label so scanners cannot grow the series without bound
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
 // SecurityHeaders adds security headers to responses
 func SecurityHeaders() gin.HandlerFunc {
 	return func(c *gin.Context) {
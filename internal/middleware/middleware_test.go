@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"wgeasygo/internal/models"
+)
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name        string
+		role        string
+		tokenScopes []string // nil for a session without an API token
+		scope       string
+		want        bool
+	}{
+		{name: "admin session", role: models.RoleAdmin, scope: models.ScopeUsersWrite, want: true},
+		{name: "operator writes peers", role: models.RoleOperator, scope: models.ScopePeersWrite, want: true},
+		{name: "operator changes settings", role: models.RoleOperator, scope: models.ScopeSettingsWrite, want: false},
+		{name: "viewer writes peers", role: models.RoleViewer, scope: models.ScopePeersWrite, want: false},
+		{name: "viewer reads peers", role: models.RoleViewer, scope: models.ScopePeersRead, want: true},
+		{name: "no role", scope: models.ScopePeersRead, want: false},
+		{name: "token with scope", role: models.RoleAdmin, tokenScopes: []string{models.ScopePeersRead}, scope: models.ScopePeersRead, want: true},
+		{name: "token without scope", role: models.RoleAdmin, tokenScopes: []string{models.ScopePeersRead}, scope: models.ScopePeersWrite, want: false},
+		{name: "token scope beyond role", role: models.RoleViewer, tokenScopes: []string{models.ScopePeersWrite}, scope: models.ScopePeersWrite, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Set("role", tt.role)
+			if tt.tokenScopes != nil {
+				c.Set("scopes", tt.tokenScopes)
+			}
+			if got := HasScope(c, tt.scope); got != tt.want {
+				t.Errorf("HasScope(%s) = %v, want %v", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamTickets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tickets := NewStreamTickets(time.Minute)
+
+	// A viewer's API token limited to peers:read
+	issuer, _ := gin.CreateTestContext(httptest.NewRecorder())
+	issuer.Set("user_id", int64(7))
+	issuer.Set("username", "viewer")
+	issuer.Set("role", models.RoleViewer)
+	issuer.Set("scopes", []string{models.ScopePeersRead})
+	issuer.Set("api_token_id", int64(3))
+	ticket, err := tickets.Issue(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/events", tickets.Middleware(), func(c *gin.Context) {
+		if !HasScope(c, models.ScopePeersRead) || HasScope(c, models.ScopeUsersWrite) || HasScope(c, models.ScopeAuditRead) {
+			t.Errorf("stream has different scopes than its ticket's request")
+		}
+		if c.GetInt64("api_token_id") != 3 || c.GetInt64("user_id") != 7 {
+			t.Errorf("stream lost the ticket's API token or user")
+		}
+		c.Status(http.StatusOK)
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events?ticket="+ticket, nil))
+		if w.Code != want {
+			t.Errorf("use %d of the ticket: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
@@ -1,33 +1,207 @@
 package models
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	ID           int64     `json:"id"`
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"`
-	APIToken     string    `json:"-"`
+	Role         string    `json:"role"`     // See Role* constants
+	Disabled     bool      `json:"disabled"` // Disabled users cannot log in or use their tokens
+	TOTPEnabled  bool      `json:"totp_enabled"`
+	SSO          bool      `json:"sso"`         // Linked to an OIDC identity
+	MaxDevices   int       `json:"max_devices"` // Peers the user may own before requests for new devices are refused
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+// User roles, from most to least privileged
+const (
+	RoleAdmin    = "admin"    // Everything, including users, settings, webhooks and the audit log
+	RoleOperator = "operator" // Manage peers
+	RoleViewer   = "viewer"   // Read-only access to peers and status
+	RoleUser     = "user"     // Their own peers only, through the self-service portal
+)
+
+// ValidRole reports whether role is one of the Role* constants
+func ValidRole(role string) bool {
+	_, ok := RoleScopes[role]
+	return ok
+}
+
+// Permission scopes. Each route requires one; a user has the scopes of their role, and
+// a request with an API token only those of the token's scopes that the role grants.
+const (
+	ScopePeersRead     = "peers:read"     // Peers, their logs and traffic, live events, Tailscale status
+	ScopePeersWrite    = "peers:write"    // Create, change and delete peers, download their configs
+	ScopeSettingsRead  = "settings:read"  // Server settings
+	ScopeSettingsWrite = "settings:write" // Server settings, Tailscale and webhooks
+	ScopeUsersWrite    = "users:write"    // Users and other users' API tokens
+	ScopeAuditRead     = "audit:read"     // The audit log
+	ScopeDevices       = "devices:own"    // The user's own peers: list, download, disable and request new ones
+)
+
+// Scopes lists all scopes
+var Scopes = []string{ScopePeersRead, ScopePeersWrite, ScopeSettingsRead, ScopeSettingsWrite, ScopeUsersWrite, ScopeAuditRead, ScopeDevices}
+
+// RoleScopes lists the scopes each role grants
+var RoleScopes = map[string][]string{
+	RoleAdmin:    Scopes,
+	RoleOperator: {ScopePeersRead, ScopePeersWrite, ScopeSettingsRead},
+	RoleViewer:   {ScopePeersRead, ScopeSettingsRead},
+	RoleUser:     {ScopeDevices},
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	return containsScope(Scopes, scope)
+}
+
+// RoleHasScope reports whether role grants scope
+func RoleHasScope(role, scope string) bool {
+	return containsScope(RoleScopes[role], scope)
+}
+
+// APIToken is a named, revocable token for scripts and integrations. Only a hash of the
+// token is stored; the token itself is shown once, when it is created.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // Start of the token, to tell tokens apart
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token has an expiry date that has passed
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	return containsScope(t.Scopes, scope)
+}
+
+type CreateAPITokenRequest struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Optional, the token stops working after this time
+}
+
+type UpdateAPITokenRequest struct {
+	Name *string `json:"name,omitempty"`
+}
+
+// APITokenResponse is a token as returned by the API; Token is only set when it was just created
+type APITokenResponse struct {
+	APIToken
+	Token string `json:"token,omitempty"`
+}
+
 type Peer struct {
-	ID         int64     `json:"id"`
-	Name       string    `json:"name"`
-	PublicKey  string    `json:"public_key"`
-	PrivateKey string    `json:"-"` // Never exposed via API
-	AssignedIP string    `json:"assigned_ip"`
-	Enabled    bool      `json:"enabled"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID                int64      `json:"id"`
+	Name              string     `json:"name"`
+	PublicKey         string     `json:"public_key"`
+	PrivateKey        string     `json:"-"`               // Never exposed via API
+	HasPrivateKey     bool       `json:"has_private_key"` // False when the client brought its own key pair
+	PresharedKey      string     `json:"-"`               // Optional, never exposed via API
+	AssignedIP        string     `json:"assigned_ip"`
+	AssignedIPv6      string     `json:"assigned_ipv6,omitempty"` // Empty when no IPv6 subnet is configured
+	Enabled           bool       `json:"enabled"`
+	DisabledReason    string     `json:"disabled_reason,omitempty"` // Why the peer was disabled, see DisabledReason* constants
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`      // Peer is disabled automatically after this time
+	PreviousPublicKey string     `json:"-"`                         // Old key still routing during a key rotation grace period
+	KeyGraceUntil     *time.Time `json:"key_grace_until,omitempty"` // When the old key is dropped if the new one never connects
+	UsageRx           int64      `json:"usage_rx"`                  // Cumulative bytes received, kept across interface restarts
+	UsageTx           int64      `json:"usage_tx"`                  // Cumulative bytes sent, kept across interface restarts
+	MonthlyUsage      int64      `json:"-"`                         // Bytes (rx + tx) in UsageMonth, see CurrentMonthlyUsage
+	UsageMonth        string     `json:"-"`                         // Month MonthlyUsage was counted in, as "2006-01"
+	CounterRx         int64      `json:"-"`                         // Last interface rx counter, to compute usage deltas
+	CounterTx         int64      `json:"-"`                         // Last interface tx counter, to compute usage deltas
+	CounterKey        string     `json:"-"`                         // Public key the counters were read for, empty after a reset
+	MonthlyQuota      int64      `json:"monthly_quota"`             // Bytes (rx + tx) per calendar month, 0 for unlimited
+	TotalQuota        int64      `json:"total_quota"`               // Bytes (rx + tx) in total, 0 for unlimited
+	OwnerID           *int64     `json:"owner_id,omitempty"`        // User who sees the peer in the self-service portal
+	GroupID           *int64     `json:"group_id,omitempty"`        // Group whose client settings the peer inherits
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	// Client settings of this peer only, over its group's
+	Overrides ClientOverrides `json:"overrides"`
+}
+
+// Reasons recorded when a peer is disabled
+const (
+	DisabledReasonManual  = "manual"
+	DisabledReasonExpired = "expired"
+	DisabledReasonQuota   = "quota"
+	DisabledReasonGroup   = "group" // With its whole group, enabling the group enables it again
+)
+
+// UsageMonthFormat is the layout of Peer.UsageMonth
+const UsageMonthFormat = "2006-01"
+
+// IsExpired reports whether the peer's expiry date has passed
+func (p *Peer) IsExpired() bool {
+	return p.ExpiresAt != nil && !time.Now().Before(*p.ExpiresAt)
 }
 
+// CurrentMonthlyUsage returns the bytes used this calendar month
+func (p *Peer) CurrentMonthlyUsage() int64 {
+	if p.UsageMonth != time.Now().UTC().Format(UsageMonthFormat) {
+		return 0
+	}
+	return p.MonthlyUsage
+}
+
+// QuotaExceeded reports whether the peer has used up its monthly or total quota
+func (p *Peer) QuotaExceeded() bool {
+	if p.MonthlyQuota > 0 && p.CurrentMonthlyUsage() >= p.MonthlyQuota {
+		return true
+	}
+	return p.TotalQuota > 0 && p.UsageRx+p.UsageTx >= p.TotalQuota
+}
+
+// RefreshToken is one token of a session. Every refresh rotates it: the token is marked
+// rotated and a new one issued, so a rotated token coming back means it was copied.
 type RefreshToken struct {
-	ID        int64     `json:"id"`
-	UserID    int64     `json:"user_id"`
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"user_id"`
+	SessionID int64      `json:"session_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Session is a login, from the password (and second factor) until logout, revocation or
+// expiry, and the family of refresh tokens rotated within it
+type Session struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"user_id"`
+	AuthMethod string    `json:"auth_method"` // How the login was completed
+	UserAgent  string    `json:"user_agent"`
+	SourceIP   string    `json:"source_ip"` // Of the latest refresh
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // The session of the request listing it
 }
 
 // API Request/Response types
@@ -39,20 +213,118 @@ type LoginRequest struct {
 type LoginResponse struct {
 	AccessToken string `json:"access_token"`
 	ExpiresIn   int    `json:"expires_in"`
-	APIToken    string `json:"api_token"`
+}
+
+// TwoFactorChallenge answers a login with the right password for a user with two-factor
+// authentication. The challenge and a code are then sent to /auth/login/2fa for the tokens.
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type LoginTwoFactorRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"` // Authenticator code or recovery code
+}
+
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TwoFactorSetupResponse holds a new secret to add to an authenticator app, as text, as an
+// otpauth:// URI and as a QR code of that URI (PNG data URI)
+type TwoFactorSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QRCode string `json:"qr_code"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"` // Authenticator code or recovery code
+}
+
+// RecoveryCodesResponse holds new recovery codes, shown only this once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type CreateUserRequest struct {
+	Username   string `json:"username" binding:"required,max=64"`
+	Password   string `json:"password" binding:"required,min=8"`
+	Role       string `json:"role" binding:"required"`
+	MaxDevices *int   `json:"max_devices,omitempty"` // Defaults to portal.default_max_devices
+}
+
+type UpdateUserRequest struct {
+	Role       *string `json:"role,omitempty"`
+	Disabled   *bool   `json:"disabled,omitempty"`
+	Password   *string `json:"password,omitempty"` // Set a new password, signing the user out everywhere
+	MaxDevices *int    `json:"max_devices,omitempty"`
+	// Turn off two-factor authentication for a user who lost their authenticator and recovery codes
+	ResetTwoFactor bool `json:"reset_two_factor,omitempty"`
 }
 
 type CreatePeerRequest struct {
-	Name string `json:"name" binding:"required"`
+	Name         string     `json:"name" binding:"required"`
+	PublicKey    string     `json:"public_key,omitempty"`    // Optional client-generated key; the server then never sees the private key
+	PresharedKey *bool      `json:"preshared_key,omitempty"` // Generate a preshared key; defaults to wireguard.preshared_keys
+	AssignedIP   string     `json:"assigned_ip,omitempty"`   // Optional static IPv4, auto-assigned when empty
+	AssignedIPv6 string     `json:"assigned_ipv6,omitempty"` // Optional static IPv6, auto-assigned when empty
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`    // Optional, peer is disabled automatically after this time
+	MonthlyQuota int64      `json:"monthly_quota,omitempty"` // Optional bytes (rx + tx) per calendar month
+	TotalQuota   int64      `json:"total_quota,omitempty"`   // Optional bytes (rx + tx) in total
+	OwnerID      *int64     `json:"owner_id,omitempty"`      // Optional user who gets the peer in their self-service portal
+	GroupID      *int64     `json:"group_id,omitempty"`      // Optional group whose client settings the peer inherits
+
+	// Optional client settings of this peer only
+	Overrides *ClientOverrides `json:"overrides,omitempty"`
+}
+
+// CreateDeviceRequest is an end user's request for a new peer of their own
+type CreateDeviceRequest struct {
+	Name      string `json:"name" binding:"required,max=64"`
+	PublicKey string `json:"public_key,omitempty"` // Optional client-generated key
+}
+
+// DevicesResponse lists the requesting user's peers and how many more they may request
+type DevicesResponse struct {
+	Devices    []PeerResponse `json:"devices"`
+	MaxDevices int            `json:"max_devices"`
 }
 
 type PeerResponse struct {
-	ID              int64     `json:"id"`
-	Name            string    `json:"name"`
-	PublicKey       string    `json:"public_key"`
-	AssignedIP      string    `json:"assigned_ip"`
-	Enabled         bool      `json:"enabled"`
-	CreatedAt       time.Time `json:"created_at"`
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	PublicKey       string     `json:"public_key"`
+	AssignedIP      string     `json:"assigned_ip"`
+	AssignedIPv6    string     `json:"assigned_ipv6,omitempty"`
+	HasPrivateKey   bool       `json:"has_private_key"`
+	HasPresharedKey bool       `json:"has_preshared_key"`
+	Enabled         bool       `json:"enabled"`
+	DisabledReason  string     `json:"disabled_reason,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	Expired         bool       `json:"expired"`
+	KeyGraceUntil   *time.Time `json:"key_grace_until,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	// Persisted usage and quotas (0 = unlimited, remaining is omitted then)
+	UsageRx          int64  `json:"usage_rx"`
+	UsageTx          int64  `json:"usage_tx"`
+	MonthlyUsage     int64  `json:"monthly_usage"`
+	MonthlyQuota     int64  `json:"monthly_quota"`
+	MonthlyRemaining *int64 `json:"monthly_remaining,omitempty"`
+	TotalQuota       int64  `json:"total_quota"`
+	TotalRemaining   *int64 `json:"total_remaining,omitempty"`
+	OwnerID          *int64 `json:"owner_id,omitempty"`
+	GroupID          *int64 `json:"group_id,omitempty"`
+	// Client settings of this peer only
+	Overrides ClientOverrides `json:"overrides"`
 	// Real-time stats
 	IsOnline        bool      `json:"is_online"`
 	LatestHandshake time.Time `json:"latest_handshake,omitempty"`
@@ -62,8 +334,119 @@ type PeerResponse struct {
 }
 
 type UpdatePeerRequest struct {
-	Name    *string `json:"name,omitempty"`
-	Enabled *bool   `json:"enabled,omitempty"`
+	Name         *string `json:"name,omitempty"`
+	Enabled      *bool   `json:"enabled,omitempty"`
+	AssignedIP   *string `json:"assigned_ip,omitempty"`
+	AssignedIPv6 *string `json:"assigned_ipv6,omitempty"`
+	ExpiresAt    *string `json:"expires_at,omitempty"`    // RFC 3339 timestamp, or "" to remove the expiry
+	MonthlyQuota *int64  `json:"monthly_quota,omitempty"` // Bytes, 0 removes the quota
+	TotalQuota   *int64  `json:"total_quota,omitempty"`   // Bytes, 0 removes the quota
+	OwnerID      *int64  `json:"owner_id,omitempty"`      // User ID, 0 removes the owner
+	GroupID      *int64  `json:"group_id,omitempty"`      // Group ID, 0 removes the peer from its group
+
+	// Replaces all of the peer's overrides, {} removes them
+	Overrides *ClientOverrides `json:"overrides,omitempty"`
+}
+
+// ClientSettings are the client config values that can differ between peers. Empty values
+// are inherited: DNS and AllowedIPs from the server settings, keepalive from the default of
+// 25 seconds, and without an MTU the client picks its own.
+type ClientSettings struct {
+	DNS                 string `json:"dns,omitempty"`                  // Comma-separated resolvers and search domains
+	AllowedIPs          string `json:"allowed_ips,omitempty"`          // Comma-separated prefixes routed through the tunnel
+	MTU                 int    `json:"mtu,omitempty"`                  // 0 leaves the MTU to the client
+	PersistentKeepalive *int   `json:"persistent_keepalive,omitempty"` // Seconds, 0 turns it off
+}
+
+// ClientOverrides are client settings of a single peer. They win over its group's and the
+// server's, e.g. a split tunnel for one device while the others use a full tunnel.
+type ClientOverrides struct {
+	ClientSettings
+	EndpointHost   string   `json:"endpoint_host,omitempty"`   // Replaces the host of wireguard.server_endpoint
+	EndpointPort   int      `json:"endpoint_port,omitempty"`   // Replaces the port of wireguard.server_endpoint
+	InterfaceLines []string `json:"interface_lines,omitempty"` // Extra "Key = Value" lines in [Interface]
+}
+
+// PeerGroup gives its peers shared client settings, e.g. a full tunnel for some and a split
+// tunnel to the office network for others, and lets them be enabled and disabled together
+type PeerGroup struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	ClientSettings
+	PeerCount int       `json:"peer_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreatePeerGroupRequest struct {
+	Name        string `json:"name" binding:"required,max=64"`
+	Description string `json:"description,omitempty"`
+	ClientSettings
+}
+
+type UpdatePeerGroupRequest struct {
+	Name                *string `json:"name,omitempty"`
+	Description         *string `json:"description,omitempty"`
+	DNS                 *string `json:"dns,omitempty"`                  // "" inherits the server setting again
+	AllowedIPs          *string `json:"allowed_ips,omitempty"`          // "" inherits the server setting again
+	MTU                 *int    `json:"mtu,omitempty"`                  // 0 leaves the MTU to the client
+	PersistentKeepalive *int    `json:"persistent_keepalive,omitempty"` // -1 inherits the default again
+}
+
+// PeerGroupActionResponse reports what enabling or disabling a group did to each member
+type PeerGroupActionResponse struct {
+	Group   PeerGroup      `json:"group"`
+	Changed []PeerResponse `json:"changed"`           // Members whose enabled state changed
+	Skipped []SkippedPeer  `json:"skipped,omitempty"` // Members left as they were, with the reason
+}
+
+type SkippedPeer struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	AssignedIP string `json:"assigned_ip"`
+	Reason     string `json:"reason"`
+}
+
+// What a share link downloads
+const (
+	ShareKindConfig = "config"
+	ShareKindQRCode = "qrcode"
+)
+
+// ShareLink is a one-time, expiring link to a peer's config or QR code that works without
+// logging in. Only a hash of its token is stored; the URL is shown once, when it is created.
+type ShareLink struct {
+	ID         int64      `json:"id"`
+	PeerID     int64      `json:"peer_id"`
+	PeerName   string     `json:"peer_name"`
+	Kind       string     `json:"kind"`       // See ShareKind* constants
+	CreatedBy  string     `json:"created_by"` // Username
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"` // Set by the download, which ends the link
+	ConsumedIP string     `json:"consumed_ip,omitempty"`
+}
+
+// Usable reports whether the link has neither been used nor expired
+func (l *ShareLink) Usable(now time.Time) bool {
+	return l.ConsumedAt == nil && now.Before(l.ExpiresAt)
+}
+
+type CreateShareLinkRequest struct {
+	Kind             string `json:"kind,omitempty"`               // config (default) or qrcode
+	ExpiresInMinutes int    `json:"expires_in_minutes,omitempty"` // Default 24 hours, at most 7 days
+}
+
+// ShareLinkResponse is a share link as returned by the API; URL is only set when it was just created
+type ShareLinkResponse struct {
+	ShareLink
+	URL string `json:"url,omitempty"`
+}
+
+type RotateKeysRequest struct {
+	PublicKey          string `json:"public_key,omitempty"`           // Optional client-generated key; otherwise a key pair is generated
+	GracePeriodMinutes int    `json:"grace_period_minutes,omitempty"` // Keep the old key valid until the new one connects or this expires
 }
 
 type ErrorResponse struct {
@@ -71,18 +454,204 @@ type ErrorResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
+// ConnectionLog is one session of a peer: from its first handshake until the handshake went
+// stale or the peer roamed to another endpoint
 type ConnectionLog struct {
-	ID          int64     `json:"id"`
-	PeerID      int64     `json:"peer_id"`
-	Endpoint    string    `json:"endpoint"`
-	ConnectedAt time.Time `json:"connected_at"`
+	ID             int64      `json:"id"`
+	PeerID         int64      `json:"peer_id"`
+	Endpoint       string     `json:"endpoint"`
+	ConnectedAt    time.Time  `json:"connected_at"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"` // Nil while the session is active
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	Duration       int64      `json:"duration"` // Seconds, up to now for active sessions
+	RxBytes        int64      `json:"rx_bytes"`
+	TxBytes        int64      `json:"tx_bytes"`
+	CounterRx      int64      `json:"-"` // Interface counters at the last poll, to compute byte deltas
+	CounterTx      int64      `json:"-"`
+}
+
+// TrafficPoint is the traffic of a peer in one bucket of a traffic series
+type TrafficPoint struct {
+	Time time.Time `json:"time"` // Bucket start
+	Rx   int64     `json:"rx"`
+	Tx   int64     `json:"tx"`
+}
+
+type TrafficSeriesResponse struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Step   int64          `json:"step"` // Bucket size in seconds
+	Points []TrafficPoint `json:"points"`
+}
+
+// Webhook is an HTTP endpoint notified of events, with payloads signed by Secret
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`      // HMAC-SHA256 key for the signature header, encrypted at rest
+	Events    []string  `json:"events"` // Event types to deliver, all when empty
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Wants reports whether the webhook is enabled and subscribed to eventType
+func (w *Webhook) Wants(eventType string) bool {
+	if !w.Enabled {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"   // Waiting for its first or next attempt
+	DeliveryDelivered = "delivered" // Answered with a 2xx status
+	DeliveryFailed    = "failed"    // Gave up after the last attempt
+)
+
+// WebhookDelivery is one event sent to one webhook, with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID            int64      `json:"id"`
+	WebhookID     int64      `json:"webhook_id"`
+	EventType     string     `json:"event_type"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // Nil once delivered or failed
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+type CreateWebhookRequest struct {
+	Name    string   `json:"name" binding:"required"`
+	URL     string   `json:"url" binding:"required"`
+	Secret  string   `json:"secret,omitempty"` // Generated when empty
+	Events  []string `json:"events,omitempty"` // All events when empty
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+type UpdateWebhookRequest struct {
+	Name         *string   `json:"name,omitempty"`
+	URL          *string   `json:"url,omitempty"`
+	Events       *[]string `json:"events,omitempty"` // Empty list subscribes to all events
+	Enabled      *bool     `json:"enabled,omitempty"`
+	RotateSecret bool      `json:"rotate_secret,omitempty"` // Generate a new secret, returned in the response
+}
+
+// WebhookResponse is a webhook as returned by the API; Secret is only set when it was just created
+type WebhookResponse struct {
+	Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// How a request was authenticated, recorded in the audit log
+const (
+	AuthMethodJWT          = "jwt"
+	AuthMethodAPIToken     = "api_token"
+	AuthMethodStreamTicket = "stream_ticket"
+	AuthMethodPassword     = "password"      // Login requests
+	AuthMethodTOTP         = "totp"          // Second login step with an authenticator code
+	AuthMethodRecoveryCode = "recovery_code" // Second login step with a recovery code
+	AuthMethodOIDC         = "oidc"          // Single sign-on through the identity provider
+	AuthMethodRefreshToken = "refresh_token" // Logout requests
+	AuthMethodShareLink    = "share_link"    // Downloads through a share link, without a user
+)
+
+// AuditEntry records one administrative action: who did it, from where, and the target's
+// state before and after (JSON snapshots, omitted when the target did not exist)
+type AuditEntry struct {
+	ID         int64                  `json:"id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UserID     int64                  `json:"user_id,omitempty"`
+	Username   string                 `json:"username"`
+	SourceIP   string                 `json:"source_ip"`
+	AuthMethod string                 `json:"auth_method"`
+	Action     string                 `json:"action"`
+	Target     string                 `json:"target,omitempty"`
+	Before     json.RawMessage        `json:"before,omitempty"`
+	After      json.RawMessage        `json:"after,omitempty"`
+	Changes    map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is the before and after value of one changed field
+type AuditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// FillChanges sets Changes to the top-level fields that differ between Before and After
+func (e *AuditEntry) FillChanges() {
+	var before, after map[string]json.RawMessage
+	if json.Unmarshal(e.Before, &before) != nil || json.Unmarshal(e.After, &after) != nil {
+		return
+	}
+
+	null := json.RawMessage("null")
+	changes := make(map[string]AuditChange)
+	for key, value := range before {
+		if other, ok := after[key]; !ok || !bytes.Equal(value, other) {
+			if !ok {
+				other = null
+			}
+			changes[key] = AuditChange{Before: value, After: other}
+		}
+	}
+	for key, value := range after {
+		if _, ok := before[key]; !ok {
+			changes[key] = AuditChange{Before: null, After: value}
+		}
+	}
+	if len(changes) > 0 {
+		e.Changes = changes
+	}
+}
+
+// AuditFilter selects audit log entries; empty fields match everything
+type AuditFilter struct {
+	Action   string // Exact action, or a prefix ending in "." such as "peer."
+	Username string
+	Target   string
+	From     *time.Time
+	To       *time.Time
+}
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+}
+
+// LoginLockout is the failed login state of a username, which need not exist
+type LoginLockout struct {
+	Username      string     `json:"username"`
+	Failures      int        `json:"failures"` // In a row, reset by a successful login or an unlock
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	SourceIPs     []string   `json:"source_ips"` // Most recent first
+}
+
+// Locked reports whether logins are refused at the given time
+func (l *LoginLockout) Locked(now time.Time) bool {
+	return l.LockedUntil != nil && now.Before(*l.LockedUntil)
 }
 
 type SettingsResponse struct {
 	DNS            string `json:"dns"`
 	AllowedIPs     string `json:"allowed_ips"`
 	LoggingEnabled bool   `json:"logging_enabled"`
-	APIToken       string `json:"api_token"`
 }
 
 type UpdateSettingsRequest struct {
@@ -0,0 +1,442 @@
+// Package oidc signs panel users in through an OpenID Connect identity provider with the
+// authorization code flow and PKCE. The provider's endpoints come from discovery and ID tokens
+// are verified against its published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/models"
+)
+
+const (
+	httpTimeout     = 10 * time.Second
+	maxResponseSize = 1 << 20
+	keysMaxAge      = time.Hour       // Keys are fetched again after this, to pick up rotations
+	keysMinInterval = 1 * time.Minute // An unknown key ID refetches the keys at most this often
+	clockSkew       = time.Minute
+)
+
+// signingMethods are the ID token algorithms accepted; "none" and HMAC never are
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// ErrNoRole is returned by Role for users in none of the mapped groups without a default role
+var ErrNoRole = errors.New("not a member of any group with access to the panel")
+
+// Identity is the signed-in person as described by a verified ID token
+type Identity struct {
+	Subject  string // Stable ID at the provider
+	Username string // From the configured username claim, falling back to email and subject
+	Email    string
+	Groups   []string // From the configured groups claim
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one identity provider. Discovery happens on first use, so the panel
+// starts while the provider is unreachable.
+type Provider struct {
+	cfg    *config.OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *discoveryDocument
+	keys        map[string]interface{} // Public keys by key ID
+	keysFetched time.Time
+}
+
+// ValidateConfig reports settings that would make every login fail
+func ValidateConfig(cfg *config.OIDCConfig) error {
+	for _, required := range []struct{ name, value string }{
+		{"issuer", cfg.Issuer},
+		{"client_id", cfg.ClientID},
+		{"redirect_url", cfg.RedirectURL},
+	} {
+		if required.value == "" {
+			return fmt.Errorf("oidc.%s is required", required.name)
+		}
+	}
+	if cfg.DefaultRole != "" && !models.ValidRole(cfg.DefaultRole) {
+		return fmt.Errorf("oidc.default_role %q is not a role", cfg.DefaultRole)
+	}
+	if cfg.UsernameClaim == "" {
+		return errors.New("oidc.username_claim is required")
+	}
+	return nil
+}
+
+func NewProvider(cfg *config.OIDCConfig) *Provider {
+	return &Provider{cfg: cfg, client: &http.Client{Timeout: httpTimeout}}
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge
+func NewPKCE() (verifier, challenge string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func normalizeIssuer(issuer string) string {
+	return strings.TrimSuffix(issuer, "/")
+}
+
+// getJSON fetches a JSON document from the provider
+func (p *Provider) getJSON(ctx context.Context, endpoint string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dest)
+}
+
+// endpoints returns the discovery document, fetching it on first use
+func (p *Provider) endpoints(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var doc discoveryDocument
+	if err := p.getJSON(ctx, normalizeIssuer(p.cfg.Issuer)+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	// The document must describe the configured issuer, or tokens from another one could pass
+	if normalizeIssuer(doc.Issuer) != normalizeIssuer(p.cfg.Issuer) {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or JWKS endpoint")
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// AuthCodeURL returns the provider's login page URL to send the browser to
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	doc, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.cfg.ClientID)
+	params.Set("redirect_uri", p.cfg.RedirectURL)
+	params.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", challenge)
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return doc.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code for the raw ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	doc, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no ID token, is the openid scope requested?")
+	}
+	return body.IDToken, nil
+}
+
+// jsonWebKey is one key of a JWKS document (RFC 7517), RSA or EC
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// publicKey converts a JWK to an *rsa.PublicKey or *ecdsa.PublicKey
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// fetchKeys reads the provider's signing keys. Keys it cannot use are skipped.
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching keys failed: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the provider publishes no usable signing keys")
+	}
+	return keys, nil
+}
+
+// key returns the public key with the given ID, refetching the keys when they are old or the
+// ID is unknown, which is how a key rotation at the provider shows up
+func (p *Provider) key(ctx context.Context, jwksURI, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lookup := func() (interface{}, bool) {
+		if key, ok := p.keys[kid]; ok {
+			return key, true
+		}
+		// Tokens without a key ID are fine while the provider has a single key
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	age := time.Since(p.keysFetched)
+	if key, ok := lookup(); ok && age < keysMaxAge {
+		return key, nil
+	}
+	if p.keys == nil || age >= keysMinInterval {
+		keys, err := p.fetchKeys(ctx, jwksURI)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysFetched = keys, time.Now()
+	}
+	if key, ok := lookup(); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Verify checks an ID token's signature, issuer, audience, expiry and nonce and returns who it
+// identifies
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	doc, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, doc.JWKSURI, kid)
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(doc.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("invalid ID token: nonce does not match the login")
+	}
+	// A token for several audiences must name this client as the one it was issued to
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return nil, errors.New("invalid ID token: issued to another client")
+		}
+	}
+
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("invalid ID token: no subject")
+	}
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims[p.cfg.UsernameClaim].(string)
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Subject
+	}
+	identity.Groups = stringList(claims[p.cfg.GroupsClaim])
+	return identity, nil
+}
+
+// stringList reads a claim holding either a list of strings or a single string
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Role maps a person's groups to a panel role, the most privileged one any group grants
+func (p *Provider) Role(groups []string) (string, error) {
+	member := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		member[group] = true
+	}
+	for _, mapping := range []struct {
+		role   string
+		groups []string
+	}{
+		{models.RoleAdmin, p.cfg.AdminGroups},
+		{models.RoleOperator, p.cfg.OperatorGroups},
+		{models.RoleViewer, p.cfg.ViewerGroups},
+		{models.RoleUser, p.cfg.UserGroups},
+	} {
+		for _, group := range mapping.groups {
+			if member[group] {
+				return mapping.role, nil
+			}
+		}
+	}
+	if p.cfg.DefaultRole != "" {
+		return p.cfg.DefaultRole, nil
+	}
+	return "", ErrNoRole
+}
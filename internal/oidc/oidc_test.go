@@ -0,0 +1,305 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/models"
+)
+
+const (
+	testClientID     = "panel"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://vpn.example.com/api/v1/auth/oidc/callback"
+)
+
+// mockIdP is a minimal identity provider: discovery, JWKS, an authorize endpoint that logs
+// the configured person in right away, and a token endpoint that checks PKCE
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu     sync.Mutex
+	key    *rsa.PrivateKey
+	kid    string
+	claims jwt.MapClaims // Claims of the person logging in, on top of the standard ones
+	codes  map[string]authorization
+}
+
+type authorization struct {
+	challenge, nonce string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{t: t, codes: make(map[string]authorization)}
+	idp.rotateKey("key-1")
+	idp.claims = jwt.MapClaims{"sub": "user-42", "preferred_username": "alice", "email": "alice@example.com", "groups": []string{"vpn-admins"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", idp.serveKeys)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) rotateKey(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key, idp.kid = key, kid
+}
+
+func (idp *mockIdP) serveKeys(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"use": "sig",
+		"kid": idp.kid,
+		"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code := "code-" + q.Get("state")
+	idp.mu.Lock()
+	idp.codes[code] = authorization{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	idp.mu.Unlock()
+	http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != testClientID || secret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	auth, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge || r.PostFormValue("redirect_uri") != testRedirectURL {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(jwt.MapClaims{"nonce": auth.nonce}), "token_type": "Bearer"})
+}
+
+// sign issues an ID token for the configured person; extra claims override the defaults
+func (idp *mockIdP) sign(extra jwt.MapClaims) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	now := time.Now()
+	claims := jwt.MapClaims{"iss": idp.server.URL, "aud": testClientID, "iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix()}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed
+}
+
+func testProvider(idp *mockIdP) *Provider {
+	return NewProvider(&config.OIDCConfig{
+		Issuer:         idp.server.URL + "/",
+		ClientID:       testClientID,
+		ClientSecret:   testClientSecret,
+		RedirectURL:    testRedirectURL,
+		Scopes:         []string{"openid", "profile", "groups"},
+		UsernameClaim:  "preferred_username",
+		GroupsClaim:    "groups",
+		AdminGroups:    []string{"vpn-admins"},
+		OperatorGroups: []string{"helpdesk"},
+	})
+}
+
+func TestLoginFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	p := testProvider(idp)
+	ctx := context.Background()
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginURL, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Follow the browser to the IdP and back to the callback
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Query().Get("state") != "state-1" {
+		t.Fatalf("IdP redirected to %q", resp.Header.Get("Location"))
+	}
+
+	if _, err := p.Exchange(ctx, callback.Query().Get("code"), "wrong-verifier"); err == nil {
+		t.Error("code was redeemed with the wrong PKCE verifier")
+	}
+	resp, _ = client.Get(loginURL)
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+
+	idToken, err := p.Exchange(ctx, callback.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := p.Verify(ctx, idToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "user-42" || identity.Username != "alice" || strings.Join(identity.Groups, ",") != "vpn-admins" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if role, err := p.Role(identity.Groups); err != nil || role != models.RoleAdmin {
+		t.Errorf("role = %q, %v, want admin", role, err)
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	idp := newMockIdP(t)
+	p := testProvider(idp)
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, idp.sign(jwt.MapClaims{"nonce": "n"}), "n"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": idp.server.URL, "aud": testClientID, "sub": "x", "nonce": "n", "exp": time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte(testClientSecret))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong nonce", idp.sign(jwt.MapClaims{"nonce": "other"})},
+		{"no nonce", idp.sign(nil)},
+		{"other audience", idp.sign(jwt.MapClaims{"nonce": "n", "aud": "another-app"})},
+		{"several audiences without azp", idp.sign(jwt.MapClaims{"nonce": "n", "aud": []string{testClientID, "another-app"}})},
+		{"other issuer", idp.sign(jwt.MapClaims{"nonce": "n", "iss": "https://evil.example.com"})},
+		{"expired", idp.sign(jwt.MapClaims{"nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()})},
+		{"no expiry", idp.sign(jwt.MapClaims{"nonce": "n", "exp": nil})},
+		{"no subject", idp.sign(jwt.MapClaims{"nonce": "n", "sub": ""})},
+		{"HMAC with the client secret", hmacToken},
+		{"tampered", idp.sign(jwt.MapClaims{"nonce": "n"}) + "x"},
+	}
+	for _, tt := range tests {
+		if _, err := p.Verify(ctx, tt.token, "n"); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+
+	if _, err := p.Verify(ctx, idp.sign(jwt.MapClaims{"nonce": "n", "aud": []string{testClientID, "another-app"}, "azp": testClientID}), "n"); err != nil {
+		t.Errorf("token for several audiences with azp rejected: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	p := testProvider(idp)
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, idp.sign(jwt.MapClaims{"nonce": "n"}), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.rotateKey("key-2")
+	rotated := idp.sign(jwt.MapClaims{"nonce": "n"})
+	if _, err := p.Verify(ctx, rotated, "n"); err == nil {
+		t.Error("unknown key ID refetched the keys right after the last fetch")
+	}
+	p.keysFetched = p.keysFetched.Add(-keysMinInterval)
+	if _, err := p.Verify(ctx, rotated, "n"); err != nil {
+		t.Errorf("token signed with the rotated key: %v", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	p := testProvider(idp)
+	p.cfg.Issuer = idp.server.URL + "/realms/other"
+	if _, err := p.AuthCodeURL(context.Background(), "s", "n", "c"); err == nil {
+		t.Error("discovery for another issuer was accepted")
+	}
+}
+
+func TestRole(t *testing.T) {
+	p := NewProvider(&config.OIDCConfig{
+		AdminGroups:    []string{"admins"},
+		OperatorGroups: []string{"helpdesk"},
+		ViewerGroups:   []string{"staff"},
+	})
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"staff", "helpdesk"}, models.RoleOperator},
+		{[]string{"staff", "admins"}, models.RoleAdmin},
+		{[]string{"staff"}, models.RoleViewer},
+	}
+	for _, tt := range tests {
+		if got, err := p.Role(tt.groups); err != nil || got != tt.want {
+			t.Errorf("Role(%v) = %q, %v, want %q", tt.groups, got, err, tt.want)
+		}
+	}
+
+	if _, err := p.Role([]string{"contractors"}); err != ErrNoRole {
+		t.Errorf("unmapped groups: %v, want ErrNoRole", err)
+	}
+	p.cfg.DefaultRole = models.RoleViewer
+	if got, _ := p.Role(nil); got != models.RoleViewer {
+		t.Errorf("default role = %q, want viewer", got)
+	}
+}
@@ -0,0 +1,259 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted values look like "enc:v1:<key id>:<wrapped data key>:<ciphertext>"
+// Each value gets its own random data key, which is wrapped (encrypted) with the master key,
+// so rotating the master key only needs the data keys re-wrapped, not the values re-encrypted
+const prefix = "enc:v1:"
+
+var (
+	ErrInvalidKey        = errors.New("master key must be 32 bytes")
+	ErrMalformed         = errors.New("malformed encrypted value")
+	ErrKeyMismatch       = errors.New("value was encrypted with a different master key")
+	ErrDecryptionFailure = errors.New("failed to decrypt value")
+	ErrMasterKeyMissing  = errors.New("master key missing")
+)
+
+// Cipher encrypts and decrypts secrets with AES-256-GCM envelope encryption
+type Cipher struct {
+	kek   cipher.AEAD // Key-encryption key derived from the master key
+	keyID string
+}
+
+// New creates a Cipher from a 32-byte master key
+func New(masterKey []byte) (*Cipher, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	kek, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(masterKey)
+	return &Cipher{kek: kek, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+// LoadMasterKey returns the master key from a base64 value (e.g. an environment variable)
+// if one is given, otherwise from keyFile, which is created on first use when allowCreate is set
+func LoadMasterKey(encoded, keyFile string, allowCreate bool) ([]byte, error) {
+	if encoded != "" {
+		return decodeKey(strings.TrimSpace(encoded))
+	}
+	return LoadOrCreateKeyFile(keyFile, allowCreate)
+}
+
+// GenerateKey returns a new random 32-byte master key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	return key, nil
+}
+
+// EncodeKey returns the base64 form used in key files and environment variables
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// WriteKeyFile writes a master key to path with mode 0600
+func WriteKeyFile(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(EncodeKey(key)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// LoadOrCreateKeyFile reads a base64 master key from path, generating one (mode 0600) if missing
+// and allowCreate is set. Callers must not allow creation when data encrypted under an earlier
+// key exists: a fresh key could never decrypt it, so ErrMasterKeyMissing is returned instead.
+func LoadOrCreateKeyFile(path string, allowCreate bool) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return decodeKey(strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if !allowCreate {
+		return nil, fmt.Errorf("%w: %s does not exist but the database holds encrypted secrets; restore the key file or set DB_MASTER_KEY", ErrMasterKeyMissing, path)
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteKeyFile(path, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// KeyID returns a short fingerprint of the master key, stored with every value
+func (c *Cipher) KeyID() string {
+	return c.keyID
+}
+
+// IsEncrypted reports whether value is in the encrypted format
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt encrypts plaintext under a fresh data key; empty strings stay empty
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	dek, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(c.kek, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dek, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + c.keyID + ":" + wrapped + ":" + ciphertext, nil
+}
+
+// Decrypt reverses Encrypt; empty strings stay empty
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	keyID, wrapped, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+	if keyID != c.keyID {
+		return "", ErrKeyMismatch
+	}
+
+	dataKey, err := open(c.kek, wrapped)
+	if err != nil {
+		return "", err
+	}
+	dek, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dek, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap re-encrypts the data key of value under another master key
+// The value's ciphertext is left untouched; values already under `to` are returned as-is
+func (c *Cipher) Rewrap(value string, to *Cipher) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	keyID, wrapped, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+	if keyID == to.keyID {
+		return value, nil
+	}
+	if keyID != c.keyID {
+		return "", ErrKeyMismatch
+	}
+
+	dataKey, err := open(c.kek, wrapped)
+	if err != nil {
+		return "", err
+	}
+	rewrapped, err := seal(to.kek, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + to.keyID + ":" + rewrapped + ":" + ciphertext, nil
+}
+
+func split(value string) (keyID, wrapped, ciphertext string, err error) {
+	if !IsEncrypted(value) {
+		return "", "", "", ErrMalformed
+	}
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", "", "", ErrMalformed
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns base64(nonce || ciphertext)
+func seal(aead cipher.AEAD, plaintext []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func open(aead cipher.AEAD, encoded string) ([]byte, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailure
+	}
+	return plaintext, nil
+}
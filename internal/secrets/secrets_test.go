@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.key")
+
+	// Refused while the database holds encrypted data
+	if _, err := LoadOrCreateKeyFile(path, false); !errors.Is(err, ErrMasterKeyMissing) {
+		t.Fatalf("LoadOrCreateKeyFile(missing, false) error = %v, want ErrMasterKeyMissing", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("key file was created although creation was not allowed")
+	}
+
+	created, err := LoadOrCreateKeyFile(path, true)
+	if err != nil {
+		t.Fatalf("LoadOrCreateKeyFile(missing, true) error = %v", err)
+	}
+
+	// An existing key file is always loaded, whatever allowCreate says
+	loaded, err := LoadOrCreateKeyFile(path, false)
+	if err != nil {
+		t.Fatalf("LoadOrCreateKeyFile(existing, false) error = %v", err)
+	}
+	if string(loaded) != string(created) {
+		t.Fatalf("loaded key differs from the created key")
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("private key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) {
+		t.Fatalf("Encrypt returned %q, not in the encrypted format", encrypted)
+	}
+	if decrypted, err := c.Decrypt(encrypted); err != nil || decrypted != "private key" {
+		t.Fatalf("Decrypt = %q, %v", decrypted, err)
+	}
+
+	otherKey, _ := GenerateKey()
+	other, _ := New(otherKey)
+	if _, err := other.Decrypt(encrypted); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("Decrypt with another key error = %v, want ErrKeyMismatch", err)
+	}
+}
@@ -0,0 +1,349 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/models"
+)
+
+// Events lists the event types webhooks can subscribe to
+var Events = []string{
+	events.PeerCreated,
+	events.PeerDeleted,
+	events.PeerEnabled,
+	events.PeerDisabled,
+	events.PeerOnline,
+	events.PeerOffline,
+	events.PeerQuotaExceeded,
+	events.LoginFailureBurst,
+	events.AccountLocked,
+	events.RefreshTokenReused,
+	events.TailscaleConnected,
+	events.TailscaleDisconnected,
+}
+
+// TestEvent is sent by the test-fire endpoint, to the tested webhook only
+const TestEvent = "webhook.test"
+
+// Supported reports whether eventType can be delivered to webhooks
+func Supported(eventType string) bool {
+	for _, e := range Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Request headers of a delivery. The signature covers the timestamp and the body,
+// so receivers can reject replayed requests.
+const (
+	SignatureHeader = "X-Wgeasygo-Signature" // "sha256=" + hex HMAC-SHA256 of "<timestamp>.<body>"
+	TimestampHeader = "X-Wgeasygo-Timestamp" // Unix seconds
+	EventHeader     = "X-Wgeasygo-Event"
+	DeliveryHeader  = "X-Wgeasygo-Delivery" // Delivery ID, the same for every retry
+)
+
+const (
+	maxAttempts    = 8                // Attempts before a delivery is given up
+	retryBase      = 30 * time.Second // Delay after the first failed attempt, doubled after each further one
+	retryMax       = time.Hour
+	requestTimeout = 10 * time.Second
+	pollInterval   = 10 * time.Second // How often due retries and webhook changes are picked up
+	batchSize      = 50
+	maxErrorLength = 500
+)
+
+// Sign returns the signature header value for a request body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RetryDelay returns how long to wait after the given failed attempt (1-based)
+func RetryDelay(attempt int) time.Duration {
+	delay := retryBase
+	for i := 1; i < attempt && delay < retryMax; i++ {
+		delay *= 2
+	}
+	if delay > retryMax {
+		delay = retryMax
+	}
+	return delay
+}
+
+// Dispatcher turns hub events into webhook deliveries and sends them, retrying failures
+// with exponential backoff. Deliveries are stored before they are sent, so pending retries
+// survive a restart and every attempt shows up in the delivery log.
+type Dispatcher struct {
+	hub     *events.Hub
+	client  *http.Client
+	changed chan struct{} // Webhooks were added, edited or removed
+	pending chan struct{} // New deliveries were queued
+}
+
+func NewDispatcher(hub *events.Hub) *Dispatcher {
+	return &Dispatcher{
+		hub: hub,
+		client: &http.Client{
+			Timeout: requestTimeout,
+			// A redirect would turn the POST into a GET, report it as a failure instead
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		changed: make(chan struct{}, 1),
+		pending: make(chan struct{}, 1),
+	}
+}
+
+// WebhooksChanged makes the dispatcher re-check whether any webhook is enabled
+func (d *Dispatcher) WebhooksChanged() {
+	notify(d.changed)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Run queues deliveries for hub events and sends them until ctx is done. It only subscribes
+// to the hub while a webhook is enabled, so peer stats are not sampled for nobody.
+func (d *Dispatcher) Run(ctx context.Context) {
+	go d.deliverLoop(ctx)
+
+	var ch <-chan events.Event
+	var unsubscribe func()
+	defer func() {
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+	}()
+
+	refresh := func() {
+		active, err := db.DB.HasEnabledWebhooks()
+		if err != nil {
+			log.Printf("Warning: Failed to check webhooks: %v", err)
+			return
+		}
+		if active && unsubscribe == nil {
+			ch, unsubscribe = d.hub.Subscribe()
+		} else if !active && unsubscribe != nil {
+			unsubscribe()
+			ch, unsubscribe = nil, nil
+		}
+	}
+	refresh()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		case <-d.changed:
+			refresh()
+		case event, ok := <-ch:
+			if !ok {
+				ch, unsubscribe = nil, nil
+				continue
+			}
+			if Supported(event.Type) {
+				d.enqueue(event)
+			}
+		}
+	}
+}
+
+// enqueue stores a pending delivery of event for every webhook subscribed to it
+func (d *Dispatcher) enqueue(event events.Event) {
+	webhooks, err := db.DB.GetWebhooks()
+	if err != nil {
+		log.Printf("Warning: Failed to get webhooks for %s: %v", event.Type, err)
+		return
+	}
+
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event.Type) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(event); err != nil {
+				log.Printf("Warning: Failed to encode %s event: %v", event.Type, err)
+				return
+			}
+		}
+		if _, err := db.DB.EnqueueWebhookDelivery(webhook.ID, event.Type, string(payload), event.Time, event.Time); err != nil {
+			log.Printf("Warning: Failed to queue %s for webhook %s: %v", event.Type, webhook.Name, err)
+		}
+	}
+
+	if payload != nil {
+		notify(d.pending)
+	}
+}
+
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.pending:
+		}
+		d.deliverDue(ctx)
+	}
+}
+
+// deliverDue makes one attempt for each delivery whose next attempt is due
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := db.DB.GetDueWebhookDeliveries(time.Now(), batchSize)
+		if err != nil {
+			log.Printf("Warning: Failed to get webhook deliveries: %v", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		webhooks := make(map[int64]*models.Webhook)
+		for i := range deliveries {
+			delivery := &deliveries[i]
+			webhook, ok := webhooks[delivery.WebhookID]
+			if !ok {
+				if webhook, err = db.DB.GetWebhook(delivery.WebhookID); err != nil {
+					log.Printf("Warning: Failed to get webhook %d: %v", delivery.WebhookID, err)
+					return
+				}
+				webhooks[delivery.WebhookID] = webhook
+			}
+
+			// Deliveries queued before the webhook was disabled are not sent anymore
+			if !webhook.Enabled {
+				delivery.Status = models.DeliveryFailed
+				delivery.Error = "Webhook disabled"
+				delivery.NextAttemptAt = nil
+				if err := db.DB.SaveWebhookAttempt(delivery); err != nil {
+					log.Printf("Warning: Failed to save webhook delivery %d: %v", delivery.ID, err)
+					return
+				}
+				continue
+			}
+
+			if err := d.attempt(ctx, webhook, delivery); err != nil {
+				log.Printf("Warning: Failed to save webhook delivery %d: %v", delivery.ID, err)
+				return
+			}
+		}
+
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and saves the outcome, scheduling a retry if it failed
+func (d *Dispatcher) attempt(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery) error {
+	code, err := d.send(ctx, webhook, delivery)
+	now := time.Now()
+
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.NextAttemptAt = nil
+	if err == nil {
+		delivery.Status = models.DeliveryDelivered
+		delivery.Error = ""
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.Error = err.Error()
+		if len(delivery.Error) > maxErrorLength {
+			delivery.Error = delivery.Error[:maxErrorLength]
+		}
+		if delivery.Attempts >= maxAttempts {
+			delivery.Status = models.DeliveryFailed
+		} else {
+			next := now.Add(RetryDelay(delivery.Attempts))
+			delivery.Status = models.DeliveryPending
+			delivery.NextAttemptAt = &next
+		}
+	}
+
+	return db.DB.SaveWebhookAttempt(delivery)
+}
+
+// send POSTs the signed payload and returns the response status; non-2xx statuses are errors
+func (d *Dispatcher) send(ctx context.Context, webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wgeasygo-webhooks")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Test sends a TestEvent to webhook right away and returns the delivery with its outcome.
+// It is logged like any delivery and retried if it failed; the worker only picks it up
+// once the first retry is due, so it is never sent twice at once.
+func (d *Dispatcher) Test(ctx context.Context, webhook *models.Webhook) (*models.WebhookDelivery, error) {
+	now := time.Now()
+	payload, err := json.Marshal(events.Event{
+		Type: TestEvent,
+		Time: now,
+		Data: map[string]interface{}{"webhook_id": webhook.ID, "name": webhook.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := db.DB.EnqueueWebhookDelivery(webhook.ID, TestEvent, string(payload), now, now.Add(RetryDelay(1)))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.attempt(ctx, webhook, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
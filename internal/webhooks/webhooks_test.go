@@ -0,0 +1,161 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wgeasygo/internal/db"
+	"wgeasygo/internal/events"
+	"wgeasygo/internal/models"
+	"wgeasygo/internal/secrets"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"type":"webhook.test"}' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", 1700000000, []byte(`{"type":"webhook.test"}`))
+	want := "sha256=2d94e1bb3360468efe3464511574f1b8ec8bf0c3fbe834012e9648ea95cd38fc"
+	if got != want {
+		t.Fatalf("Sign() = %q, want %q", got, want)
+	}
+	if Sign("secret", 1700000000, []byte("a")) == Sign("secret", 1700000001, []byte("a")) {
+		t.Error("signature does not cover the timestamp")
+	}
+	if Sign("secret", 1700000000, []byte("a")) == Sign("other", 1700000000, []byte("a")) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}
+	for i, w := range want {
+		if got := RetryDelay(i + 1); got != w {
+			t.Errorf("RetryDelay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := secrets.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Initialize(filepath.Join(t.TempDir(), "test.db"), cipher)
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+}
+
+func TestDeliveryRetriesAndSigns(t *testing.T) {
+	openTestDatabase(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		if r.Header.Get(SignatureHeader) != Sign("s3cret", timestamp, body) {
+			t.Errorf("request signature %q does not match its body", r.Header.Get(SignatureHeader))
+		}
+		if r.Header.Get(EventHeader) != events.PeerOffline {
+			t.Errorf("event header = %q, want %q", r.Header.Get(EventHeader), events.PeerOffline)
+		}
+		// Fail the first attempt
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	subscribed, err := db.DB.CreateWebhook(&models.Webhook{Name: "chat", URL: server.URL, Secret: "s3cret", Events: []string{events.PeerOffline}, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.CreateWebhook(&models.Webhook{Name: "other", URL: server.URL, Secret: "x", Events: []string{events.PeerCreated}, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(events.NewHub())
+	d.enqueue(events.Event{Type: events.PeerOffline, Time: time.Now(), Data: events.PeerStatus{ID: 1}})
+	d.deliverDue(context.Background())
+
+	deliveries, err := db.DB.GetWebhookDeliveries(subscribed.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	delivery := deliveries[0]
+	if delivery.Status != models.DeliveryPending || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusServiceUnavailable || delivery.NextAttemptAt == nil {
+		t.Fatalf("after a failed attempt: %+v, want pending with a retry", delivery)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("server got %d requests, want 1 (the other webhook is not subscribed)", calls.Load())
+	}
+
+	// Not due yet
+	d.deliverDue(context.Background())
+	if calls.Load() != 1 {
+		t.Fatalf("retry was sent before it was due")
+	}
+
+	delivered, err := db.DB.GetDueWebhookDeliveries(delivery.NextAttemptAt.Add(time.Second), 10)
+	if err != nil || len(delivered) != 1 {
+		t.Fatalf("GetDueWebhookDeliveries after the backoff = %v, %v, want the retry", delivered, err)
+	}
+	if err := d.attempt(context.Background(), subscribed, &delivered[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, _ = db.DB.GetWebhookDeliveries(subscribed.ID, 10)
+	delivery = deliveries[0]
+	if delivery.Status != models.DeliveryDelivered || delivery.Attempts != 2 || delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil {
+		t.Fatalf("after a successful retry: %+v, want delivered", delivery)
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	openTestDatabase(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer server.Close()
+
+	webhook, err := db.DB.CreateWebhook(&models.Webhook{Name: "broken", URL: server.URL, Secret: "s", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(events.NewHub())
+	delivery, err := d.Test(context.Background(), webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.ResponseCode != http.StatusFound || delivery.Status != models.DeliveryPending {
+		t.Fatalf("test delivery = %+v, want a pending retry after the redirect", delivery)
+	}
+
+	for delivery.Status == models.DeliveryPending {
+		if err := d.attempt(context.Background(), webhook, delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivery.Status != models.DeliveryFailed || delivery.Attempts != maxAttempts {
+		t.Errorf("delivery = %+v, want failed after %d attempts", delivery, maxAttempts)
+	}
+}
@@ -0,0 +1,248 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ErrPoolExhausted is returned when every assignable address in a pool is taken
+var ErrPoolExhausted = errors.New("no available IP addresses in subnet")
+
+// addrRange is an inclusive range of addresses
+type addrRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return addr.Compare(r.first) >= 0 && addr.Compare(r.last) <= 0
+}
+
+// Pools holds the IPv4 pool and the optional IPv6 pool used for dual-stack peers
+type Pools struct {
+	V4 *Pool
+	V6 *Pool // nil when no IPv6 subnet is configured
+}
+
+// NewPools creates the peer address pools; subnetV6 may be empty
+func NewPools(subnet, subnetV6 string, reserved []string) (*Pools, error) {
+	v4, err := NewPool(subnet, reserved)
+	if err != nil {
+		return nil, err
+	}
+	if v4.Is6() {
+		return nil, fmt.Errorf("subnet %q is not an IPv4 subnet", subnet)
+	}
+
+	pools := &Pools{V4: v4}
+	if subnetV6 != "" {
+		v6, err := NewPool(subnetV6, reserved)
+		if err != nil {
+			return nil, err
+		}
+		if !v6.Is6() {
+			return nil, fmt.Errorf("subnet %q is not an IPv6 subnet", subnetV6)
+		}
+		pools.V6 = v6
+	}
+
+	return pools, nil
+}
+
+// Pool allocates host addresses from a single CIDR prefix
+// The network address, the server address (network + 1) and, for IPv4,
+// the broadcast address are never handed out, nor is anything in a reserved range
+type Pool struct {
+	prefix   netip.Prefix
+	first    netip.Addr // first address after the server address
+	last     netip.Addr // last assignable address (broadcast excluded)
+	reserved []addrRange
+}
+
+// NewPool creates a pool for subnet (e.g. "10.8.0.0/22" or "fd42:42:42::/64")
+// reserved entries may be single addresses, CIDR prefixes or "first-last" ranges;
+// entries of the other address family are ignored
+func NewPool(subnet string, reserved []string) (*Pool, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(subnet))
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	prefix = prefix.Masked()
+
+	network := prefix.Addr()
+	last := lastAddr(prefix)
+	if network.Is4() && prefix.Bits() < 31 {
+		last = last.Prev() // Skip broadcast
+	}
+
+	pool := &Pool{
+		prefix: prefix,
+		first:  network.Next().Next(), // Skip network and server address
+		last:   last,
+	}
+
+	for _, entry := range reserved {
+		r, err := parseRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		if r.first.Is4() != network.Is4() {
+			continue
+		}
+		pool.reserved = append(pool.reserved, r)
+	}
+
+	return pool, nil
+}
+
+// Prefix returns the pool's subnet
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Is6 reports whether the pool hands out IPv6 addresses
+func (p *Pool) Is6() bool {
+	return p.prefix.Addr().Is6()
+}
+
+// ServerAddress returns the address reserved for the server (network + 1)
+func (p *Pool) ServerAddress() netip.Addr {
+	return p.prefix.Addr().Next()
+}
+
+// Assignable reports whether addr may be given to a peer
+func (p *Pool) Assignable(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !p.prefix.Contains(addr) {
+		return false
+	}
+	if addr.Compare(p.first) < 0 || addr.Compare(p.last) > 0 {
+		return false
+	}
+	return p.reservedRange(addr) == nil
+}
+
+// Next returns the lowest assignable address not present in used
+func (p *Pool) Next(used map[netip.Addr]struct{}) (netip.Addr, error) {
+	if !p.first.IsValid() || !p.last.IsValid() {
+		return netip.Addr{}, ErrPoolExhausted
+	}
+
+	addr := p.first
+	for addr.IsValid() && addr.Compare(p.last) <= 0 {
+		// Jump over reserved ranges instead of walking them address by address
+		if r := p.reservedRange(addr); r != nil {
+			addr = r.last.Next()
+			continue
+		}
+		if _, taken := used[addr]; !taken {
+			return addr, nil
+		}
+		addr = addr.Next()
+	}
+
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+// Size returns the number of assignable addresses, as a float since IPv6 pools are huge
+func (p *Pool) Size() float64 {
+	if !p.first.IsValid() || !p.last.IsValid() || p.first.Compare(p.last) > 0 {
+		return 0
+	}
+	size := rangeSize(p.first, p.last)
+
+	// Subtract reserved ranges clipped to the pool, merging overlaps so nothing counts twice
+	var clipped []addrRange
+	for _, r := range p.reserved {
+		if r.last.Compare(p.first) < 0 || r.first.Compare(p.last) > 0 {
+			continue
+		}
+		if r.first.Compare(p.first) < 0 {
+			r.first = p.first
+		}
+		if r.last.Compare(p.last) > 0 {
+			r.last = p.last
+		}
+		clipped = append(clipped, r)
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].first.Less(clipped[j].first) })
+
+	var end netip.Addr
+	for _, r := range clipped {
+		if end.IsValid() && r.first.Compare(end) <= 0 {
+			if r.last.Compare(end) <= 0 {
+				continue
+			}
+			r.first = end.Next()
+		}
+		size -= rangeSize(r.first, r.last)
+		end = r.last
+	}
+	return size
+}
+
+// rangeSize returns the number of addresses from first to last inclusive
+func rangeSize(first, last netip.Addr) float64 {
+	a, b := first.As16(), last.As16()
+	diff := new(big.Int).Sub(new(big.Int).SetBytes(b[:]), new(big.Int).SetBytes(a[:]))
+	size, _ := new(big.Float).SetInt(diff.Add(diff, big.NewInt(1))).Float64()
+	return size
+}
+
+func (p *Pool) reservedRange(addr netip.Addr) *addrRange {
+	for i := range p.reserved {
+		if p.reserved[i].contains(addr) {
+			return &p.reserved[i]
+		}
+	}
+	return nil
+}
+
+// parseRange parses "10.8.0.5", "10.8.0.64/28" or "10.8.0.100-10.8.0.120"
+func parseRange(entry string) (addrRange, error) {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q: %w", entry, err)
+		}
+		prefix = prefix.Masked()
+		return addrRange{first: prefix.Addr(), last: lastAddr(prefix)}, nil
+	}
+
+	if from, to, ok := strings.Cut(entry, "-"); ok {
+		first, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q: %w", entry, err)
+		}
+		last, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q: %w", entry, err)
+		}
+		if first.Is4() != last.Is4() || first.Compare(last) > 0 {
+			return addrRange{}, fmt.Errorf("invalid reserved range %q", entry)
+		}
+		return addrRange{first: first, last: last}, nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid reserved address %q: %w", entry, err)
+	}
+	return addrRange{first: addr, last: addr}, nil
+}
+
+// lastAddr returns the highest address in a (masked) prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
@@ -0,0 +1,247 @@
+package ipam
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func mustPool(t *testing.T, subnet string, reserved ...string) *Pool {
+	t.Helper()
+	pool, err := NewPool(subnet, reserved)
+	if err != nil {
+		t.Fatalf("NewPool(%q, %q): %v", subnet, reserved, err)
+	}
+	return pool
+}
+
+func usedSet(addrs ...string) map[netip.Addr]struct{} {
+	used := make(map[netip.Addr]struct{}, len(addrs))
+	for _, addr := range addrs {
+		used[netip.MustParseAddr(addr)] = struct{}{}
+	}
+	return used
+}
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		reserved []string
+		prefix   string // Expected masked prefix, empty when an error is expected
+		server   string
+	}{
+		{name: "ipv4", subnet: "10.8.0.0/24", prefix: "10.8.0.0/24", server: "10.8.0.1"},
+		{name: "host bits masked", subnet: " 10.8.1.77/22 ", prefix: "10.8.0.0/22", server: "10.8.0.1"},
+		{name: "ipv6", subnet: "fd42:42:42::/64", prefix: "fd42:42:42::/64", server: "fd42:42:42::1"},
+		{name: "valid reserved entries", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.5", "10.8.0.64/28", "10.8.0.100 - 10.8.0.120", "fd42::1"}, prefix: "10.8.0.0/24", server: "10.8.0.1"},
+		{name: "invalid subnet", subnet: "10.8.0.0"},
+		{name: "invalid reserved address", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.300"}},
+		{name: "invalid reserved prefix", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.0/33"}},
+		{name: "reversed reserved range", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.20-10.8.0.10"}},
+		{name: "mixed family reserved range", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-fd42::1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewPool(tt.subnet, tt.reserved)
+			if tt.prefix == "" {
+				if err == nil {
+					t.Fatalf("NewPool(%q, %q) succeeded, want error", tt.subnet, tt.reserved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewPool(%q, %q): %v", tt.subnet, tt.reserved, err)
+			}
+			if got := pool.Prefix().String(); got != tt.prefix {
+				t.Errorf("Prefix() = %s, want %s", got, tt.prefix)
+			}
+			if got := pool.ServerAddress().String(); got != tt.server {
+				t.Errorf("ServerAddress() = %s, want %s", got, tt.server)
+			}
+		})
+	}
+}
+
+func TestPoolNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		reserved []string
+		used     []string
+		want     string // Empty when the pool is exhausted
+	}{
+		{name: "first after server", subnet: "10.8.0.0/24", want: "10.8.0.2"},
+		{name: "skips used", subnet: "10.8.0.0/24", used: []string{"10.8.0.2", "10.8.0.3"}, want: "10.8.0.4"},
+		{name: "fills gaps", subnet: "10.8.0.0/24", used: []string{"10.8.0.2", "10.8.0.4"}, want: "10.8.0.3"},
+		{name: "jumps reserved address", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.2"}, want: "10.8.0.3"},
+		{name: "jumps reserved prefix", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.0/28"}, want: "10.8.0.16"},
+		{name: "jumps adjacent reserved ranges", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.2-10.8.0.9", "10.8.0.10-10.8.0.20"}, used: []string{"10.8.0.21"}, want: "10.8.0.22"},
+		{name: "ignores other family", subnet: "10.8.0.0/24", reserved: []string{"fd42:42:42::2", "fd42:42:42::/64"}, want: "10.8.0.2"},
+		{name: "skips broadcast", subnet: "10.8.0.0/30", used: []string{"10.8.0.2"}},
+		{name: "last before broadcast", subnet: "10.8.0.0/29", used: []string{"10.8.0.2", "10.8.0.3", "10.8.0.4", "10.8.0.5"}, want: "10.8.0.6"},
+		{name: "reserved up to broadcast", subnet: "10.8.0.0/29", reserved: []string{"10.8.0.3-10.8.0.7"}, used: []string{"10.8.0.2"}},
+		{name: "/31 has no peer addresses", subnet: "10.8.0.0/31"},
+		{name: "/32 has no peer addresses", subnet: "10.8.0.0/32"},
+		{name: "/31 at the top of the address space", subnet: "255.255.255.254/31"},
+		{name: "ipv6 has no broadcast", subnet: "fd42:42:42::/126", used: []string{"fd42:42:42::2"}, want: "fd42:42:42::3"},
+		{name: "ipv6 jumps reserved prefix", subnet: "fd42:42:42::/64", reserved: []string{"fd42:42:42::/120", "10.8.0.0/24"}, want: "fd42:42:42::100"},
+		{name: "ipv6 /128 has no peer addresses", subnet: "fd42:42:42::/128"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := mustPool(t, tt.subnet, tt.reserved...)
+			got, err := pool.Next(usedSet(tt.used...))
+			if tt.want == "" {
+				if !errors.Is(err, ErrPoolExhausted) {
+					t.Fatalf("Next() = %v, %v, want ErrPoolExhausted", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Next(): %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("Next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolNextExhaustsAllAddresses(t *testing.T) {
+	pool := mustPool(t, "10.8.0.0/28", "10.8.0.5-10.8.0.7")
+	used := usedSet()
+
+	var handed []string
+	for {
+		addr, err := pool.Next(used)
+		if errors.Is(err, ErrPoolExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next(): %v", err)
+		}
+		used[addr] = struct{}{}
+		handed = append(handed, addr.String())
+	}
+
+	// .0 network, .1 server, .5-.7 reserved, .15 broadcast
+	want := []string{"10.8.0.2", "10.8.0.3", "10.8.0.4", "10.8.0.8", "10.8.0.9", "10.8.0.10", "10.8.0.11", "10.8.0.12", "10.8.0.13", "10.8.0.14"}
+	if len(handed) != len(want) {
+		t.Fatalf("handed out %v, want %v", handed, want)
+	}
+	for i := range want {
+		if handed[i] != want[i] {
+			t.Fatalf("handed out %v, want %v", handed, want)
+		}
+	}
+	if got := pool.Size(); got != float64(len(want)) {
+		t.Errorf("Size() = %v, want %d", got, len(want))
+	}
+}
+
+func TestPoolAssignable(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		reserved []string
+		addr     string
+		want     bool
+	}{
+		{name: "peer address", subnet: "10.8.0.0/24", addr: "10.8.0.2", want: true},
+		{name: "last before broadcast", subnet: "10.8.0.0/24", addr: "10.8.0.254", want: true},
+		{name: "network", subnet: "10.8.0.0/24", addr: "10.8.0.0"},
+		{name: "server", subnet: "10.8.0.0/24", addr: "10.8.0.1"},
+		{name: "broadcast", subnet: "10.8.0.0/24", addr: "10.8.0.255"},
+		{name: "outside subnet", subnet: "10.8.0.0/24", addr: "10.8.1.2"},
+		{name: "other family", subnet: "10.8.0.0/24", addr: "fd42:42:42::2"},
+		{name: "ipv4-mapped ipv6", subnet: "10.8.0.0/24", addr: "::ffff:10.8.0.2", want: true},
+		{name: "reserved address", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.5"}, addr: "10.8.0.5"},
+		{name: "reserved range start", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.20"}, addr: "10.8.0.10"},
+		{name: "reserved range end", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.20"}, addr: "10.8.0.20"},
+		{name: "after reserved range", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.20"}, addr: "10.8.0.21", want: true},
+		{name: "reserved prefix", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.64/28"}, addr: "10.8.0.79"},
+		{name: "cross-family reservation ignored", subnet: "fd42:42:42::/64", reserved: []string{"10.8.0.0/8"}, addr: "fd42:42:42::a", want: true},
+		{name: "ipv6 reserved", subnet: "fd42:42:42::/64", reserved: []string{"fd42:42:42::a"}, addr: "fd42:42:42::a"},
+		{name: "ipv6 last address", subnet: "fd42:42:42::/64", addr: "fd42:42:42::ffff:ffff:ffff:ffff", want: true},
+		{name: "/31 low", subnet: "10.8.0.0/31", addr: "10.8.0.0"},
+		{name: "/31 high", subnet: "10.8.0.0/31", addr: "10.8.0.1"},
+		{name: "/32", subnet: "10.8.0.7/32", addr: "10.8.0.7"},
+		{name: "invalid address", subnet: "10.8.0.0/24"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := mustPool(t, tt.subnet, tt.reserved...)
+			var addr netip.Addr
+			if tt.addr != "" {
+				addr = netip.MustParseAddr(tt.addr)
+			}
+			if got := pool.Assignable(addr); got != tt.want {
+				t.Errorf("Assignable(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		reserved []string
+		want     float64
+	}{
+		{name: "/24", subnet: "10.8.0.0/24", want: 253},
+		{name: "/30", subnet: "10.8.0.0/30", want: 1},
+		{name: "/31", subnet: "10.8.0.0/31", want: 0},
+		{name: "/32", subnet: "10.8.0.0/32", want: 0},
+		{name: "reserved address", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.5"}, want: 252},
+		{name: "overlapping ranges merged", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.20", "10.8.0.15-10.8.0.25"}, want: 237},
+		{name: "contained range merged", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.30", "10.8.0.12-10.8.0.14"}, want: 232},
+		{name: "duplicate entries", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.64/28", "10.8.0.64/28"}, want: 237},
+		{name: "adjacent ranges", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.19", "10.8.0.20-10.8.0.29"}, want: 233},
+		{name: "clipped to pool", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.0/29", "10.8.0.248/29"}, want: 240},
+		{name: "outside pool", subnet: "10.8.0.0/24", reserved: []string{"10.9.0.0/16"}, want: 253},
+		{name: "whole pool reserved", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.0/24"}, want: 0},
+		{name: "cross-family reservation ignored", subnet: "10.8.0.0/24", reserved: []string{"fd42:42:42::/64"}, want: 253},
+		{name: "mixed reservations", subnet: "10.8.0.0/24", reserved: []string{"10.8.0.10-10.8.0.20", "10.8.0.15-10.8.0.25", "10.8.0.250/29"}, want: 230},
+		{name: "ipv6 /120", subnet: "fd42:42:42::/120", want: 254},
+		{name: "ipv6 /64", subnet: "fd42:42:42::/64", reserved: []string{"fd42:42:42::/120"}, want: 1<<64 - 256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := mustPool(t, tt.subnet, tt.reserved...)
+			if got := pool.Size(); got != tt.want {
+				t.Errorf("Size() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPools(t *testing.T) {
+	pools, err := NewPools("10.8.0.0/24", "", nil)
+	if err != nil {
+		t.Fatalf("NewPools: %v", err)
+	}
+	if pools.V6 != nil {
+		t.Errorf("V6 = %v, want nil without an IPv6 subnet", pools.V6.Prefix())
+	}
+
+	pools, err = NewPools("10.8.0.0/24", "fd42:42:42::/64", []string{"10.8.0.2", "fd42:42:42::2"})
+	if err != nil {
+		t.Fatalf("NewPools: %v", err)
+	}
+	if pools.V4.Assignable(netip.MustParseAddr("10.8.0.2")) || pools.V6.Assignable(netip.MustParseAddr("fd42:42:42::2")) {
+		t.Error("reserved addresses are assignable")
+	}
+
+	if _, err := NewPools("fd42:42:42::/64", "", nil); err == nil {
+		t.Error("NewPools accepted an IPv6 subnet as the IPv4 subnet")
+	}
+	if _, err := NewPools("10.8.0.0/24", "10.9.0.0/24", nil); err == nil {
+		t.Error("NewPools accepted an IPv4 subnet as the IPv6 subnet")
+	}
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Process-wide metrics updated by the HTTP middleware and the auth handlers
+var (
+	HTTPRequests = NewCounterVec("wgeasygo_http_requests_total", "HTTP requests by method, route and status code", "method", "route", "status")
+	HTTPDuration = NewHistogramVec("wgeasygo_http_request_duration_seconds", "HTTP request latency by method and route",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "method", "route")
+	LoginFailures = NewCounterVec("wgeasygo_login_failures_total", "Failed login attempts")
+	LoginLockouts = NewCounterVec("wgeasygo_login_lockouts_total", "Accounts locked after too many failed logins")
+)
+
+// CounterVec is a counter with a fixed set of label names
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+// Inc adds 1 to the counter with the given label values (in label name order)
+func (c *CounterVec) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = values
+	}
+	c.values[key]++
+}
+
+// Write writes the counter in the Prometheus text format
+func (c *CounterVec) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	WriteHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		WriteSample(w, c.name, nil, 0)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		WriteSample(w, c.name, pairs(c.labels, c.keys[key]), c.values[key])
+	}
+}
+
+// HistogramVec is a histogram with fixed buckets and label names
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+	keys   map[string][]string
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+		keys:    make(map[string][]string),
+	}
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.keys[key] = values
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+// Write writes the histogram in the Prometheus text format
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	WriteHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		labels := pairs(h.labels, h.keys[key])
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			WriteSample(w, h.name+"_bucket", append(labels, "le", formatValue(bound)), float64(cumulative))
+		}
+		WriteSample(w, h.name+"_bucket", append(labels, "le", "+Inf"), float64(s.count))
+		WriteSample(w, h.name+"_sum", labels, s.sum)
+		WriteSample(w, h.name+"_count", labels, float64(s.count))
+	}
+}
+
+// WriteHeader writes the HELP and TYPE lines of a metric family
+func WriteHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// WriteSample writes one sample; labels alternate between names and values
+func WriteSample(w io.Writer, name string, labels []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabel(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+// pairs interleaves label names and values for WriteSample
+func pairs(names, values []string) []string {
+	labels := make([]string, 0, len(names)*2)
+	for i, name := range names {
+		labels = append(labels, name, values[i])
+	}
+	return labels
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
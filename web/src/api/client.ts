@@ -3,9 +3,19 @@
 interface LoginResponse {
   access_token: string;
   expires_in: number;
-  api_token: string;
 }
 
+// Returned instead of tokens when the account has two-factor authentication
+interface TwoFactorChallenge {
+  two_factor_required: true;
+  challenge: string;
+  expires_in: number;
+}
+
+type LoginResult = 'success' | 'two_factor_required' | 'locked' | 'failed';
+
+const LOCKED_ERROR = 'Too many failed login attempts';
+
 interface Peer {
   id: number;
   name: string;
@@ -18,6 +28,9 @@ interface Peer {
   transfer_rx: number;
   transfer_tx: number;
   endpoint: string;
+  has_private_key: boolean;
+  group_id?: number;
+  overrides: ClientOverrides;
 }
 
 interface ApiError {
@@ -27,6 +40,7 @@ interface ApiError {
 
 class ApiClient {
   private accessToken: string | null = null;
+  private loginChallenge: string | null = null;
   private tokenExpiry: number = 0;
   private static TOKEN_KEY = 'wg_access_token';
   private static EXPIRY_KEY = 'wg_token_expiry';
@@ -105,7 +119,7 @@ class ApiClient {
       credentials: 'include',
     });
 
-    if (response.status === 401 && endpoint !== '/auth/login') {
+    if (response.status === 401 && !endpoint.startsWith('/auth/login')) {
       // Try to refresh token
       const refreshed = await this.refresh();
       if (refreshed) {
@@ -137,12 +151,31 @@ class ApiClient {
     return text ? JSON.parse(text) : ({} as T);
   }
 
-  async login(username: string, password: string): Promise<boolean> {
+  async login(username: string, password: string): Promise<LoginResult> {
     try {
-      const data = await this.request<LoginResponse>('/auth/login', {
+      const data = await this.request<LoginResponse | TwoFactorChallenge>('/auth/login', {
         method: 'POST',
         body: JSON.stringify({ username, password }),
       });
+      if ('two_factor_required' in data) {
+        this.loginChallenge = data.challenge;
+        return 'two_factor_required';
+      }
+      this.setToken(data.access_token, data.expires_in);
+      return 'success';
+    } catch (err) {
+      return err instanceof Error && err.message === LOCKED_ERROR ? 'locked' : 'failed';
+    }
+  }
+
+  // Completes a login that returned 'two_factor_required', with an authenticator or recovery code
+  async loginTwoFactor(code: string): Promise<boolean> {
+    try {
+      const data = await this.request<LoginResponse>('/auth/login/2fa', {
+        method: 'POST',
+        body: JSON.stringify({ challenge: this.loginChallenge, code }),
+      });
+      this.loginChallenge = null;
       this.setToken(data.access_token, data.expires_in);
       return true;
     } catch {
@@ -150,6 +183,18 @@ class ApiClient {
     }
   }
 
+  // Returns the single sign-on button label, or null when SSO is not configured
+  async getSSOName(): Promise<string | null> {
+    try {
+      const response = await fetch('/api/v1/auth/oidc');
+      if (!response.ok) return null;
+      const data: { enabled: boolean; name: string } = await response.json();
+      return data.enabled ? data.name : null;
+    } catch {
+      return null;
+    }
+  }
+
   async refresh(): Promise<boolean> {
     try {
       const response = await fetch('/api/v1/auth/refresh', {
@@ -178,10 +223,10 @@ class ApiClient {
     return peers || [];
   }
 
-  async createPeer(name: string): Promise<Peer> {
+  async createPeer(name: string, groupId?: number): Promise<Peer> {
     return this.request<Peer>('/peers', {
       method: 'POST',
-      body: JSON.stringify({ name }),
+      body: JSON.stringify({ name, group_id: groupId }),
     });
   }
 
@@ -189,15 +234,17 @@ class ApiClient {
     await this.request(`/peers/${ip}`, { method: 'DELETE' });
   }
 
-  async updatePeer(ip: string, data: { name?: string; enabled?: boolean }): Promise<Peer> {
+  // overrides replaces all of the peer's client settings, {} removes them
+  async updatePeer(ip: string, data: { name?: string; enabled?: boolean; overrides?: ClientOverrides }): Promise<Peer> {
     return this.request<Peer>(`/peers/${ip}`, {
       method: 'PATCH',
       body: JSON.stringify(data),
     });
   }
 
-  async downloadConfig(ip: string, filename: string): Promise<void> {
-    const response = await fetch(`/api/v1/peers/${ip}/config`, {
+  // base is '/devices' for the signed-in user's own peers in the self-service portal
+  async downloadConfig(ip: string, filename: string, base = '/peers'): Promise<void> {
+    const response = await fetch(`/api/v1${base}/${ip}/config`, {
       headers: {
         'Authorization': `Bearer ${this.accessToken}`,
       },
@@ -219,8 +266,8 @@ class ApiClient {
     document.body.removeChild(a);
   }
 
-  async getQRCode(ip: string): Promise<string> {
-    const response = await fetch(`/api/v1/peers/${ip}/qrcode`, {
+  async getQRCode(ip: string, base = '/peers'): Promise<string> {
+    const response = await fetch(`/api/v1${base}/${ip}/qrcode`, {
       headers: {
         'Authorization': `Bearer ${this.accessToken}`,
       },
@@ -251,6 +298,119 @@ class ApiClient {
     });
   }
 
+  // Session methods
+  async getAccount(): Promise<Account> {
+    return this.request<Account>('/account');
+  }
+
+  async getDevices(): Promise<Devices> {
+    return this.request<Devices>('/devices');
+  }
+
+  async createDevice(name: string): Promise<Peer> {
+    return this.request<Peer>('/devices', {
+      method: 'POST',
+      body: JSON.stringify({ name }),
+    });
+  }
+
+  async disableDevice(ip: string): Promise<Peer> {
+    return this.request<Peer>(`/devices/${ip}/disable`, { method: 'POST' });
+  }
+
+  async getSessions(): Promise<Session[]> {
+    return this.request<Session[]>('/account/sessions');
+  }
+
+  async revokeSession(id: number): Promise<void> {
+    await this.request(`/account/sessions/${id}`, { method: 'DELETE' });
+  }
+
+  // Two-factor authentication methods
+  async getTwoFactorStatus(): Promise<TwoFactorStatus> {
+    return this.request<TwoFactorStatus>('/account/2fa');
+  }
+
+  async setupTwoFactor(): Promise<TwoFactorSetup> {
+    return this.request<TwoFactorSetup>('/account/2fa/setup', { method: 'POST' });
+  }
+
+  async enableTwoFactor(code: string): Promise<string[]> {
+    const data = await this.request<{ recovery_codes: string[] }>('/account/2fa/enable', {
+      method: 'POST',
+      body: JSON.stringify({ code }),
+    });
+    return data.recovery_codes;
+  }
+
+  async disableTwoFactor(password: string, code: string): Promise<void> {
+    await this.request('/account/2fa/disable', {
+      method: 'POST',
+      body: JSON.stringify({ password, code }),
+    });
+  }
+
+  async regenerateRecoveryCodes(code: string): Promise<string[]> {
+    const data = await this.request<{ recovery_codes: string[] }>('/account/2fa/recovery-codes', {
+      method: 'POST',
+      body: JSON.stringify({ code }),
+    });
+    return data.recovery_codes;
+  }
+
+  // API token methods
+  async getApiTokens(): Promise<ApiToken[]> {
+    return this.request<ApiToken[]>('/tokens');
+  }
+
+  async createApiToken(name: string, scopes: string[]): Promise<ApiToken> {
+    return this.request<ApiToken>('/tokens', {
+      method: 'POST',
+      body: JSON.stringify({ name, scopes }),
+    });
+  }
+
+  async revokeApiToken(id: number): Promise<void> {
+    await this.request(`/tokens/${id}`, { method: 'DELETE' });
+  }
+
+  // Peer group methods
+  async getGroups(): Promise<PeerGroup[]> {
+    return this.request<PeerGroup[]>('/groups');
+  }
+
+  async createGroup(group: CreatePeerGroupRequest): Promise<PeerGroup> {
+    return this.request<PeerGroup>('/groups', {
+      method: 'POST',
+      body: JSON.stringify(group),
+    });
+  }
+
+  async deleteGroup(id: number): Promise<void> {
+    await this.request(`/groups/${id}`, { method: 'DELETE' });
+  }
+
+  // Enables or disables all of a group's peers; skipped lists the ones left as they were
+  async setGroupEnabled(id: number, enabled: boolean): Promise<PeerGroupAction> {
+    return this.request<PeerGroupAction>(`/groups/${id}/${enabled ? 'enable' : 'disable'}`, { method: 'POST' });
+  }
+
+  // Share link methods
+  async createShareLink(ip: string, kind: ShareKind, expiresInMinutes?: number): Promise<ShareLink> {
+    return this.request<ShareLink>(`/peers/${ip}/share`, {
+      method: 'POST',
+      body: JSON.stringify({ kind, expires_in_minutes: expiresInMinutes }),
+    });
+  }
+
+  async getShareLinks(): Promise<ShareLink[]> {
+    return this.request<ShareLink[]>('/share-links');
+  }
+
+  async revokeShareLink(id: number): Promise<void> {
+    await this.request(`/share-links/${id}`, { method: 'DELETE' });
+  }
+
   async getPeerLogs(ip: string): Promise<ConnectionLog[]> {
     const logs = await this.request<ConnectionLog[] | null>(`/peers/${ip}/logs`);
     return logs || [];
@@ -338,7 +498,101 @@ interface Settings {
   dns: string;
   allowed_ips: string;
   logging_enabled: boolean;
-  api_token: string;
+}
+
+// The signed-in user; role 'user' only has the self-service portal
+interface Account {
+  id: number;
+  username: string;
+  role: 'admin' | 'operator' | 'viewer' | 'user';
+  max_devices: number;
+}
+
+interface Devices {
+  devices: Peer[];
+  max_devices: number;
+}
+
+interface ApiToken {
+  id: number;
+  user_id: number;
+  name: string;
+  prefix: string;
+  scopes: string[];
+  expires_at?: string;
+  last_used_at?: string;
+  created_at: string;
+  token?: string; // Only set in the response that created it
+}
+
+// Client settings a group gives its peers; unset values come from the server settings
+interface ClientSettings {
+  dns?: string;
+  allowed_ips?: string;
+  mtu?: number;
+  persistent_keepalive?: number;
+}
+
+// Per-peer settings on top of the group's and the server's
+interface ClientOverrides extends ClientSettings {
+  endpoint_host?: string;
+  endpoint_port?: number;
+  interface_lines?: string[];
+}
+
+interface PeerGroup extends ClientSettings {
+  id: number;
+  name: string;
+  description?: string;
+  peer_count: number;
+  created_at: string;
+  updated_at: string;
+}
+
+interface CreatePeerGroupRequest extends ClientSettings {
+  name: string;
+  description?: string;
+}
+
+interface PeerGroupAction {
+  group: PeerGroup;
+  changed: Peer[];
+  skipped?: { id: number; name: string; assigned_ip: string; reason: string }[];
+}
+
+type ShareKind = 'config' | 'qrcode';
+
+interface ShareLink {
+  id: number;
+  peer_id: number;
+  peer_name: string;
+  kind: ShareKind;
+  created_by: string;
+  created_at: string;
+  expires_at: string;
+  url?: string; // Only set in the response that created it
+}
+
+interface Session {
+  id: number;
+  auth_method: string;
+  user_agent: string;
+  source_ip: string;
+  created_at: string;
+  last_used_at: string;
+  expires_at: string;
+  current: boolean;
+}
+
+interface TwoFactorStatus {
+  enabled: boolean;
+  recovery_codes_remaining: number;
+}
+
+interface TwoFactorSetup {
+  secret: string;
+  uri: string;
+  qr_code: string; // PNG data URI of the otpauth:// URI
 }
 
 interface UpdateSettingsRequest {
@@ -356,4 +610,4 @@ interface ConnectionLog {
 }
 
 export const api = new ApiClient();
-export type { Peer, ApiError, Settings, ConnectionLog, TailscaleStatus, TailscalePeer, TailscaleRoute, TailscaleConnectResponse, TailscaleResponse };
+export type { Peer, ClientOverrides, ApiError, Settings, Account, Devices, ApiToken, PeerGroup, CreatePeerGroupRequest, PeerGroupAction, ShareKind, ShareLink, Session, TwoFactorStatus, TwoFactorSetup, ConnectionLog, TailscaleStatus, TailscalePeer, TailscaleRoute, TailscaleConnectResponse, TailscaleResponse };
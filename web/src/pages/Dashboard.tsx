@@ -18,18 +18,58 @@ import {
   Settings,
   FileText,
   ChevronLeft,
-  ChevronRight
+  ChevronRight,
+  Link,
+  Copy,
+  Layers,
+  SlidersHorizontal
 } from 'lucide-react'
-import { api, Peer, ConnectionLog } from '../api/client'
+import { api, Peer, PeerGroup, ClientOverrides, ConnectionLog, ShareKind } from '../api/client'
 import '../styles/dashboard.css'
 
+// The client settings form keeps every field as typed; empty fields inherit
+interface OverridesForm {
+  dns: string
+  allowed_ips: string
+  mtu: string
+  persistent_keepalive: string
+  endpoint_host: string
+  endpoint_port: string
+  interface_lines: string
+}
+
+function overridesToForm(o: ClientOverrides): OverridesForm {
+  return {
+    dns: o.dns ?? '',
+    allowed_ips: o.allowed_ips ?? '',
+    mtu: o.mtu ? String(o.mtu) : '',
+    persistent_keepalive: o.persistent_keepalive !== undefined ? String(o.persistent_keepalive) : '',
+    endpoint_host: o.endpoint_host ?? '',
+    endpoint_port: o.endpoint_port ? String(o.endpoint_port) : '',
+    interface_lines: (o.interface_lines ?? []).join('\n')
+  }
+}
+
+function formToOverrides(f: OverridesForm): ClientOverrides {
+  const overrides: ClientOverrides = {}
+  if (f.dns.trim()) overrides.dns = f.dns.trim()
+  if (f.allowed_ips.trim()) overrides.allowed_ips = f.allowed_ips.trim()
+  if (f.mtu.trim()) overrides.mtu = Number(f.mtu)
+  if (f.persistent_keepalive.trim()) overrides.persistent_keepalive = Number(f.persistent_keepalive)
+  if (f.endpoint_host.trim()) overrides.endpoint_host = f.endpoint_host.trim()
+  if (f.endpoint_port.trim()) overrides.endpoint_port = Number(f.endpoint_port)
+  const lines = f.interface_lines.split('\n').map(l => l.trim()).filter(Boolean)
+  if (lines.length > 0) overrides.interface_lines = lines
+  return overrides
+}
+
 interface DashboardProps {
   onLogout: () => void
   onSettings: () => void
 }
 
 // Format bytes to human readable
-function formatBytes(bytes: number): string {
+export function formatBytes(bytes: number): string {
   if (bytes === 0) return '0 B'
   const k = 1024
   const sizes = ['B', 'KB', 'MB', 'GB', 'TB']
@@ -38,7 +78,7 @@ function formatBytes(bytes: number): string {
 }
 
 // Format time ago
-function timeAgo(dateString: string): string {
+export function timeAgo(dateString: string): string {
   if (!dateString || dateString === '0001-01-01T00:00:00Z') return 'Never'
   const date = new Date(dateString)
   const now = new Date()
@@ -64,8 +104,19 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
   const [editingPeer, setEditingPeer] = useState<string | null>(null)
   const [editName, setEditName] = useState('')
   const [newPeerName, setNewPeerName] = useState('')
+  const [newPeerGroup, setNewPeerGroup] = useState<number | undefined>(undefined)
+  const [groups, setGroups] = useState<PeerGroup[]>([])
   const [addingPeer, setAddingPeer] = useState(false)
   const [qrCodeUrl, setQrCodeUrl] = useState<string | null>(null)
+  const [sharePeer, setSharePeer] = useState<Peer | null>(null)
+  const [shareKind, setShareKind] = useState<ShareKind>('config')
+  const [shareExpiry, setShareExpiry] = useState(24 * 60)
+  const [shareUrl, setShareUrl] = useState<string | null>(null)
+  const [shareError, setShareError] = useState('')
+  const [shareCopied, setShareCopied] = useState(false)
+  const [settingsPeer, setSettingsPeer] = useState<Peer | null>(null)
+  const [overridesForm, setOverridesForm] = useState<OverridesForm>(overridesToForm({}))
+  const [overridesError, setOverridesError] = useState('')
   const [confirmModal, setConfirmModal] = useState<{
     show: boolean
     title: string
@@ -90,6 +141,7 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
     api.getSettings().then(settings => {
       setLoggingEnabled(settings.logging_enabled)
     }).catch(() => {})
+    api.getGroups().then(setGroups).catch(() => {})
     // Auto-refresh every 5 seconds
     const interval = setInterval(fetchPeers, 5000)
     return () => clearInterval(interval)
@@ -126,8 +178,9 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
 
     setAddingPeer(true)
     try {
-      await api.createPeer(newPeerName.trim())
+      await api.createPeer(newPeerName.trim(), newPeerGroup)
       setNewPeerName('')
+      setNewPeerGroup(undefined)
       setShowAddModal(false)
       await fetchPeers()
     } catch (err) {
@@ -202,6 +255,61 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
     setShowQRModal(null)
   }
 
+  const handleOpenShare = (peer: Peer) => {
+    setSharePeer(peer)
+    setShareKind('config')
+    setShareExpiry(24 * 60)
+    setShareUrl(null)
+    setShareError('')
+    setShareCopied(false)
+  }
+
+  const handleCreateShareLink = async (e: React.FormEvent) => {
+    e.preventDefault()
+    if (!sharePeer) return
+    setShareError('')
+    try {
+      const link = await api.createShareLink(sharePeer.assigned_ip, shareKind, shareExpiry)
+      setShareUrl(link.url || null)
+    } catch (err) {
+      setShareError(err instanceof Error ? err.message : 'Failed to create share link')
+    }
+  }
+
+  const handleCopyShareUrl = async () => {
+    if (!shareUrl) return
+    try {
+      await navigator.clipboard.writeText(shareUrl)
+      setShareCopied(true)
+      setTimeout(() => setShareCopied(false), 2000)
+    } catch (err) {
+      console.error('Failed to copy share link:', err)
+    }
+  }
+
+  const handleOpenSettings = (peer: Peer) => {
+    setSettingsPeer(peer)
+    setOverridesForm(overridesToForm(peer.overrides ?? {}))
+    setOverridesError('')
+  }
+
+  const handleSaveOverrides = async (e: React.FormEvent) => {
+    e.preventDefault()
+    if (!settingsPeer) return
+    setOverridesError('')
+    try {
+      await api.updatePeer(settingsPeer.assigned_ip, { overrides: formToOverrides(overridesForm) })
+      setSettingsPeer(null)
+      await fetchPeers()
+    } catch (err) {
+      setOverridesError(err instanceof Error ? err.message : 'Failed to save client settings')
+    }
+  }
+
+  const setOverridesField = (field: keyof OverridesForm) =>
+    (e: React.ChangeEvent<HTMLInputElement | HTMLTextAreaElement>) =>
+      setOverridesForm(f => ({ ...f, [field]: e.target.value }))
+
   const onlineCount = peers.filter(p => p.is_online).length
   const totalTransfer = peers.reduce((acc, p) => acc + p.transfer_rx + p.transfer_tx, 0)
 
@@ -310,6 +418,12 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
                     <Clock size={12} />
                     {timeAgo(peer.latest_handshake)}
                   </span>
+                  {peer.group_id && (
+                    <span className="detail">
+                      <Layers size={12} />
+                      {groups.find(g => g.id === peer.group_id)?.name}
+                    </span>
+                  )}
                 </div>
 
                 <div className="client-transfer">
@@ -355,6 +469,20 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
                 >
                   <Download size={16} />
                 </button>
+                <button
+                  onClick={() => handleOpenShare(peer)}
+                  className="btn-icon-sm"
+                  title="Share Link"
+                >
+                  <Link size={16} />
+                </button>
+                <button
+                  onClick={() => handleOpenSettings(peer)}
+                  className="btn-icon-sm"
+                  title="Client Settings"
+                >
+                  <SlidersHorizontal size={16} />
+                </button>
                 <button
                   onClick={() => handleDeletePeer(peer.assigned_ip, peer.name)}
                   className="btn-icon-sm delete"
@@ -395,6 +523,21 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
                   required
                   autoFocus
                 />
+                {groups.length > 0 && (
+                  <>
+                    <label htmlFor="clientGroup">Group</label>
+                    <select
+                      id="clientGroup"
+                      value={newPeerGroup ?? ''}
+                      onChange={e => setNewPeerGroup(e.target.value ? Number(e.target.value) : undefined)}
+                    >
+                      <option value="">None (server settings)</option>
+                      {groups.map(group => (
+                        <option key={group.id} value={group.id}>{group.name}</option>
+                      ))}
+                    </select>
+                  </>
+                )}
               </div>
               <div className="modal-footer">
                 <button type="button" onClick={() => setShowAddModal(false)} className="btn-secondary">
@@ -431,6 +574,121 @@ export default function Dashboard({ onLogout, onSettings }: DashboardProps) {
         </div>
       )}
 
+      {/* Share Link Modal */}
+      {sharePeer && (
+        <div className="modal-overlay" onClick={() => setSharePeer(null)}>
+          <div className="modal" onClick={e => e.stopPropagation()}>
+            <div className="modal-header">
+              <h2>Share "{sharePeer.name}"</h2>
+              <button onClick={() => setSharePeer(null)} className="btn-icon-sm">
+                <X size={18} />
+              </button>
+            </div>
+            {shareUrl ? (
+              <div className="modal-body">
+                <label htmlFor="shareUrl">Share Link</label>
+                <div className="share-url">
+                  <input id="shareUrl" type="text" value={shareUrl} readOnly onFocus={e => e.target.select()} />
+                  <button type="button" onClick={handleCopyShareUrl} className="btn-icon-sm" title="Copy link">
+                    {shareCopied ? <Check size={16} /> : <Copy size={16} />}
+                  </button>
+                </div>
+                <p className="confirm-message">
+                  Anyone with this link can download the configuration once, without logging in. It is not shown again.
+                </p>
+              </div>
+            ) : (
+              <form onSubmit={handleCreateShareLink}>
+                <div className="modal-body">
+                  {shareError && <p className="confirm-message">{shareError}</p>}
+                  <label htmlFor="shareKind">Content</label>
+                  <select id="shareKind" value={shareKind} onChange={e => setShareKind(e.target.value as ShareKind)}>
+                    <option value="config">Config file</option>
+                    {sharePeer.has_private_key && <option value="qrcode">QR code</option>}
+                  </select>
+                  <label htmlFor="shareExpiry">Expires After</label>
+                  <select id="shareExpiry" value={shareExpiry} onChange={e => setShareExpiry(Number(e.target.value))}>
+                    <option value={60}>1 hour</option>
+                    <option value={24 * 60}>1 day</option>
+                    <option value={7 * 24 * 60}>7 days</option>
+                  </select>
+                </div>
+                <div className="modal-footer">
+                  <button type="button" onClick={() => setSharePeer(null)} className="btn-secondary">
+                    Cancel
+                  </button>
+                  <button type="submit" className="btn-primary">
+                    Create Link
+                  </button>
+                </div>
+              </form>
+            )}
+          </div>
+        </div>
+      )}
+
+      {/* Client Settings Modal */}
+      {settingsPeer && (
+        <div className="modal-overlay" onClick={() => setSettingsPeer(null)}>
+          <div className="modal" onClick={e => e.stopPropagation()}>
+            <div className="modal-header">
+              <h2>Client Settings for "{settingsPeer.name}"</h2>
+              <button onClick={() => setSettingsPeer(null)} className="btn-icon-sm">
+                <X size={18} />
+              </button>
+            </div>
+            <form onSubmit={handleSaveOverrides}>
+              <div className="modal-body">
+                {overridesError && <p className="confirm-message">{overridesError}</p>}
+                <p className="confirm-message">Empty fields use the group's or the server's settings.</p>
+                <div className="client-settings">
+                  <div>
+                    <label htmlFor="overrideDNS">DNS</label>
+                    <input id="overrideDNS" type="text" value={overridesForm.dns} onChange={setOverridesField('dns')} placeholder="e.g., 10.8.0.1, 1.1.1.1" />
+                  </div>
+                  <div>
+                    <label htmlFor="overrideAllowedIPs">Allowed IPs</label>
+                    <input id="overrideAllowedIPs" type="text" value={overridesForm.allowed_ips} onChange={setOverridesField('allowed_ips')} placeholder="e.g., 10.0.0.0/8" />
+                  </div>
+                  <div>
+                    <label htmlFor="overrideMTU">MTU</label>
+                    <input id="overrideMTU" type="number" min={1280} max={9000} value={overridesForm.mtu} onChange={setOverridesField('mtu')} />
+                  </div>
+                  <div>
+                    <label htmlFor="overrideKeepalive">Keepalive (0 = off)</label>
+                    <input id="overrideKeepalive" type="number" min={0} max={65535} value={overridesForm.persistent_keepalive} onChange={setOverridesField('persistent_keepalive')} />
+                  </div>
+                  <div>
+                    <label htmlFor="overrideEndpointHost">Endpoint Host</label>
+                    <input id="overrideEndpointHost" type="text" value={overridesForm.endpoint_host} onChange={setOverridesField('endpoint_host')} placeholder="e.g., vpn2.example.com" />
+                  </div>
+                  <div>
+                    <label htmlFor="overrideEndpointPort">Endpoint Port</label>
+                    <input id="overrideEndpointPort" type="number" min={1} max={65535} value={overridesForm.endpoint_port} onChange={setOverridesField('endpoint_port')} />
+                  </div>
+                </div>
+                <label htmlFor="overrideInterfaceLines">Extra [Interface] Lines</label>
+                <textarea
+                  id="overrideInterfaceLines"
+                  rows={3}
+                  value={overridesForm.interface_lines}
+                  onChange={setOverridesField('interface_lines')}
+                  placeholder={'e.g., Table = off'}
+                />
+              </div>
+              <div className="modal-footer">
+                <button type="button" onClick={() => setSettingsPeer(null)} className="btn-secondary">
+                  Cancel
+                </button>
+                <button type="submit" className="btn-primary">
+                  Save
+                </button>
+              </div>
+            </form>
+          </div>
+        </div>
+      )}
+
       {/* Logs Modal */}
       {showLogsModal && (
         <div className="modal-overlay" onClick={handleCloseLogsModal}>
@@ -1,16 +1,43 @@
-import { useState } from 'react'
-import { Shield, Lock, AlertCircle } from 'lucide-react'
+import { useEffect, useState } from 'react'
+import { Shield, Lock, AlertCircle, KeyRound, User } from 'lucide-react'
 import { api } from '../api/client'
 import '../styles/login.css'
 
+// Messages for the error codes the SSO callback sends back to the login page
+const ssoErrors: Record<string, string> = {
+  unavailable: 'Single sign-on is unavailable right now.',
+  denied: 'Sign-in was cancelled at the identity provider.',
+  state: 'Sign-in could not be verified. Please try again.',
+  expired: 'Sign-in took too long. Please try again.',
+  forbidden: 'Your account has no access to this panel.',
+  unknown_user: 'Your account has no access to this panel.',
+  conflict: 'A panel user with your name already exists.',
+  disabled: 'Your account is disabled.',
+}
+
 interface LoginProps {
   onLogin: () => void
 }
 
 export default function Login({ onLogin }: LoginProps) {
+  const [username, setUsername] = useState('')
   const [password, setPassword] = useState('')
+  const [code, setCode] = useState('')
+  const [needsCode, setNeedsCode] = useState(false)
   const [error, setError] = useState('')
   const [loading, setLoading] = useState(false)
+  const [ssoName, setSSOName] = useState<string | null>(null)
+
+  useEffect(() => {
+    api.getSSOName().then(setSSOName)
+
+    const params = new URLSearchParams(window.location.search)
+    const ssoError = params.get('sso_error')
+    if (ssoError) {
+      setError(ssoErrors[ssoError] || 'Single sign-on failed. Please try again.')
+      window.history.replaceState(null, '', window.location.pathname)
+    }
+  }, [])
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault()
@@ -18,12 +45,25 @@ export default function Login({ onLogin }: LoginProps) {
     setLoading(true)
 
     try {
-      // Always use 'layerweb' as username (static, cannot be changed)
-      const success = await api.login('layerweb', password)
-      if (success) {
+      if (needsCode) {
+        if (await api.loginTwoFactor(code)) {
+          onLogin()
+        } else {
+          setError('Invalid code')
+          setCode('')
+        }
+        return
+      }
+
+      const result = await api.login(username.trim(), password)
+      if (result === 'success') {
         onLogin()
+      } else if (result === 'two_factor_required') {
+        setNeedsCode(true)
+      } else if (result === 'locked') {
+        setError('Too many failed attempts. Please wait and try again.')
       } else {
-        setError('Invalid password')
+        setError('Invalid username or password')
       }
     } catch (err) {
       setError('Connection error. Please try again.')
@@ -51,22 +91,58 @@ export default function Login({ onLogin }: LoginProps) {
             </div>
           )}
 
-          <div className="form-group">
-            <label htmlFor="password">
-              <Lock size={14} />
-              Password
-            </label>
-            <input
-              id="password"
-              type="password"
-              value={password}
-              onChange={(e) => setPassword(e.target.value)}
-              placeholder="Enter password"
-              required
-              autoComplete="current-password"
-              autoFocus
-            />
-          </div>
+          {needsCode ? (
+            <div className="form-group">
+              <label htmlFor="code">
+                <KeyRound size={14} />
+                Authentication Code
+              </label>
+              <input
+                id="code"
+                type="text"
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+                placeholder="6-digit code or recovery code"
+                required
+                autoComplete="one-time-code"
+                autoFocus
+              />
+            </div>
+          ) : (
+            <>
+              <div className="form-group">
+                <label htmlFor="username">
+                  <User size={14} />
+                  Username
+                </label>
+                <input
+                  id="username"
+                  type="text"
+                  value={username}
+                  onChange={(e) => setUsername(e.target.value)}
+                  placeholder="Enter username"
+                  required
+                  autoComplete="username"
+                  autoFocus
+                />
+              </div>
+              <div className="form-group">
+                <label htmlFor="password">
+                  <Lock size={14} />
+                  Password
+                </label>
+                <input
+                  id="password"
+                  type="password"
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                  placeholder="Enter password"
+                  required
+                  autoComplete="current-password"
+                />
+              </div>
+            </>
+          )}
 
           <button type="submit" className="login-button" disabled={loading}>
             {loading ? (
@@ -75,9 +151,15 @@ export default function Login({ onLogin }: LoginProps) {
                 Signing in...
               </>
             ) : (
-              'Sign In'
+              needsCode ? 'Verify' : 'Sign In'
             )}
           </button>
+
+          {ssoName && !needsCode && (
+            <a href="/api/v1/auth/oidc/login" className="login-sso">
+              Sign in with {ssoName}
+            </a>
+          )}
         </form>
       </div>
     </div>
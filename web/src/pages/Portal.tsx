@@ -0,0 +1,289 @@
+import { useState, useEffect, useCallback } from 'react'
+import {
+  Shield,
+  Plus,
+  Download,
+  QrCode,
+  LogOut,
+  RefreshCw,
+  X,
+  Power,
+  ArrowDown,
+  ArrowUp,
+  Clock,
+  Globe
+} from 'lucide-react'
+import { api, Peer } from '../api/client'
+import { formatBytes, timeAgo } from './Dashboard'
+import '../styles/dashboard.css'
+
+interface PortalProps {
+  onLogout: () => void
+}
+
+// Self-service portal for users with the 'user' role: only their own devices, which they
+// can download, disable and add up to the limit an admin set
+export default function Portal({ onLogout }: PortalProps) {
+  const [devices, setDevices] = useState<Peer[]>([])
+  const [maxDevices, setMaxDevices] = useState(0)
+  const [loading, setLoading] = useState(true)
+  const [error, setError] = useState('')
+  const [showAddModal, setShowAddModal] = useState(false)
+  const [newDeviceName, setNewDeviceName] = useState('')
+  const [addingDevice, setAddingDevice] = useState(false)
+  const [qrCodeUrl, setQrCodeUrl] = useState<string | null>(null)
+  const [confirmDisable, setConfirmDisable] = useState<Peer | null>(null)
+
+  const fetchDevices = useCallback(async () => {
+    try {
+      const data = await api.getDevices()
+      setDevices(data.devices || [])
+      setMaxDevices(data.max_devices)
+    } catch (err) {
+      console.error('Failed to load devices:', err)
+    } finally {
+      setLoading(false)
+    }
+  }, [])
+
+  useEffect(() => {
+    fetchDevices()
+    const interval = setInterval(fetchDevices, 5000)
+    return () => clearInterval(interval)
+  }, [fetchDevices])
+
+  const handleAddDevice = async (e: React.FormEvent) => {
+    e.preventDefault()
+    if (!newDeviceName.trim()) return
+
+    setAddingDevice(true)
+    setError('')
+    try {
+      await api.createDevice(newDeviceName.trim())
+      setNewDeviceName('')
+      setShowAddModal(false)
+      await fetchDevices()
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Failed to add device')
+    } finally {
+      setAddingDevice(false)
+    }
+  }
+
+  const handleDisable = async (device: Peer) => {
+    try {
+      await api.disableDevice(device.assigned_ip)
+      await fetchDevices()
+    } catch (err) {
+      console.error('Failed to disable device:', err)
+    }
+    setConfirmDisable(null)
+  }
+
+  const handleDownloadConfig = async (device: Peer) => {
+    try {
+      await api.downloadConfig(device.assigned_ip, `${device.name}.conf`, '/devices')
+    } catch (err) {
+      console.error('Failed to download config:', err)
+    }
+  }
+
+  const handleShowQRCode = async (device: Peer) => {
+    try {
+      setQrCodeUrl(await api.getQRCode(device.assigned_ip, '/devices'))
+    } catch (err) {
+      console.error('Failed to get QR code:', err)
+    }
+  }
+
+  const handleLogout = async () => {
+    await api.logout()
+    onLogout()
+  }
+
+  const canAdd = devices.length < maxDevices
+
+  return (
+    <div className="dashboard">
+      <header className="header">
+        <div className="header-brand">
+          <div className="logo">
+            <Shield size={20} />
+          </div>
+          <h1>My Devices</h1>
+        </div>
+        <div className="header-actions">
+          <button onClick={fetchDevices} className="btn-icon" title="Refresh">
+            <RefreshCw size={18} className={loading ? 'spin' : ''} />
+          </button>
+          <button onClick={handleLogout} className="btn-icon" title="Logout">
+            <LogOut size={18} />
+          </button>
+        </div>
+      </header>
+
+      <div className="stats-bar">
+        <div className="stat">
+          <span className="stat-value">{devices.length} / {maxDevices}</span>
+          <span className="stat-label">Devices</span>
+        </div>
+        <div className="stat">
+          <span className="stat-value connected">{devices.filter(d => d.is_online).length}</span>
+          <span className="stat-label">Connected</span>
+        </div>
+      </div>
+
+      <div className="client-list">
+        {loading && devices.length === 0 ? (
+          <div className="empty-state">
+            <RefreshCw size={32} className="spin" />
+            <p>Loading devices...</p>
+          </div>
+        ) : devices.length === 0 ? (
+          <div className="empty-state">
+            <Shield size={48} />
+            <p>{canAdd ? 'No devices yet, add one with the + button' : 'No devices assigned to you'}</p>
+          </div>
+        ) : (
+          devices.map(device => (
+            <div key={device.id} className={`client-card ${!device.enabled ? 'disabled' : ''}`}>
+              <div className="client-status">
+                <div className={`status-indicator ${device.is_online ? 'online' : 'offline'}`} />
+              </div>
+
+              <div className="client-info">
+                <div className="client-name-row">
+                  <h3 className="client-name">{device.name}</h3>
+                </div>
+                <div className="client-details">
+                  <span className="detail">
+                    <Globe size={12} />
+                    {device.assigned_ip}
+                  </span>
+                  <span className="detail">
+                    <Clock size={12} />
+                    {timeAgo(device.latest_handshake)}
+                  </span>
+                </div>
+                <div className="client-transfer">
+                  <span className="transfer-item">
+                    <ArrowDown size={12} />
+                    {formatBytes(device.transfer_rx)}
+                  </span>
+                  <span className="transfer-item">
+                    <ArrowUp size={12} />
+                    {formatBytes(device.transfer_tx)}
+                  </span>
+                </div>
+              </div>
+
+              <div className="client-actions">
+                {device.enabled && (
+                  <button
+                    onClick={() => setConfirmDisable(device)}
+                    className="btn-icon-sm enabled"
+                    title="Disable"
+                  >
+                    <Power size={16} />
+                  </button>
+                )}
+                <button onClick={() => handleShowQRCode(device)} className="btn-icon-sm" title="Show QR Code">
+                  <QrCode size={16} />
+                </button>
+                <button onClick={() => handleDownloadConfig(device)} className="btn-icon-sm" title="Download Config">
+                  <Download size={16} />
+                </button>
+              </div>
+            </div>
+          ))
+        )}
+      </div>
+
+      {canAdd && (
+        <button onClick={() => setShowAddModal(true)} className="fab">
+          <Plus size={24} />
+        </button>
+      )}
+
+      {showAddModal && (
+        <div className="modal-overlay" onClick={() => setShowAddModal(false)}>
+          <div className="modal" onClick={e => e.stopPropagation()}>
+            <div className="modal-header">
+              <h2>New Device</h2>
+              <button onClick={() => setShowAddModal(false)} className="btn-icon-sm">
+                <X size={18} />
+              </button>
+            </div>
+            <form onSubmit={handleAddDevice}>
+              <div className="modal-body">
+                {error && <p className="confirm-message">{error}</p>}
+                <label htmlFor="deviceName">Device Name</label>
+                <input
+                  id="deviceName"
+                  type="text"
+                  value={newDeviceName}
+                  onChange={e => setNewDeviceName(e.target.value)}
+                  placeholder="e.g., My Phone"
+                  maxLength={64}
+                  required
+                  autoFocus
+                />
+              </div>
+              <div className="modal-footer">
+                <button type="button" onClick={() => setShowAddModal(false)} className="btn-secondary">
+                  Cancel
+                </button>
+                <button type="submit" className="btn-primary" disabled={addingDevice}>
+                  {addingDevice ? 'Creating...' : 'Create'}
+                </button>
+              </div>
+            </form>
+          </div>
+        </div>
+      )}
+
+      {qrCodeUrl && (
+        <div className="modal-overlay" onClick={() => setQrCodeUrl(null)}>
+          <div className="modal qr-modal" onClick={e => e.stopPropagation()}>
+            <div className="modal-header">
+              <h2>Scan QR Code</h2>
+              <button onClick={() => setQrCodeUrl(null)} className="btn-icon-sm">
+                <X size={18} />
+              </button>
+            </div>
+            <div className="modal-body qr-body">
+              <img src={qrCodeUrl} alt="WireGuard QR Code" className="qr-image" />
+              <p>Scan with WireGuard app</p>
+            </div>
+          </div>
+        </div>
+      )}
+
+      {confirmDisable && (
+        <div className="modal-overlay" onClick={() => setConfirmDisable(null)}>
+          <div className="modal confirm-modal" onClick={e => e.stopPropagation()}>
+            <div className="modal-header">
+              <h2>Disable Device</h2>
+              <button onClick={() => setConfirmDisable(null)} className="btn-icon-sm">
+                <X size={18} />
+              </button>
+            </div>
+            <div className="modal-body">
+              <p className="confirm-message">
+                Disable "{confirmDisable.name}"? It can no longer connect, and only an administrator can enable it again.
+              </p>
+            </div>
+            <div className="modal-footer">
+              <button type="button" onClick={() => setConfirmDisable(null)} className="btn-secondary">
+                Cancel
+              </button>
+              <button type="button" onClick={() => handleDisable(confirmDisable)} className="btn-danger">
+                Disable
+              </button>
+            </div>
+          </div>
+        </div>
+      )}
+    </div>
+  )
+}
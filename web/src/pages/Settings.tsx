@@ -15,9 +15,15 @@ import {
   ExternalLink,
   Power,
   PowerOff,
-  Router
+  Router,
+  Plus,
+  Trash2,
+  ShieldCheck,
+  MonitorSmartphone,
+  Link,
+  Layers
 } from 'lucide-react'
-import { api, Settings as SettingsType, TailscaleStatus } from '../api/client'
+import { api, Settings as SettingsType, TailscaleStatus, ApiToken, PeerGroup, ShareLink, Session, TwoFactorStatus, TwoFactorSetup } from '../api/client'
 import '../styles/settings.css'
 
 interface SettingsProps {
@@ -37,8 +43,35 @@ export default function Settings({ onBack }: SettingsProps) {
   const [newPassword, setNewPassword] = useState('')
   const [confirmPassword, setConfirmPassword] = useState('')
   const [tokenCopied, setTokenCopied] = useState(false)
+
+  // API token state
+  const [apiTokens, setApiTokens] = useState<ApiToken[]>([])
+  const [newTokenName, setNewTokenName] = useState('')
+  const [newTokenScopes, setNewTokenScopes] = useState<string[]>(['peers:read'])
+  const [createdToken, setCreatedToken] = useState<string | null>(null)
   const [showApiDocs, setShowApiDocs] = useState(false)
 
+  // Peer group state
+  const [groups, setGroups] = useState<PeerGroup[]>([])
+  const [newGroupName, setNewGroupName] = useState('')
+  const [newGroupDns, setNewGroupDns] = useState('')
+  const [newGroupAllowedIPs, setNewGroupAllowedIPs] = useState('')
+  const [newGroupMtu, setNewGroupMtu] = useState('')
+  const [newGroupKeepalive, setNewGroupKeepalive] = useState('')
+
+  // Share link state; null when the account may not manage peers
+  const [shareLinks, setShareLinks] = useState<ShareLink[] | null>(null)
+
+  // Session state
+  const [sessions, setSessions] = useState<Session[]>([])
+
+  // Two-factor authentication state
+  const [twoFactor, setTwoFactor] = useState<TwoFactorStatus | null>(null)
+  const [twoFactorSetup, setTwoFactorSetup] = useState<TwoFactorSetup | null>(null)
+  const [twoFactorCode, setTwoFactorCode] = useState('')
+  const [twoFactorPassword, setTwoFactorPassword] = useState('')
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null)
+
   // Tailscale state
   const [tailscale, setTailscale] = useState<TailscaleStatus | null>(null)
   const [tailscaleLoading, setTailscaleLoading] = useState(false)
@@ -47,8 +80,148 @@ export default function Settings({ onBack }: SettingsProps) {
   useEffect(() => {
     fetchSettings()
     fetchTailscaleStatus()
+    fetchApiTokens()
+    fetchTwoFactor()
+    fetchSessions()
+    fetchShareLinks()
+    fetchGroups()
   }, [])
 
+  const fetchGroups = async () => {
+    try {
+      setGroups(await api.getGroups())
+    } catch (err) {
+      console.error('Failed to load groups:', err)
+    }
+  }
+
+  const handleCreateGroup = async () => {
+    if (!newGroupName.trim()) {
+      setMessage({ type: 'error', text: 'Enter a group name' })
+      return
+    }
+    try {
+      await api.createGroup({
+        name: newGroupName.trim(),
+        dns: newGroupDns.trim() || undefined,
+        allowed_ips: newGroupAllowedIPs.trim() || undefined,
+        mtu: newGroupMtu ? Number(newGroupMtu) : undefined,
+        persistent_keepalive: newGroupKeepalive ? Number(newGroupKeepalive) : undefined,
+      })
+      setNewGroupName('')
+      setNewGroupDns('')
+      setNewGroupAllowedIPs('')
+      setNewGroupMtu('')
+      setNewGroupKeepalive('')
+      await fetchGroups()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to create group' })
+    }
+  }
+
+  const handleSetGroupEnabled = async (group: PeerGroup, enabled: boolean) => {
+    if (!enabled && !confirm(`Disable all ${group.peer_count} clients in "${group.name}"?`)) return
+    try {
+      const result = await api.setGroupEnabled(group.id, enabled)
+      const skipped = result.skipped?.length ? `, ${result.skipped.length} left as they were` : ''
+      setMessage({ type: 'success', text: `${enabled ? 'Enabled' : 'Disabled'} ${result.changed.length} clients${skipped}` })
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to update group' })
+    }
+  }
+
+  const handleDeleteGroup = async (group: PeerGroup) => {
+    if (!confirm(`Delete group "${group.name}"? Its clients are kept and use the server settings again.`)) return
+    try {
+      await api.deleteGroup(group.id)
+      await fetchGroups()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to delete group' })
+    }
+  }
+
+  const fetchShareLinks = async () => {
+    try {
+      setShareLinks(await api.getShareLinks())
+    } catch (err) {
+      console.error('Failed to load share links:', err)
+    }
+  }
+
+  const handleRevokeShareLink = async (link: ShareLink) => {
+    if (!confirm(`Revoke the share link for "${link.peer_name}"?`)) return
+    try {
+      await api.revokeShareLink(link.id)
+      await fetchShareLinks()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to revoke share link' })
+    }
+  }
+
+  const fetchSessions = async () => {
+    try {
+      setSessions(await api.getSessions())
+    } catch (err) {
+      console.error('Failed to load sessions:', err)
+    }
+  }
+
+  const handleRevokeSession = async (session: Session) => {
+    if (!confirm('Sign out this session?')) return
+    try {
+      await api.revokeSession(session.id)
+      await fetchSessions()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to revoke session' })
+    }
+  }
+
+  const fetchTwoFactor = async () => {
+    try {
+      setTwoFactor(await api.getTwoFactorStatus())
+    } catch (err) {
+      console.error('Failed to load two-factor status:', err)
+    }
+  }
+
+  const twoFactorAction = async (action: () => Promise<void>) => {
+    try {
+      await action()
+      setTwoFactorCode('')
+      setTwoFactorPassword('')
+      await fetchTwoFactor()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Two-factor authentication request failed' })
+    }
+  }
+
+  const handleSetupTwoFactor = () => twoFactorAction(async () => {
+    setRecoveryCodes(null)
+    setTwoFactorSetup(await api.setupTwoFactor())
+  })
+
+  const handleEnableTwoFactor = () => twoFactorAction(async () => {
+    setRecoveryCodes(await api.enableTwoFactor(twoFactorCode))
+    setTwoFactorSetup(null)
+  })
+
+  const handleDisableTwoFactor = () => twoFactorAction(async () => {
+    await api.disableTwoFactor(twoFactorPassword, twoFactorCode)
+    setRecoveryCodes(null)
+  })
+
+  const handleRegenerateRecoveryCodes = () => twoFactorAction(async () => {
+    setRecoveryCodes(await api.regenerateRecoveryCodes(twoFactorCode))
+  })
+
+  const fetchApiTokens = async () => {
+    try {
+      setApiTokens(await api.getApiTokens())
+    } catch (err) {
+      console.error('Failed to load API tokens:', err)
+    }
+  }
+
   const fetchSettings = async () => {
     try {
       const data = await api.getSettings()
@@ -103,9 +276,8 @@ export default function Settings({ onBack }: SettingsProps) {
       if (Object.keys(updateData).length > 0) {
         await api.updateSettings(updateData)
 
-        // If password changed, refetch settings to get new API token
         if (newPassword) {
-          setMessage({ type: 'success', text: 'Settings saved. Please login again with your new password to use the new API token.' })
+          setMessage({ type: 'success', text: 'Settings saved. Other sessions have to login again with the new password.' })
           await fetchSettings()
         } else {
           setMessage({ type: 'success', text: 'Settings saved successfully' })
@@ -131,8 +303,37 @@ export default function Settings({ onBack }: SettingsProps) {
     }
   }
 
+  const handleCreateToken = async () => {
+    if (!newTokenName.trim() || newTokenScopes.length === 0) {
+      setMessage({ type: 'error', text: 'Enter a token name and select at least one scope' })
+      return
+    }
+    try {
+      const created = await api.createApiToken(newTokenName.trim(), newTokenScopes)
+      setCreatedToken(created.token || null)
+      setNewTokenName('')
+      await fetchApiTokens()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to create token' })
+    }
+  }
+
+  const handleRevokeToken = async (token: ApiToken) => {
+    if (!confirm(`Revoke token "${token.name}"? Scripts using it stop working.`)) return
+    try {
+      await api.revokeApiToken(token.id)
+      await fetchApiTokens()
+    } catch (err) {
+      setMessage({ type: 'error', text: err instanceof Error ? err.message : 'Failed to revoke token' })
+    }
+  }
+
+  const toggleTokenScope = (scope: string) => {
+    setNewTokenScopes(prev => prev.includes(scope) ? prev.filter(s => s !== scope) : [...prev, scope])
+  }
+
   const handleCopyToken = async () => {
-    const token = settings?.api_token
+    const token = createdToken
     if (token) {
       try {
         await navigator.clipboard.writeText(token)
@@ -355,28 +556,176 @@ export default function Settings({ onBack }: SettingsProps) {
 
         <section className="settings-section">
           <h2>
-            <Key size={18} />
-            API Token
+            <MonitorSmartphone size={18} />
+            Sessions
           </h2>
           <div className="form-group">
-            <label>Current Token</label>
-            <div className="token-display">
-              <code className="token-value">
-                {settings?.api_token || 'Login again to generate token'}
-              </code>
-              <button
-                type="button"
-                onClick={handleCopyToken}
-                className="copy-token-btn"
-                title="Copy token"
-                disabled={!settings?.api_token}
-              >
-                {tokenCopied ? <Check size={16} /> : <Copy size={16} />}
+            {sessions.map(session => (
+              <div className="token-display token-row" key={session.id}>
+                <div className="token-value">
+                  <strong>{session.user_agent || 'Unknown device'}</strong> {session.source_ip}
+                  <span className="hint">
+                    {' · '}
+                    {session.current ? 'this session' : `last active ${new Date(session.last_used_at).toLocaleString()}`}
+                    {` · signed in ${new Date(session.created_at).toLocaleDateString()}`}
+                  </span>
+                </div>
+                {!session.current && (
+                  <button
+                    type="button"
+                    onClick={() => handleRevokeSession(session)}
+                    className="copy-token-btn"
+                    title="Sign out session"
+                  >
+                    <Trash2 size={16} />
+                  </button>
+                )}
+              </div>
+            ))}
+          </div>
+        </section>
+
+        <section className="settings-section">
+          <h2>
+            <ShieldCheck size={18} />
+            Two-Factor Authentication
+          </h2>
+          {recoveryCodes && (
+            <div className="form-group">
+              <label>Recovery Codes</label>
+              <div className="recovery-codes">
+                {recoveryCodes.map(code => <code key={code}>{code}</code>)}
+              </div>
+              <span className="hint">
+                Store these somewhere safe, they are not shown again. Each one signs you in once
+                without your authenticator app.
+              </span>
+            </div>
+          )}
+          {twoFactor?.enabled ? (
+            <div className="form-group">
+              <span className="hint">
+                Enabled. {twoFactor.recovery_codes_remaining} recovery codes left.
+              </span>
+              <input
+                type="text"
+                value={twoFactorCode}
+                onChange={e => setTwoFactorCode(e.target.value)}
+                placeholder="Current code"
+                autoComplete="one-time-code"
+              />
+              <input
+                type="password"
+                value={twoFactorPassword}
+                onChange={e => setTwoFactorPassword(e.target.value)}
+                placeholder="Password (to disable)"
+              />
+              <button type="button" className="btn-primary" onClick={handleRegenerateRecoveryCodes}>
+                New Recovery Codes
+              </button>
+              <button type="button" className="btn-primary" onClick={handleDisableTwoFactor}>
+                Disable
               </button>
             </div>
-            <span className="hint">
-              This token is derived from your password and stays constant. It will only change when you update your password.
-            </span>
+          ) : twoFactorSetup ? (
+            <div className="form-group">
+              <img className="two-factor-qr" src={twoFactorSetup.qr_code} alt="Authenticator QR code" />
+              <span className="hint">
+                Scan the code with your authenticator app, or enter the key <code>{twoFactorSetup.secret}</code>,
+                then enter the code it shows.
+              </span>
+              <input
+                type="text"
+                value={twoFactorCode}
+                onChange={e => setTwoFactorCode(e.target.value)}
+                placeholder="6-digit code"
+                autoComplete="one-time-code"
+              />
+              <button type="button" className="btn-primary" onClick={handleEnableTwoFactor}>
+                Enable
+              </button>
+            </div>
+          ) : (
+            <div className="form-group">
+              <span className="hint">Require a code from an authenticator app in addition to your password.</span>
+              <button type="button" className="btn-primary" onClick={handleSetupTwoFactor}>
+                Set Up
+              </button>
+            </div>
+          )}
+        </section>
+
+        <section className="settings-section">
+          <h2>
+            <Key size={18} />
+            API Tokens
+          </h2>
+          {createdToken && (
+            <div className="form-group">
+              <label>New Token</label>
+              <div className="token-display">
+                <code className="token-value">{createdToken}</code>
+                <button
+                  type="button"
+                  onClick={handleCopyToken}
+                  className="copy-token-btn"
+                  title="Copy token"
+                >
+                  {tokenCopied ? <Check size={16} /> : <Copy size={16} />}
+                </button>
+              </div>
+              <span className="hint">Copy this token now, it is not shown again.</span>
+            </div>
+          )}
+          <div className="form-group">
+            <label>Your Tokens</label>
+            {apiTokens.length === 0 && <span className="hint">No API tokens yet.</span>}
+            {apiTokens.map(token => (
+              <div className="token-display token-row" key={token.id}>
+                <div className="token-value">
+                  <strong>{token.name}</strong> <code>{token.prefix}…</code> {token.scopes.join(', ')}
+                  <span className="hint">
+                    {' · '}
+                    {token.last_used_at ? `last used ${new Date(token.last_used_at).toLocaleString()}` : 'never used'}
+                    {token.expires_at && ` · expires ${new Date(token.expires_at).toLocaleDateString()}`}
+                  </span>
+                </div>
+                <button
+                  type="button"
+                  onClick={() => handleRevokeToken(token)}
+                  className="copy-token-btn"
+                  title="Revoke token"
+                >
+                  <Trash2 size={16} />
+                </button>
+              </div>
+            ))}
+          </div>
+          <div className="form-group">
+            <label htmlFor="tokenName">New Token</label>
+            <input
+              id="tokenName"
+              type="text"
+              value={newTokenName}
+              onChange={e => setNewTokenName(e.target.value)}
+              placeholder="Name, e.g. monitoring"
+            />
+            <div className="token-scopes">
+              {['peers:read', 'peers:write', 'settings:read', 'settings:write', 'users:write', 'audit:read', 'devices:own'].map(scope => (
+                <label key={scope}>
+                  <input
+                    type="checkbox"
+                    checked={newTokenScopes.includes(scope)}
+                    onChange={() => toggleTokenScope(scope)}
+                  />
+                  {scope}
+                </label>
+              ))}
+            </div>
+            <button type="button" className="btn-primary" onClick={handleCreateToken}>
+              <Plus size={16} />
+              Create Token
+            </button>
           </div>
           <div className="form-group">
             <button
@@ -540,6 +889,125 @@ export default function Settings({ onBack }: SettingsProps) {
           </div>
         </section>
 
+        <section className="settings-section">
+          <h2>
+            <Layers size={18} />
+            Peer Groups
+          </h2>
+          <div className="form-group">
+            {groups.length === 0 && <span className="hint">No groups yet. Clients in a group use its settings instead of the ones above.</span>}
+            {groups.map(group => (
+              <div className="token-display token-row" key={group.id}>
+                <div className="token-value">
+                  <strong>{group.name}</strong> {group.peer_count} clients
+                  <span className="hint">
+                    {group.dns && ` · DNS ${group.dns}`}
+                    {group.allowed_ips && ` · ${group.allowed_ips}`}
+                    {group.mtu !== undefined && ` · MTU ${group.mtu}`}
+                    {group.persistent_keepalive !== undefined && ` · keepalive ${group.persistent_keepalive}s`}
+                  </span>
+                </div>
+                <button
+                  type="button"
+                  onClick={() => handleSetGroupEnabled(group, true)}
+                  className="copy-token-btn"
+                  title="Enable group"
+                >
+                  <Power size={16} />
+                </button>
+                <button
+                  type="button"
+                  onClick={() => handleSetGroupEnabled(group, false)}
+                  className="copy-token-btn"
+                  title="Disable group"
+                >
+                  <PowerOff size={16} />
+                </button>
+                <button
+                  type="button"
+                  onClick={() => handleDeleteGroup(group)}
+                  className="copy-token-btn"
+                  title="Delete group"
+                >
+                  <Trash2 size={16} />
+                </button>
+              </div>
+            ))}
+          </div>
+          <div className="form-group">
+            <label htmlFor="groupName">New Group</label>
+            <input
+              id="groupName"
+              type="text"
+              value={newGroupName}
+              onChange={e => setNewGroupName(e.target.value)}
+              placeholder="Name, e.g. split-tunnel-office"
+            />
+            <div className="group-settings">
+              <input
+                type="text"
+                value={newGroupDns}
+                onChange={e => setNewGroupDns(e.target.value)}
+                placeholder="DNS (empty: server setting)"
+              />
+              <input
+                type="text"
+                value={newGroupAllowedIPs}
+                onChange={e => setNewGroupAllowedIPs(e.target.value)}
+                placeholder="Allowed IPs, e.g. 10.0.0.0/8 (empty: server setting)"
+              />
+              <input
+                type="text"
+                inputMode="numeric"
+                value={newGroupMtu}
+                onChange={e => setNewGroupMtu(e.target.value.replace(/\D/g, ''))}
+                placeholder="MTU (empty: client default)"
+              />
+              <input
+                type="text"
+                inputMode="numeric"
+                value={newGroupKeepalive}
+                onChange={e => setNewGroupKeepalive(e.target.value.replace(/\D/g, ''))}
+                placeholder="Keepalive seconds (empty: 25, 0: off)"
+              />
+            </div>
+            <button type="button" className="btn-primary" onClick={handleCreateGroup}>
+              <Plus size={16} />
+              Create Group
+            </button>
+          </div>
+        </section>
+
+        {shareLinks && (
+          <section className="settings-section">
+            <h2>
+              <Link size={18} />
+              Share Links
+            </h2>
+            <div className="form-group">
+              {shareLinks.length === 0 && <span className="hint">No outstanding share links. Create one from a client on the dashboard.</span>}
+              {shareLinks.map(link => (
+                <div className="token-display token-row" key={link.id}>
+                  <div className="token-value">
+                    <strong>{link.peer_name}</strong> {link.kind === 'qrcode' ? 'QR code' : 'config'}
+                    <span className="hint">
+                      {` · by ${link.created_by} · expires ${new Date(link.expires_at).toLocaleString()}`}
+                    </span>
+                  </div>
+                  <button
+                    type="button"
+                    onClick={() => handleRevokeShareLink(link)}
+                    className="copy-token-btn"
+                    title="Revoke share link"
+                  >
+                    <Trash2 size={16} />
+                  </button>
+                </div>
+              ))}
+            </div>
+          </section>
+        )}
+
         {/* Tailscale Section */}
         <section className="settings-section">
           <h2>